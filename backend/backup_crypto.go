@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Формат зашифрованного бэкапа:
+//
+//	magic "UNIBAK1\n"
+//	mode  1 байт: 1 — пароль, 2 — открытый ключ получателя X25519
+//	mode 1: salt (16) | итерации PBKDF2-SHA256 (uint32 BE)
+//	mode 2: эфемерный открытый ключ X25519 (32)
+//	nonce (12) | шифротекст AES-256-GCM с тегом
+//
+// Весь заголовок до nonce включительно используется как additional data GCM.
+const (
+	backupMagic          = "UNIBAK1\n"
+	backupModePassphrase = 1
+	backupModeX25519     = 2
+	backupPBKDF2Iter     = 600000
+	backupHKDFInfo       = "universe-backup-v1"
+)
+
+// Допустимое число итераций PBKDF2 при расшифровке. Оно берётся из заголовка
+// файла, который мог прислать кто угодно (загрузка CSV, входящая почта), поэтому
+// сверху ограничено двумя значениями по умолчанию: файл с подобранным заголовком
+// стоит не больше двух честных расшифровок.
+const (
+	backupPBKDF2MinIter = 100000
+	backupPBKDF2MaxIter = 2 * backupPBKDF2Iter
+)
+
+var errNotEncryptedBackup = errors.New("файл не является зашифрованным бэкапом")
+
+// isEncryptedBackup проверяет сигнатуру зашифрованного бэкапа
+func isEncryptedBackup(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(backupMagic))
+}
+
+// encryptBackupPassphrase шифрует данные ключом, выведенным из пароля
+func encryptBackupPassphrase(plain []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, backupPBKDF2Iter, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(backupMagic)
+	header = append(header, backupModePassphrase)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, backupPBKDF2Iter)
+	return sealBackup(header, key, plain)
+}
+
+// encryptBackupRecipient шифрует данные для владельца приватного ключа X25519
+func encryptBackupRecipient(plain []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	key, err := backupRecipientKey(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(backupMagic)
+	header = append(header, backupModeX25519)
+	header = append(header, ephemeral.PublicKey().Bytes()...)
+	return sealBackup(header, key, plain)
+}
+
+// decryptBackup расшифровывает бэкап паролем или приватным ключом (нужен тот, которым он зашифрован)
+func decryptBackup(data []byte, passphrase string, identity *ecdh.PrivateKey) ([]byte, error) {
+	if !isEncryptedBackup(data) {
+		return nil, errNotEncryptedBackup
+	}
+	rest := data[len(backupMagic):]
+	if len(rest) < 1 {
+		return nil, fmt.Errorf("бэкап повреждён")
+	}
+
+	var key []byte
+	var headerLen int
+	switch rest[0] {
+	case backupModePassphrase:
+		if len(rest) < 1+16+4 {
+			return nil, fmt.Errorf("бэкап повреждён")
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("бэкап зашифрован паролем, но пароль не указан")
+		}
+		salt := rest[1:17]
+		iter := binary.BigEndian.Uint32(rest[17:21])
+		if iter < backupPBKDF2MinIter || iter > backupPBKDF2MaxIter {
+			return nil, fmt.Errorf("бэкап повреждён: недопустимое число итераций PBKDF2 %d", iter)
+		}
+		var err error
+		if key, err = pbkdf2.Key(sha256.New, passphrase, salt, int(iter), 32); err != nil {
+			return nil, err
+		}
+		headerLen = len(backupMagic) + 1 + 16 + 4
+	case backupModeX25519:
+		if len(rest) < 1+32 {
+			return nil, fmt.Errorf("бэкап повреждён")
+		}
+		if identity == nil {
+			return nil, fmt.Errorf("бэкап зашифрован открытым ключом, но приватный ключ не указан")
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(rest[1:33])
+		if err != nil {
+			return nil, fmt.Errorf("бэкап повреждён: %v", err)
+		}
+		shared, err := identity.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = backupRecipientKey(shared, ephemeral, identity.PublicKey()); err != nil {
+			return nil, err
+		}
+		headerLen = len(backupMagic) + 1 + 32
+	default:
+		return nil, fmt.Errorf("неизвестный режим шифрования бэкапа: %d", rest[0])
+	}
+
+	gcm, err := newBackupGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerLen+gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("бэкап повреждён")
+	}
+	nonceEnd := headerLen + gcm.NonceSize()
+	plain, err := gcm.Open(nil, data[headerLen:nonceEnd], data[nonceEnd:], data[:nonceEnd])
+	if err != nil {
+		return nil, fmt.Errorf("не удалось расшифровать бэкап: неверный ключ или файл повреждён")
+	}
+	return plain, nil
+}
+
+// sealBackup дописывает к заголовку nonce и шифротекст
+func sealBackup(header, key, plain []byte) ([]byte, error) {
+	gcm, err := newBackupGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, plain, bytes.Clone(out)), nil
+}
+
+func newBackupGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupRecipientKey выводит ключ AES из общего секрета X25519
+func backupRecipientKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, backupHKDFInfo, 32)
+}
+
+// encryptBackupForConfig шифрует бэкап согласно настройкам.
+// Возвращает исходные данные и false, если шифрование не настроено.
+func encryptBackupForConfig(plain []byte) ([]byte, bool, error) {
+	if cfg.BackupRecipient != "" {
+		recipient, err := parseBackupPublicKey(cfg.BackupRecipient)
+		if err != nil {
+			return nil, false, err
+		}
+		out, err := encryptBackupRecipient(plain, recipient)
+		return out, true, err
+	}
+	if cfg.BackupPassphrase != "" {
+		out, err := encryptBackupPassphrase(plain, cfg.BackupPassphrase)
+		return out, true, err
+	}
+	return plain, false, nil
+}
+
+// decryptBackupForConfig расшифровывает бэкап паролем из запроса или ключами из настроек
+func decryptBackupForConfig(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		passphrase = cfg.BackupPassphrase
+	}
+	var identity *ecdh.PrivateKey
+	if cfg.BackupIdentityFile != "" {
+		var err error
+		if identity, err = loadBackupIdentity(cfg.BackupIdentityFile); err != nil {
+			return nil, err
+		}
+	}
+	return decryptBackup(data, passphrase, identity)
+}
+
+// parseBackupPublicKey разбирает открытый ключ X25519 в base64
+func parseBackupPublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("неверный открытый ключ бэкапа: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// loadBackupIdentity читает приватный ключ X25519 (base64) из файла
+func loadBackupIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать ключ бэкапа: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("неверный приватный ключ бэкапа: %v", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encryptBackupIter — как encryptBackupPassphrase, но с заданным числом итераций
+func encryptBackupIter(t *testing.T, plain []byte, passphrase string, iter uint32) []byte {
+	t.Helper()
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, int(iter), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append([]byte(backupMagic), backupModePassphrase)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, iter)
+	data, err := sealBackup(header, key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBackupCryptoRoundTrip(t *testing.T) {
+	plain := []byte("id,name\n1,Иван\n")
+
+	data, err := encryptBackupPassphrase(plain, "пароль")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedBackup(data) || bytes.Contains(data, plain) {
+		t.Fatal("бэкап не зашифрован")
+	}
+	if got, err := decryptBackup(data, "пароль", nil); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("расшифровка паролем: %q, %v", got, err)
+	}
+	if _, err := decryptBackup(data, "другой", nil); err == nil {
+		t.Fatal("бэкап расшифрован неверным паролем")
+	}
+	tampered := bytes.Clone(data)
+	tampered[len(backupMagic)+1] ^= 1 // соль входит в additional data
+	if _, err := decryptBackup(tampered, "пароль", nil); err == nil {
+		t.Fatal("изменённый заголовок не замечен")
+	}
+
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = encryptBackupRecipient(plain, identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decryptBackup(data, "", identity); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("расшифровка ключом: %q, %v", got, err)
+	}
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := decryptBackup(data, "", other); err == nil {
+		t.Fatal("бэкап расшифрован чужим ключом")
+	}
+
+	if _, err := decryptBackup(plain, "пароль", nil); err != errNotEncryptedBackup {
+		t.Fatalf("незашифрованный файл: %v", err)
+	}
+}
+
+func TestBackupPBKDF2Bounds(t *testing.T) {
+	if backupPBKDF2MaxIter > 4*backupPBKDF2Iter || backupPBKDF2MinIter > backupPBKDF2Iter {
+		t.Fatalf("границы итераций [%d, %d] при значении по умолчанию %d", backupPBKDF2MinIter, backupPBKDF2MaxIter, backupPBKDF2Iter)
+	}
+	plain := []byte("data")
+
+	// Нижняя граница допустима
+	data := encryptBackupIter(t, plain, "пароль", backupPBKDF2MinIter)
+	if got, err := decryptBackup(data, "пароль", nil); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("итераций %d: %q, %v", backupPBKDF2MinIter, got, err)
+	}
+
+	// Число итераций за границами отклоняется сразу, без вывода ключа
+	for _, iter := range []uint32{0, 1, backupPBKDF2MinIter - 1, backupPBKDF2MaxIter + 1, 1 << 31, 1<<32 - 1} {
+		data := bytes.Clone(encryptBackupIter(t, plain, "пароль", 1))
+		binary.BigEndian.PutUint32(data[len(backupMagic)+1+16:], iter)
+		start := time.Now()
+		_, err := decryptBackup(data, "пароль", nil)
+		if err == nil || !strings.Contains(err.Error(), "итераций") {
+			t.Fatalf("итераций %d: %v", iter, err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("итераций %d: отказ занял %v", iter, elapsed)
+		}
+	}
+}
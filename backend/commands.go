@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCommand выполняет команду командной строки и возвращает код выхода
+func runCommand(args []string) int {
+	// Командам, работающим с каталогом видео, нужны его таблицы
+	switch args[0] {
+	case "reconcile", "faststart", "hls", "retention":
+		if err := initVideoDB(); err != nil {
+			fmt.Fprintln(os.Stderr, "Ошибка:", err)
+			return 1
+		}
+	}
+
+	var err error
+	switch args[0] {
+	case "seed-demo":
+		err = seedDemoUsers()
+	case "decrypt-backup":
+		err = decryptBackupCommand(args[1:])
+	case "backup-keygen":
+		err = backupKeygenCommand(args[1:])
+	case "reconcile":
+		err = reconcileCommand(args[1:])
+	case "faststart":
+		err = faststartCommand(args[1:])
+	case "hls":
+		err = hlsCommand(args[1:])
+	case "retention":
+		err = retentionCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Неизвестная команда: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "Доступные команды: decrypt-backup, backup-keygen, reconcile, faststart, hls, retention, seed-demo")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка:", err)
+		return 1
+	}
+	return 0
+}
+
+// decryptBackupCommand расшифровывает вложение из письма с бэкапом
+func decryptBackupCommand(args []string) error {
+	fs := flag.NewFlagSet("decrypt-backup", flag.ExitOnError)
+	in := fs.String("in", "", "зашифрованный файл бэкапа")
+	out := fs.String("out", "", "куда записать CSV (по умолчанию stdout)")
+	passphrase := fs.String("passphrase", os.Getenv("BACKUP_PASSPHRASE"), "пароль бэкапа")
+	identityFile := fs.String("identity", os.Getenv("BACKUP_IDENTITY_FILE"), "файл с приватным ключом X25519")
+	fs.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("укажите файл через -in")
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+
+	var identity *ecdh.PrivateKey
+	if *identityFile != "" {
+		if identity, err = loadBackupIdentity(*identityFile); err != nil {
+			return err
+		}
+	}
+	plain, err := decryptBackup(data, *passphrase, identity)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(plain)
+		return err
+	}
+	return os.WriteFile(*out, plain, 0600)
+}
+
+// backupKeygenCommand создаёт пару ключей X25519 для шифрования бэкапов
+func backupKeygenCommand(args []string) error {
+	fs := flag.NewFlagSet("backup-keygen", flag.ExitOnError)
+	out := fs.String("out", "backup.key", "куда записать приватный ключ")
+	fs.Parse(args)
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, []byte(base64.StdEncoding.EncodeToString(key.Bytes())+"\n"), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Приватный ключ записан в %s\n", *out)
+	fmt.Printf("BACKUP_RECIPIENT=%s\n", base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	return nil
+}
+
+// reconcileCommand сверяет каталог видео с файлами в хранилище
+func reconcileCommand(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "только показать расхождения, ничего не меняя")
+	fs.Parse(args)
+
+	initVideoStore()
+	report, err := reconcileCatalog(context.Background(), *dryRun, func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Добавлено: %d, пропало: %d, восстановлено: %d, пропущено: %d, файлов без ссылок: %d\n",
+		len(report.Added), len(report.Missing), len(report.Restored), len(report.Skipped), len(report.Orphaned))
+	return nil
+}
+
+// retentionCommand применяет правила хранения из RETENTION_POLICY_FILE
+func retentionCommand(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "только показать, что будет удалено")
+	fs.Parse(args)
+
+	policy, err := loadRetentionPolicy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return errors.New("не задан RETENTION_POLICY_FILE")
+	}
+	initVideoStore()
+	report, err := applyRetention(context.Background(), policy, *dryRun, func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Проверено: %d, подпадает под правила: %d, перемещено в корзину: %d\n",
+		report.Checked, len(report.Actions), report.Removed)
+	return nil
+}
+
+// faststartCommand переносит moov в начало MP4-файлов библиотеки, которые ещё не faststart
+func faststartCommand(args []string) error {
+	fs := flag.NewFlagSet("faststart", flag.ExitOnError)
+	key := fs.String("file", "", "обработать только этот файл (ключ в хранилище)")
+	fs.Parse(args)
+
+	initVideoStore()
+	ctx := context.Background()
+	videos, err := catalog.List(ctx, videoStatusReady)
+	if err != nil {
+		return err
+	}
+
+	var done, failed int
+	for _, v := range videos {
+		if v.Faststart || (*key != "" && v.Key != *key) {
+			continue
+		}
+		changed, err := faststartVideo(ctx, v)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%s: ошибка: %v\n", v.Key, err)
+		case changed:
+			done++
+			fmt.Printf("%s: moov перенесён\n", v.Key)
+		}
+	}
+	fmt.Printf("Обработано: %d, с ошибками: %d\n", done, failed)
+	return nil
+}
+
+// hlsCommand упаковывает в HLS видео библиотеки, для которых упаковки ещё нет
+func hlsCommand(args []string) error {
+	fs := flag.NewFlagSet("hls", flag.ExitOnError)
+	key := fs.String("file", "", "обработать только этот файл (ключ в хранилище)")
+	force := fs.Bool("force", false, "упаковать заново, даже если HLS уже готов")
+	fs.Parse(args)
+
+	initVideoStore()
+	ctx := context.Background()
+	videos, err := catalog.List(ctx, videoStatusReady)
+	if err != nil {
+		return err
+	}
+
+	var done, skipped, failed int
+	for _, v := range videos {
+		if *key != "" && v.Key != *key {
+			continue
+		}
+		if *key == "" && !*force && (v.HLSStatus == hlsStatusReady || v.HLSStatus == hlsStatusUnsupported) {
+			continue
+		}
+		err := packageHLS(ctx, v)
+		switch {
+		case errors.Is(err, errHLSUnsupported):
+			skipped++
+			fmt.Printf("%s: пропущено: %v\n", v.Key, err)
+		case err != nil:
+			failed++
+			fmt.Printf("%s: ошибка: %v\n", v.Key, err)
+		default:
+			done++
+			fmt.Printf("%s: готово\n", v.Key)
+		}
+	}
+	fmt.Printf("Упаковано: %d, пропущено: %d, с ошибками: %d\n", done, skipped, failed)
+	return nil
+}
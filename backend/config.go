@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config содержит настройки, которые можно переопределить через переменные окружения
+type Config struct {
+	// DKIM-подпись исходящих писем. Подпись включается, если заданы все три поля.
+	DKIMSelector string
+	DKIMDomain   string
+	DKIMKeyFile  string
+
+	// Шифрование вложения с ежедневным бэкапом. Если задан открытый ключ получателя,
+	// он важнее пароля. Приватный ключ нужен только для восстановления.
+	BackupPassphrase   string
+	BackupRecipient    string
+	BackupIdentityFile string
+
+	// Приём CSV по почте: адрес встроенного SMTP-сервера (например ":2525"),
+	// список отправителей, от которых принимаются письма, и секретный токен,
+	// который должен быть в теме письма или заголовке X-Import-Token: адрес
+	// отправителя легко подделать
+	InboundSMTPAddr       string
+	InboundAllowedSenders []string
+	InboundImportToken    string
+
+	// JSON-файл с подписчиками событий (вебхуки и почта), см. subscriberConfig
+	EventSubscribersFile string
+	// Сколько дней хранить журнал доставки событий
+	EventLogRetentionDays int
+
+	// Планировщик: зона по умолчанию (IANA, например "Europe/Moscow")
+	// и JSON-файл с расписанием задач, см. jobConfig
+	SchedulerTimezone string
+	SchedulerJobsFile string
+
+	// Хранилище видео: "local" (папка VideoDir) или "s3"
+	StorageBackend string
+	VideoDir       string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3Prefix       string
+	// Переносить moov в начало загруженных MP4 (faststart)
+	VideoFaststart bool
+	// Упаковывать загруженные MP4 в HLS и длительность сегмента в секундах
+	VideoHLS          bool
+	HLSSegmentSeconds int
+	// Квоты в байтах (0 — без ограничения): на все хранимые видео и на видео
+	// одного загрузившего; UploaderQuotas — отдельные квоты "имя=МБ".
+	// MinFreeSpace — сколько места должно оставаться на диске после загрузки (0 — не проверять).
+	LibraryQuota   int64
+	UploaderQuota  int64
+	UploaderQuotas []string
+	MinFreeSpace   int64
+	// Через сколько незавершённая загрузка считается брошенной: при запуске её
+	// временные файлы и запись каталога в состоянии "uploading" удаляются
+	UploadStaleAfter time.Duration
+
+	// Сколько дней видео хранится в корзине до окончательного удаления
+	TrashRetentionDays int
+	// JSON-файл с правилами хранения видео, см. retentionPolicy
+	RetentionPolicyFile string
+
+	// Следить за папкой видео (inotify) и добавлять в каталог файлы, положенные
+	// в обход приложения; VideoSettle — сколько файл должен не меняться, чтобы
+	// считаться записанным
+	VideoWatch  bool
+	VideoSettle time.Duration
+	// Скорость чтения файлов задачей integrity-check в байтах в секунду (0 — без ограничения)
+	IntegrityCheckRate int64
+
+	// Подписанные ссылки на видео: ключ подписи (если не задан — случайный,
+	// ссылки действуют до перезапуска), обязательность подписи, срок действия
+	// выдаваемых ссылок и привязка ссылки к IP клиента
+	VideoURLSecret  string
+	VideoSignedURLs bool
+	VideoURLTTL     time.Duration
+	VideoURLBindIP  bool
+
+	// Возобновляемая загрузка (tus): папка для незавершённых загрузок
+	// и время, через которое брошенная загрузка удаляется
+	TusDir        string
+	TusExpiration time.Duration
+}
+
+var cfg = loadConfig()
+
+// loadConfig читает настройки из переменных окружения
+func loadConfig() Config {
+	return Config{
+		DKIMSelector: getEnv("DKIM_SELECTOR", ""),
+		DKIMDomain:   getEnv("DKIM_DOMAIN", ""),
+		DKIMKeyFile:  getEnv("DKIM_KEY_FILE", ""),
+
+		BackupPassphrase:   getEnv("BACKUP_PASSPHRASE", ""),
+		BackupRecipient:    getEnv("BACKUP_RECIPIENT", ""),
+		BackupIdentityFile: getEnv("BACKUP_IDENTITY_FILE", ""),
+
+		InboundSMTPAddr:       getEnv("INBOUND_SMTP_ADDR", ""),
+		InboundAllowedSenders: getEnvList("INBOUND_ALLOWED_SENDERS"),
+		InboundImportToken:    getEnv("INBOUND_IMPORT_TOKEN", ""),
+
+		EventSubscribersFile:  getEnv("EVENT_SUBSCRIBERS_FILE", ""),
+		EventLogRetentionDays: getEnvInt("EVENT_LOG_RETENTION_DAYS", 30),
+
+		SchedulerTimezone: getEnv("SCHEDULER_TZ", "Local"),
+		SchedulerJobsFile: getEnv("SCHEDULER_JOBS_FILE", ""),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "local"),
+		VideoDir:       getEnv("VIDEO_DIR", UploadDir),
+		S3Endpoint:     getEnv("S3_ENDPOINT", ""),
+		S3Region:       getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:       getEnv("S3_BUCKET", ""),
+		S3AccessKey:    getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:    getEnv("S3_SECRET_KEY", ""),
+		S3Prefix:       getEnv("S3_PREFIX", ""),
+		VideoFaststart: getEnvBool("VIDEO_FASTSTART", false),
+
+		VideoHLS:          getEnvBool("VIDEO_HLS", false),
+		HLSSegmentSeconds: getEnvInt("HLS_SEGMENT_SECONDS", 6),
+		LibraryQuota:      int64(getEnvInt("VIDEO_LIBRARY_QUOTA_MB", 0)) << 20,
+		UploaderQuota:     int64(getEnvInt("VIDEO_UPLOADER_QUOTA_MB", 0)) << 20,
+		UploaderQuotas:    getEnvList("VIDEO_UPLOADER_QUOTAS"),
+		MinFreeSpace:      int64(getEnvInt("MIN_FREE_SPACE_MB", 0)) << 20,
+		UploadStaleAfter:  time.Duration(getEnvInt("UPLOAD_STALE_HOURS", 6)) * time.Hour,
+
+		TrashRetentionDays:  getEnvInt("TRASH_RETENTION_DAYS", 30),
+		RetentionPolicyFile: getEnv("RETENTION_POLICY_FILE", ""),
+
+		VideoWatch:  getEnvBool("VIDEO_WATCH", true),
+		VideoSettle: time.Duration(getEnvInt("VIDEO_SETTLE_SECONDS", 10)) * time.Second,
+
+		IntegrityCheckRate: int64(getEnvInt("INTEGRITY_CHECK_MB_PER_SEC", 32)) << 20,
+
+		VideoURLSecret:  getEnv("VIDEO_URL_SECRET", ""),
+		VideoSignedURLs: getEnvBool("VIDEO_SIGNED_URLS", false),
+		VideoURLTTL:     time.Duration(getEnvInt("VIDEO_URL_TTL_MINUTES", 360)) * time.Minute,
+		VideoURLBindIP:  getEnvBool("VIDEO_URL_BIND_IP", false),
+
+		TusDir:        getEnv("TUS_DIR", "tus-uploads"),
+		TusExpiration: time.Duration(getEnvInt("TUS_EXPIRATION_HOURS", 24)) * time.Hour,
+	}
+}
+
+// getEnv возвращает значение переменной окружения или значение по умолчанию
+func getEnv(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvList разбирает список значений через запятую
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// getEnvInt возвращает целое значение переменной окружения или значение по умолчанию
+func getEnvInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// getEnvBool возвращает логическое значение переменной окружения (1, true, yes, on)
+func getEnvBool(key string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	}
+	return def
+}
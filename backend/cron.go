@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule — расписание в формате cron из пяти полей:
+// минута, час, день месяца, месяц, день недели.
+// Поддерживаются *, списки, диапазоны, шаги, имена месяцев и дней,
+// сокращения @hourly/@daily/@weekly/@monthly/@yearly и префикс CRON_TZ=<зона>.
+type cronSchedule struct {
+	spec   string
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	// Если ограничены и день месяца, и день недели, подходит любой из них (как в cron)
+	domStar bool
+	dowStar bool
+	loc     *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron разбирает выражение cron. defaultLoc используется, если в выражении нет CRON_TZ.
+func parseCron(spec string, defaultLoc *time.Location) (*cronSchedule, error) {
+	s := &cronSchedule{spec: spec, loc: defaultLoc}
+	expr := strings.TrimSpace(spec)
+
+	if strings.HasPrefix(expr, "CRON_TZ=") || strings.HasPrefix(expr, "TZ=") {
+		tz, rest, _ := strings.Cut(expr, " ")
+		_, name, _ := strings.Cut(tz, "=")
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("неизвестная временная зона %q: %v", name, err)
+		}
+		s.loc = loc
+		expr = strings.TrimSpace(rest)
+	}
+	if s.loc == nil {
+		s.loc = time.Local
+	}
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("выражение cron %q должно содержать 5 полей", spec)
+	}
+
+	if err := parseCronField(fields[0], 0, 59, nil, s.minute[:]); err != nil {
+		return nil, fmt.Errorf("минуты: %v", err)
+	}
+	if err := parseCronField(fields[1], 0, 23, nil, s.hour[:]); err != nil {
+		return nil, fmt.Errorf("часы: %v", err)
+	}
+	if err := parseCronField(fields[2], 1, 31, nil, s.dom[:]); err != nil {
+		return nil, fmt.Errorf("день месяца: %v", err)
+	}
+	if err := parseCronField(fields[3], 1, 12, cronMonthNames, s.month[:]); err != nil {
+		return nil, fmt.Errorf("месяц: %v", err)
+	}
+	// День недели допускает 7 как воскресенье
+	var dow [8]bool
+	if err := parseCronField(fields[4], 0, 7, cronDayNames, dow[:]); err != nil {
+		return nil, fmt.Errorf("день недели: %v", err)
+	}
+	copy(s.dow[:], dow[:7])
+	if dow[7] {
+		s.dow[0] = true
+	}
+
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+// parseCronField заполняет set значениями поля вида "1,5-10/2,*/15"
+func parseCronField(field string, lo, hi int, names map[string]int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return fmt.Errorf("неверный шаг %q", stepPart)
+			}
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			from, to = lo, hi
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = parseCronValue(a, names); err != nil {
+				return err
+			}
+			if to, err = parseCronValue(b, names); err != nil {
+				return err
+			}
+		default:
+			v, err := parseCronValue(rangePart, names)
+			if err != nil {
+				return err
+			}
+			from, to = v, v
+			if hasStep {
+				to = hi
+			}
+		}
+
+		if from < lo || to > hi || from > to {
+			return fmt.Errorf("значение %q вне диапазона %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("неверное значение %q", s)
+	}
+	return v, nil
+}
+
+// dayMatches проверяет день месяца и день недели
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next возвращает ближайшее время запуска строго после t.
+// Расчёт идёт по местному времени зоны расписания, поэтому 09:00 остаётся 09:00
+// после перехода на летнее/зимнее время. Несуществующее время (при переводе
+// часов вперёд) сдвигается вперёд, повторяющийся час запускается один раз.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	start := t
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, s.loc)
+	if !t.After(start) {
+		t = start.Truncate(time.Minute).Add(time.Minute)
+	}
+
+	limit := start.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case !s.month[t.Month()]:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+		case !s.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+		case !s.hour[t.Hour()]:
+			want := t.Hour() + 1
+			next = time.Date(t.Year(), t.Month(), t.Day(), want, 0, 0, 0, s.loc)
+			if !next.After(t) || next.Hour() != want%24 {
+				// Час попал в разрыв при переводе часов вперёд: берём момент сразу после
+				// перевода и, если пропущенный час есть в расписании, запускаем в этот момент
+				next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, s.loc).Add(time.Hour)
+				if want < 24 && s.hour[want] {
+					return next
+				}
+			}
+		case !s.minute[t.Minute()]:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, s.loc)
+		default:
+			return t
+		}
+		// Защита от шага назад при переходе с летнего времени
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
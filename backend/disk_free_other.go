@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFree не поддерживается на этой платформе: проверка свободного места пропускается
+func diskFree(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// dkimDefaultHeaders — заголовки, которые включаются в подпись, если они есть в письме
+var dkimDefaultHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner подписывает письма по RFC 6376 (rsa-sha256) и RFC 8463 (ed25519-sha256).
+// Канонизация всегда relaxed/relaxed.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Headers  []string
+
+	key  crypto.Signer
+	algo string
+}
+
+// loadDKIMSigner читает приватный ключ из PEM-файла (PKCS#8 или PKCS#1)
+func loadDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать ключ DKIM: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("файл %s не содержит PEM-блока", keyFile)
+	}
+
+	var key any
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("неподдерживаемый формат ключа DKIM: %v", err)
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("ключ DKIM не поддерживает подпись")
+	}
+	return newDKIMSigner(domain, selector, signer)
+}
+
+// newDKIMSigner создаёт подписчик, алгоритм определяется по типу ключа
+func newDKIMSigner(domain, selector string, key crypto.Signer) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, fmt.Errorf("для DKIM нужны домен и селектор")
+	}
+	s := &DKIMSigner{Domain: domain, Selector: selector, Headers: dkimDefaultHeaders, key: key}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algo = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("неподдерживаемый тип ключа DKIM: %T", key)
+	}
+	return s, nil
+}
+
+// DNSRecord возвращает TXT-запись для <selector>._domainkey.<domain>
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", fmt.Errorf("неподдерживаемый тип ключа DKIM")
+}
+
+// Sign возвращает письмо с добавленным заголовком DKIM-Signature
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	msg = normalizeCRLF(msg)
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, fmt.Errorf("в письме нет разделителя заголовков и тела")
+	}
+	fields := splitHeaderFields(string(header) + "\r\n")
+
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(string(body))))
+
+	// Выбираем подписываемые заголовки: для повторяющихся берём последний ещё не использованный
+	used := make(map[int]bool)
+	var names []string
+	var signed strings.Builder
+	for _, name := range s.Headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headerFieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(name))
+			signed.WriteString(dkimRelaxedHeader(fields[i]))
+			signed.WriteString("\r\n")
+			break
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("в письме нет заголовков для подписи")
+	}
+
+	sigHeader := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algo, s.Domain, s.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signed.WriteString(dkimRelaxedHeader(sigHeader))
+
+	digest := sha256.Sum256([]byte(signed.String()))
+	var sig []byte
+	var err error
+	if s.algo == "ed25519-sha256" {
+		// RFC 8463: Ed25519 подписывает SHA-256 от данных заголовков
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(sigHeader)
+	out.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	out.WriteString("\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// normalizeCRLF приводит все переводы строк к CRLF
+func normalizeCRLF(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+// splitHeaderFields разбивает блок заголовков на поля вместе со строками продолжения
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+// headerFieldName возвращает имя заголовка без двоеточия
+func headerFieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// dkimRelaxedHeader — канонизация заголовка relaxed (RFC 6376, 3.4.2)
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = collapseWSP(value)
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Trim(value, " ")
+}
+
+// dkimRelaxedBody — канонизация тела relaxed (RFC 6376, 3.4.4)
+func dkimRelaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// collapseWSP заменяет последовательности пробелов и табуляций одним пробелом
+func collapseWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// foldBase64 переносит длинное значение подписи, чтобы строки заголовка не превышали лимит
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for i := 0; i < len(s); i += width {
+		if i > 0 {
+			b.WriteString("\r\n\t")
+		}
+		b.WriteString(s[i:min(i+width, len(s))])
+	}
+	return b.String()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Проверка подписи написана отдельно от dkim.go по RFC 6376 (раздел 6),
+// чтобы тесты не повторяли ошибки подписчика.
+
+var (
+	testWSP     = regexp.MustCompile(`[ \t]+`)
+	testSigTagB = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+// testRelaxedHeader — канонизация relaxed заголовка по RFC 6376, 3.4.2
+func testRelaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	value = strings.Trim(testWSP.ReplaceAllString(value, " "), " ")
+	return name + ":" + value
+}
+
+// testRelaxedBody — канонизация relaxed тела по RFC 6376, 3.4.4
+func testRelaxedBody(body string) string {
+	var out []string
+	for _, line := range strings.Split(body, "\r\n") {
+		out = append(out, strings.TrimRight(testWSP.ReplaceAllString(line, " "), " "))
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+// testHeaderFields разбирает заголовки письма на поля со строками продолжения
+func testHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func testFieldName(field string) string {
+	return strings.ToLower(strings.TrimSpace(field[:strings.IndexByte(field, ':')]))
+}
+
+// verifyDKIM проверяет первую подпись DKIM-Signature письма по записи DNS record
+func verifyDKIM(msg []byte, record string) error {
+	header, body, ok := strings.Cut(string(msg), "\r\n\r\n")
+	if !ok {
+		return errors.New("нет разделителя заголовков и тела")
+	}
+	fields := testHeaderFields(header)
+	if testFieldName(fields[0]) != "dkim-signature" {
+		return errors.New("первый заголовок не DKIM-Signature")
+	}
+	sigField := fields[0]
+	fields = fields[1:]
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(sigField[strings.IndexByte(sigField, ':')+1:], ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("неожиданные теги v=%q c=%q", tags["v"], tags["c"])
+	}
+
+	bodyHash := sha256.Sum256([]byte(testRelaxedBody(body)))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("не совпадает хеш тела")
+	}
+
+	// Экземпляры одноимённых заголовков берутся снизу вверх (RFC 6376, 5.4.2)
+	used := map[int]bool{}
+	var data strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && testFieldName(fields[i]) == strings.ToLower(name) {
+				used[i] = true
+				data.WriteString(testRelaxedHeader(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	data.WriteString(testRelaxedHeader(testSigTagB.ReplaceAllString(sigField, "$1$2")))
+	digest := sha256.Sum256([]byte(data.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	recordTags := map[string]string{}
+	for _, tag := range strings.Split(record, ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		recordTags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	pub, err := base64.StdEncoding.DecodeString(recordTags["p"])
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, err := x509.ParsePKIXPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+	case "ed25519-sha256":
+		if !ed25519.Verify(ed25519.PublicKey(pub), digest[:], sig) {
+			return errors.New("неверная подпись ed25519")
+		}
+		return nil
+	}
+	return fmt.Errorf("неизвестный алгоритм %q", tags["a"])
+}
+
+func testDKIMSigners(t *testing.T) map[string]*DKIMSigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]*DKIMSigner{}
+	for name, key := range map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey} {
+		s, err := newDKIMSigner("example.com", "mail", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = s
+	}
+	return signers
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	messages := map[string]string{
+		"простое":                 "From: a@example.com\r\nTo: b@example.org\r\nSubject: Отчёт\r\n\r\nТело письма\r\n",
+		"переносы LF":             "From: a@example.com\nTo: b@example.org\nSubject: test\n\nline 1\nline 2\n",
+		"свёрнутый заголовок":     "From: a@example.com\r\nSubject: very\r\n long\r\n\t subject\r\nTo: b@example.org\r\n\r\nbody\r\n",
+		"пробелы в заголовках":    "FROM : a@example.com  \r\nto:\tb@example.org\r\nSubject:  a   b\t\tc \r\n\r\nbody\r\n",
+		"повторяющийся заголовок": "From: a@example.com\r\nTo: first@example.org\r\nTo: second@example.org\r\nSubject: x\r\n\r\nbody\r\n",
+		"пробелы в теле":          "From: a@example.com\r\nSubject: x\r\n\r\n  C \r\nD \t E\r\n\r\n\r\n",
+		"пустое тело":             "From: a@example.com\r\nSubject: x\r\n\r\n",
+		"multipart": "From: a@example.com\r\nSubject: x\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n--b1\r\nContent-Type: text/plain\r\n\r\nhi\r\n--b1--\r\n",
+	}
+	for algo, signer := range testDKIMSigners(t) {
+		record, err := signer.DNSRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, msg := range messages {
+			t.Run(algo+"/"+name, func(t *testing.T) {
+				signed, err := signer.Sign([]byte(msg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+algo+"; c=relaxed/relaxed; d=example.com; s=mail;")) {
+					t.Fatalf("неожиданный заголовок подписи: %.120q", signed)
+				}
+				if err := verifyDKIM(signed, record); err != nil {
+					t.Fatalf("подпись не прошла проверку: %v\n%s", err, signed)
+				}
+			})
+		}
+	}
+}
+
+// Изменения, которые relaxed-канонизация допускает, не ломают подпись,
+// а изменения содержимого — ломают
+func TestDKIMVerifyAfterTransit(t *testing.T) {
+	msg := "From: a@example.com\r\nTo: b@example.org\r\nSubject: hello world\r\n\r\nline one\r\nline two\r\n"
+	for algo, signer := range testDKIMSigners(t) {
+		record, _ := signer.DNSRecord()
+		signed, err := signer.Sign([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			name  string
+			old   string
+			new   string
+			valid bool
+		}{
+			{"перенос заголовка", "Subject: hello world", "Subject: hello\r\n world", true},
+			{"регистр имени", "Subject:", "SUBJECT:", true},
+			{"пробелы в теле", "line one", "line  \t one", true},
+			{"пустые строки в конце", "line two\r\n", "line two\r\n\r\n\r\n", true},
+			{"изменена тема", "hello world", "hello word", false},
+			{"изменено тело", "line two", "line 2", false},
+			{"подписанный заголовок добавлен выше", "From: a@example.com", "To: c@example.org\r\nFrom: a@example.com", true},
+			{"подписанный заголовок добавлен ниже", "Subject: hello world\r\n", "Subject: hello world\r\nTo: c@example.org\r\n", false},
+		}
+		for _, c := range cases {
+			t.Run(algo+"/"+c.name, func(t *testing.T) {
+				changed := strings.Replace(string(signed), c.old, c.new, 1)
+				err := verifyDKIM([]byte(changed), record)
+				if c.valid && err != nil {
+					t.Fatalf("подпись должна остаться верной: %v", err)
+				}
+				if !c.valid && err == nil {
+					t.Fatal("изменённое письмо прошло проверку")
+				}
+			})
+		}
+	}
+}
+
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	// Пример из RFC 6376, 3.4.5
+	headers := []struct{ in, want string }{
+		{"A: X", "a:X"},
+		{"B : Y\t\r\n\tZ  ", "b:Y Z"},
+		{"Subject:   ", "subject:"},
+		{"X-Test:a\t \tb", "x-test:a b"},
+	}
+	for _, h := range headers {
+		if got := dkimRelaxedHeader(h.in); got != h.want {
+			t.Errorf("dkimRelaxedHeader(%q) = %q, want %q", h.in, got, h.want)
+		}
+	}
+
+	bodies := []struct{ in, want string }{
+		{" C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"no newline", "no newline\r\n"},
+		{"a  \r\n\r\nb", "a\r\n\r\nb\r\n"},
+	}
+	for _, b := range bodies {
+		if got := dkimRelaxedBody(b.in); got != b.want {
+			t.Errorf("dkimRelaxedBody(%q) = %q, want %q", b.in, got, b.want)
+		}
+	}
+
+	fields := splitHeaderFields("A: 1\r\nB: 2\r\n\tcont\r\n 3\r\nC: 4\r\n")
+	want := []string{"A: 1", "B: 2\r\n\tcont\r\n 3", "C: 4"}
+	if strings.Join(fields, "|") != strings.Join(want, "|") {
+		t.Errorf("splitHeaderFields = %q, want %q", fields, want)
+	}
+}
+
+func TestDKIMSignErrors(t *testing.T) {
+	signer := testDKIMSigners(t)["ed25519-sha256"]
+	if _, err := signer.Sign([]byte("From: a@example.com\r\nno body separator")); err == nil {
+		t.Error("письмо без тела подписано")
+	}
+	if _, err := signer.Sign([]byte("X-Other: 1\r\n\r\nbody")); err == nil {
+		t.Error("письмо без подписываемых заголовков подписано")
+	}
+	if _, err := newDKIMSigner("", "mail", signer.key); err == nil {
+		t.Error("подписчик создан без домена")
+	}
+}
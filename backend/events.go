@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Типы событий
+const (
+	EventVideoUploaded = "video.uploaded"
+	EventVideoUpdated  = "video.updated"
+	EventVideoTrashed  = "video.trashed"
+	EventVideoRestored = "video.restored"
+	EventVideoDeleted  = "video.deleted" // окончательно, из корзины
+	EventUsersImported = "users.imported"
+	EventBackupFailed  = "backup.failed"
+)
+
+// Event — событие приложения, которое рассылается подписчикам
+type Event struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// EventSubscriber доставляет события в одно место назначения
+type EventSubscriber interface {
+	Name() string
+	Deliver(evt Event) error
+}
+
+type subscription struct {
+	sub    EventSubscriber
+	events map[string]bool // пустая карта — все события
+}
+
+// EventBus — внутрипроцессная шина событий с повторными попытками доставки
+type EventBus struct {
+	mu      sync.RWMutex
+	subs    []subscription
+	retries int
+	backoff time.Duration
+}
+
+var events = &EventBus{retries: 5, backoff: 2 * time.Second}
+
+// Subscribe подписывает получателя на указанные типы событий (все, если список пуст)
+func (b *EventBus) Subscribe(sub EventSubscriber, types ...string) {
+	s := subscription{sub: sub, events: make(map[string]bool)}
+	for _, t := range types {
+		s.events[t] = true
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+}
+
+// Publish рассылает событие асинхронно, не задерживая обработчик запроса
+func (b *EventBus) Publish(eventType string, data map[string]interface{}) {
+	evt := Event{
+		ID:   fmt.Sprintf("%d_%s", time.Now().UnixNano(), generateRandomString(8)),
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		if len(s.events) > 0 && !s.events[eventType] {
+			continue
+		}
+		go b.deliver(s.sub, evt)
+	}
+}
+
+// deliver пытается доставить событие с экспоненциальной задержкой между попытками
+func (b *EventBus) deliver(sub EventSubscriber, evt Event) {
+	delay := b.backoff
+	for attempt := 1; attempt <= b.retries; attempt++ {
+		err := sub.Deliver(evt)
+		logEventDelivery(evt, sub.Name(), attempt, err)
+		if err == nil {
+			return
+		}
+		log.Printf("Доставка события %s (%s) в %s, попытка %d: %v", evt.ID, evt.Type, sub.Name(), attempt, err)
+		if attempt < b.retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("Событие %s (%s) не доставлено в %s", evt.ID, evt.Type, sub.Name())
+}
+
+// webhookSubscriber отправляет события POST-запросом с подписью HMAC-SHA256.
+// Подпись: hex(HMAC(secret, "<timestamp>.<тело>")) в заголовке X-Signature.
+type webhookSubscriber struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (s *webhookSubscriber) Name() string { return "webhook:" + s.url }
+
+func (s *webhookSubscriber) Deliver(evt Event) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", evt.Type)
+	req.Header.Set("X-Event-ID", evt.ID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+signWebhook(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ответ %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook вычисляет подпись тела вебхука
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailSubscriber отправляет события письмом
+type emailSubscriber struct {
+	to string
+}
+
+func (s *emailSubscriber) Name() string { return "email:" + s.to }
+
+func (s *emailSubscriber) Deliver(evt Event) error {
+	data, err := json.MarshalIndent(evt.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Событие %s", evt.Type)
+
+	var msg bytes.Buffer
+	msg.WriteString(fmt.Sprintf("From: %s\r\n", SMTPUsername))
+	msg.WriteString(fmt.Sprintf("To: %s\r\n", s.to))
+	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject)))
+	msg.WriteString(fmt.Sprintf("Date: %s\r\n", mailDateHeader()))
+	msg.WriteString(fmt.Sprintf("Message-ID: %s\r\n", mailMessageID()))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(fmt.Sprintf("Событие: %s\r\nID: %s\r\nВремя: %s\r\n\r\n",
+		evt.Type, evt.ID, evt.Time.Format("2006-01-02 15:04:05")))
+	msg.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+
+	return sendMail([]string{s.to}, msg.Bytes())
+}
+
+// subscriberConfig — описание подписчика в файле EVENT_SUBSCRIBERS_FILE
+//
+//	[{"type": "webhook", "url": "https://...", "secret": "...", "events": ["video.uploaded"]},
+//	 {"type": "email", "to": "admin@example.com", "events": ["backup.failed"]}]
+type subscriberConfig struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	To     string   `json:"to"`
+	Events []string `json:"events"`
+}
+
+// initEventSubscribers подписывает получателей из файла настроек
+func initEventSubscribers() {
+	if cfg.EventSubscribersFile == "" {
+		return
+	}
+	data, err := os.ReadFile(cfg.EventSubscribersFile)
+	if err != nil {
+		log.Printf("Не удалось прочитать подписчиков событий: %v", err)
+		return
+	}
+	var list []subscriberConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Неверный формат %s: %v", cfg.EventSubscribersFile, err)
+		return
+	}
+
+	for _, c := range list {
+		var sub EventSubscriber
+		switch c.Type {
+		case "webhook":
+			if c.URL == "" || c.Secret == "" {
+				log.Printf("Вебхук пропущен: нужны url и secret")
+				continue
+			}
+			sub = &webhookSubscriber{url: c.URL, secret: c.Secret, client: &http.Client{Timeout: 10 * time.Second}}
+		case "email":
+			if c.To == "" {
+				log.Printf("Почтовый подписчик пропущен: нужен адрес to")
+				continue
+			}
+			sub = &emailSubscriber{to: c.To}
+		default:
+			log.Printf("Неизвестный тип подписчика: %q", c.Type)
+			continue
+		}
+		events.Subscribe(sub, c.Events...)
+		log.Printf("Подписчик событий: %s %v", sub.Name(), c.Events)
+	}
+}
+
+// logEventDelivery записывает попытку доставки в журнал event_deliveries
+func logEventDelivery(evt Event, subscriber string, attempt int, deliveryErr error) {
+	status, errText := "delivered", ""
+	if deliveryErr != nil {
+		status, errText = "failed", deliveryErr.Error()
+	}
+
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO event_deliveries (event_id, event_type, subscriber, attempt, status, error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, evt.ID, evt.Type, subscriber, attempt, status, errText, time.Now())
+	if err != nil {
+		log.Printf("Не удалось записать журнал доставки: %v", err)
+	}
+}
+
+// eventDeliveriesHandler возвращает последние записи журнала доставки событий
+func eventDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		http.Error(w, "Ошибка подключения к БД", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT event_id, event_type, subscriber, attempt, status, error, created_at
+		FROM event_deliveries ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []map[string]interface{}{}
+	for rows.Next() {
+		var eventID, eventType, subscriber, status, errText string
+		var attempt int
+		var createdAt time.Time
+		if err := rows.Scan(&eventID, &eventType, &subscriber, &attempt, &status, &errText, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, map[string]interface{}{
+			"event_id":   eventID,
+			"event_type": eventType,
+			"subscriber": subscriber,
+			"attempt":    attempt,
+			"status":     status,
+			"error":      errText,
+			"created_at": createdAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Упаковка MP4 (H.264 + AAC) в HLS без перекодирования: кадры из таблиц сэмплов
+// перекладываются в сегменты MPEG-TS, которые начинаются с ключевого кадра.
+// Результат лежит в хранилище под hls/{id}/: master.m3u8, index.m3u8 (VOD)
+// и сегменты; отдаётся по /api/video/{id}/hls/.
+
+const (
+	hlsPrefix         = "hls/"
+	hlsMasterPlaylist = "master.m3u8"
+	hlsMediaPlaylist  = "index.m3u8"
+	// hlsMaxSampleSize — ограничение на размер одного кадра, читаемого в память
+	hlsMaxSampleSize = 64 << 20
+)
+
+// Состояние упаковки HLS в каталоге
+const (
+	hlsStatusProcessing  = "processing"
+	hlsStatusReady       = "ready"
+	hlsStatusFailed      = "failed"
+	hlsStatusUnsupported = "unsupported" // не MP4 или кодеки не H.264/AAC
+)
+
+var errHLSUnsupported = errors.New("для HLS нужен MP4 с видео H.264 и аудио AAC")
+
+func hlsKey(id int64, name string) string {
+	return fmt.Sprintf("%s%d/%s", hlsPrefix, id, name)
+}
+
+func hlsSegmentName(i int) string {
+	return fmt.Sprintf("segment%05d.ts", i)
+}
+
+// packageHLS упаковывает видео из каталога в HLS и отмечает результат в каталоге
+func packageHLS(ctx context.Context, v *Video) error {
+	if err := catalog.SetHLSStatus(ctx, v.ID, hlsStatusProcessing); err != nil {
+		return err
+	}
+	err := writeHLS(ctx, v)
+	status := hlsStatusReady
+	switch {
+	case errors.Is(err, errHLSUnsupported):
+		status = hlsStatusUnsupported
+	case err != nil:
+		status = hlsStatusFailed
+	}
+	if err != nil {
+		if delErr := deleteHLS(ctx, v.ID); delErr != nil {
+			log.Printf("HLS %s: не удалось удалить неполный результат: %v", v.Key, delErr)
+		}
+	}
+	if setErr := catalog.SetHLSStatus(ctx, v.ID, status); setErr != nil && err == nil {
+		err = setErr
+	}
+	v.HLSStatus = status
+	return err
+}
+
+// deleteHLS удаляет плейлисты и сегменты видео
+func deleteHLS(ctx context.Context, id int64) error {
+	blobs, err := videoStore.List(ctx, hlsKey(id, ""))
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if err := videoStore.Delete(ctx, b.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// hlsSegment — границы сегмента: видеокадры [first, end), время в тиках 90 кГц
+type hlsSegment struct {
+	first, end int
+	start      int64
+	duration   int64
+	size       int
+}
+
+// hlsStream — дорожки, подготовленные к упаковке
+type hlsStream struct {
+	video, audio *mp4Track
+	aac          aacConfig
+	offset       int64 // прибавляется ко всем временам, чтобы они были неотрицательны
+}
+
+// ts90 переводит время сэмпла дорожки в тики 90 кГц
+func (s *hlsStream) ts90(t *mp4Track, v int64) int64 {
+	return (v+t.Shift)*90000/int64(t.Timescale) + s.offset
+}
+
+func writeHLS(ctx context.Context, v *Video) error {
+	switch v.MIME {
+	case "video/mp4", "video/quicktime", "video/x-m4v", "video/3gpp":
+	default:
+		return errHLSUnsupported
+	}
+	f, err := videoStore.Open(ctx, v.BlobKey)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tracks, err := readMP4Tracks(f, f.Info().Size)
+	if err != nil {
+		return err
+	}
+	stream, err := newHLSStream(tracks)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteHLS(ctx, v.ID); err != nil {
+		return err
+	}
+
+	segments := stream.plan(float64(cfg.HLSSegmentSeconds))
+	mux := newTSMuxer(stream.audio != nil)
+	src := &sampleReader{r: f, pos: -1}
+	audioNext := 0
+	var buf bytes.Buffer
+	for i := range segments {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seg := &segments[i]
+		// Аудио до начала следующего сегмента; последнему сегменту — всё оставшееся
+		audioEnd := int64(math.MaxInt64)
+		if i+1 < len(segments) {
+			audioEnd = segments[i+1].start
+		}
+		buf.Reset()
+		if audioNext, err = stream.writeSegment(&buf, mux, src, seg, audioNext, audioEnd); err != nil {
+			return err
+		}
+		seg.size = buf.Len()
+		if _, err := videoStore.Put(ctx, hlsKey(v.ID, hlsSegmentName(i)), &buf); err != nil {
+			return err
+		}
+	}
+
+	if _, err := videoStore.Put(ctx, hlsKey(v.ID, hlsMediaPlaylist), strings.NewReader(hlsMediaPlaylistText(segments))); err != nil {
+		return err
+	}
+	master := stream.masterPlaylistText(segments, v.Width, v.Height)
+	_, err = videoStore.Put(ctx, hlsKey(v.ID, hlsMasterPlaylist), strings.NewReader(master))
+	return err
+}
+
+// newHLSStream выбирает первую видео- и первую аудиодорожку и проверяет кодеки
+func newHLSStream(tracks []*mp4Track) (*hlsStream, error) {
+	s := &hlsStream{}
+	for _, t := range tracks {
+		switch {
+		case t.Handler == "vide" && s.video == nil:
+			if (t.Codec != "avc1" && t.Codec != "avc3") || t.NALLength == 0 {
+				return nil, errHLSUnsupported
+			}
+			s.video = t
+		case t.Handler == "soun" && s.audio == nil:
+			aac, err := parseAACConfig(t.AudioConfig)
+			if t.Codec != "mp4a" || err != nil {
+				return nil, errHLSUnsupported
+			}
+			s.audio, s.aac = t, aac
+		}
+	}
+	if s.video == nil || len(s.video.Samples) == 0 {
+		return nil, errHLSUnsupported
+	}
+	if s.audio != nil && len(s.audio.Samples) == 0 {
+		s.audio = nil
+	}
+
+	// Сдвигаем время так, чтобы самый ранний DTS стал нулём
+	minDTS := s.ts90(s.video, s.video.Samples[0].DTS)
+	if s.audio != nil {
+		minDTS = min(minDTS, s.ts90(s.audio, s.audio.Samples[0].DTS))
+	}
+	s.offset = -minDTS
+	return s, nil
+}
+
+// plan режет видео на сегменты не короче target секунд по ключевым кадрам
+func (s *hlsStream) plan(target float64) []hlsSegment {
+	samples := s.video.Samples
+	limit := int64(target * 90000)
+	var segments []hlsSegment
+	cur := hlsSegment{first: 0, start: s.ts90(s.video, samples[0].DTS)}
+	for i := 1; i < len(samples); i++ {
+		t := s.ts90(s.video, samples[i].DTS)
+		if samples[i].Key && t-cur.start >= limit {
+			cur.end, cur.duration = i, t-cur.start
+			segments = append(segments, cur)
+			cur = hlsSegment{first: i, start: t}
+		}
+	}
+	last := samples[len(samples)-1]
+	cur.end = len(samples)
+	cur.duration = s.ts90(s.video, last.DTS+int64(last.Duration)) - cur.start
+	return append(segments, cur)
+}
+
+// writeSegment пишет сегмент, чередуя видео и аудио по времени декодирования.
+// Возвращает индекс первого аудиокадра следующего сегмента.
+func (s *hlsStream) writeSegment(w io.Writer, mux *tsMuxer, src *sampleReader, seg *hlsSegment, audioNext int, audioEnd int64) (int, error) {
+	if err := mux.writeTables(w); err != nil {
+		return audioNext, err
+	}
+	vi := seg.first
+	for vi < seg.end || (s.audio != nil && audioNext < len(s.audio.Samples) &&
+		s.ts90(s.audio, s.audio.Samples[audioNext].DTS) < audioEnd) {
+
+		writeAudio := false
+		if s.audio != nil && audioNext < len(s.audio.Samples) {
+			adts := s.ts90(s.audio, s.audio.Samples[audioNext].DTS)
+			writeAudio = adts < audioEnd && (vi >= seg.end || adts <= s.ts90(s.video, s.video.Samples[vi].DTS))
+		}
+
+		if writeAudio {
+			sample := s.audio.Samples[audioNext]
+			data, err := src.read(sample)
+			if err != nil {
+				return audioNext, err
+			}
+			frame := append(s.aac.adtsHeader(len(data)), data...)
+			pts := s.ts90(s.audio, sample.DTS)
+			if err := mux.writePES(w, tsPIDAudio, tsStreamIDAudio, pts, pts, -1, false, frame); err != nil {
+				return audioNext, err
+			}
+			audioNext++
+			continue
+		}
+
+		sample := s.video.Samples[vi]
+		data, err := src.read(sample)
+		if err != nil {
+			return audioNext, err
+		}
+		au, err := s.annexB(data, sample.Key)
+		if err != nil {
+			return audioNext, err
+		}
+		dts := s.ts90(s.video, sample.DTS)
+		pts := s.ts90(s.video, sample.DTS+sample.CTS)
+		if err := mux.writePES(w, tsPIDVideo, tsStreamIDVideo, pts, dts, dts, sample.Key, au); err != nil {
+			return audioNext, err
+		}
+		vi++
+	}
+	return audioNext, nil
+}
+
+// annexB переводит кадр H.264 из формата MP4 (NAL с длиной) в поток с
+// разделителями: AUD в начале, SPS/PPS перед ключевым кадром
+func (s *hlsStream) annexB(data []byte, key bool) ([]byte, error) {
+	startCode := []byte{0, 0, 0, 1}
+	n := s.video.NALLength
+	var nals [][]byte
+	hasSPS := false
+	for len(data) > 0 {
+		if len(data) < n {
+			return nil, invalidVideo("обрезанный NAL в кадре H.264")
+		}
+		var size int
+		for _, b := range data[:n] {
+			size = size<<8 | int(b)
+		}
+		if size > len(data)-n {
+			return nil, invalidVideo("обрезанный NAL в кадре H.264")
+		}
+		nal := data[n : n+size]
+		data = data[n+size:]
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case 9: // AUD добавляем сами
+			continue
+		case 7:
+			hasSPS = true
+		}
+		nals = append(nals, nal)
+	}
+
+	out := []byte{0, 0, 0, 1, 0x09, 0xF0}
+	if key && !hasSPS {
+		for _, ps := range append(append([][]byte{}, s.video.SPS...), s.video.PPS...) {
+			out = append(append(out, startCode...), ps...)
+		}
+	}
+	for _, nal := range nals {
+		out = append(append(out, startCode...), nal...)
+	}
+	return out, nil
+}
+
+// hlsMediaPlaylistText — VOD-плейлист сегментов
+func hlsMediaPlaylistText(segments []hlsSegment) string {
+	var target int64
+	for _, seg := range segments {
+		target = max(target, int64(math.Ceil(float64(seg.duration)/90000)))
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", max(target, 1))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i, seg := range segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", float64(seg.duration)/90000, hlsSegmentName(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// masterPlaylistText — мастер-плейлист с единственным вариантом
+func (s *hlsStream) masterPlaylistText(segments []hlsSegment, width, height int) string {
+	var peak, total, duration float64
+	for _, seg := range segments {
+		if seg.duration > 0 {
+			peak = max(peak, float64(seg.size)*8/(float64(seg.duration)/90000))
+		}
+		total += float64(seg.size)
+		duration += float64(seg.duration) / 90000
+	}
+	average := peak
+	if duration > 0 {
+		average = total * 8 / duration
+	}
+
+	codecs := "avc1.42E01E"
+	if sps := s.video.SPS; len(sps) > 0 && len(sps[0]) >= 4 {
+		codecs = fmt.Sprintf("avc1.%02X%02X%02X", sps[0][1], sps[0][2], sps[0][3])
+	}
+	if s.audio != nil {
+		codecs += fmt.Sprintf(",mp4a.40.%d", s.aac.objectType)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=%q",
+		int64(math.Ceil(peak)), int64(math.Ceil(average)), codecs)
+	if width > 0 && height > 0 {
+		fmt.Fprintf(&b, ",RESOLUTION=%dx%d", width, height)
+	}
+	b.WriteString("\n" + hlsMediaPlaylist + "\n")
+	return b.String()
+}
+
+// aacConfig — параметры AAC из AudioSpecificConfig, нужные для заголовков ADTS
+type aacConfig struct {
+	objectType int
+	freqIndex  int
+	channels   int
+}
+
+func parseAACConfig(asc []byte) (aacConfig, error) {
+	if len(asc) < 2 {
+		return aacConfig{}, errHLSUnsupported
+	}
+	bits := uint32(binary.BigEndian.Uint16(asc[:2]))
+	c := aacConfig{
+		objectType: int(bits >> 11),
+		freqIndex:  int(bits>>7) & 0x0F,
+		channels:   int(bits>>3) & 0x0F,
+	}
+	// Расширенный тип объекта и явная частота в ADTS не выражаются
+	if c.objectType == 0 || c.objectType == 31 || c.freqIndex > 12 || c.channels > 7 {
+		return aacConfig{}, errHLSUnsupported
+	}
+	return c, nil
+}
+
+// adtsHeader — заголовок ADTS для кадра AAC длиной n байт
+func (c aacConfig) adtsHeader(n int) []byte {
+	profile := c.objectType - 1
+	if profile > 3 { // HE-AAC и другие расширения сигнализируются неявно поверх LC
+		profile = 1
+	}
+	length := n + 7
+	return []byte{
+		0xFF, 0xF1,
+		byte(profile)<<6 | byte(c.freqIndex)<<2 | byte(c.channels>>2),
+		byte(c.channels&3)<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&7)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+// sampleReader читает кадры по возрастанию смещений; небольшие промежутки между
+// кадрами пропускает чтением, чтобы не обрывать поток (важно для S3)
+type sampleReader struct {
+	r   io.ReadSeeker
+	pos int64 // -1, если позиция неизвестна
+	buf []byte
+}
+
+const sampleReaderMaxSkip = 1 << 20
+
+func (s *sampleReader) read(sample mp4Sample) ([]byte, error) {
+	if sample.Size > hlsMaxSampleSize {
+		return nil, invalidVideo("кадр слишком большой: %d bytes", sample.Size)
+	}
+	if gap := sample.Offset - s.pos; s.pos >= 0 && gap >= 0 && gap <= sampleReaderMaxSkip {
+		if _, err := io.CopyN(io.Discard, s.r, gap); err != nil {
+			return nil, truncated(err)
+		}
+	} else if _, err := s.r.Seek(sample.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if cap(s.buf) < int(sample.Size) {
+		s.buf = make([]byte, sample.Size)
+	}
+	buf := s.buf[:sample.Size]
+	_, err := io.ReadFull(s.r, buf)
+	s.pos = sample.Offset + int64(len(buf))
+	if err != nil {
+		s.pos = -1 // позиция неизвестна: следующий кадр читаем через Seek
+		return nil, truncated(err)
+	}
+	return buf, nil
+}
+
+// hlsHandler отдаёт плейлисты и сегменты: /api/video/{id}/hls/{name}
+func hlsHandler(w http.ResponseWriter, r *http.Request, id int64, name string) {
+	if name == "" {
+		name = hlsMasterPlaylist
+	}
+	if strings.Contains(name, "/") || strings.Contains(name, "..") || strings.Contains(name, "\\") {
+		http.Error(w, "Некорректное имя файла", http.StatusBadRequest)
+		return
+	}
+
+	video, err := catalog.GetByID(r.Context(), id)
+	if errors.Is(err, errVideoNotFound) || (err == nil && (video.Status != videoStatusReady || video.HLSStatus != hlsStatusReady)) {
+		http.Error(w, "HLS для видео не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога: %v", err)
+		http.Error(w, "Ошибка доступа к файлу", http.StatusInternalServerError)
+		return
+	}
+	if !checkVideoAccess(w, r, id) {
+		return
+	}
+
+	f, err := videoStore.Open(r.Context(), hlsKey(id, name))
+	if errors.Is(err, ErrBlobNotFound) || errors.Is(err, ErrInvalidKey) {
+		http.Error(w, "Файл не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Не удалось открыть %s: %v", hlsKey(id, name), err)
+		http.Error(w, "Не удалось открыть файл", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info := f.Info()
+
+	if name == hlsMasterPlaylist {
+		notePlayback(r, video)
+	}
+
+	signed := r.URL.Query().Has("sig")
+	switch path.Ext(name) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		if signed {
+			// Ссылки плейлиста получают ту же подпись, что и сам плейлист
+			data, err := io.ReadAll(f)
+			if err != nil {
+				log.Printf("Не удалось прочитать %s: %v", hlsKey(id, name), err)
+				http.Error(w, "Не удалось открыть файл", http.StatusInternalServerError)
+				return
+			}
+			data = signPlaylistURIs(data, r)
+			serveRanges(w, r, bytes.NewReader(data), int64(len(data)), info.ModTime, "")
+			return
+		}
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+		if signed {
+			w.Header().Set("Cache-Control", "private, max-age=86400")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+		}
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	serveRanges(w, r, f, info.Size, info.ModTime, videoETag(info.Size, info.ModTime, video.SHA256))
+}
+
+// parseHLSPath разбирает путь вида {id}/hls/{name}
+func parseHLSPath(p string) (int64, string, bool) {
+	idPart, rest, ok := strings.Cut(p, "/hls/")
+	if !ok {
+		if idPart, ok = strings.CutSuffix(p, "/hls"); !ok {
+			return 0, "", false
+		}
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, "", false
+	}
+	return id, rest, true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// synthHLSStream — 30 кадров H.264 (30 к/с, ключевой каждые 10, с B-кадрами)
+// и AAC-LC 48 кГц стерео; данные кадров лежат в возвращаемом файле
+func synthHLSStream(t *testing.T) (*hlsStream, []byte) {
+	t.Helper()
+	var file bytes.Buffer
+	video := &mp4Track{
+		Handler: "vide", Codec: "avc1", Timescale: 30000, NALLength: 4,
+		SPS: [][]byte{{0x67, 0x42, 0xC0, 0x1E, 0xAA}}, PPS: [][]byte{{0x68, 0xCE, 0x3C, 0x80}},
+	}
+	for i := 0; i < 30; i++ {
+		key := i%10 == 0
+		nal := []byte{0x41}
+		if key {
+			nal[0] = 0x65
+		}
+		nal = append(nal, bytes.Repeat([]byte{byte(i)}, 50+i*37)...)
+		sample := mp4Sample{Offset: int64(file.Len()), DTS: int64(i) * 1000, Duration: 1000, Key: key}
+		if !key {
+			sample.CTS = 2000 // кадр показывается позже, чем декодируется
+		}
+		binary.Write(&file, binary.BigEndian, uint32(len(nal)))
+		file.Write(nal)
+		sample.Size = uint32(int64(file.Len()) - sample.Offset)
+		video.Samples = append(video.Samples, sample)
+	}
+
+	audio := &mp4Track{Handler: "soun", Codec: "mp4a", Timescale: 48000, AudioConfig: []byte{0x11, 0x90}}
+	for i := 0; i < 47; i++ { // чуть больше секунды
+		data := bytes.Repeat([]byte{0xA0 | byte(i%16)}, 20+i)
+		audio.Samples = append(audio.Samples, mp4Sample{Offset: int64(file.Len()), Size: uint32(len(data)), DTS: int64(i) * 1024, Duration: 1024})
+		file.Write(data)
+	}
+
+	s, err := newHLSStream([]*mp4Track{video, audio})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, file.Bytes()
+}
+
+func TestParseAACConfig(t *testing.T) {
+	c, err := parseAACConfig([]byte{0x11, 0x90})
+	if err != nil || c != (aacConfig{objectType: 2, freqIndex: 3, channels: 2}) {
+		t.Fatalf("parseAACConfig = %+v, %v", c, err)
+	}
+	for _, asc := range [][]byte{nil, {0x11}, {0xF8, 0x00}, {0x16, 0x90}} {
+		if _, err := parseAACConfig(asc); err == nil {
+			t.Fatalf("% x: неподдерживаемая конфигурация принята", asc)
+		}
+	}
+}
+
+func TestADTSHeader(t *testing.T) {
+	c := aacConfig{objectType: 2, freqIndex: 3, channels: 2}
+	for _, n := range []int{0, 1, 300, 8184} {
+		h := c.adtsHeader(n)
+		if len(h) != 7 || h[0] != 0xFF || h[1]&0xF6 != 0xF0 || h[1]&1 != 1 {
+			t.Fatalf("%d: заголовок % x: нет синхрослова или есть CRC", n, h)
+		}
+		profile, freq := h[2]>>6, h[2]>>2&0x0F
+		channels := h[2]&1<<2 | h[3]>>6
+		length := int(h[3]&3)<<11 | int(h[4])<<3 | int(h[5]>>5)
+		if profile != 1 || freq != 3 || channels != 2 || length != n+7 {
+			t.Fatalf("%d: профиль %d, частота %d, каналы %d, длина %d", n, profile, freq, channels, length)
+		}
+	}
+}
+
+func TestHLSSegments(t *testing.T) {
+	s, file := synthHLSStream(t)
+
+	// Кадры по 3000 тиков, ключевые 0, 10, 20: сегменты не короче 0,3 с режутся по ним
+	segments := s.plan(0.3)
+	if len(segments) != 3 {
+		t.Fatalf("сегментов %d: %+v", len(segments), segments)
+	}
+	for i, seg := range segments {
+		if seg.first != i*10 || seg.end != i*10+10 || seg.start != int64(i)*30000 || seg.duration != 30000 {
+			t.Fatalf("сегмент %d: %+v", i, seg)
+		}
+	}
+	if got := s.plan(10); len(got) != 1 || got[0].end != 30 || got[0].duration != 90000 {
+		t.Fatalf("один длинный сегмент: %+v", got)
+	}
+
+	mux := newTSMuxer(true)
+	src := &sampleReader{r: bytes.NewReader(file), pos: -1}
+	d := newTSDemux(t)
+	audioNext := 0
+	var perSegment [][]*tsPES
+	for i := range segments {
+		audioEnd := int64(1 << 62)
+		if i+1 < len(segments) {
+			audioEnd = segments[i+1].start
+		}
+		var buf bytes.Buffer
+		var err error
+		if audioNext, err = s.writeSegment(&buf, mux, src, &segments[i], audioNext, audioEnd); err != nil {
+			t.Fatal(err)
+		}
+		// Каждый сегмент начинается с PAT и PMT
+		before, pesBefore := len(d.tables), len(d.pes)
+		seg := buf.Bytes()
+		if pid := uint16(seg[1]&0x1F)<<8 | uint16(seg[2]); pid != tsPIDPAT {
+			t.Fatalf("сегмент %d начинается с PID %#x", i, pid)
+		}
+		d.feed(seg)
+		if len(d.tables) != before+2 {
+			t.Fatalf("сегмент %d: таблиц %d", i, len(d.tables)-before)
+		}
+		perSegment = append(perSegment, d.pes[pesBefore:])
+	}
+	if audioNext != len(s.audio.Samples) {
+		t.Fatalf("записано аудиокадров %d из %d", audioNext, len(s.audio.Samples))
+	}
+
+	all := d.finish()
+	videoIdx, audioIdx := 0, 0
+	for i, pes := range perSegment {
+		segEnd := int64(1 << 62)
+		if i+1 < len(segments) {
+			segEnd = segments[i+1].start
+		}
+		for _, p := range pes {
+			switch p.pid {
+			case tsPIDVideo:
+				sample := s.video.Samples[videoIdx]
+				if videoIdx == segments[i].first && (!sample.Key || !p.key) {
+					t.Fatalf("сегмент %d начинается не с ключевого кадра", i)
+				}
+				checkVideoPES(t, s, file, p, sample)
+				videoIdx++
+			case tsPIDAudio:
+				sample := s.audio.Samples[audioIdx]
+				pts := int64(audioIdx) * 1920 // 1024 сэмпла при 48 кГц в тиках 90 кГц
+				if p.pts != pts || p.hasDTS || p.pcr >= 0 {
+					t.Fatalf("аудиокадр %d: PTS %d (want %d), DTS %v, PCR %d", audioIdx, p.pts, pts, p.hasDTS, p.pcr)
+				}
+				if pts >= segEnd || (i > 0 && pts < segments[i].start) {
+					t.Fatalf("аудиокадр %d (%d) не в своём сегменте %d", audioIdx, pts, i)
+				}
+				h := s.aac.adtsHeader(int(sample.Size))
+				want := append(h, file[sample.Offset:sample.Offset+int64(sample.Size)]...)
+				if !bytes.Equal(p.data, want) {
+					t.Fatalf("аудиокадр %d: данные ADTS не совпадают", audioIdx)
+				}
+				audioIdx++
+			default:
+				t.Fatalf("PES на неизвестном PID %#x", p.pid)
+			}
+		}
+		if videoIdx != segments[i].end {
+			t.Fatalf("сегмент %d закончился на кадре %d, want %d", i, videoIdx, segments[i].end)
+		}
+	}
+	if len(all) != videoIdx+audioIdx || audioIdx != len(s.audio.Samples) {
+		t.Fatalf("PES %d, видео %d, аудио %d", len(all), videoIdx, audioIdx)
+	}
+}
+
+// checkVideoPES сверяет PES видеокадра с исходным сэмплом: время, PCR и Annex B
+func checkVideoPES(t *testing.T, s *hlsStream, file []byte, p *tsPES, sample mp4Sample) {
+	t.Helper()
+	dts := sample.DTS * 3
+	pts := (sample.DTS + sample.CTS) * 3
+	if p.dts != dts || p.pts != pts || p.hasDTS != (sample.CTS != 0) || p.pcr != dts || p.key != sample.Key {
+		t.Fatalf("кадр %d: PTS %d/%d, DTS %d/%d, PCR %d, ключевой %v", sample.DTS/1000, p.pts, pts, p.dts, dts, p.pcr, p.key)
+	}
+	want := []byte{0, 0, 0, 1, 0x09, 0xF0}
+	if sample.Key {
+		want = append(append(want, 0, 0, 0, 1), s.video.SPS[0]...)
+		want = append(append(want, 0, 0, 0, 1), s.video.PPS[0]...)
+	}
+	nal := file[sample.Offset+4 : sample.Offset+int64(sample.Size)]
+	want = append(append(want, 0, 0, 0, 1), nal...)
+	if !bytes.Equal(p.data, want) {
+		t.Fatalf("кадр %d: Annex B не совпадает", sample.DTS/1000)
+	}
+}
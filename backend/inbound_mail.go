@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Максимальный размер входящего письма
+const inboundMaxMessageSize = 25 << 20 // 25MB
+
+// inboundTokenHeader — заголовок с токеном импорта (вместо токена в теме письма)
+const inboundTokenHeader = "X-Import-Token"
+
+// inboundSMTPServer — минимальный SMTP-сервер, который принимает письма с CSV
+// от разрешённых отправителей и импортирует вложения в таблицу users.
+// Адрес отправителя ничего не доказывает, поэтому письмо должно содержать
+// секретный токен; письма без него отклоняются ещё в SMTP-диалоге, чтобы
+// не отвечать на поддельный адрес.
+type inboundSMTPServer struct {
+	hostname string
+	allowed  map[string]bool
+	token    string
+	// handle вызывается для каждого принятого письма (в отдельной горутине)
+	handle func(from string, raw []byte)
+}
+
+// startInboundSMTP запускает приём почты, если задан адрес INBOUND_SMTP_ADDR
+func startInboundSMTP() {
+	if cfg.InboundSMTPAddr == "" {
+		return
+	}
+	if len(cfg.InboundAllowedSenders) == 0 {
+		log.Printf("Приём почты не запущен: список INBOUND_ALLOWED_SENDERS пуст")
+		return
+	}
+	if len(cfg.InboundImportToken) < 16 {
+		log.Printf("Приём почты не запущен: INBOUND_IMPORT_TOKEN не задан или короче 16 символов")
+		return
+	}
+
+	l, err := net.Listen("tcp", cfg.InboundSMTPAddr)
+	if err != nil {
+		log.Printf("Не удалось запустить приём почты на %s: %v", cfg.InboundSMTPAddr, err)
+		return
+	}
+	srv := newInboundSMTPServer(cfg.InboundAllowedSenders, cfg.InboundImportToken, processInboundMessage)
+	log.Printf("Приём CSV по почте запущен на %s", cfg.InboundSMTPAddr)
+	go srv.Serve(l)
+}
+
+func newInboundSMTPServer(allowed []string, token string, handle func(from string, raw []byte)) *inboundSMTPServer {
+	s := &inboundSMTPServer{hostname: "localhost", allowed: make(map[string]bool), token: token, handle: handle}
+	for _, a := range allowed {
+		s.allowed[strings.ToLower(strings.TrimSpace(a))] = true
+	}
+	return s
+}
+
+// Serve принимает соединения, пока слушатель не закрыт
+func (s *inboundSMTPServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *inboundSMTPServer) isAllowed(addr string) bool {
+	return s.allowed[strings.ToLower(addr)]
+}
+
+// handleConn ведёт SMTP-диалог с одним клиентом
+func (s *inboundSMTPServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	var from string
+	var rcpts int
+	reset := func() { from, rcpts = "", 0 }
+
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	tp.PrintfLine("220 %s ESMTP готов", s.hostname)
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			tp.PrintfLine("250 %s", s.hostname)
+		case "EHLO":
+			tp.PrintfLine("250-%s", s.hostname)
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250 SIZE %d", inboundMaxMessageSize)
+		case "MAIL":
+			addr, ok := parseSMTPPath(arg, "FROM:")
+			if !ok {
+				tp.PrintfLine("501 Неверный синтаксис MAIL FROM")
+				continue
+			}
+			if !s.isAllowed(addr) {
+				log.Printf("Входящее письмо отклонено: отправитель %q не в списке разрешённых", addr)
+				tp.PrintfLine("550 Отправитель не разрешён")
+				continue
+			}
+			reset()
+			from = addr
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if from == "" {
+				tp.PrintfLine("503 Сначала MAIL FROM")
+				continue
+			}
+			if _, ok := parseSMTPPath(arg, "TO:"); !ok {
+				tp.PrintfLine("501 Неверный синтаксис RCPT TO")
+				continue
+			}
+			rcpts++
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if from == "" || rcpts == 0 {
+				tp.PrintfLine("503 Сначала MAIL FROM и RCPT TO")
+				continue
+			}
+			tp.PrintfLine("354 Передавайте письмо, в конце <CRLF>.<CRLF>")
+			raw, err := io.ReadAll(io.LimitReader(tp.DotReader(), inboundMaxMessageSize+1))
+			if err != nil {
+				return
+			}
+			if len(raw) > inboundMaxMessageSize {
+				// Дочитываем остаток, чтобы не сломать диалог
+				io.Copy(io.Discard, tp.DotReader())
+				tp.PrintfLine("552 Письмо слишком большое")
+				reset()
+				continue
+			}
+			if err := s.authorize(from, raw); err != nil {
+				log.Printf("Входящее письмо от %s отклонено: %v", from, err)
+				tp.PrintfLine("550 Письмо не прошло проверку")
+				reset()
+				continue
+			}
+			go s.handle(from, raw)
+			tp.PrintfLine("250 Письмо принято в обработку")
+			reset()
+		case "RSET":
+			reset()
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 До свидания")
+			return
+		default:
+			tp.PrintfLine("502 Команда не поддерживается")
+		}
+	}
+}
+
+// authorize проверяет, что письмо действительно от разрешённого отправителя:
+// заголовок From совпадает с конвертом, и в письме есть токен импорта
+func (s *inboundSMTPServer) authorize(from string, raw []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("не удалось разобрать письмо: %v", err)
+	}
+	header, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil || !strings.EqualFold(header.Address, from) {
+		return fmt.Errorf("заголовок From не совпадает с отправителем")
+	}
+	if !hasImportToken(msg.Header, s.token) {
+		return fmt.Errorf("нет верного токена импорта")
+	}
+	return nil
+}
+
+// hasImportToken ищет токен в заголовке X-Import-Token или отдельным словом в теме
+func hasImportToken(header mail.Header, token string) bool {
+	if token == "" {
+		return false
+	}
+	candidates := strings.Fields(decodeMailHeader(header.Get("Subject")))
+	candidates = append(candidates, strings.TrimSpace(header.Get(inboundTokenHeader)))
+	found := false
+	for _, c := range candidates {
+		c = strings.Trim(c, "[]()<>")
+		if subtle.ConstantTimeCompare([]byte(c), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// stripImportToken убирает токен из темы, чтобы он не попал в ответ и журнал
+func stripImportToken(subject, token string) string {
+	if token == "" {
+		return subject
+	}
+	words := strings.Fields(subject)
+	kept := words[:0]
+	for _, w := range words {
+		if strings.Trim(w, "[]()<>") != token {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// parseSMTPPath разбирает аргумент вида "FROM:<user@host> SIZE=123"
+func parseSMTPPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if i := strings.IndexByte(path, '>'); strings.HasPrefix(path, "<") && i > 0 {
+		return strings.ToLower(path[1:i]), true
+	}
+	path, _, _ = strings.Cut(path, " ")
+	return strings.ToLower(path), path != ""
+}
+
+// mailAttachment — вложение из входящего письма
+type mailAttachment struct {
+	Filename string
+	Data     []byte
+}
+
+// processInboundMessage импортирует CSV-вложение и отвечает отправителю результатом
+func processInboundMessage(from string, raw []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("Не удалось разобрать входящее письмо от %s: %v", from, err)
+		return
+	}
+
+	// Отправитель и токен уже проверены в authorize
+	subject := stripImportToken(decodeMailHeader(msg.Header.Get("Subject")), cfg.InboundImportToken)
+	attachments, err := extractCSVAttachments(textproto.MIMEHeader(msg.Header), msg.Body)
+
+	var result string
+	switch {
+	case err != nil:
+		result = "Не удалось прочитать вложения: " + err.Error()
+	case len(attachments) == 0:
+		result = "В письме нет CSV-вложения. Приложите файл с расширением .csv."
+	default:
+		att := attachments[0]
+		inserted, err := importUsersCSV(att.Data, "")
+		if err != nil {
+			result = fmt.Sprintf("Ошибка импорта файла %s: %v", att.Filename, err)
+		} else {
+			result = fmt.Sprintf("Файл %s импортирован. Таблица users заменена, загружено строк: %d", att.Filename, inserted)
+			events.Publish(EventUsersImported, map[string]interface{}{
+				"source":   "email",
+				"sender":   from,
+				"filename": att.Filename,
+				"rows":     inserted,
+			})
+		}
+		if len(attachments) > 1 {
+			result += fmt.Sprintf("\nОстальные CSV-вложения (%d) пропущены: за раз импортируется один файл.", len(attachments)-1)
+		}
+	}
+	log.Printf("Импорт CSV из письма от %s: %s", from, result)
+
+	if err := sendImportReply(from, subject, result); err != nil {
+		log.Printf("Не удалось отправить ответ на %s: %v", from, err)
+	}
+}
+
+// extractCSVAttachments рекурсивно обходит MIME-части и возвращает CSV-вложения
+func extractCSVAttachments(header textproto.MIMEHeader, body io.Reader) ([]mailAttachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		var result []mailAttachment
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return result, nil
+			}
+			if err != nil {
+				return result, err
+			}
+			found, err := extractCSVAttachments(part.Header, part)
+			if err != nil {
+				return result, err
+			}
+			result = append(result, found...)
+		}
+	}
+
+	filename := ""
+	if _, dp, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		filename = dp["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeMailHeader(filename)
+
+	name := strings.ToLower(filename)
+	isCSV := mediaType == "text/csv" || filepath.Ext(name) == ".csv" || strings.HasSuffix(name, ".csv.enc")
+	if !isCSV {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		filename = "attachment.csv"
+	}
+	return []mailAttachment{{Filename: filename, Data: data}}, nil
+}
+
+// decodeTransferEncoding снимает base64 или quoted-printable
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// decodeMailHeader декодирует RFC 2047 (=?UTF-8?B?...?=)
+func decodeMailHeader(s string) string {
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// sendImportReply отправляет отправителю результат импорта
+func sendImportReply(to, subject, text string) error {
+	if subject == "" {
+		subject = "Импорт CSV"
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var msg bytes.Buffer
+	w := bufio.NewWriter(&msg)
+	fmt.Fprintf(w, "From: %s\r\n", SMTPUsername)
+	fmt.Fprintf(w, "To: %s\r\n", to)
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(w, "Date: %s\r\n", mailDateHeader())
+	fmt.Fprintf(w, "Message-ID: %s\r\n", mailMessageID())
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(w, "\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	for i := 0; i < len(encoded); i += 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[i:min(i+76, len(encoded))])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return sendMail([]string{to}, msg.Bytes())
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testImportToken = "tok-0123456789abcdef"
+
+// startTestInboundSMTP запускает сервер приёма почты на локальном порту
+func startTestInboundSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan string, 10)
+	srv := newInboundSMTPServer([]string{"Admin@Example.com"}, testImportToken, func(from string, raw []byte) {
+		received <- from + "\n" + string(raw)
+	})
+	go srv.Serve(l)
+	return l.Addr().String(), received
+}
+
+func testMail(from, subject, extra string) string {
+	return "From: " + from + "\r\nTo: import@localhost\r\nSubject: " + subject + "\r\n" + extra +
+		"Content-Type: text/csv; name=\"users.csv\"\r\n\r\nname,email\r\nA,a@example.com\r\n"
+}
+
+func TestInboundSMTPAuthorization(t *testing.T) {
+	addr, received := startTestInboundSMTP(t)
+
+	cases := []struct {
+		name     string
+		envelope string
+		msg      string
+		accepted bool
+	}{
+		{"токен в теме", "admin@example.com", testMail("Admin <admin@example.com>", "Импорт "+testImportToken, ""), true},
+		{"токен в скобках", "admin@example.com", testMail("admin@example.com", "Импорт ["+testImportToken+"]", ""), true},
+		{"токен в заголовке", "admin@example.com", testMail("admin@example.com", "Импорт", "X-Import-Token: "+testImportToken+"\r\n"), true},
+		{"без токена", "admin@example.com", testMail("admin@example.com", "Импорт", ""), false},
+		{"неверный токен", "admin@example.com", testMail("admin@example.com", "Импорт tok-0123456789abcdeX", ""), false},
+		{"токен внутри слова", "admin@example.com", testMail("admin@example.com", "x"+testImportToken, ""), false},
+		{"From не совпадает с конвертом", "admin@example.com", testMail("other@example.com", testImportToken, ""), false},
+		{"отправитель не разрешён", "other@example.com", testMail("other@example.com", testImportToken, ""), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := smtp.SendMail(addr, nil, c.envelope, []string{"import@localhost"}, []byte(c.msg))
+			if c.accepted {
+				if err != nil {
+					t.Fatalf("письмо отклонено: %v", err)
+				}
+				select {
+				case got := <-received:
+					if !strings.HasPrefix(got, c.envelope+"\n") || !strings.Contains(got, "A,a@example.com") {
+						t.Fatalf("обработчик получил не то письмо: %q", got)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("обработчик не вызван")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "550") {
+				t.Fatalf("ожидался отказ 550, получено %v", err)
+			}
+			select {
+			case got := <-received:
+				t.Fatalf("отклонённое письмо передано в обработку: %q", got)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestInboundSMTPDialog(t *testing.T) {
+	addr, _ := startTestInboundSMTP(t)
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(cmd string, code int) {
+		t.Helper()
+		if cmd != "" {
+			if err := conn.PrintfLine("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("%q: %v", cmd, err)
+		}
+	}
+	expect("", 220)
+	expect("EHLO test", 250)
+	expect("RCPT TO:<import@localhost>", 503)
+	expect("DATA", 503)
+	expect("MAIL FROM:<admin@example.com> SIZE=100", 250)
+	expect("RCPT TO:<import@localhost>", 250)
+	expect("RSET", 250)
+	expect("DATA", 503)
+	expect("VRFY admin", 502)
+	expect("QUIT", 221)
+}
+
+func TestParseSMTPPath(t *testing.T) {
+	cases := []struct {
+		arg, prefix, want string
+		ok                bool
+	}{
+		{"FROM:<User@Example.com>", "FROM:", "user@example.com", true},
+		{"from: <a@b.c> SIZE=100", "FROM:", "a@b.c", true},
+		{"FROM:a@b.c BODY=8BITMIME", "FROM:", "a@b.c", true},
+		{"TO:<x@y.z>", "TO:", "x@y.z", true},
+		{"TO:<x@y.z>", "FROM:", "", false},
+		{"FROM:", "FROM:", "", false},
+	}
+	for _, c := range cases {
+		got, ok := parseSMTPPath(c.arg, c.prefix)
+		if got != c.want || ok != c.ok {
+			t.Errorf("parseSMTPPath(%q, %q) = %q, %v; want %q, %v", c.arg, c.prefix, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestExtractCSVAttachments(t *testing.T) {
+	body := "--outer\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nПривет\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/mixed; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"=?UTF-8?B?0L/QvtC70YzQt9C+0LLQsNGC0LXQu9C4LmNzdg==?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"bmFtZSxlbWFpbA0KQSxhQGV4YW1wbGUuY29tDQo=\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"name,email=0D=0AB,b@example.com\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"users.csv.enc\"\r\n\r\n" +
+		"UNIBAK1\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png; name=\"photo.png\"\r\n\r\nPNG\r\n" +
+		"--outer--\r\n"
+	header := textproto.MIMEHeader{"Content-Type": {"multipart/mixed; boundary=outer"}}
+
+	got, err := extractCSVAttachments(header, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mailAttachment{
+		{"пользователи.csv", []byte("name,email\r\nA,a@example.com\r\n")},
+		{"attachment.csv", []byte("name,email\r\nB,b@example.com")},
+		{"users.csv.enc", []byte("UNIBAK1")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("найдено вложений: %d, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Filename != want[i].Filename || string(got[i].Data) != string(want[i].Data) {
+			t.Errorf("вложение %d = %q %q, want %q %q", i, got[i].Filename, got[i].Data, want[i].Filename, want[i].Data)
+		}
+	}
+}
+
+func TestStripImportToken(t *testing.T) {
+	cases := map[string]string{
+		"Импорт " + testImportToken:         "Импорт",
+		"[" + testImportToken + "] users":   "users",
+		"Re: отчёт":                         "Re: отчёт",
+		"x" + testImportToken + " остаётся": "x" + testImportToken + " остаётся",
+	}
+	for in, want := range cases {
+		if got := stripImportToken(in, testImportToken); got != want {
+			t.Errorf("stripImportToken(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// jobConfig — описание задачи в файле SCHEDULER_JOBS_FILE:
+//
+//	[{"name": "daily-backup-email", "enabled": true, "schedule": "0 9 * * *", "timezone": "Europe/Moscow", "timeout": "5m"},
+//	 {"name": "integrity-check", "enabled": false, "catch_up": false}]
+//
+// Записи из файла заменяют одноимённые задачи по умолчанию, незаданные поля
+// берутся из задачи по умолчанию.
+type jobConfig struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	Timeout  string `json:"timeout"`
+	Enabled  *bool  `json:"enabled"`
+	// CatchUp — выполнить один раз при старте, если запуски были пропущены
+	CatchUp *bool `json:"catch_up"`
+}
+
+// Задачи по умолчанию. Ежедневное письмо с выгрузкой пользователей уходит
+// наружу, поэтому включается только явно ("enabled": true в SCHEDULER_JOBS_FILE).
+var defaultJobs = []jobConfig{
+	{Name: "daily-backup-email", Schedule: "0 9 * * *", Timeout: "5m", Enabled: boolPtr(false), CatchUp: boolPtr(true)},
+	{Name: "retention-cleanup", Schedule: "30 3 * * *", Timeout: "30m"},
+	{Name: "integrity-check", Schedule: "0 4 * * *", Timeout: "6h"},
+	{Name: "tus-cleanup", Schedule: "15 * * * *", Timeout: "10m"},
+	{Name: "video-retention", Schedule: "15 3 * * *", Timeout: "30m"},
+	{Name: "trash-purge", Schedule: "45 3 * * *", Timeout: "30m"},
+	{Name: "video-rescan", Schedule: "*/30 * * * *", Timeout: "30m"},
+}
+
+// jobFuncs связывает имена задач из настроек с их реализацией
+var jobFuncs = map[string]JobFunc{
+	"daily-backup-email": runDailyBackupEmail,
+	"retention-cleanup":  runRetentionCleanup,
+	"integrity-check":    runIntegrityCheck,
+	"tus-cleanup":        runTusCleanup,
+	"video-retention":    runVideoRetention,
+	"trash-purge":        runTrashPurge,
+	"video-rescan":       runVideoRescan,
+}
+
+// loadJobConfigs объединяет задачи по умолчанию с настройками из файла
+func loadJobConfigs() ([]jobConfig, error) {
+	jobs := append([]jobConfig(nil), defaultJobs...)
+	if cfg.SchedulerJobsFile == "" {
+		return jobs, nil
+	}
+
+	data, err := os.ReadFile(cfg.SchedulerJobsFile)
+	if err != nil {
+		return nil, err
+	}
+	var overrides []jobConfig
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("неверный формат %s: %v", cfg.SchedulerJobsFile, err)
+	}
+
+	for _, o := range overrides {
+		replaced := false
+		for i := range jobs {
+			if jobs[i].Name != o.Name {
+				continue
+			}
+			// Незаданные поля берём из задачи по умолчанию
+			if o.Schedule == "" {
+				o.Schedule = jobs[i].Schedule
+			}
+			if o.Timeout == "" {
+				o.Timeout = jobs[i].Timeout
+			}
+			if o.Enabled == nil {
+				o.Enabled = jobs[i].Enabled
+			}
+			if o.CatchUp == nil {
+				o.CatchUp = jobs[i].CatchUp
+			}
+			jobs[i] = o
+			replaced = true
+		}
+		if !replaced {
+			jobs = append(jobs, o)
+		}
+	}
+	return jobs, nil
+}
+
+// startScheduler регистрирует задачи из настроек и запускает планировщик
+func startScheduler() {
+	defaultLoc, err := time.LoadLocation(cfg.SchedulerTimezone)
+	if err != nil {
+		log.Printf("Неизвестная зона SCHEDULER_TZ=%q, используется местное время: %v", cfg.SchedulerTimezone, err)
+		defaultLoc = time.Local
+	}
+
+	jobs, err := loadJobConfigs()
+	if err != nil {
+		log.Printf("Ошибка настроек планировщика: %v", err)
+		jobs = defaultJobs
+	}
+
+	for _, jc := range jobs {
+		if jc.Enabled != nil && !*jc.Enabled {
+			log.Printf("Задача %s отключена", jc.Name)
+			continue
+		}
+		fn, ok := jobFuncs[jc.Name]
+		if !ok {
+			log.Printf("Неизвестная задача %q пропущена", jc.Name)
+			continue
+		}
+
+		loc := defaultLoc
+		if jc.Timezone != "" {
+			if loc, err = time.LoadLocation(jc.Timezone); err != nil {
+				log.Printf("Задача %s: неизвестная зона %q: %v", jc.Name, jc.Timezone, err)
+				continue
+			}
+		}
+		var timeout time.Duration
+		if jc.Timeout != "" {
+			if timeout, err = time.ParseDuration(jc.Timeout); err != nil {
+				log.Printf("Задача %s: неверный таймаут %q", jc.Name, jc.Timeout)
+				continue
+			}
+		}
+
+		job, err := scheduler.Register(jc.Name, jc.Schedule, loc, timeout, fn)
+		if err != nil {
+			log.Printf("Ошибка регистрации задачи: %v", err)
+			continue
+		}
+		job.CatchUp = jc.CatchUp != nil && *jc.CatchUp
+	}
+
+	// Состояние задач в БД: пропущенные запуски и защита от запуска на нескольких экземплярах
+	store, err := newMySQLSchedulerStore(DBConnection)
+	if err != nil {
+		log.Printf("Планировщик работает без БД (состояние не сохраняется): %v", err)
+	} else {
+		scheduler.store = store
+	}
+
+	scheduler.Start()
+}
+
+// runDailyBackupEmail отправляет ежедневный бэкап таблицы users
+func runDailyBackupEmail(ctx context.Context) error {
+	if err := sendDailyEmail(); err != nil {
+		return err
+	}
+	jobLog(ctx).Printf("Бэкап отправлен на %s", ToEmail)
+	return nil
+}
+
+// runRetentionCleanup удаляет устаревшие служебные записи
+func runRetentionCleanup(ctx context.Context) error {
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cutoff := time.Now().AddDate(0, 0, -cfg.EventLogRetentionDays)
+	res, err := db.ExecContext(ctx, "DELETE FROM event_deliveries WHERE created_at < ?", cutoff)
+	if err != nil {
+		return fmt.Errorf("очистка журнала доставки: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	jobLog(ctx).Printf("Очистка: удалено записей журнала доставки событий: %d", n)
+	return nil
+}
+
+// runIntegrityCheck проверяет доступность БД и целостность файлов видео: каждый
+// файл по хешу читается целиком (не быстрее INTEGRITY_CHECK_MB_PER_SEC) и его
+// SHA-256 сравнивается с ключом. Несовпадающий файл уходит в quarantine/,
+// а ссылающиеся на него видео — в статус corrupted.
+func runIntegrityCheck(ctx context.Context) error {
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("БД недоступна: %v", err)
+	}
+
+	files, err := videoStore.List(ctx, blobPrefix)
+	if err != nil {
+		return err
+	}
+
+	var checked, broken, corrupted int
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		checked++
+
+		sum, err := blobChecksum(ctx, file.Key, cfg.IntegrityCheckRate)
+		if errors.Is(err, ErrBlobNotFound) {
+			continue // удалён после получения списка
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			jobLog(ctx).Printf("Проверка: не удалось прочитать %s: %v", file.Key, err)
+			broken++
+			continue
+		}
+		if sum == path.Base(file.Key) {
+			continue
+		}
+
+		corrupted++
+		jobLog(ctx).Printf("Проверка: SHA-256 файла %s не совпадает с ключом: %s", file.Key, sum)
+		videos, err := catalog.VideosByBlob(ctx, file.Key)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения каталога: %v", err)
+		}
+		if err := quarantineBlob(ctx, file.Key, videos); err != nil {
+			jobLog(ctx).Printf("Проверка: не удалось убрать %s в карантин: %v", file.Key, err)
+		}
+	}
+
+	jobLog(ctx).Printf("Проверка целостности: файлов %d, не читается %d, не совпадает хеш %d", checked, broken, corrupted)
+	if broken+corrupted > 0 {
+		return fmt.Errorf("найдено повреждённых файлов: %d", broken+corrupted)
+	}
+	return nil
+}
+
+// runTusCleanup удаляет брошенные возобновляемые загрузки
+func runTusCleanup(ctx context.Context) error {
+	n, err := tusUploads.cleanupExpired(time.Now())
+	if err != nil {
+		return err
+	}
+	jobLog(ctx).Printf("Удалено просроченных загрузок tus: %d", n)
+	return nil
+}
+
+func boolPtr(b bool) *bool { return &b }
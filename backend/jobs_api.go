@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jobsHandler возвращает список задач планировщика (GET /api/jobs)
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	states := []JobState{}
+	for _, job := range scheduler.Jobs() {
+		states = append(states, job.State())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+// jobHandler обрабатывает действия с одной задачей:
+//
+//	GET  /api/jobs/{name}
+//	POST /api/jobs/{name}/run
+//	POST /api/jobs/{name}/pause
+//	POST /api/jobs/{name}/resume
+//	GET  /api/jobs/{name}/runs?page=1&per_page=20
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	name, action, _ := strings.Cut(path, "/")
+	if name == "" {
+		http.Error(w, "Не указано имя задачи", http.StatusBadRequest)
+		return
+	}
+
+	job := scheduler.Job(name)
+	if job == nil {
+		http.Error(w, "Задача не найдена", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.State())
+
+	case "run":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		run, err := scheduler.Trigger(name)
+		if errors.Is(err, errJobRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "success",
+			"message": "Задача запущена",
+			"run":     run,
+		})
+
+	case "pause", "resume":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := scheduler.SetPaused(name, action == "pause"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.State())
+
+	case "runs":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		page, perPage := 1, 20
+		if v, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && v > 0 {
+			page = v
+		}
+		if v, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && v > 0 && v <= 100 {
+			perPage = v
+		}
+		// Смещение (page-1)*perPage не должно переполнять int
+		if page > math.MaxInt/perPage {
+			http.Error(w, "Слишком большой номер страницы", http.StatusBadRequest)
+			return
+		}
+		runs, total, err := scheduler.Runs(job, (page-1)*perPage, perPage)
+		if err != nil {
+			log.Printf("Не удалось загрузить историю задачи %s: %v", name, err)
+			http.Error(w, "Не удалось загрузить историю запусков", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job":      name,
+			"page":     page,
+			"per_page": perPage,
+			"total":    total,
+			"runs":     runs,
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
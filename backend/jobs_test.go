@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadJobConfigsDailyEmailOptIn(t *testing.T) {
+	saved := cfg.SchedulerJobsFile
+	t.Cleanup(func() { cfg.SchedulerJobsFile = saved })
+
+	enabled := func(jobs []jobConfig, name string) bool {
+		for _, j := range jobs {
+			if j.Name == name {
+				return j.Enabled == nil || *j.Enabled
+			}
+		}
+		t.Fatalf("задача %s не найдена", name)
+		return false
+	}
+
+	cfg.SchedulerJobsFile = ""
+	jobs, err := loadJobConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled(jobs, "daily-backup-email") {
+		t.Fatal("ежедневное письмо включено по умолчанию")
+	}
+	if !enabled(jobs, "integrity-check") {
+		t.Fatal("задача integrity-check отключена по умолчанию")
+	}
+
+	cases := map[string]bool{
+		`[{"name": "daily-backup-email", "schedule": "0 8 * * *"}]`: false,
+		`[{"name": "daily-backup-email", "enabled": true}]`:         true,
+	}
+	for content, want := range cases {
+		cfg.SchedulerJobsFile = filepath.Join(t.TempDir(), "jobs.json")
+		if err := os.WriteFile(cfg.SchedulerJobsFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := loadJobConfigs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := enabled(jobs, "daily-backup-email"); got != want {
+			t.Errorf("%s: включено %v, want %v", content, got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+var (
+	dkimOnce   sync.Once
+	dkimSigner *DKIMSigner
+)
+
+// getDKIMSigner загружает ключ DKIM при первом обращении.
+// Если DKIM не настроен или ключ не читается, письма уходят без подписи.
+func getDKIMSigner() *DKIMSigner {
+	dkimOnce.Do(func() {
+		if cfg.DKIMSelector == "" || cfg.DKIMDomain == "" || cfg.DKIMKeyFile == "" {
+			return
+		}
+		signer, err := loadDKIMSigner(cfg.DKIMDomain, cfg.DKIMSelector, cfg.DKIMKeyFile)
+		if err != nil {
+			log.Printf("DKIM отключён: %v", err)
+			return
+		}
+		dkimSigner = signer
+		if record, err := signer.DNSRecord(); err == nil {
+			log.Printf("DKIM включён (%s._domainkey.%s): %s", signer.Selector, signer.Domain, record)
+		}
+	})
+	return dkimSigner
+}
+
+// sendMail подписывает письмо DKIM (если настроено) и отправляет его через SMTP с таймаутом
+func sendMail(to []string, msg []byte) error {
+	if signer := getDKIMSigner(); signer != nil {
+		signed, err := signer.Sign(msg)
+		if err != nil {
+			return fmt.Errorf("ошибка DKIM-подписи: %v", err)
+		}
+		msg = signed
+	}
+
+	auth := smtp.PlainAuth("", SMTPUsername, SMTPPassword, SMTPHost)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- smtp.SendMail(SMTPHost+":"+SMTPPort, auth, SMTPUsername, to, msg)
+	}()
+
+	// Таймаут 15 секунд
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("ошибка отправки почты: %v", err)
+		}
+		return nil
+	case <-time.After(15 * time.Second):
+		return fmt.Errorf("таймаут: отправка почты заняла слишком много времени")
+	}
+}
+
+// mailDateHeader и mailMessageID формируют заголовки, которые ожидают почтовые фильтры
+func mailDateHeader() string {
+	return time.Now().Format(time.RFC1123Z)
+}
+
+func mailMessageID() string {
+	domain := cfg.DKIMDomain
+	if domain == "" {
+		domain = "localhost"
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), generateRandomString(8), domain)
+}
@@ -2,18 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math/rand/v2"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"net/smtp"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -31,7 +32,7 @@ const (
 	SMTPPassword = "kmgvvlmovsskkowg"
 	ToEmail      = "79140050089@yandex.ru"
 	UploadDir    = "video"
-	DBConnection = "myuser:mypassword@tcp(localhost:3306)/myapp?charset=utf8mb4"
+	DBConnection = "myuser:mypassword@tcp(localhost:3306)/myapp?charset=utf8mb4&parseTime=true&loc=Local"
 )
 
 type User struct {
@@ -118,46 +119,301 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(User{ID: int(id), Name: input.Name})
 }
 
+// initDB создаёт недостающие таблицы приложения и каталога видео. Без схемы
+// каталог, загрузки и задачи не работают, поэтому при ошибке процесс завершается.
+// Тестовые данные сюда не входят — их добавляет команда seed-demo.
 func initDB() {
-	db, err := sql.Open("mysql", DBConnection)
-	if err != nil {
+	if err := migrateDB(createAppTables, createVideoTables); err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	log.Println("✅ База данных инициализирована успешно")
+}
 
-	// Проверяем подключение
-	err = db.Ping()
+// initVideoDB создаёт только таблицы каталога видео — для команд, которым
+// остальная схема не нужна
+func initVideoDB() error {
+	return migrateDB(createVideoTables)
+}
+
+// migrateDB подключается к БД и создаёт недостающие таблицы
+func migrateDB(steps ...func(*sql.DB) error) error {
+	db, err := sql.Open("mysql", DBConnection)
 	if err != nil {
-		log.Fatal("Не удалось подключиться к БД:", err)
+		return err
 	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("не удалось подключиться к БД: %v", err)
+	}
+	for _, step := range steps {
+		if err := step(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Создаем таблицу если не существует
-	_, err = db.Exec(`
+// createAppTables — пользователи, журнал событий и состояние планировщика
+func createAppTables(db *sql.DB) error {
+	_, err := db.Exec(`
         CREATE TABLE IF NOT EXISTS users (
             id INT AUTO_INCREMENT PRIMARY KEY,
             name VARCHAR(255) NOT NULL
         ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
     `)
 	if err != nil {
-		log.Fatal("Не удалось создать таблицу:", err)
+		return fmt.Errorf("не удалось создать таблицу users: %v", err)
 	}
 
-	// Добавляем тестовые данные если таблица пустая
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
-	if count == 0 {
-		_, err = db.Exec(`INSERT INTO users (name) VALUES ('Алексей'), ('Мария')`)
-		if err != nil {
-			log.Println("Не удалось вставить тестовые данные:", err)
-		} else {
-			log.Println("Тестовые данные добавлены в MySQL.")
+	// Журнал доставки событий подписчикам
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS event_deliveries (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            event_id VARCHAR(64) NOT NULL,
+            event_type VARCHAR(64) NOT NULL,
+            subscriber VARCHAR(512) NOT NULL,
+            attempt INT NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            error TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            INDEX idx_event_id (event_id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу event_deliveries: %v", err)
+	}
+
+	// Состояние планировщика: последний выполненный слот, пауза, история и аренды
+	for _, stmt := range []string{`
+        CREATE TABLE IF NOT EXISTS scheduler_jobs (
+            name VARCHAR(128) PRIMARY KEY,
+            last_slot DATETIME(6) NULL,
+            last_run_at DATETIME(6) NULL,
+            last_status VARCHAR(16) NOT NULL DEFAULT '',
+            paused BOOLEAN NOT NULL DEFAULT FALSE
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `, `
+        CREATE TABLE IF NOT EXISTS scheduler_runs (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            job VARCHAR(128) NOT NULL,
+            run_id BIGINT NOT NULL,
+            run_trigger VARCHAR(16) NOT NULL,
+            started_at DATETIME(6) NOT NULL,
+            duration_ms BIGINT NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            error TEXT NOT NULL,
+            output MEDIUMTEXT NOT NULL,
+            instance VARCHAR(255) NOT NULL,
+            INDEX idx_job (job, id)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `, `
+        CREATE TABLE IF NOT EXISTS scheduler_locks (
+            job VARCHAR(128) PRIMARY KEY,
+            owner VARCHAR(255) NOT NULL,
+            expires_at DATETIME(6) NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `} {
+		if _, err = db.Exec(stmt); err != nil {
+			return fmt.Errorf("не удалось создать таблицы планировщика: %v", err)
 		}
 	}
 
-	log.Println("✅ База данных инициализирована успешно")
+	return nil
+}
+
+// createVideoTables — каталог видео, плейлисты, ссылки и хранение файлов
+func createVideoTables(db *sql.DB) error {
+	// Каталог видео
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS videos (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            storage_key VARCHAR(512) NOT NULL,
+            blob_key VARCHAR(512) NOT NULL,
+            original_filename VARCHAR(255) NOT NULL,
+            title VARCHAR(255) NOT NULL,
+            description TEXT NOT NULL,
+            size BIGINT NOT NULL,
+            mime_type VARCHAR(100) NOT NULL,
+            sha256 CHAR(64) NOT NULL,
+            uploader VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            duration DOUBLE NOT NULL DEFAULT 0,
+            width INT NOT NULL DEFAULT 0,
+            height INT NOT NULL DEFAULT 0,
+            fps DOUBLE NOT NULL DEFAULT 0,
+            video_codec VARCHAR(32) NOT NULL DEFAULT '',
+            audio_codec VARCHAR(32) NOT NULL DEFAULT '',
+            faststart BOOLEAN NOT NULL DEFAULT TRUE,
+            hls_status VARCHAR(16) NOT NULL DEFAULT '',
+            deleted_at DATETIME NULL,
+            deleted_by VARCHAR(255) NOT NULL DEFAULT '',
+            folder VARCHAR(255) NOT NULL DEFAULT '',
+            last_played_at DATETIME NULL,
+            ext VARCHAR(16) AS (LOWER(SUBSTRING_INDEX(storage_key, '.', -1))) STORED,
+            UNIQUE KEY uniq_storage_key (storage_key),
+            INDEX idx_status (status, id),
+            INDEX idx_created (status, created_at, id),
+            INDEX idx_size (status, size, id),
+            INDEX idx_title (status, title, id),
+            INDEX idx_duration (status, duration, id),
+            INDEX idx_ext (status, ext, id),
+            INDEX idx_folder (folder, id),
+            INDEX idx_sha256 (sha256),
+            FULLTEXT INDEX ft_title_description (title, description)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу videos: %v", err)
+	}
+
+	// Папки библиотеки (пути вида "a/b/c")
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS video_folders (
+            path VARCHAR(255) PRIMARY KEY,
+            created_at DATETIME NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу video_folders: %v", err)
+	}
+
+	// Метки видео
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS video_tags (
+            video_id BIGINT NOT NULL,
+            tag VARCHAR(64) NOT NULL,
+            PRIMARY KEY (video_id, tag),
+            INDEX idx_tag (tag),
+            FOREIGN KEY (video_id) REFERENCES videos(id) ON DELETE CASCADE
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу video_tags: %v", err)
+	}
+
+	// Плейлисты и их видео по порядку
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS playlists (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            description TEXT NOT NULL,
+            cover_video_id BIGINT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            INDEX idx_name (name),
+            FOREIGN KEY (cover_video_id) REFERENCES videos(id) ON DELETE SET NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу playlists: %v", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS playlist_items (
+            playlist_id BIGINT NOT NULL,
+            video_id BIGINT NOT NULL,
+            position INT NOT NULL,
+            added_by VARCHAR(255) NOT NULL,
+            added_at DATETIME NOT NULL,
+            PRIMARY KEY (playlist_id, video_id),
+            INDEX idx_position (playlist_id, position),
+            INDEX idx_video (video_id),
+            FOREIGN KEY (playlist_id) REFERENCES playlists(id) ON DELETE CASCADE,
+            FOREIGN KEY (video_id) REFERENCES videos(id) ON DELETE CASCADE
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу playlist_items: %v", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS video_shares (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            token_hash CHAR(64) NOT NULL UNIQUE,
+            video_id BIGINT NOT NULL,
+            password_hash VARCHAR(255) NOT NULL DEFAULT '',
+            expires_at DATETIME NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            INDEX idx_video (video_id, expires_at),
+            INDEX idx_expires (expires_at),
+            FOREIGN KEY (video_id) REFERENCES videos(id) ON DELETE CASCADE
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу video_shares: %v", err)
+	}
+
+	// Журнал удалений по правилам хранения
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS video_retention_audit (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            video_id BIGINT NOT NULL,
+            storage_key VARCHAR(512) NOT NULL,
+            title VARCHAR(255) NOT NULL,
+            rule VARCHAR(128) NOT NULL,
+            reason VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            INDEX idx_created (created_at)
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу video_retention_audit: %v", err)
+	}
+
+	// Файлы видео по хешу содержимого и число ссылок на них из каталога
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS video_blobs (
+            sha256 CHAR(64) PRIMARY KEY,
+            storage_key VARCHAR(512) NOT NULL,
+            size BIGINT NOT NULL,
+            refs INT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+    `)
+	if err != nil {
+		return fmt.Errorf("не удалось создать таблицу video_blobs: %v", err)
+	}
+
+	return nil
+}
+
+// seedDemoUsers добавляет тестовых пользователей в пустую таблицу users
+// (команда seed-demo, только для разработки)
+func seedDemoUsers() error {
+	if err := migrateDB(createAppTables); err != nil {
+		return err
+	}
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Printf("В таблице users уже есть записи (%d), тестовые данные не добавлены", count)
+		return nil
+	}
+	if _, err := db.Exec(`INSERT INTO users (name) VALUES ('Алексей'), ('Мария')`); err != nil {
+		return fmt.Errorf("не удалось вставить тестовые данные: %v", err)
+	}
+	log.Println("Тестовые данные добавлены в MySQL.")
+	return nil
 }
 
 func main() {
+	// Команды командной строки: app <команда> [флаги]
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	server := &http.Server{
 		Addr:         ":8080",
 		ReadTimeout:  30 * time.Minute,  // 30 минут для загрузки
@@ -165,12 +421,16 @@ func main() {
 		IdleTimeout:  120 * time.Second, // 2 минуты
 	}
 
-	if err := os.MkdirAll(UploadDir, 0755); err != nil {
-		log.Printf("Ошибка создания папки %s: %v", UploadDir, err)
-	}
-	//initDB()
+	initDB()
+	initVideoStore()
+	checkVideoURLConfig()
+	go sweepStaleUploads(context.Background())
+	startVideoWatcher()
 
-	//go startDailyEmailScheduler()
+	startScheduler()
+
+	initEventSubscribers()
+	startInboundSMTP()
 
 	// API-эндпоинты
 	http.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
@@ -195,12 +455,30 @@ func main() {
 	http.HandleFunc("/api/upload-csv", uploadCSV)
 	http.HandleFunc("/api/export-csv", exportCSV)
 	http.HandleFunc("/api/send-csv-email", sendCSVHandler)
+	http.HandleFunc("/api/event-deliveries", eventDeliveriesHandler)
+
+	// Планировщик задач
+	http.HandleFunc("/api/jobs", jobsHandler)
+	http.HandleFunc("/api/jobs/", jobHandler)
 
 	// Новые эндпоинты для работы с видео
 	http.HandleFunc("/api/upload-video", uploadVideoHandler)
+	http.HandleFunc("/api/tus/", tusHandler)
 	http.HandleFunc("/api/videos", listVideosHandler)
+	http.HandleFunc("/api/videos/usage", videoUsageHandler)
+	http.HandleFunc("/api/videos/", videoItemHandler)
+	http.HandleFunc("/api/folders", foldersHandler)
+	http.HandleFunc("/api/folders/", folderItemHandler)
+	http.HandleFunc("/api/tags", tagsHandler)
+	http.HandleFunc("/api/playlists", playlistsHandler)
+	http.HandleFunc("/api/playlists/", playlistItemHandler)
 	http.HandleFunc("/api/video/", serveVideoHandler)
+	http.HandleFunc("/api/share/", shareHandler)
 	http.HandleFunc("/api/delete-video/", deleteVideoHandler)
+	http.HandleFunc("/api/trash", trashHandler)
+	http.HandleFunc("/api/trash/", trashItemHandler)
+	http.HandleFunc("/api/retention", retentionHandler)
+	http.HandleFunc("/api/retention/audit", retentionAuditHandler)
 
 	// Раздача статики Angular из правильной папки
 	staticDir := "../frontend/dist/browser"
@@ -250,41 +528,87 @@ func uploadCSV(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	db, err := sql.Open("mysql", DBConnection)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Ошибка чтения файла", http.StatusBadRequest)
+		return
+	}
+
+	inserted, err := importUsersCSV(data, r.FormValue("passphrase"))
 	if err != nil {
-		http.Error(w, "Ошибка подключения к БД", http.StatusInternalServerError)
+		var ie *importError
+		if errors.As(err, &ie) {
+			http.Error(w, ie.msg, ie.status)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+
+	events.Publish(EventUsersImported, map[string]interface{}{
+		"source": "upload",
+		"rows":   inserted,
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Таблица users полностью заменена данными из CSV",
+		"rows":    inserted,
+	})
+}
+
+// importError — ошибка импорта CSV с HTTP-статусом для ответа
+type importError struct {
+	status int
+	msg    string
+}
+
+func (e *importError) Error() string { return e.msg }
+
+// importUsersCSV полностью заменяет таблицу users данными из CSV.
+// Используется и загрузкой через API, и импортом из входящей почты.
+func importUsersCSV(data []byte, passphrase string) (int, error) {
+	// Зашифрованный бэкап сначала расшифровываем
+	if isEncryptedBackup(data) {
+		var err error
+		data, err = decryptBackupForConfig(data, passphrase)
+		if err != nil {
+			return 0, &importError{http.StatusBadRequest, err.Error()}
+		}
+	}
+
+	db, err := sql.Open("mysql", DBConnection)
+	if err != nil {
+		return 0, &importError{http.StatusInternalServerError, "Ошибка подключения к БД"}
+	}
 	defer db.Close()
 
 	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Не удалось начать транзакцию", http.StatusInternalServerError)
-		return
+		return 0, &importError{http.StatusInternalServerError, "Не удалось начать транзакцию"}
 	}
 	defer tx.Rollback()
 
 	// 1. Очищаем таблицу
 	_, err = tx.Exec("DELETE FROM users")
 	if err != nil {
-		http.Error(w, "Не удалось очистить таблицу", http.StatusInternalServerError)
-		return
+		return 0, &importError{http.StatusInternalServerError, "Не удалось очистить таблицу"}
 	}
 
 	// 2. Читаем CSV
-	reader := csv.NewReader(file)
+	reader := csv.NewReader(bytes.NewReader(data))
 	reader.Comma = ';' // разделитель — точка с запятой
 	reader.TrimLeadingSpace = true
 
 	records, err := reader.ReadAll()
 	if err != nil {
-		http.Error(w, "Ошибка чтения CSV: "+err.Error(), http.StatusBadRequest)
-		return
+		return 0, &importError{http.StatusBadRequest, "Ошибка чтения CSV: " + err.Error()}
 	}
 
 	if len(records) == 0 {
-		http.Error(w, "Файл пуст", http.StatusBadRequest)
-		return
+		return 0, &importError{http.StatusBadRequest, "Файл пуст"}
 	}
 
 	// 3. Находим начало данных (пропускаем мусор)
@@ -327,19 +651,16 @@ func uploadCSV(w http.ResponseWriter, r *http.Request) {
 
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Неверный ID в строке %d: %s", i+1, idStr), http.StatusBadRequest)
-			return
+			return 0, &importError{http.StatusBadRequest, fmt.Sprintf("Неверный ID в строке %d: %s", i+1, idStr)}
 		}
 
 		if !utf8.ValidString(name) {
-			http.Error(w, fmt.Sprintf("Неверная кодировка в строке %d", i+1), http.StatusBadRequest)
-			return
+			return 0, &importError{http.StatusBadRequest, fmt.Sprintf("Неверная кодировка в строке %d", i+1)}
 		}
 
 		_, err = tx.Exec("INSERT INTO users (id, name) VALUES (?, ?)", id, name)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Ошибка вставки в строке %d: %s", i+1, err.Error()), http.StatusInternalServerError)
-			return
+			return 0, &importError{http.StatusInternalServerError, fmt.Sprintf("Ошибка вставки в строке %d: %s", i+1, err.Error())}
 		}
 		inserted++
 	}
@@ -347,17 +668,10 @@ func uploadCSV(w http.ResponseWriter, r *http.Request) {
 	// 5. Сохраняем
 	err = tx.Commit()
 	if err != nil {
-		http.Error(w, "Ошибка сохранения данных", http.StatusInternalServerError)
-		return
+		return 0, &importError{http.StatusInternalServerError, "Ошибка сохранения данных"}
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "success",
-		"message": "Таблица users полностью заменена данными из CSV",
-		"rows":    inserted,
-	})
+	return inserted, nil
 }
 
 // Вспомогательная функция: проверяет, состоит ли строка из цифр (и, возможно, знака)
@@ -475,6 +789,15 @@ func sendCSVByEmail() error {
 	body := fmt.Sprintf("Во вложении CSV файл с пользователями.\n\nСгенерировано: %s\nКоличество записей: %d",
 		time.Now().Format("2006-01-02 15:04:05"), userCount)
 
+	// Шифруем вложение, если задан пароль или ключ получателя
+	attachment, encrypted, err := encryptBackupForConfig(csvData.Bytes())
+	if err != nil {
+		return fmt.Errorf("ошибка шифрования бэкапа: %v", err)
+	}
+	if encrypted {
+		body += "\nФайл зашифрован. Для расшифровки: app decrypt-backup -in <файл> -out users.csv"
+	}
+
 	// Создаем MIME сообщение
 	var msg bytes.Buffer
 	boundary := "boundary12345"
@@ -482,6 +805,8 @@ func sendCSVByEmail() error {
 	msg.WriteString(fmt.Sprintf("From: %s\r\n", SMTPUsername))
 	msg.WriteString(fmt.Sprintf("To: %s\r\n", ToEmail))
 	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", encodedSubject))
+	msg.WriteString(fmt.Sprintf("Date: %s\r\n", mailDateHeader()))
+	msg.WriteString(fmt.Sprintf("Message-ID: %s\r\n", mailMessageID()))
 	msg.WriteString("MIME-Version: 1.0\r\n")
 	msg.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", boundary))
 	msg.WriteString("\r\n")
@@ -496,13 +821,18 @@ func sendCSVByEmail() error {
 	// Вложение
 	filename := fmt.Sprintf("users_export_%s.csv", time.Now().Format("20060102"))
 	msg.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	msg.WriteString("Content-Type: text/csv; charset=utf-8\r\n")
+	if encrypted {
+		filename += ".enc"
+		msg.WriteString("Content-Type: application/octet-stream\r\n")
+	} else {
+		msg.WriteString("Content-Type: text/csv; charset=utf-8\r\n")
+	}
 	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
 	msg.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", filename))
 	msg.WriteString("\r\n")
 
 	// Кодируем CSV в base64
-	encoded := base64.StdEncoding.EncodeToString(csvData.Bytes())
+	encoded := base64.StdEncoding.EncodeToString(attachment)
 
 	// Пишем base64 построчно
 	lineLength := 76
@@ -517,27 +847,12 @@ func sendCSVByEmail() error {
 	msg.WriteString("\r\n")
 	msg.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
 
-	// Отправка с таймаутом
-	auth := smtp.PlainAuth("", SMTPUsername, SMTPPassword, SMTPHost)
-
-	done := make(chan error, 1)
-
-	go func() {
-		err = smtp.SendMail(SMTPHost+":"+SMTPPort, auth, SMTPUsername, []string{ToEmail}, msg.Bytes())
-		done <- err
-	}()
-
-	// Таймаут 15 секунд
-	select {
-	case err := <-done:
-		if err != nil {
-			return fmt.Errorf("ошибка отправки почты: %v", err)
-		}
-		log.Printf("✅ Письмо с бэкапом отправлено: %s", subject)
-		return nil
-	case <-time.After(15 * time.Second):
-		return fmt.Errorf("таймаут: отправка почты заняла слишком много времени")
+	// Отправка с таймаутом (и DKIM-подписью, если она настроена)
+	if err := sendMail([]string{ToEmail}, msg.Bytes()); err != nil {
+		return err
 	}
+	log.Printf("✅ Письмо с бэкапом отправлено: %s", subject)
+	return nil
 }
 
 // sendCSVHandler обрабатывает запрос на отправку CSV по почте
@@ -561,73 +876,58 @@ func sendCSVHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// startDailyEmailScheduler запускает планировщик ежедневной отправки
-func startDailyEmailScheduler() {
-	// Вычисляем время до следующего 09:00
-	now := time.Now()
-	next := time.Date(now.Year(), now.Month(), now.Day(), 9, 0, 0, 0, now.Location())
-	if now.After(next) {
-		next = next.Add(24 * time.Hour)
-	}
-	durationUntilNext := next.Sub(now)
-
-	// Запускаем первый раз через вычисленное время
-	time.AfterFunc(durationUntilNext, func() {
-		sendDailyEmail()
-		// Затем каждые 24 часа
-		ticker := time.NewTicker(24 * time.Hour)
-		for range ticker.C {
-			sendDailyEmail()
-		}
-	})
-
-	log.Printf("Ежедневная отправка CSV настроена. Первая отправка в %s", next.Format("2006-01-02 15:04:05"))
-}
-
-// sendDailyEmail отправляет ежедневный отчет
-func sendDailyEmail() {
+// sendDailyEmail отправляет ежедневный отчет (задача daily-backup-email)
+func sendDailyEmail() error {
 	err := sendCSVByEmail()
 	if err != nil {
 		log.Printf("Ошибка ежедневной отправки CSV: %v", err)
-	} else {
-		log.Printf("Ежедневный CSV отправлен на почту: %s", time.Now().Format("2006-01-02 15:04:05"))
+		events.Publish(EventBackupFailed, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return err
 	}
+	log.Printf("Ежедневный CSV отправлен на почту: %s", time.Now().Format("2006-01-02 15:04:05"))
+	return nil
 }
 
-// listVideosHandler возвращает список загруженных видео
+// listVideosHandler возвращает список загруженных видео.
+// Фильтры: ?folder=a/b (&recursive=true — с вложенными папками), ?tag=x (можно несколько, нужны все).
 func listVideosHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// АБСОЛЮТНЫЙ путь к папке video
-	videoDir := "/var/www/your-app/video"
-
-	files, err := os.ReadDir(videoDir)
+	filter, err := parseVideoListQuery(r.URL.Query())
 	if err != nil {
-		log.Printf("Ошибка чтения папки %s: %v", videoDir, err)
-		http.Error(w, "Ошибка чтения папки с видео", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var videos []map[string]interface{}
-	for _, file := range files {
-		if !file.IsDir() && isVideoFile(file.Name()) {
-			info, err := file.Info()
-			if err != nil {
-				continue
-			}
+	list, next, err := catalog.Find(r.Context(), filter)
+	if err == nil {
+		err = catalog.LoadTags(r.Context(), list)
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога видео: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
 
-			videos = append(videos, map[string]interface{}{
-				"filename":    file.Name(),
-				"size":        info.Size(),
-				"uploaded_at": info.ModTime().Format("2006-01-02 15:04:05"),
-				"url":         "/video/" + file.Name(),
-			})
-		}
+	videos := []map[string]interface{}{}
+	for _, v := range list {
+		videos = append(videos, videoJSON(r, v))
 	}
 
+	// Тело остаётся массивом; следующая страница — по курсору из заголовков
+	if next != nil {
+		nextURL := *r.URL
+		query := nextURL.Query()
+		query.Set("cursor", next.String())
+		nextURL.RawQuery = query.Encode()
+		w.Header().Set("X-Next-Cursor", next.String())
+		w.Header().Set("Link", "<"+nextURL.RequestURI()+`>; rel="next"`)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(videos)
 }
@@ -636,15 +936,16 @@ func listVideosHandler(w http.ResponseWriter, r *http.Request) {
 func serveVideoHandler(w http.ResponseWriter, r *http.Request) {
 	// Разрешаем CORS для видео запросов
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Range, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Range, If-Range, If-None-Match, If-Modified-Since, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges, ETag, Last-Modified")
 
 	// Обрабатываем preflight OPTIONS запрос
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
 		return
 	}
@@ -655,148 +956,88 @@ func serveVideoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Защита от path traversal атак
-	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
-		http.Error(w, "Некорректное имя файла", http.StatusBadRequest)
+	// Плейлисты и сегменты HLS: /api/video/{id}/hls/{name}
+	if id, name, ok := parseHLSPath(filename); ok {
+		hlsHandler(w, r, id, name)
 		return
 	}
 
-	// АБСОЛЮТНЫЙ путь к файлу
-	filePath := filepath.Join("/var/www/your-app/video", filename)
+	// Ищем видео в каталоге: постоянный адрес /api/video/{id} или прежний по имени файла
+	var video *Video
+	var err error
+	if id, perr := strconv.ParseInt(filename, 10, 64); perr == nil && id > 0 {
+		video, err = catalog.GetByID(r.Context(), id)
+	} else {
+		// Защита от path traversal атак
+		if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
+			http.Error(w, "Некорректное имя файла", http.StatusBadRequest)
+			return
+		}
 
-	// Проверяем существование файла
-	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		log.Printf("Файл не найден: %s", filePath)
+		// Проверяем, что это видео файл
+		if !isVideoFile(filename) {
+			http.Error(w, "Файл не является видео", http.StatusBadRequest)
+			return
+		}
+		video, err = catalog.GetByKey(r.Context(), filename)
+	}
+	if errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusReady) {
 		http.Error(w, "Файл не найден", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("Ошибка доступа к файлу %s: %v", filePath, err)
+		log.Printf("Ошибка чтения каталога: %v", err)
 		http.Error(w, "Ошибка доступа к файлу", http.StatusInternalServerError)
 		return
 	}
-
-	// Проверяем, что это файл, а не директория
-	if fileInfo.IsDir() {
-		http.Error(w, "Указанный путь является директорией", http.StatusBadRequest)
+	if !checkVideoAccess(w, r, video.ID) {
 		return
 	}
 
-	// Проверяем, что это видео файл
-	if !isVideoFile(filename) {
-		http.Error(w, "Файл не является видео", http.StatusBadRequest)
+	// Открываем файл в хранилище
+	file, err := videoStore.Open(r.Context(), video.BlobKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Printf("Файл из каталога отсутствует в хранилище: %s (%s)", video.Key, video.BlobKey)
+		http.Error(w, "Файл не найден", http.StatusNotFound)
 		return
 	}
-
-	// Открываем файл
-	file, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("Не удалось открыть файл %s: %v", filePath, err)
+		log.Printf("Не удалось открыть файл %s: %v", video.Key, err)
 		http.Error(w, "Не удалось открыть файл", http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
+	fileInfo := file.Info()
 
-	// Получаем размер файла
-	fileSize := fileInfo.Size()
-
-	// Устанавливаем правильные заголовки
-	ext := strings.ToLower(filepath.Ext(filename))
-	contentType := getContentType(ext)
+	// Устанавливаем правильные заголовки: тип определён по содержимому при загрузке
+	contentType := video.MIME
+	if contentType == "" {
+		contentType = getContentType(strings.ToLower(filepath.Ext(video.Key)))
+	}
 	if contentType != "" {
 		w.Header().Set("Content-Type", contentType)
 	} else {
 		w.Header().Set("Content-Type", "video/mp4") // fallback
 	}
 
-	// Важные заголовки для потоковой передачи
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", filename))
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-
-	// Обрабатываем Range запрос (для перемотки и докачки)
-	rangeHeader := r.Header.Get("Range")
-
-	// Если Range не указан - отдаем весь файл
-	if rangeHeader == "" {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize))
-		http.ServeContent(w, r, filename, fileInfo.ModTime(), file)
-		return
+	// ?download=1 — скачать файл, а не воспроизвести в браузере
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
 	}
-
-	// Парсим Range заголовок
-	var start, end int64
-	ranges := strings.TrimPrefix(rangeHeader, "bytes=")
-	rangeParts := strings.Split(ranges, "-")
-
-	if len(rangeParts) == 2 {
-		start, _ = strconv.ParseInt(rangeParts[0], 10, 64)
-		end, _ = strconv.ParseInt(rangeParts[1], 10, 64)
-
-		// Если end не указан или больше размера файла
-		if end == 0 || end >= fileSize {
-			end = fileSize - 1
-		}
-	} else if len(rangeParts) == 1 && rangeParts[0] != "" {
-		// Только start указан
-		start, _ = strconv.ParseInt(rangeParts[0], 10, 64)
-		end = fileSize - 1
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": video.OriginalFilename}))
+	if r.URL.Query().Has("sig") {
+		// Подписанную ссылку не должны кешировать общие кеши
+		w.Header().Set("Cache-Control", "private, max-age=3600")
 	} else {
-		http.Error(w, "Invalid range header", http.StatusBadRequest)
-		return
+		w.Header().Set("Cache-Control", "public, max-age=3600")
 	}
 
-	// Валидация диапазона
-	if start < 0 || end >= fileSize || start > end {
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
-		http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
+	notePlayback(r, video)
 
-	// Вычисляем длину контента
-	contentLength := end - start + 1
-
-	// Устанавливаем заголовки для частичного контента
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	w.WriteHeader(http.StatusPartialContent)
-
-	// Перемещаемся к нужной позиции в файле
-	_, err = file.Seek(start, 0)
-	if err != nil {
-		log.Printf("Ошибка seek файла: %v", err)
-		return
-	}
-
-	// Отправляем данные чанками
-	buffer := make([]byte, 64*1024) // 64KB chunks
-	remaining := contentLength
-
-	for remaining > 0 {
-		chunkSize := int64(len(buffer))
-		if chunkSize > remaining {
-			chunkSize = remaining
-		}
-
-		n, err := file.Read(buffer[:chunkSize])
-		if err != nil && err != io.EOF {
-			log.Printf("Ошибка чтения файла: %v", err)
-			break
-		}
-
-		if n == 0 {
-			break
-		}
-
-		_, err = w.Write(buffer[:n])
-		if err != nil {
-			log.Printf("Ошибка отправки данных: %v", err)
-			break
-		}
-
-		remaining -= int64(n)
-	}
+	// Условные запросы и Range (перемотка, докачка) по RFC 9110
+	etag := videoETag(fileInfo.Size, fileInfo.ModTime, video.SHA256)
+	serveRanges(w, r, file, fileInfo.Size, fileInfo.ModTime, etag)
 }
 
 // uploadVideoHandler обрабатывает загрузку видео
@@ -808,6 +1049,18 @@ func uploadVideoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Квоты и место на диске проверяем по размеру запроса до приёма файла
+	if err := checkUploadLimits(r.Context(), requestIdentity(r), videoStagingDir(), max(r.ContentLength, 0)); err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			log.Printf("Загрузка отклонена: %v", err)
+			writeStorageLimitError(w, err)
+			return
+		}
+		log.Printf("Ошибка проверки квот: %v", err)
+		http.Error(w, "Ошибка проверки квот", http.StatusInternalServerError)
+		return
+	}
+
 	// ⭐⭐⭐ ПОТОКОВАЯ ЗАГРУЗКА БЕЗ ЗАГРУЗКИ В ПАМЯТЬ ⭐⭐⭐
 	reader, err := r.MultipartReader()
 	if err != nil {
@@ -818,6 +1071,7 @@ func uploadVideoHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Ищем часть с видео
 	var filePart *multipart.Part
+	fields := map[string]string{}
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
@@ -832,6 +1086,11 @@ func uploadVideoHandler(w http.ResponseWriter, r *http.Request) {
 			filePart = part
 			break
 		}
+		// Текстовые поля формы должны идти до файла
+		if name := part.FormName(); name == "title" || name == "description" {
+			value, _ := io.ReadAll(io.LimitReader(part, 64*1024))
+			fields[name] = strings.TrimSpace(string(value))
+		}
 		part.Close()
 	}
 
@@ -853,79 +1112,55 @@ func uploadVideoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Создаем уникальное имя файла
-	ext := strings.ToLower(filepath.Ext(filename))
-	newFilename := fmt.Sprintf("%d_%s%s", time.Now().Unix(), generateRandomString(8), ext)
-	filePath := filepath.Join("/var/www/your-app/video", newFilename)
-
-	// Создаем файл на сервере
-	dst, err := os.Create(filePath)
-	if err != nil {
-		log.Printf("Ошибка создания файла %s: %v", filePath, err)
-		http.Error(w, "Не удалось создать файл: "+err.Error(), http.StatusInternalServerError)
+	// ⭐⭐⭐ ПОТОКОВОЕ КОПИРОВАНИЕ в хранилище ⭐⭐⭐
+	startTime := time.Now()
+	src := &uploadProgressReader{r: filePart, limit: maxVideoSize, lastLog: startTime}
+	video, err := addVideo(r.Context(), videoUpload{
+		OriginalFilename: filename,
+		Title:            fields["title"],
+		Description:      fields["description"],
+		Uploader:         requestIdentity(r),
+	}, src)
+	if errors.Is(err, errUploadTooLarge) {
+		http.Error(w, "Файл слишком большой. Максимальный размер: 2GB", http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
-
-	// ⭐⭐⭐ ПОТОКОВОЕ КОПИРОВАНИЕ с маленьким буфером ⭐⭐⭐
-	buffer := make([]byte, 32*1024) // 32KB буфер - очень мало памяти!
-	var totalBytes int64
-	startTime := time.Now()
-	lastLog := time.Now()
-
-	for {
-		n, err := filePart.Read(buffer)
-		if n > 0 {
-			// Проверяем общий размер (макс 2GB)
-			totalBytes += int64(n)
-			if totalBytes > (2 << 30) {
-				dst.Close()
-				os.Remove(filePath)
-				http.Error(w, "Файл слишком большой. Максимальный размер: 2GB", http.StatusBadRequest)
-				return
-			}
-
-			_, writeErr := dst.Write(buffer[:n])
-			if writeErr != nil {
-				dst.Close()
-				os.Remove(filePath)
-				http.Error(w, "Ошибка записи файла: "+writeErr.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// Логируем прогресс каждые 5 секунд
-			if time.Since(lastLog) > 5*time.Second {
-				log.Printf("Прогресс загрузки: %.2f MB", float64(totalBytes)/(1024*1024))
-				lastLog = time.Now()
-			}
-		}
-
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			dst.Close()
-			os.Remove(filePath)
-			http.Error(w, "Ошибка чтения файла: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if errors.Is(err, errInvalidVideo) {
+		log.Printf("Видео %s отклонено: %v", filename, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInsufficientStorage) {
+		log.Printf("Видео %s отклонено: %v", filename, err)
+		writeStorageLimitError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка сохранения файла %s: %v", filename, err)
+		http.Error(w, "Ошибка записи файла: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	log.Printf("✅ Видео успешно загружено: %s (%d bytes, время: %v)",
-		newFilename, totalBytes, time.Since(startTime))
+		video.Key, video.Size, time.Since(startTime))
 
+	videoInfo := videoJSON(r, video)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":      "success",
 		"message":     "Видео успешно загружено",
-		"filename":    newFilename,
-		"size":        totalBytes,
-		"uploaded_at": time.Now().Format("2006-01-02 15:04:05"),
-		"url":         "/video/" + newFilename,
+		"id":          video.ID,
+		"filename":    video.Key,
+		"size":        video.Size,
+		"mime_type":   video.MIME,
+		"uploaded_at": video.CreatedAt.Format("2006-01-02 15:04:05"),
+		"url":         videoInfo["url"],
+		"video":       videoInfo,
 	})
 }
 
-// deleteVideoHandler удаляет видео файл
+// deleteVideoHandler перемещает видео в корзину. Файл остаётся в хранилище
+// до восстановления или окончательного удаления (см. video_trash.go).
 func deleteVideoHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
@@ -944,61 +1179,77 @@ func deleteVideoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// АБСОЛЮТНЫЙ путь к файлу
-	filePath := filepath.Join("/var/www/your-app/video", filename)
+	// Проверяем, что это видео файл
+	if !isVideoFile(filename) {
+		http.Error(w, "Файл не является видео", http.StatusBadRequest)
+		return
+	}
 
-	// Проверяем существование файла
-	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		log.Printf("Файл не найден для удаления: %s", filePath)
+	// Ищем видео в каталоге; видео в корзине удаляются через /api/trash/
+	video, err := catalog.GetByKey(r.Context(), filename)
+	if errors.Is(err, errVideoNotFound) || (err == nil && (video.Status == videoStatusUploading || video.Status == videoStatusTrashed)) {
+		log.Printf("Видео не найдено для удаления: %s", filename)
 		http.Error(w, "Файл не найден", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("Ошибка доступа к файлу %s: %v", filePath, err)
+		log.Printf("Ошибка чтения каталога: %v", err)
 		http.Error(w, "Ошибка доступа к файлу", http.StatusInternalServerError)
 		return
 	}
 
-	// Проверяем, что это файл, а не директория
-	if fileInfo.IsDir() {
-		http.Error(w, "Указанный путь является директорией", http.StatusBadRequest)
-		return
-	}
-
-	// Проверяем, что это видео файл
-	if !isVideoFile(filename) {
-		http.Error(w, "Файл не является видео", http.StatusBadRequest)
+	err = trashVideo(r.Context(), video, requestIdentity(r))
+	if errors.Is(err, errVideoNotFound) {
+		http.Error(w, "Файл не найден", http.StatusNotFound)
 		return
 	}
-
-	// Удаляем файл
-	err = os.Remove(filePath)
 	if err != nil {
-		log.Printf("Ошибка удаления файла %s: %v", filePath, err)
+		log.Printf("Ошибка перемещения видео %d в корзину: %v", video.ID, err)
 		http.Error(w, "Ошибка удаления файла", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Видео удалено: %s", filename)
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "success",
-		"message": "Видео успешно удалено",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"message":  "Видео перемещено в корзину",
+		"purge_at": trashPurgeAt(video).Format("2006-01-02 15:04:05"),
 	})
 }
 
 // Вспомогательные функции
 
-// generateRandomString генерирует случайную строку
+var errUploadTooLarge = errors.New("файл слишком большой")
+
+// uploadProgressReader ограничивает размер загрузки и логирует прогресс каждые 5 секунд
+type uploadProgressReader struct {
+	r       io.Reader
+	limit   int64
+	n       int64
+	lastLog time.Time
+}
+
+func (u *uploadProgressReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.n += int64(n)
+	if u.n > u.limit {
+		return n, errUploadTooLarge
+	}
+	if time.Since(u.lastLog) > 5*time.Second {
+		log.Printf("Прогресс загрузки: %.2f MB", float64(u.n)/(1024*1024))
+		u.lastLog = time.Now()
+	}
+	return n, err
+}
+
+// generateRandomString генерирует случайную строку. Общий генератор math/rand/v2
+// засевается случайно один раз и безопасен для одновременных вызовов.
 func generateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		b[i] = charset[rand.IntN(len(charset))]
 	}
 	return string(b)
 }
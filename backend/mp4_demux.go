@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Чтение таблиц сэмплов MP4 (stbl) для перепаковки без перекодирования:
+// смещение, размер и время каждого кадра, ключевые кадры, параметры
+// декодера H.264 (avcC) и AAC (esds).
+
+// mp4MaxSamples — ограничение на число сэмплов дорожки (при постоянном размере
+// сэмпла stsz не содержит таблицы, и число ничем не подтверждено)
+const mp4MaxSamples = 1 << 24
+
+// mp4Sample — кадр дорожки. Время в единицах timescale дорожки.
+type mp4Sample struct {
+	Offset   int64
+	Size     uint32
+	DTS      int64
+	CTS      int64 // сдвиг времени показа относительно DTS
+	Duration uint32
+	Key      bool
+}
+
+// mp4Track — дорожка MP4 с таблицей сэмплов
+type mp4Track struct {
+	Handler   string // vide, soun
+	Codec     string // тип записи stsd: avc1, mp4a...
+	Timescale uint32
+	// Shift — сдвиг из списка правок (edts/elst), прибавляется к DTS и PTS
+	Shift   int64
+	Samples []mp4Sample
+
+	// H.264: параметры из avcC
+	SPS, PPS  [][]byte
+	NALLength int
+	// AAC: AudioSpecificConfig из esds
+	AudioConfig []byte
+}
+
+func (n *mp4Node) child(typ string) *mp4Node {
+	for _, c := range n.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// readMP4Tracks читает moov и строит таблицы сэмплов всех дорожек
+func readMP4Tracks(r io.ReadSeeker, size int64) ([]*mp4Track, error) {
+	for pos := int64(0); pos < size; {
+		box, err := readISOBox(r, pos, size)
+		if err != nil {
+			return nil, err
+		}
+		pos = box.end()
+		if box.Type != "moov" {
+			continue
+		}
+		if box.Size > mp4MaxMoovSize {
+			return nil, fmt.Errorf("блок moov слишком большой: %d bytes", box.Size)
+		}
+		raw := make([]byte, box.Size)
+		if _, err := readAt(r, box.Pos, raw); err != nil {
+			return nil, truncated(err)
+		}
+		nodes, err := parseMP4Nodes(raw)
+		if err != nil {
+			return nil, err
+		}
+		moov := nodes[0]
+
+		var movieTimescale float64
+		if mvhd := moov.child("mvhd"); mvhd != nil {
+			movieTimescale, _, _ = parseISOTimes(mvhd.data)
+		}
+		var tracks []*mp4Track
+		for _, trak := range moov.children {
+			if trak.typ != "trak" {
+				continue
+			}
+			t, err := parseMP4Track(trak, movieTimescale)
+			if err != nil {
+				return nil, err
+			}
+			if t != nil {
+				tracks = append(tracks, t)
+			}
+		}
+		return tracks, nil
+	}
+	return nil, invalidVideo("нет блока moov")
+}
+
+// parseMP4Track разбирает дорожку; для дорожек без нужных блоков возвращает nil
+func parseMP4Track(trak *mp4Node, movieTimescale float64) (*mp4Track, error) {
+	mdia := trak.child("mdia")
+	if mdia == nil {
+		return nil, nil
+	}
+	mdhd, hdlr, minf := mdia.child("mdhd"), mdia.child("hdlr"), mdia.child("minf")
+	if mdhd == nil || hdlr == nil || minf == nil || len(hdlr.data) < 12 {
+		return nil, nil
+	}
+	stbl := minf.child("stbl")
+	if stbl == nil {
+		return nil, nil
+	}
+	timescale := mdhdTimescale(mdhd.data)
+	if timescale == 0 {
+		return nil, invalidVideo("неверный блок mdhd")
+	}
+
+	t := &mp4Track{Handler: string(hdlr.data[8:12]), Timescale: uint32(timescale)}
+	if stsd := stbl.child("stsd"); stsd != nil {
+		if err := parseMP4SampleEntry(t, stsd.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := buildMP4Samples(t, stbl); err != nil {
+		return nil, fmt.Errorf("дорожка %s: %v", t.Handler, err)
+	}
+	if edts := trak.child("edts"); edts != nil && movieTimescale > 0 {
+		t.Shift = parseEditShift(edts.data, movieTimescale, timescale)
+	}
+	return t, nil
+}
+
+// mdhdTimescale читает timescale дорожки (длительность при этом может быть неизвестна)
+func mdhdTimescale(data []byte) float64 {
+	switch {
+	case len(data) >= 24 && data[0] == 1:
+		return float64(binary.BigEndian.Uint32(data[20:24]))
+	case len(data) >= 16 && data[0] == 0:
+		return float64(binary.BigEndian.Uint32(data[12:16]))
+	}
+	return 0
+}
+
+// findChildBox ищет вложенный блок в сыром содержимом и возвращает его данные
+func findChildBox(buf []byte, typ string) []byte {
+	for len(buf) >= 8 {
+		size := int(binary.BigEndian.Uint32(buf[0:4]))
+		if size < 8 || size > len(buf) {
+			return nil
+		}
+		if string(buf[4:8]) == typ {
+			return buf[8:size]
+		}
+		buf = buf[size:]
+	}
+	return nil
+}
+
+// parseMP4SampleEntry читает первую запись stsd: кодек и параметры декодера
+func parseMP4SampleEntry(t *mp4Track, stsd []byte) error {
+	if len(stsd) < 16 {
+		return nil
+	}
+	entry := stsd[8:]
+	size := int(binary.BigEndian.Uint32(entry[0:4]))
+	if size < 8 || size > len(entry) {
+		return invalidVideo("неверная запись stsd")
+	}
+	entry = entry[:size]
+	t.Codec = string(entry[4:8])
+
+	switch t.Codec {
+	case "avc1", "avc3":
+		// VisualSampleEntry: 8 байт SampleEntry и 70 байт описания кадра
+		if len(entry) < 8+8+70 {
+			return invalidVideo("неполная запись %s", t.Codec)
+		}
+		if avcC := findChildBox(entry[86:], "avcC"); avcC != nil {
+			return parseAVCConfig(t, avcC)
+		}
+	case "mp4a":
+		// AudioSampleEntry: у QuickTime версий 1 и 2 описание длиннее
+		if len(entry) < 8+8+20 {
+			return invalidVideo("неполная запись mp4a")
+		}
+		children := 36
+		switch binary.BigEndian.Uint16(entry[16:18]) {
+		case 1:
+			children += 16
+		case 2:
+			children += 36
+		}
+		if children > len(entry) {
+			return invalidVideo("неполная запись mp4a")
+		}
+		esds := findChildBox(entry[children:], "esds")
+		if esds == nil {
+			// QuickTime кладёт esds внутрь блока wave
+			if wave := findChildBox(entry[children:], "wave"); wave != nil {
+				esds = findChildBox(wave, "esds")
+			}
+		}
+		if esds != nil && len(esds) > 4 {
+			t.AudioConfig = parseESDSConfig(esds[4:])
+		}
+	}
+	return nil
+}
+
+// parseAVCConfig читает AVCDecoderConfigurationRecord
+func parseAVCConfig(t *mp4Track, b []byte) error {
+	if len(b) < 6 {
+		return invalidVideo("неполный блок avcC")
+	}
+	t.NALLength = int(b[4]&3) + 1
+	readSets := func(pos, count int) ([][]byte, int, error) {
+		var sets [][]byte
+		for i := 0; i < count; i++ {
+			if pos+2 > len(b) {
+				return nil, pos, invalidVideo("неполный блок avcC")
+			}
+			n := int(binary.BigEndian.Uint16(b[pos:]))
+			if pos+2+n > len(b) {
+				return nil, pos, invalidVideo("неполный блок avcC")
+			}
+			sets = append(sets, b[pos+2:pos+2+n])
+			pos += 2 + n
+		}
+		return sets, pos, nil
+	}
+	var err error
+	pos := 6
+	if t.SPS, pos, err = readSets(pos, int(b[5]&0x1f)); err != nil {
+		return err
+	}
+	if pos >= len(b) {
+		return invalidVideo("неполный блок avcC")
+	}
+	t.PPS, _, err = readSets(pos+1, int(b[pos]))
+	return err
+}
+
+// parseESDSConfig достаёт DecoderSpecificInfo (AudioSpecificConfig) из ES_Descriptor
+func parseESDSConfig(b []byte) []byte {
+	readDescr := func(b []byte) (tag byte, body, rest []byte, ok bool) {
+		if len(b) < 2 {
+			return 0, nil, nil, false
+		}
+		tag = b[0]
+		n, i := 0, 1
+		for ; i < len(b) && i <= 4; i++ {
+			n = n<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				break
+			}
+		}
+		i++
+		if i > len(b) || n > len(b)-i {
+			return 0, nil, nil, false
+		}
+		return tag, b[i : i+n], b[i+n:], true
+	}
+
+	tag, es, _, ok := readDescr(b)
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return nil
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 { // streamDependenceFlag
+		if len(es) < 2 {
+			return nil
+		}
+		es = es[2:]
+	}
+	if flags&0x40 != 0 { // URL_Flag
+		if len(es) < 1 || len(es) < 1+int(es[0]) {
+			return nil
+		}
+		es = es[1+int(es[0]):]
+	}
+	if flags&0x20 != 0 { // OCRstreamFlag
+		if len(es) < 2 {
+			return nil
+		}
+		es = es[2:]
+	}
+	tag, dc, _, ok := readDescr(es)
+	if !ok || tag != 0x04 || len(dc) < 13 || dc[0] != 0x40 { // 0x40 — MPEG-4 Audio
+		return nil
+	}
+	for rest := dc[13:]; len(rest) > 0; {
+		var body []byte
+		if tag, body, rest, ok = readDescr(rest); !ok {
+			return nil
+		}
+		if tag == 0x05 {
+			return body
+		}
+	}
+	return nil
+}
+
+// buildMP4Samples строит список сэмплов из stsz, stsc, stco/co64, stts, ctts и stss
+func buildMP4Samples(t *mp4Track, stbl *mp4Node) error {
+	stsz := stbl.child("stsz")
+	stsc := stbl.child("stsc")
+	stts := stbl.child("stts")
+	offsetsNode := stbl.child("stco")
+	if offsetsNode == nil {
+		offsetsNode = stbl.child("co64")
+	}
+	if stsz == nil || stsc == nil || stts == nil || offsetsNode == nil {
+		return invalidVideo("нет таблицы сэмплов")
+	}
+
+	// Размеры
+	if len(stsz.data) < 12 {
+		return invalidVideo("неполный блок stsz")
+	}
+	fixed := binary.BigEndian.Uint32(stsz.data[4:8])
+	count := int(binary.BigEndian.Uint32(stsz.data[8:12]))
+	if fixed == 0 && (count < 0 || len(stsz.data) < 12+count*4) {
+		return invalidVideo("неполный блок stsz")
+	}
+	if count > mp4MaxSamples {
+		return invalidVideo("слишком много сэмплов: %d", count)
+	}
+	samples := make([]mp4Sample, count)
+	for i := range samples {
+		if fixed != 0 {
+			samples[i].Size = fixed
+		} else {
+			samples[i].Size = binary.BigEndian.Uint32(stsz.data[12+i*4:])
+		}
+	}
+
+	// Смещения: сэмплы лежат в чанках подряд
+	chunks, err := chunkOffsets(offsetsNode)
+	if err != nil {
+		return err
+	}
+	entries, err := mp4Table(stsc, 12)
+	if err != nil {
+		return err
+	}
+	sample := 0
+	for e := 0; e < len(entries) && sample < count; e++ {
+		first := int(binary.BigEndian.Uint32(entries[e]))
+		perChunk := int(binary.BigEndian.Uint32(entries[e][4:]))
+		last := len(chunks) + 1
+		if e+1 < len(entries) {
+			last = int(binary.BigEndian.Uint32(entries[e+1]))
+		}
+		if first < 1 || last > len(chunks)+1 {
+			return invalidVideo("неверный блок stsc")
+		}
+		for chunk := first; chunk < last && sample < count; chunk++ {
+			off := int64(chunks[chunk-1])
+			for i := 0; i < perChunk && sample < count; i++ {
+				samples[sample].Offset = off
+				off += int64(samples[sample].Size)
+				sample++
+			}
+		}
+	}
+	if sample < count {
+		return invalidVideo("таблица stsc описывает не все сэмплы")
+	}
+
+	// Время декодирования
+	entries, err = mp4Table(stts, 8)
+	if err != nil {
+		return err
+	}
+	sample = 0
+	var dts int64
+	for _, e := range entries {
+		n := int(binary.BigEndian.Uint32(e))
+		delta := binary.BigEndian.Uint32(e[4:])
+		for i := 0; i < n && sample < count; i++ {
+			samples[sample].DTS = dts
+			samples[sample].Duration = delta
+			dts += int64(delta)
+			sample++
+		}
+	}
+
+	// Сдвиг времени показа (B-кадры)
+	if ctts := stbl.child("ctts"); ctts != nil {
+		if entries, err = mp4Table(ctts, 8); err != nil {
+			return err
+		}
+		sample = 0
+		for _, e := range entries {
+			n := int(binary.BigEndian.Uint32(e))
+			offset := int64(int32(binary.BigEndian.Uint32(e[4:])))
+			for i := 0; i < n && sample < count; i++ {
+				samples[sample].CTS = offset
+				sample++
+			}
+		}
+	}
+
+	// Ключевые кадры; без stss ключевые все
+	if stss := stbl.child("stss"); stss != nil {
+		if entries, err = mp4Table(stss, 4); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if n := int(binary.BigEndian.Uint32(e)); n >= 1 && n <= count {
+				samples[n-1].Key = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].Key = true
+		}
+	}
+
+	t.Samples = samples
+	return nil
+}
+
+// mp4Table разбивает таблицу полного блока (версия, флаги, число записей) на записи
+func mp4Table(n *mp4Node, width int) ([][]byte, error) {
+	if len(n.data) < 8 {
+		return nil, invalidVideo("неполный блок %s", n.typ)
+	}
+	count := int(binary.BigEndian.Uint32(n.data[4:8]))
+	if count < 0 || count > (len(n.data)-8)/width {
+		return nil, invalidVideo("неполная таблица %s", n.typ)
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i] = n.data[8+i*width : 8+(i+1)*width]
+	}
+	return entries, nil
+}
+
+// parseEditShift переводит список правок в сдвиг времени дорожки: пустые правки
+// задерживают начало, media_time первой непустой правки отрезает начало дорожки
+func parseEditShift(edts []byte, movieTimescale, trackTimescale float64) int64 {
+	elst := findChildBox(edts, "elst")
+	if len(elst) < 8 {
+		return 0
+	}
+	version := elst[0]
+	count := int(binary.BigEndian.Uint32(elst[4:8]))
+	width := 12
+	if version == 1 {
+		width = 20
+	}
+	var empty float64
+	for i := 0; i < count && 8+(i+1)*width <= len(elst); i++ {
+		e := elst[8+i*width:]
+		var duration float64
+		var mediaTime int64
+		if version == 1 {
+			duration = float64(binary.BigEndian.Uint64(e))
+			mediaTime = int64(binary.BigEndian.Uint64(e[8:]))
+		} else {
+			duration = float64(binary.BigEndian.Uint32(e))
+			mediaTime = int64(int32(binary.BigEndian.Uint32(e[4:])))
+		}
+		if mediaTime == -1 {
+			empty += duration
+			continue
+		}
+		return int64(empty/movieTimescale*trackTimescale) - mediaTime
+	}
+	return 0
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+// Faststart: перенос блока moov перед mdat, чтобы браузер мог начать воспроизведение,
+// не запрашивая конец файла. Смещения чанков в stco/co64 сдвигаются на размер moov;
+// если 32-битные смещения перестают помещаться, stco заменяется на co64.
+//
+// Файл в хранилище не перезаписывается: результат сохраняется как новое
+// содержимое по хешу, запись каталога переключается на него после проверки,
+// и только затем освобождается исходный файл.
+
+// mp4MaxMoovSize — ограничение на размер moov, который читается в память
+const mp4MaxMoovSize = 256 << 20
+
+var errNotMP4Faststart = errors.New("перенос moov для этого файла не поддерживается")
+
+// mp4Node — блок MP4, прочитанный в память. У контейнеров заполнены children, у остальных data.
+type mp4Node struct {
+	typ      string
+	data     []byte
+	children []*mp4Node
+}
+
+// Контейнеры на пути к таблицам смещений чанков
+var mp4ContainerBoxes = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+}
+
+func parseMP4Nodes(buf []byte) ([]*mp4Node, error) {
+	var nodes []*mp4Node
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, invalidVideo("неполный заголовок блока в moov")
+		}
+		size := uint64(binary.BigEndian.Uint32(buf[0:4]))
+		typ := string(buf[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(buf))
+		case 1:
+			if len(buf) < 16 {
+				return nil, invalidVideo("неполный заголовок блока %q", printableType(typ))
+			}
+			size = binary.BigEndian.Uint64(buf[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(buf)) {
+			return nil, invalidVideo("блок %q выходит за пределы moov", printableType(typ))
+		}
+
+		node := &mp4Node{typ: typ}
+		body := buf[header:size]
+		if mp4ContainerBoxes[typ] {
+			children, err := parseMP4Nodes(body)
+			if err != nil {
+				return nil, err
+			}
+			node.children = children
+		} else {
+			node.data = body
+		}
+		nodes = append(nodes, node)
+		buf = buf[size:]
+	}
+	return nodes, nil
+}
+
+func (n *mp4Node) size() uint64 {
+	body := uint64(len(n.data))
+	for _, c := range n.children {
+		body += c.size()
+	}
+	if body+8 > math.MaxUint32 {
+		return body + 16
+	}
+	return body + 8
+}
+
+func (n *mp4Node) writeTo(buf *bytes.Buffer) {
+	size := n.size()
+	if size > math.MaxUint32 {
+		binary.Write(buf, binary.BigEndian, uint32(1))
+		buf.WriteString(n.typ)
+		binary.Write(buf, binary.BigEndian, size)
+	} else {
+		binary.Write(buf, binary.BigEndian, uint32(size))
+		buf.WriteString(n.typ)
+	}
+	buf.Write(n.data)
+	for _, c := range n.children {
+		c.writeTo(buf)
+	}
+}
+
+// chunkOffsetTables возвращает все блоки stco и co64
+func chunkOffsetTables(nodes []*mp4Node) []*mp4Node {
+	var tables []*mp4Node
+	for _, n := range nodes {
+		if n.typ == "stco" || n.typ == "co64" {
+			tables = append(tables, n)
+		}
+		tables = append(tables, chunkOffsetTables(n.children)...)
+	}
+	return tables
+}
+
+// chunkOffsets читает смещения из stco или co64
+func chunkOffsets(n *mp4Node) ([]uint64, error) {
+	if len(n.data) < 8 {
+		return nil, invalidVideo("неполный блок %s", n.typ)
+	}
+	count := int(binary.BigEndian.Uint32(n.data[4:8]))
+	width := 4
+	if n.typ == "co64" {
+		width = 8
+	}
+	if count < 0 || len(n.data) < 8+count*width {
+		return nil, invalidVideo("неполная таблица %s", n.typ)
+	}
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		p := n.data[8+i*width:]
+		if width == 4 {
+			offsets[i] = uint64(binary.BigEndian.Uint32(p))
+		} else {
+			offsets[i] = binary.BigEndian.Uint64(p)
+		}
+	}
+	return offsets, nil
+}
+
+// setChunkOffsets записывает смещения; co64 задаёт формат таблицы
+func setChunkOffsets(n *mp4Node, offsets []uint64, co64 bool) {
+	width := 4
+	n.typ = "stco"
+	if co64 {
+		width = 8
+		n.typ = "co64"
+	}
+	data := make([]byte, 8+len(offsets)*width)
+	copy(data[0:4], n.data[0:4]) // версия и флаги
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(offsets)))
+	for i, off := range offsets {
+		if co64 {
+			binary.BigEndian.PutUint64(data[8+i*8:], off)
+		} else {
+			binary.BigEndian.PutUint32(data[8+i*4:], uint32(off))
+		}
+	}
+	n.data = data
+}
+
+// mp4Faststart записывает в w файл с moov перед mdat. Если moov уже в начале,
+// ничего не пишет и возвращает false.
+func mp4Faststart(r io.ReadSeeker, size int64, w io.Writer) (bool, error) {
+	var boxes []isoBox
+	for pos := int64(0); pos < size; {
+		box, err := readISOBox(r, pos, size)
+		if err != nil {
+			return false, err
+		}
+		boxes = append(boxes, box)
+		pos = box.end()
+	}
+
+	moovIdx, mdatIdx := -1, -1
+	for i, box := range boxes {
+		switch box.Type {
+		case "moov":
+			moovIdx = i
+		case "mdat":
+			if mdatIdx < 0 {
+				mdatIdx = i
+			}
+		case "moof":
+			return false, errNotMP4Faststart // фрагментированный MP4
+		}
+	}
+	if moovIdx < 0 || mdatIdx < 0 {
+		return false, errNotMP4Faststart
+	}
+	if moovIdx < mdatIdx {
+		return false, nil
+	}
+	moovBox, insertPos := boxes[moovIdx], boxes[mdatIdx].Pos
+	if moovBox.Size > mp4MaxMoovSize {
+		return false, fmt.Errorf("блок moov слишком большой: %d bytes", moovBox.Size)
+	}
+
+	raw := make([]byte, moovBox.Size)
+	if _, err := readAt(r, moovBox.Pos, raw); err != nil {
+		return false, truncated(err)
+	}
+	nodes, err := parseMP4Nodes(raw)
+	if err != nil {
+		return false, err
+	}
+	moov := nodes[0]
+
+	tables := chunkOffsetTables(moov.children)
+	offsets := make([][]uint64, len(tables))
+	var maxOffset uint64
+	for i, t := range tables {
+		if offsets[i], err = chunkOffsets(t); err != nil {
+			return false, err
+		}
+		for _, off := range offsets[i] {
+			maxOffset = max(maxOffset, off)
+		}
+	}
+
+	// Если после сдвига 32-битные смещения переполнятся, переводим все таблицы в co64
+	useCo64 := maxOffset+moov.size() > math.MaxUint32
+	for i, t := range tables {
+		setChunkOffsets(t, offsets[i], useCo64 || t.typ == "co64")
+	}
+
+	newSize := moov.size()
+	oldStart, oldEnd := uint64(moovBox.Pos), uint64(moovBox.end())
+	for i, t := range tables {
+		for j, off := range offsets[i] {
+			switch {
+			case off >= uint64(insertPos) && off < oldStart:
+				offsets[i][j] = off + newSize
+			case off >= oldEnd:
+				offsets[i][j] = off + newSize - uint64(moovBox.Size)
+			}
+		}
+		setChunkOffsets(t, offsets[i], t.typ == "co64")
+	}
+
+	var moovBuf bytes.Buffer
+	moov.writeTo(&moovBuf)
+
+	// [до mdat] [новый moov] [от mdat до старого moov] [после старого moov]
+	copyRange := func(from, to int64) error {
+		if _, err := r.Seek(from, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(w, r, to-from)
+		return truncated(err)
+	}
+	if err := copyRange(0, insertPos); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(moovBuf.Bytes()); err != nil {
+		return false, err
+	}
+	if err := copyRange(insertPos, moovBox.Pos); err != nil {
+		return false, err
+	}
+	if err := copyRange(moovBox.end(), size); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mp4ChunkOffsets читает таблицы смещений чанков из файла (для проверки результата)
+func mp4ChunkOffsets(r io.ReadSeeker, size int64) ([][]uint64, error) {
+	for pos := int64(0); pos < size; {
+		box, err := readISOBox(r, pos, size)
+		if err != nil {
+			return nil, err
+		}
+		if box.Type == "moov" {
+			if box.Size > mp4MaxMoovSize {
+				return nil, fmt.Errorf("блок moov слишком большой: %d bytes", box.Size)
+			}
+			raw := make([]byte, box.Size)
+			if _, err := readAt(r, box.Pos, raw); err != nil {
+				return nil, truncated(err)
+			}
+			nodes, err := parseMP4Nodes(raw)
+			if err != nil {
+				return nil, err
+			}
+			var result [][]uint64
+			for _, t := range chunkOffsetTables(nodes) {
+				offsets, err := chunkOffsets(t)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, offsets)
+			}
+			return result, nil
+		}
+		pos = box.end()
+	}
+	return nil, invalidVideo("нет блока moov")
+}
+
+// verifyFaststart сравнивает исходный и переписанный файлы: контейнер корректен,
+// moov в начале, сведения о видео совпадают, а чанки по новым смещениям
+// содержат те же байты, что и по старым.
+func verifyFaststart(orig io.ReadSeeker, origSize int64, res io.ReadSeeker, resSize int64, filename string) error {
+	origContainer, origMeta, err := probeVideo(orig, origSize, filename)
+	if err != nil {
+		return err
+	}
+	resContainer, resMeta, err := probeVideo(res, resSize, filename)
+	if err != nil {
+		return fmt.Errorf("результат не прошёл проверку: %v", err)
+	}
+	if !resContainer.Faststart || resContainer.Format != origContainer.Format || resMeta != origMeta {
+		return errors.New("результат отличается от исходного файла")
+	}
+
+	origTables, err := mp4ChunkOffsets(orig, origSize)
+	if err != nil {
+		return err
+	}
+	resTables, err := mp4ChunkOffsets(res, resSize)
+	if err != nil {
+		return err
+	}
+	if len(origTables) != len(resTables) {
+		return errors.New("число таблиц смещений изменилось")
+	}
+
+	a, b := make([]byte, 64), make([]byte, 64)
+	for i := range origTables {
+		if len(origTables[i]) != len(resTables[i]) {
+			return errors.New("число чанков изменилось")
+		}
+		// Проверяем чанки выборочно: первые, последние и каждый сотый
+		for j := range origTables[i] {
+			if j > 4 && j < len(origTables[i])-4 && j%100 != 0 {
+				continue
+			}
+			na, errA := readAt(orig, int64(origTables[i][j]), a)
+			nb, errB := readAt(res, int64(resTables[i][j]), b)
+			if (errA != nil && errA != io.ErrUnexpectedEOF) || (errB != nil && errB != io.ErrUnexpectedEOF) {
+				return errors.New("смещение чанка за пределами файла")
+			}
+			if na != nb || !bytes.Equal(a[:na], b[:nb]) {
+				return fmt.Errorf("данные чанка %d дорожки %d не совпадают", j, i)
+			}
+		}
+	}
+	return nil
+}
+
+// faststartVideo переносит moov в начало видео из каталога и обновляет запись.
+// Возвращает false, если файл уже был faststart или формат не подходит.
+func faststartVideo(ctx context.Context, v *Video) (bool, error) {
+	orig, err := videoStore.Open(ctx, v.BlobKey)
+	if err != nil {
+		return false, err
+	}
+	defer orig.Close()
+	origSize := orig.Info().Size
+
+	tmp, err := os.CreateTemp("", "faststart-*.mp4")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	changed, err := mp4Faststart(orig, origSize, tmp)
+	if errors.Is(err, errNotMP4Faststart) || (err == nil && !changed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resSize, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if err := verifyFaststart(orig, origSize, tmp, resSize, v.Key); err != nil {
+		return false, err
+	}
+
+	// Результат — новое содержимое со своим хешем; исходный файл остаётся на месте
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	incoming, _, sum, err := putIncoming(ctx, tmp)
+	if err != nil {
+		return false, err
+	}
+	blobKey, _, err := catalog.AcquireBlob(ctx, incoming, sum, resSize)
+	if err != nil {
+		videoStore.Delete(ctx, incoming)
+		return false, err
+	}
+
+	// Проверяем то, что действительно лежит в хранилище, и только потом переключаем запись
+	release := func() {
+		if err := catalog.ReleaseBlob(ctx, sum); err != nil {
+			log.Printf("Faststart %s: не удалось освободить %s: %v", v.Key, blobKey, err)
+		}
+	}
+	if err := verifyStoredFaststart(ctx, blobKey, v.BlobKey, v.Key, resSize); err != nil {
+		release()
+		return false, err
+	}
+	// Запись переключается, только если видео всё ещё готово и с прежним
+	// содержимым; иначе исходный файл уже освободил тот, кто его изменил
+	// или удалил, и освобождать нужно только новое содержимое
+	if err := catalog.UpdateContent(ctx, v.ID, v.SHA256, blobKey, resSize, sum, true); err != nil {
+		release()
+		if errors.Is(err, errVideoNotFound) {
+			return false, errors.New("видео удалено или изменено во время переноса moov")
+		}
+		return false, fmt.Errorf("ошибка обновления каталога: %v", err)
+	}
+	if err := catalog.ReleaseBlob(ctx, v.SHA256); err != nil {
+		log.Printf("Faststart %s: не удалось освободить исходный файл %s: %v", v.Key, v.BlobKey, err)
+	}
+	v.BlobKey, v.Size, v.SHA256, v.Faststart = blobKey, resSize, sum, true
+	return true, nil
+}
+
+func verifyStoredFaststart(ctx context.Context, key, origKey, filename string, size int64) error {
+	res, err := videoStore.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	if res.Info().Size != size {
+		return fmt.Errorf("размер в хранилище %d, ожидалось %d", res.Info().Size, size)
+	}
+	orig, err := videoStore.Open(ctx, origKey)
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	return verifyFaststart(orig, orig.Info().Size, res, size, filename)
+}
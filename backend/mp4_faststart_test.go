@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// mp4Box собирает блок MP4 из типа и содержимого
+func mp4Box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], typ)
+	return append(box, body...)
+}
+
+// mp4OffsetTable — блок stco или co64 со смещениями offsets
+func mp4OffsetTable(typ string, offsets []uint64) []byte {
+	n := &mp4Node{typ: typ, data: make([]byte, 8)}
+	setChunkOffsets(n, offsets, typ == "co64")
+	var buf bytes.Buffer
+	n.writeTo(&buf)
+	return buf.Bytes()
+}
+
+// mp4Chunks — содержимое mdat из различимых чанков
+func mp4Chunks(name string, n int) [][]byte {
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		chunks[i] = []byte(fmt.Sprintf("%s-chunk-%02d-%s", name, i, bytes.Repeat([]byte{byte('a' + i)}, 5+i)))
+	}
+	return chunks
+}
+
+// mp4Moov — moov с одной дорожкой, таблицей смещений typ и служебными блоками вокруг неё
+func mp4Moov(typ string, offsets []uint64) []byte {
+	stbl := mp4Box("stbl",
+		mp4Box("stsd", []byte("sample description")),
+		mp4Box("stsz", []byte("sample sizes")),
+		mp4OffsetTable(typ, offsets),
+	)
+	trak := mp4Box("trak", mp4Box("tkhd", []byte("track header")), mp4Box("mdia", mp4Box("minf", stbl)))
+	return mp4Box("moov", mp4Box("mvhd", []byte("movie header")), trak)
+}
+
+// synthMP4 собирает файл из блоков layout: "ftyp", "free", "mdat1", "mdat2" и
+// "moov". Чанки лежат в mdat1 и mdat2; смещения в moov указывают на них.
+func synthMP4(t *testing.T, typ string, layout ...string) (file []byte, chunks [][]byte, offsets []uint64) {
+	t.Helper()
+	mdats := map[string][][]byte{"mdat1": mp4Chunks("first", 4), "mdat2": mp4Chunks("second", 3)}
+	// moov не меняет размер от значений смещений, поэтому сначала считаем позиции
+	// с нулевыми смещениями, а затем собираем файл заново
+	build := func(offs []uint64) ([]byte, []uint64, [][]byte) {
+		var buf bytes.Buffer
+		var found []uint64
+		var all [][]byte
+		for _, name := range layout {
+			switch name {
+			case "ftyp":
+				buf.Write(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41")))
+			case "free":
+				buf.Write(mp4Box("free", []byte("padding")))
+			case "moov":
+				buf.Write(mp4Moov(typ, offs))
+			default:
+				pos := uint64(buf.Len() + 8)
+				for _, c := range mdats[name] {
+					found = append(found, pos)
+					all = append(all, c)
+					pos += uint64(len(c))
+				}
+				buf.Write(mp4Box("mdat", mdats[name]...))
+			}
+		}
+		return buf.Bytes(), found, all
+	}
+	var count int
+	for _, name := range layout {
+		count += len(mdats[name])
+	}
+	_, offsets, _ = build(make([]uint64, count))
+	file, _, chunks = build(offsets)
+	return file, chunks, offsets
+}
+
+// topBoxes разбивает файл на блоки верхнего уровня
+func topBoxes(t *testing.T, file []byte) []isoBox {
+	t.Helper()
+	r := bytes.NewReader(file)
+	var boxes []isoBox
+	for pos := int64(0); pos < int64(len(file)); {
+		box, err := readISOBox(r, pos, int64(len(file)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		boxes = append(boxes, box)
+		pos = box.end()
+	}
+	return boxes
+}
+
+func TestMP4Faststart(t *testing.T) {
+	cases := []struct {
+		name   string
+		typ    string
+		layout []string
+	}{
+		{"stco", "stco", []string{"ftyp", "mdat1", "moov"}},
+		{"co64", "co64", []string{"ftyp", "mdat1", "moov"}},
+		{"stco, free перед mdat", "stco", []string{"ftyp", "free", "mdat1", "moov"}},
+		{"stco, mdat после moov", "stco", []string{"ftyp", "mdat1", "moov", "mdat2"}},
+		{"co64, mdat после moov", "co64", []string{"ftyp", "mdat1", "moov", "mdat2"}},
+		{"без ftyp", "stco", []string{"mdat1", "moov"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			orig, chunks, origOffsets := synthMP4(t, c.typ, c.layout...)
+
+			var out bytes.Buffer
+			changed, err := mp4Faststart(bytes.NewReader(orig), int64(len(orig)), &out)
+			if err != nil || !changed {
+				t.Fatalf("mp4Faststart = %v, %v", changed, err)
+			}
+			res := out.Bytes()
+			if len(res) != len(orig) {
+				t.Fatalf("размер %d, было %d", len(res), len(orig))
+			}
+
+			// Блоки те же и побайтно совпадают, moov стоит перед первым mdat
+			origBoxes, resBoxes := topBoxes(t, orig), topBoxes(t, res)
+			var want []isoBox
+			var origMoov isoBox
+			for _, b := range origBoxes {
+				if b.Type == "moov" {
+					origMoov = b
+				}
+			}
+			inserted := false
+			for _, b := range origBoxes {
+				if b.Type == "mdat" && !inserted {
+					want, inserted = append(want, origMoov), true
+				}
+				if b.Type != "moov" {
+					want = append(want, b)
+				}
+			}
+			if len(resBoxes) != len(origBoxes) {
+				t.Fatalf("блоков %d, было %d", len(resBoxes), len(origBoxes))
+			}
+			var resMoov isoBox
+			for i, b := range resBoxes {
+				if b.Type != want[i].Type {
+					t.Fatalf("блок %d: %s, want %s", i, b.Type, want[i].Type)
+				}
+				if b.Type == "moov" {
+					resMoov = b
+					continue
+				}
+				if !bytes.Equal(res[b.Pos:b.end()], orig[want[i].Pos:want[i].end()]) {
+					t.Fatalf("блок %d (%s) изменился", i, b.Type)
+				}
+			}
+
+			// Смещения указывают на те же байты чанков
+			resTables, err := mp4ChunkOffsets(bytes.NewReader(res), int64(len(res)))
+			if err != nil || len(resTables) != 1 || len(resTables[0]) != len(chunks) {
+				t.Fatalf("таблицы смещений %v, %v", resTables, err)
+			}
+			for i, off := range resTables[0] {
+				if got := res[off : off+uint64(len(chunks[i]))]; !bytes.Equal(got, chunks[i]) {
+					t.Fatalf("чанк %d по смещению %d: %q, want %q", i, off, got, chunks[i])
+				}
+			}
+
+			// В moov изменились только смещения: с исходными он совпадает побайтно
+			nodes, err := parseMP4Nodes(res[resMoov.Pos:resMoov.end()])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tables := chunkOffsetTables(nodes)
+			if len(tables) != 1 || tables[0].typ != c.typ {
+				t.Fatalf("таблица смещений %v", tables)
+			}
+			setChunkOffsets(tables[0], origOffsets, tables[0].typ == "co64")
+			var moov bytes.Buffer
+			nodes[0].writeTo(&moov)
+			if !bytes.Equal(moov.Bytes(), orig[origMoov.Pos:origMoov.end()]) {
+				t.Fatal("moov отличается не только смещениями чанков")
+			}
+
+			// Повторный перенос не нужен
+			changed, err = mp4Faststart(bytes.NewReader(res), int64(len(res)), &out)
+			if err != nil || changed {
+				t.Fatalf("повторный mp4Faststart = %v, %v", changed, err)
+			}
+		})
+	}
+}
+
+func TestMP4FaststartSkips(t *testing.T) {
+	moovFirst, _, _ := synthMP4(t, "stco", "ftyp", "moov", "mdat1")
+	noMdat := bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Moov("stco", nil)}, nil)
+	fragmented := bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Box("moof"), mp4Box("mdat"), mp4Moov("stco", nil)}, nil)
+
+	var out bytes.Buffer
+	if changed, err := mp4Faststart(bytes.NewReader(moovFirst), int64(len(moovFirst)), &out); err != nil || changed || out.Len() != 0 {
+		t.Fatalf("moov уже в начале: %v, %v, записано %d", changed, err, out.Len())
+	}
+	for name, file := range map[string][]byte{"без mdat": noMdat, "фрагментированный": fragmented} {
+		if _, err := mp4Faststart(bytes.NewReader(file), int64(len(file)), &out); err != errNotMP4Faststart {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// Смещение за пределами таблицы stco — ошибка, а не паника
+	broken, _, _ := synthMP4(t, "stco", "ftyp", "mdat1", "moov")
+	idx := bytes.Index(broken, []byte("stco")) + 8
+	binary.BigEndian.PutUint32(broken[idx:], 1000)
+	if _, err := mp4Faststart(bytes.NewReader(broken), int64(len(broken)), &out); err == nil {
+		t.Fatal("испорченная таблица stco принята")
+	}
+}
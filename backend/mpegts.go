@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Мультиплексор MPEG-TS (ISO/IEC 13818-1) для сегментов HLS: одна программа,
+// видео H.264 и необязательное аудио AAC в ADTS. Время — в тиках 90 кГц.
+
+const (
+	tsPacketSize = 188
+
+	tsPIDPAT   = 0x0000
+	tsPIDPMT   = 0x1000
+	tsPIDVideo = 0x0100
+	tsPIDAudio = 0x0101
+
+	tsStreamTypeH264 = 0x1B
+	tsStreamTypeAAC  = 0x0F
+
+	tsStreamIDVideo = 0xE0
+	tsStreamIDAudio = 0xC0
+)
+
+// tsMuxer пишет пакеты и ведёт счётчики непрерывности по PID.
+// Счётчики продолжаются между сегментами одного потока.
+type tsMuxer struct {
+	audio bool
+	cc    map[uint16]byte
+	pkt   [tsPacketSize]byte
+}
+
+func newTSMuxer(audio bool) *tsMuxer {
+	return &tsMuxer{audio: audio, cc: make(map[uint16]byte)}
+}
+
+// writeTables пишет PAT и PMT; ими начинается каждый сегмент
+func (m *tsMuxer) writeTables(w io.Writer) error {
+	pat := []byte{
+		0x00,       // table_id
+		0xB0, 0x0D, // section_length
+		0x00, 0x01, // transport_stream_id
+		0xC1, 0x00, 0x00,
+		0x00, 0x01, // program_number
+		0xE0 | tsPIDPMT>>8, tsPIDPMT & 0xFF,
+	}
+	if err := m.writeSection(w, tsPIDPAT, pat); err != nil {
+		return err
+	}
+
+	streams := []byte{tsStreamTypeH264, 0xE0 | tsPIDVideo>>8, tsPIDVideo & 0xFF, 0xF0, 0x00}
+	if m.audio {
+		streams = append(streams, tsStreamTypeAAC, 0xE0|tsPIDAudio>>8, tsPIDAudio&0xFF, 0xF0, 0x00)
+	}
+	length := 9 + len(streams) + 4
+	pmt := []byte{
+		0x02, // table_id
+		0xB0 | byte(length>>8), byte(length),
+		0x00, 0x01, // program_number
+		0xC1, 0x00, 0x00,
+		0xE0 | tsPIDVideo>>8, tsPIDVideo & 0xFF, // PCR_PID
+		0xF0, 0x00, // program_info_length
+	}
+	return m.writeSection(w, tsPIDPMT, append(pmt, streams...))
+}
+
+func (m *tsMuxer) writeSection(w io.Writer, pid uint16, section []byte) error {
+	p := m.pkt[:]
+	m.header(p, pid, true, false)
+	p[4] = 0 // pointer_field
+	n := 5 + copy(p[5:], section)
+	binary.BigEndian.PutUint32(p[n:], crc32MPEG(section))
+	for i := n + 4; i < tsPacketSize; i++ {
+		p[i] = 0xFF
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+func (m *tsMuxer) header(p []byte, pid uint16, start, adaptation bool) {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0F
+	p[0] = 0x47
+	p[1] = byte(pid>>8) & 0x1F
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	p[3] = 0x10 | cc
+	if adaptation {
+		p[3] |= 0x20
+	}
+}
+
+// writePES пишет кадр в пакетах PES. pcr — база PCR в тиках 90 кГц, pcr < 0 — без PCR;
+// при dts == pts DTS не пишется.
+// key отмечает точку произвольного доступа.
+func (m *tsMuxer) writePES(w io.Writer, pid uint16, streamID byte, pts, dts, pcr int64, key bool, data []byte) error {
+	hdr := []byte{0x00, 0x00, 0x01, streamID, 0, 0, 0x80, 0x80, 5}
+	hdr = appendTSTimestamp(hdr, 0x2, pts)
+	if dts != pts {
+		hdr[7], hdr[8] = 0xC0, 10
+		hdr[len(hdr)-5] = hdr[len(hdr)-5]&0x0F | 0x30
+		hdr = appendTSTimestamp(hdr, 0x1, dts)
+	}
+	// Для видео длина PES может быть 0 (не ограничена)
+	if pesLen := len(hdr) - 6 + len(data); streamID != tsStreamIDVideo && pesLen <= 0xFFFF {
+		binary.BigEndian.PutUint16(hdr[4:6], uint16(pesLen))
+	}
+	payload := append(hdr, data...)
+
+	p := m.pkt[:]
+	for first := true; len(payload) > 0; first = false {
+		var af []byte
+		if first && (pcr >= 0 || key) {
+			af = []byte{1, 0}
+			if key {
+				af[1] |= 0x40 // random_access_indicator
+			}
+			if pcr >= 0 {
+				af[1] |= 0x10
+				base := pcr & (1<<33 - 1)
+				af = append(af, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7E, 0)
+			}
+			af[0] = byte(len(af) - 1)
+		}
+		// Последний пакет добиваем байтами заполнения в поле адаптации
+		if space := tsPacketSize - 4 - len(af); len(payload) < space {
+			stuff := space - len(payload)
+			if af == nil {
+				af = []byte{0}
+				if stuff > 1 {
+					af = append(af, 0)
+				}
+				stuff -= len(af)
+			}
+			for ; stuff > 0; stuff-- {
+				af = append(af, 0xFF)
+			}
+			af[0] = byte(len(af) - 1)
+		}
+
+		m.header(p, pid, first, af != nil)
+		n := 4 + copy(p[4:], af)
+		payload = payload[copy(p[n:], payload):]
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTSTimestamp кодирует PTS или DTS (33 бита) в 5 байт
+func appendTSTimestamp(b []byte, prefix byte, ts int64) []byte {
+	ts &= 1<<33 - 1
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0E|1,
+		byte(ts>>22),
+		byte(ts>>14)|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+var crc32MPEGTable = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// crc32MPEG — CRC-32/MPEG-2 для таблиц PSI
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^v]
+	}
+	return crc
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tsPES — разобранный пакет PES
+type tsPES struct {
+	pid      uint16
+	streamID byte
+	length   int // поле PES_packet_length
+	pts, dts int64
+	hasDTS   bool
+	pcr      int64 // -1 — без PCR
+	key      bool  // random_access_indicator
+	data     []byte
+}
+
+// tsDemux — разбор потока MPEG-TS для проверок: PAT, PMT и PES по PID
+type tsDemux struct {
+	t       *testing.T
+	cc      map[uint16]byte
+	pmtPID  uint16
+	streams map[uint16]byte // PID → stream_type из PMT
+	tables  []uint16        // PID таблиц в порядке появления
+	pes     []*tsPES
+	open    map[uint16]*tsPES
+}
+
+func newTSDemux(t *testing.T) *tsDemux {
+	return &tsDemux{t: t, cc: make(map[uint16]byte), open: make(map[uint16]*tsPES)}
+}
+
+// feed разбирает очередной кусок потока (например, сегмент)
+func (d *tsDemux) feed(data []byte) {
+	t := d.t
+	t.Helper()
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("длина потока %d не кратна %d", len(data), tsPacketSize)
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		p := data[i : i+tsPacketSize]
+		if p[0] != 0x47 {
+			t.Fatalf("пакет %d: байт синхронизации %#x", i/tsPacketSize, p[0])
+		}
+		pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+		start := p[1]&0x40 != 0
+		if p[3]&0x10 == 0 {
+			t.Fatalf("пакет %d без полезной нагрузки", i/tsPacketSize)
+		}
+		cc := p[3] & 0x0F
+		if prev, ok := d.cc[pid]; ok && cc != (prev+1)&0x0F {
+			t.Fatalf("PID %#x: счётчик непрерывности %d после %d", pid, cc, prev)
+		}
+		d.cc[pid] = cc
+
+		payload := p[4:]
+		pcr, key := int64(-1), false
+		if p[3]&0x20 != 0 {
+			afLen := int(p[4])
+			if afLen > 0 {
+				flags := p[5]
+				key = flags&0x40 != 0
+				if flags&0x10 != 0 {
+					b := p[6:12]
+					pcr = int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4]>>7)
+				}
+			}
+			payload = p[5+afLen:]
+		}
+
+		switch {
+		case pid == tsPIDPAT || (d.pmtPID != 0 && pid == d.pmtPID):
+			if !start || payload[0] != 0 {
+				t.Fatalf("PID %#x: таблица не с начала пакета", pid)
+			}
+			d.section(pid, payload[1:])
+		case start:
+			pes := &tsPES{pid: pid, pcr: pcr, key: key}
+			d.pes = append(d.pes, pes)
+			d.open[pid] = pes
+			pes.data = append(pes.data, payload...)
+		default:
+			pes := d.open[pid]
+			if pes == nil {
+				t.Fatalf("PID %#x: продолжение PES без начала", pid)
+			}
+			pes.data = append(pes.data, payload...)
+		}
+	}
+}
+
+func (d *tsDemux) section(pid uint16, b []byte) {
+	t := d.t
+	t.Helper()
+	length := int(b[1]&0x0F)<<8 | int(b[2])
+	section := b[:3+length]
+	body, crc := section[:len(section)-4], binary.BigEndian.Uint32(section[len(section)-4:])
+	if got := crc32MPEG(body); got != crc {
+		t.Fatalf("PID %#x: CRC %#08x, в таблице %#08x", pid, got, crc)
+	}
+	if crc32MPEG(section) != 0 {
+		t.Fatalf("PID %#x: остаток CRC по таблице с CRC не нулевой", pid)
+	}
+	for _, v := range b[3+length:] {
+		if v != 0xFF {
+			t.Fatalf("PID %#x: после таблицы не байты заполнения", pid)
+		}
+	}
+	d.tables = append(d.tables, pid)
+
+	switch b[0] {
+	case 0x00: // PAT: одна программа
+		d.pmtPID = uint16(body[10]&0x1F)<<8 | uint16(body[11])
+	case 0x02: // PMT
+		pcrPID := uint16(body[8]&0x1F)<<8 | uint16(body[9])
+		if pcrPID != tsPIDVideo {
+			t.Fatalf("PCR_PID %#x", pcrPID)
+		}
+		infoLen := int(body[10]&0x0F)<<8 | int(body[11])
+		d.streams = make(map[uint16]byte)
+		for es := body[12+infoLen:]; len(es) > 0; es = es[5:] {
+			d.streams[uint16(es[1]&0x1F)<<8|uint16(es[2])] = es[0]
+		}
+	default:
+		t.Fatalf("неизвестная таблица %#x", b[0])
+	}
+}
+
+// finish разбирает заголовки собранных PES
+func (d *tsDemux) finish() []*tsPES {
+	t := d.t
+	t.Helper()
+	for _, pes := range d.pes {
+		b := pes.data
+		if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+			t.Fatalf("PID %#x: нет префикса PES", pes.pid)
+		}
+		pes.streamID = b[3]
+		pes.length = int(binary.BigEndian.Uint16(b[4:6]))
+		flags, hdrLen := b[7]>>6, int(b[8])
+		switch flags {
+		case 2:
+			pes.pts = decodeTSTimestamp(t, b[9:14], 0x2)
+			pes.dts = pes.pts
+		case 3:
+			pes.pts = decodeTSTimestamp(t, b[9:14], 0x3)
+			pes.dts = decodeTSTimestamp(t, b[14:19], 0x1)
+			pes.hasDTS = true
+		default:
+			t.Fatalf("PES без PTS: флаги %d", flags)
+		}
+		if pes.length != 0 && pes.length != len(b)-6 {
+			t.Fatalf("PES_packet_length %d, данных %d", pes.length, len(b)-6)
+		}
+		pes.data = b[9+hdrLen:]
+	}
+	return d.pes
+}
+
+// decodeTSTimestamp разбирает 5 байт PTS/DTS и проверяет префикс и маркерные биты
+func decodeTSTimestamp(t *testing.T, b []byte, prefix byte) int64 {
+	t.Helper()
+	if b[0]>>4 != prefix || b[0]&1 != 1 || b[2]&1 != 1 || b[4]&1 != 1 {
+		t.Fatalf("метка времени % x: неверный префикс или маркеры", b)
+	}
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func TestCRC32MPEG(t *testing.T) {
+	// Контрольное значение CRC-32/MPEG-2
+	if got := crc32MPEG([]byte("123456789")); got != 0x0376E6E7 {
+		t.Fatalf("crc32MPEG = %#08x", got)
+	}
+	if got := crc32MPEG(nil); got != 0xFFFFFFFF {
+		t.Fatalf("crc32MPEG(nil) = %#08x", got)
+	}
+}
+
+func TestAppendTSTimestamp(t *testing.T) {
+	for _, ts := range []int64{0, 1, 90000, 1<<30 - 1, 1 << 30, 1<<32 + 12345, 1<<33 - 1} {
+		for _, prefix := range []byte{0x1, 0x2, 0x3} {
+			b := appendTSTimestamp(nil, prefix, ts)
+			if len(b) != 5 {
+				t.Fatalf("%d: %d байт", ts, len(b))
+			}
+			if got := decodeTSTimestamp(t, b, prefix); got != ts {
+				t.Fatalf("%d с префиксом %d: прочитано %d", ts, prefix, got)
+			}
+		}
+	}
+	// Время больше 33 бит переполняется по модулю, как в самом MPEG-TS
+	if got := decodeTSTimestamp(t, appendTSTimestamp(nil, 0x2, 1<<33+7), 0x2); got != 7 {
+		t.Fatalf("переполнение 33 бит: %d", got)
+	}
+}
+
+func TestTSMuxerTables(t *testing.T) {
+	for _, audio := range []bool{false, true} {
+		m := newTSMuxer(audio)
+		var buf bytes.Buffer
+		for i := 0; i < 20; i++ { // счётчики непрерывности проходят через 15
+			if err := m.writeTables(&buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d := newTSDemux(t)
+		d.feed(buf.Bytes())
+		if len(d.tables) != 40 || d.tables[0] != tsPIDPAT || d.tables[1] != tsPIDPMT || d.pmtPID != tsPIDPMT {
+			t.Fatalf("таблицы %v, PMT %#x", d.tables[:2], d.pmtPID)
+		}
+		want := map[uint16]byte{tsPIDVideo: tsStreamTypeH264}
+		if audio {
+			want[tsPIDAudio] = tsStreamTypeAAC
+		}
+		if len(d.streams) != len(want) {
+			t.Fatalf("потоки в PMT %v, want %v", d.streams, want)
+		}
+		for pid, typ := range want {
+			if d.streams[pid] != typ {
+				t.Fatalf("потоки в PMT %v, want %v", d.streams, want)
+			}
+		}
+	}
+}
+
+func TestTSMuxerPES(t *testing.T) {
+	m := newTSMuxer(true)
+	var buf bytes.Buffer
+	frames := []struct {
+		pid      uint16
+		streamID byte
+		pts, dts int64
+		pcr      int64
+		key      bool
+		size     int
+	}{
+		{tsPIDVideo, tsStreamIDVideo, 6000, 3000, 3000, true, 1000},
+		{tsPIDVideo, tsStreamIDVideo, 9000, 6000, 6000, false, 170}, // ровно в один пакет с PCR
+		{tsPIDVideo, tsStreamIDVideo, 12000, 12000, -1, false, 183 - 14},
+		{tsPIDAudio, tsStreamIDAudio, 1920, 1920, -1, false, 1},
+		{tsPIDAudio, tsStreamIDAudio, 3840, 3840, -1, false, 184 - 14}, // полный пакет без поля адаптации
+		{tsPIDAudio, tsStreamIDAudio, 5760, 5760, -1, false, 184 - 14 - 1},
+		{tsPIDAudio, tsStreamIDAudio, 7680, 7680, -1, false, 5000},
+	}
+	for i, f := range frames {
+		data := bytes.Repeat([]byte{byte(i + 1)}, f.size)
+		if err := m.writePES(&buf, f.pid, f.streamID, f.pts, f.dts, f.pcr, f.key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := newTSDemux(t)
+	d.feed(buf.Bytes())
+	pes := d.finish()
+	if len(pes) != len(frames) {
+		t.Fatalf("PES %d, want %d", len(pes), len(frames))
+	}
+	for i, f := range frames {
+		p := pes[i]
+		if p.pid != f.pid || p.streamID != f.streamID || p.pts != f.pts || p.dts != f.dts || p.hasDTS != (f.pts != f.dts) {
+			t.Fatalf("PES %d: PID %#x, поток %#x, PTS %d, DTS %d", i, p.pid, p.streamID, p.pts, p.dts)
+		}
+		if p.pcr != f.pcr || p.key != f.key {
+			t.Fatalf("PES %d: PCR %d, ключевой %v", i, p.pcr, p.key)
+		}
+		if f.streamID == tsStreamIDVideo && p.length != 0 {
+			t.Fatalf("PES %d: у видео длина %d, want 0", i, p.length)
+		}
+		if !bytes.Equal(p.data, bytes.Repeat([]byte{byte(i + 1)}, f.size)) {
+			t.Fatalf("PES %d: данные не совпадают (%d байт, want %d)", i, len(p.data), f.size)
+		}
+	}
+}
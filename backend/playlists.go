@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Плейлисты — упорядоченные подборки видео (например, учебные курсы). Видео
+// из корзины остаются в плейлисте, но не показываются и не экспортируются,
+// а при окончательном удалении видео пропадает из плейлистов каскадно.
+//
+//	GET    /api/playlists                        — плейлисты
+//	POST   /api/playlists                        — {"name", "description"}: создать плейлист
+//	GET    /api/playlists/{id}                   — плейлист с видео по порядку
+//	PATCH  /api/playlists/{id}                   — {"name", "description", "cover_video_id"}, любые поля
+//	DELETE /api/playlists/{id}                   — удалить плейлист (сами видео не удаляются)
+//	POST   /api/playlists/{id}/videos            — {"video_id", "position"}: добавить видео
+//	PUT    /api/playlists/{id}/videos            — {"video_ids": [...]}: задать порядок видео
+//	DELETE /api/playlists/{id}/videos/{video_id} — убрать видео из плейлиста
+//	GET    /api/playlists/{id}/playlist.m3u8     — экспорт со ссылками на /api/video/
+
+const (
+	maxPlaylistNameLength = 255
+	maxPlaylistVideos     = 1000
+)
+
+var (
+	errPlaylistNotFound     = errors.New("плейлист не найден")
+	errPlaylistVideoExists  = errors.New("видео уже есть в плейлисте")
+	errPlaylistVideoMissing = errors.New("видео нет в плейлисте")
+	errPlaylistFull         = fmt.Errorf("в плейлисте не может быть больше %d видео", maxPlaylistVideos)
+	errPlaylistOrder        = errors.New("неверный порядок видео")
+)
+
+// playlist — плейлист со счётчиками видео, которые в нём видны
+type playlist struct {
+	ID           int64
+	Name         string
+	Description  string
+	CoverVideoID int64 // 0 — обложка не выбрана, используется первое видео
+	CreatedBy    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Videos       int
+	Duration     float64
+}
+
+// toJSON — плейлист без списка видео для ответов API
+func (p *playlist) toJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"id":             p.ID,
+		"name":           p.Name,
+		"description":    p.Description,
+		"cover_video_id": p.CoverVideoID,
+		"created_by":     p.CreatedBy,
+		"created_at":     p.CreatedAt.Format("2006-01-02 15:04:05"),
+		"updated_at":     p.UpdatedAt.Format("2006-01-02 15:04:05"),
+		"videos":         p.Videos,
+		"duration":       p.Duration,
+		"m3u8_url":       fmt.Sprintf("/api/playlists/%d/playlist.m3u8", p.ID),
+	}
+}
+
+// Счётчики считаются только по видимым видео: ready и missing
+const playlistColumns = `p.id, p.name, p.description, p.cover_video_id, p.created_by, p.created_at, p.updated_at,
+	COUNT(v.id), COALESCE(SUM(v.duration), 0)
+	FROM playlists p
+	LEFT JOIN playlist_items i ON i.playlist_id = p.id
+	LEFT JOIN videos v ON v.id = i.video_id AND v.status IN (?, ?, ?)`
+
+func scanPlaylist(row rowScanner) (*playlist, error) {
+	var p playlist
+	var cover sql.NullInt64
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &cover, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt, &p.Videos, &p.Duration)
+	if err == sql.ErrNoRows {
+		return nil, errPlaylistNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.CoverVideoID = cover.Int64
+	return &p, nil
+}
+
+// ListPlaylists возвращает плейлисты по названию
+func (c *videoCatalog) ListPlaylists(ctx context.Context) ([]*playlist, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+playlistColumns+" GROUP BY p.id ORDER BY p.name, p.id",
+		videoStatusReady, videoStatusMissing, videoStatusCorrupted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*playlist{}
+	for rows.Next() {
+		p, err := scanPlaylist(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// GetPlaylist ищет плейлист по идентификатору
+func (c *videoCatalog) GetPlaylist(ctx context.Context, id int64) (*playlist, error) {
+	return scanPlaylist(c.db.QueryRowContext(ctx, "SELECT "+playlistColumns+" WHERE p.id = ? GROUP BY p.id",
+		videoStatusReady, videoStatusMissing, videoStatusCorrupted, id))
+}
+
+// CreatePlaylist добавляет плейлист и заполняет p.ID
+func (c *videoCatalog) CreatePlaylist(ctx context.Context, p *playlist) error {
+	res, err := c.db.ExecContext(ctx, "INSERT INTO playlists (name, description, created_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		p.Name, p.Description, p.CreatedBy, p.CreatedAt, p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	p.ID, err = res.LastInsertId()
+	return err
+}
+
+// UpdatePlaylist сохраняет название, описание и обложку плейлиста
+func (c *videoCatalog) UpdatePlaylist(ctx context.Context, p *playlist) error {
+	cover := sql.NullInt64{Int64: p.CoverVideoID, Valid: p.CoverVideoID != 0}
+	_, err := c.db.ExecContext(ctx, "UPDATE playlists SET name = ?, description = ?, cover_video_id = ?, updated_at = ? WHERE id = ?",
+		p.Name, p.Description, cover, p.UpdatedAt, p.ID)
+	return err
+}
+
+// DeletePlaylist удаляет плейлист; его элементы удаляются каскадно
+func (c *videoCatalog) DeletePlaylist(ctx context.Context, id int64) error {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM playlists WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errPlaylistNotFound
+	}
+	return nil
+}
+
+// PlaylistVideos возвращает видимые видео плейлиста по порядку.
+// В playlist_items нет столбцов с именами из videoColumns, поэтому они не уточняются.
+func (c *videoCatalog) PlaylistVideos(ctx context.Context, id int64) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+` FROM playlist_items i JOIN videos ON videos.id = i.video_id
+		WHERE i.playlist_id = ? AND videos.status IN (?, ?, ?) ORDER BY i.position`,
+		id, videoStatusReady, videoStatusMissing, videoStatusCorrupted)
+}
+
+// editPlaylistOrder блокирует плейлист, передаёт edit текущий порядок всех его
+// видео (включая видео из корзины) и сохраняет порядок, который вернёт edit.
+// Добавить или удалить строки playlist_items должен сам edit.
+func (c *videoCatalog) editPlaylistOrder(ctx context.Context, id int64, edit func(tx *sql.Tx, order []int64) ([]int64, error)) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM playlists WHERE id = ? FOR UPDATE", id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return errPlaylistNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT video_id, position FROM playlist_items WHERE playlist_id = ? ORDER BY position", id)
+	if err != nil {
+		return err
+	}
+	var order []int64
+	positions := make(map[int64]int)
+	for rows.Next() {
+		var videoID int64
+		var pos int
+		if err := rows.Scan(&videoID, &pos); err != nil {
+			rows.Close()
+			return err
+		}
+		order = append(order, videoID)
+		positions[videoID] = pos
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	order, err = edit(tx, order)
+	if err != nil {
+		return err
+	}
+	for i, videoID := range order {
+		if pos, ok := positions[videoID]; ok && pos == i {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE playlist_items SET position = ? WHERE playlist_id = ? AND video_id = ?",
+			i, id, videoID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE playlists SET updated_at = ? WHERE id = ?", time.Now(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddPlaylistVideo вставляет видео в плейлист на место position (< 0 — в конец)
+func (c *videoCatalog) AddPlaylistVideo(ctx context.Context, id, videoID int64, position int, by string) error {
+	return c.editPlaylistOrder(ctx, id, func(tx *sql.Tx, order []int64) ([]int64, error) {
+		if indexOfID(order, videoID) >= 0 {
+			return nil, errPlaylistVideoExists
+		}
+		if len(order) >= maxPlaylistVideos {
+			return nil, errPlaylistFull
+		}
+		if position < 0 || position > len(order) {
+			position = len(order)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO playlist_items (playlist_id, video_id, position, added_by, added_at) VALUES (?, ?, ?, ?, ?)",
+			id, videoID, len(order), by, time.Now()); err != nil {
+			return nil, err
+		}
+		order = append(order, 0)
+		copy(order[position+1:], order[position:])
+		order[position] = videoID
+		return order, nil
+	})
+}
+
+// RemovePlaylistVideo убирает видео из плейлиста; если оно было обложкой, обложка сбрасывается
+func (c *videoCatalog) RemovePlaylistVideo(ctx context.Context, id, videoID int64) error {
+	return c.editPlaylistOrder(ctx, id, func(tx *sql.Tx, order []int64) ([]int64, error) {
+		i := indexOfID(order, videoID)
+		if i < 0 {
+			return nil, errPlaylistVideoMissing
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM playlist_items WHERE playlist_id = ? AND video_id = ?", id, videoID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE playlists SET cover_video_id = NULL WHERE id = ? AND cover_video_id = ?", id, videoID); err != nil {
+			return nil, err
+		}
+		return append(order[:i], order[i+1:]...), nil
+	})
+}
+
+// ReorderPlaylist задаёт порядок видимых видео плейлиста. ids должен содержать
+// каждое видимое видео ровно один раз; видео из корзины ставятся после них.
+func (c *videoCatalog) ReorderPlaylist(ctx context.Context, id int64, ids []int64) error {
+	return c.editPlaylistOrder(ctx, id, func(tx *sql.Tx, order []int64) ([]int64, error) {
+		rows, err := tx.QueryContext(ctx, `SELECT i.video_id FROM playlist_items i JOIN videos v ON v.id = i.video_id
+			WHERE i.playlist_id = ? AND v.status IN (?, ?, ?)`,
+			id, videoStatusReady, videoStatusMissing, videoStatusCorrupted)
+		if err != nil {
+			return nil, err
+		}
+		visible := make(map[int64]bool)
+		for rows.Next() {
+			var videoID int64
+			if err := rows.Scan(&videoID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			visible[videoID] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if len(ids) != len(visible) {
+			return nil, errPlaylistOrder
+		}
+		seen := make(map[int64]bool, len(ids))
+		for _, videoID := range ids {
+			if !visible[videoID] || seen[videoID] {
+				return nil, errPlaylistOrder
+			}
+			seen[videoID] = true
+		}
+		reordered := append([]int64{}, ids...)
+		for _, videoID := range order {
+			if !visible[videoID] {
+				reordered = append(reordered, videoID)
+			}
+		}
+		return reordered, nil
+	})
+}
+
+func indexOfID(ids []int64, id int64) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// cleanPlaylistName проверяет название плейлиста
+func cleanPlaylistName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxPlaylistNameLength || hasControlChars(name) {
+		return "", fmt.Errorf("название плейлиста должно быть от 1 до %d символов", maxPlaylistNameLength)
+	}
+	return name, nil
+}
+
+// playlistCover — обложка плейлиста: выбранное видео или первое доступное
+func playlistCover(p *playlist, videos []*Video) *Video {
+	for _, v := range videos {
+		if v.ID == p.CoverVideoID {
+			return v
+		}
+	}
+	for _, v := range videos {
+		if v.Status == videoStatusReady {
+			return v
+		}
+	}
+	return nil
+}
+
+// playlistDetailJSON — плейлист со списком видео для ответа на запрос r
+func playlistDetailJSON(r *http.Request, p *playlist, videos []*Video) map[string]interface{} {
+	m := p.toJSON()
+	items := []map[string]interface{}{}
+	for i, v := range videos {
+		item := videoJSON(r, v)
+		item["position"] = i
+		items = append(items, item)
+	}
+	m["items"] = items
+	m["cover"] = nil
+	if cover := playlistCover(p, videos); cover != nil {
+		m["cover"] = videoJSON(r, cover)
+	}
+	return m
+}
+
+// loadPlaylist читает плейлист с видео и метками видео
+func loadPlaylist(ctx context.Context, id int64) (*playlist, []*Video, error) {
+	p, err := catalog.GetPlaylist(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	videos, err := catalog.PlaylistVideos(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := catalog.LoadTags(ctx, videos); err != nil {
+		return nil, nil, err
+	}
+	return p, videos, nil
+}
+
+// writePlaylistM3U8 пишет плейлист в формате расширенного M3U (UTF-8) со ссылками
+// на отдачу видео для клиента, сделавшего запрос r. В экспорт попадают только
+// доступные видео.
+func writePlaylistM3U8(w io.Writer, r *http.Request, p *playlist, videos []*Video) error {
+	baseURL := requestBaseURL(r)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", m3uText(p.Name))
+	for _, v := range videos {
+		if v.Status != videoStatusReady {
+			continue
+		}
+		duration := -1
+		if v.Duration > 0 {
+			duration = int(math.Round(v.Duration))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n", duration, m3uText(v.Title))
+		fmt.Fprintf(&b, "%s%s\n", baseURL, videoStreamURL(r, v))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// m3uText убирает переводы строк, которые сломали бы разметку M3U
+func m3uText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// requestBaseURL — адрес сервера, на который пришёл запрос (с учётом обратного прокси)
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
+// playlistsHandler — список плейлистов (GET) и создание плейлиста (POST): /api/playlists
+func playlistsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := catalog.ListPlaylists(r.Context())
+		if err != nil {
+			log.Printf("Ошибка чтения плейлистов: %v", err)
+			http.Error(w, "Ошибка чтения плейлистов", http.StatusInternalServerError)
+			return
+		}
+		playlists := []map[string]interface{}{}
+		for _, p := range list {
+			playlists = append(playlists, p.toJSON())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(playlists)
+
+	case http.MethodPost:
+		var input struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&input); err != nil {
+			http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name, err := cleanPlaylistName(input.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		description := strings.TrimSpace(input.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			http.Error(w, fmt.Sprintf("Описание длиннее %d символов", maxDescriptionLength), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		p := &playlist{Name: name, Description: description, CreatedBy: requestIdentity(r), CreatedAt: now, UpdatedAt: now}
+		if err := catalog.CreatePlaylist(r.Context(), p); err != nil {
+			log.Printf("Ошибка создания плейлиста: %v", err)
+			http.Error(w, "Ошибка создания плейлиста", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Создан плейлист %d %q (%s)", p.ID, p.Name, p.CreatedBy)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "success",
+			"message":  "Плейлист создан",
+			"playlist": playlistDetailJSON(r, p, nil),
+		})
+
+	default:
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+	}
+}
+
+// playlistItemHandler — плейлист, его видео и экспорт: /api/playlists/{id}/...
+func playlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	idPart, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/playlists/"), "/")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Некорректный идентификатор плейлиста", http.StatusBadRequest)
+		return
+	}
+
+	var videoID int64
+	if rest, ok := strings.CutPrefix(sub, "videos/"); ok {
+		videoID, err = strconv.ParseInt(rest, 10, 64)
+		if err != nil || videoID <= 0 {
+			http.Error(w, "Некорректный идентификатор видео", http.StatusBadRequest)
+			return
+		}
+		sub = "videos/{id}"
+	}
+
+	var allowed bool
+	switch sub {
+	case "":
+		allowed = r.Method == http.MethodGet || r.Method == http.MethodPatch || r.Method == http.MethodDelete
+	case "videos":
+		allowed = r.Method == http.MethodPost || r.Method == http.MethodPut
+	case "videos/{id}":
+		allowed = r.Method == http.MethodDelete
+	case "playlist.m3u8":
+		allowed = r.Method == http.MethodGet || r.Method == http.MethodHead
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, videos, err := loadPlaylist(r.Context(), id)
+	if errors.Is(err, errPlaylistNotFound) {
+		http.Error(w, "Плейлист не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения плейлиста %d: %v", id, err)
+		http.Error(w, "Ошибка чтения плейлиста", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case sub == "playlist.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": p.Name + ".m3u8"}))
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := writePlaylistM3U8(w, r, p, videos); err != nil {
+			log.Printf("Ошибка отправки плейлиста %d: %v", id, err)
+		}
+
+	case sub == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(playlistDetailJSON(r, p, videos))
+
+	case sub == "" && r.Method == http.MethodPatch:
+		updatePlaylist(w, r, p, videos)
+
+	case sub == "" && r.Method == http.MethodDelete:
+		if err := catalog.DeletePlaylist(r.Context(), id); err != nil && !errors.Is(err, errPlaylistNotFound) {
+			log.Printf("Ошибка удаления плейлиста %d: %v", id, err)
+			http.Error(w, "Ошибка удаления плейлиста", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Плейлист %d %q удалён (%s)", id, p.Name, requestIdentity(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "Плейлист удалён",
+		})
+
+	case sub == "videos" && r.Method == http.MethodPost:
+		addPlaylistVideo(w, r, p)
+
+	case sub == "videos":
+		reorderPlaylist(w, r, p)
+
+	default:
+		err := catalog.RemovePlaylistVideo(r.Context(), id, videoID)
+		if errors.Is(err, errPlaylistVideoMissing) {
+			http.Error(w, "Видео нет в плейлисте", http.StatusNotFound)
+			return
+		}
+		if !writePlaylistChange(w, r, id, err, "Видео убрано из плейлиста") {
+			return
+		}
+		log.Printf("Видео %d убрано из плейлиста %d (%s)", videoID, id, requestIdentity(r))
+	}
+}
+
+// updatePlaylist — переименование, описание и обложка плейлиста (PATCH)
+func updatePlaylist(w http.ResponseWriter, r *http.Request, p *playlist, videos []*Video) {
+	var input struct {
+		Name         *string `json:"name"`
+		Description  *string `json:"description"`
+		CoverVideoID *int64  `json:"cover_video_id"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.Name != nil {
+		name, err := cleanPlaylistName(*input.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Name = name
+	}
+	if input.Description != nil {
+		description := strings.TrimSpace(*input.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			http.Error(w, fmt.Sprintf("Описание длиннее %d символов", maxDescriptionLength), http.StatusBadRequest)
+			return
+		}
+		p.Description = description
+	}
+	if input.CoverVideoID != nil {
+		// 0 сбрасывает обложку; иначе это должно быть видео из плейлиста
+		cover := *input.CoverVideoID
+		if cover != 0 && !containsVideo(videos, cover) {
+			http.Error(w, "Обложкой может быть только видео из плейлиста", http.StatusBadRequest)
+			return
+		}
+		p.CoverVideoID = cover
+	}
+
+	p.UpdatedAt = time.Now()
+	if err := catalog.UpdatePlaylist(r.Context(), p); err != nil {
+		log.Printf("Ошибка изменения плейлиста %d: %v", p.ID, err)
+		http.Error(w, "Ошибка сохранения изменений", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Плейлист %d изменён (%s)", p.ID, requestIdentity(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"message":  "Плейлист изменён",
+		"playlist": playlistDetailJSON(r, p, videos),
+	})
+}
+
+func containsVideo(videos []*Video, id int64) bool {
+	for _, v := range videos {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// addPlaylistVideo — добавление доступного видео в плейлист (POST .../videos)
+func addPlaylistVideo(w http.ResponseWriter, r *http.Request, p *playlist) {
+	var input struct {
+		VideoID  int64 `json:"video_id"`
+		Position *int  `json:"position"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.VideoID <= 0 {
+		http.Error(w, "Не указано видео", http.StatusBadRequest)
+		return
+	}
+	position := -1
+	if input.Position != nil {
+		if *input.Position < 0 {
+			http.Error(w, "Позиция не может быть отрицательной", http.StatusBadRequest)
+			return
+		}
+		position = *input.Position
+	}
+
+	video, err := catalog.GetByID(r.Context(), input.VideoID)
+	if errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusReady) {
+		http.Error(w, "Видео не найдено", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
+
+	err = catalog.AddPlaylistVideo(r.Context(), p.ID, video.ID, position, requestIdentity(r))
+	switch {
+	case errors.Is(err, errPlaylistVideoExists):
+		http.Error(w, "Видео уже есть в плейлисте", http.StatusConflict)
+		return
+	case errors.Is(err, errPlaylistFull):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if !writePlaylistChange(w, r, p.ID, err, "Видео добавлено в плейлист") {
+		return
+	}
+	log.Printf("Видео %s добавлено в плейлист %d (%s)", video.Key, p.ID, requestIdentity(r))
+}
+
+// reorderPlaylist — новый порядок видео плейлиста (PUT .../videos)
+func reorderPlaylist(w http.ResponseWriter, r *http.Request, p *playlist) {
+	var input struct {
+		VideoIDs []int64 `json:"video_ids"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := catalog.ReorderPlaylist(r.Context(), p.ID, input.VideoIDs)
+	if errors.Is(err, errPlaylistOrder) {
+		http.Error(w, "Порядок должен содержать каждое видео плейлиста ровно один раз", http.StatusConflict)
+		return
+	}
+	if !writePlaylistChange(w, r, p.ID, err, "Порядок видео изменён") {
+		return
+	}
+	log.Printf("Изменён порядок видео в плейлисте %d (%s)", p.ID, requestIdentity(r))
+}
+
+// writePlaylistChange отвечает на изменение состава плейлиста: ошибкой, если
+// err != nil, иначе плейлистом в новом виде. Возвращает, удалось ли изменение.
+func writePlaylistChange(w http.ResponseWriter, r *http.Request, id int64, err error, message string) bool {
+	if errors.Is(err, errPlaylistNotFound) {
+		http.Error(w, "Плейлист не найден", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Printf("Ошибка изменения плейлиста %d: %v", id, err)
+		http.Error(w, "Ошибка изменения плейлиста", http.StatusInternalServerError)
+		return false
+	}
+	p, videos, err := loadPlaylist(r.Context(), id)
+	if err != nil {
+		log.Printf("Ошибка чтения плейлиста %d: %v", id, err)
+		http.Error(w, "Ошибка чтения плейлиста", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"message":  message,
+		"playlist": playlistDetailJSON(r, p, videos),
+	})
+	return true
+}
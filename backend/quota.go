@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Квоты библиотеки видео и запас свободного места на диске. Квота библиотеки
+// считает хранимые файлы (одинаковое содержимое — один раз), квота загрузившего —
+// размеры его видео. Свободное место проверяется до загрузки и по ходу записи,
+// чтобы видео не заполнили диск, на котором работает и MySQL.
+
+// errInsufficientStorage — загрузка не помещается в квоту или на диск (507)
+var errInsufficientStorage = errors.New("недостаточно места для видео")
+
+// Причины отказа в storageLimitError.Reason
+const (
+	limitLibraryQuota  = "library_quota"
+	limitUploaderQuota = "uploader_quota"
+	limitFreeSpace     = "free_space"
+)
+
+// storageLimitError описывает, какой предел превышен
+type storageLimitError struct {
+	Reason    string
+	Uploader  string
+	Limit     int64 // квота или минимальный запас места
+	Used      int64 // занято (для free_space — свободно)
+	Requested int64
+}
+
+func (e *storageLimitError) Error() string {
+	switch e.Reason {
+	case limitLibraryQuota:
+		return fmt.Sprintf("превышена квота библиотеки видео: занято %s из %s, загрузка %s",
+			formatMB(e.Used), formatMB(e.Limit), formatMB(e.Requested))
+	case limitUploaderQuota:
+		return fmt.Sprintf("превышена квота пользователя %s: занято %s из %s, загрузка %s",
+			e.Uploader, formatMB(e.Used), formatMB(e.Limit), formatMB(e.Requested))
+	default:
+		msg := fmt.Sprintf("недостаточно свободного места на диске: свободно %s, должно оставаться не меньше %s",
+			formatMB(e.Used), formatMB(e.Limit))
+		if e.Requested > 0 {
+			msg += ", загрузка " + formatMB(e.Requested)
+		}
+		return msg
+	}
+}
+
+func (e *storageLimitError) Is(target error) bool { return target == errInsufficientStorage }
+
+func formatMB(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// uploaderQuota — квота загрузившего: отдельная из VIDEO_UPLOADER_QUOTAS или общая
+func uploaderQuota(uploader string) int64 {
+	for _, entry := range cfg.UploaderQuotas {
+		name, mb, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) != uploader {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(mb), 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Неверная квота в VIDEO_UPLOADER_QUOTAS: %q", entry)
+			break
+		}
+		return n << 20
+	}
+	return cfg.UploaderQuota
+}
+
+// checkUploadQuota — предварительная проверка, что загрузка size байт помещается
+// в квоты (до приёма файла). Окончательно место занимает ReserveUpload.
+func checkUploadQuota(ctx context.Context, uploader string, size int64) error {
+	return quotaCheck(ctx, catalog.db, 0, uploader, size, "")
+}
+
+// queryRower — *sql.DB или *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// quotaCheck проверяет квоты для загрузки size байт без учёта записи exclude
+// (её собственного резерва). sum — хеш содержимого, если уже известен: уже
+// хранимое содержимое не увеличивает занятое библиотекой место.
+func quotaCheck(ctx context.Context, q queryRower, exclude int64, uploader string, size int64, sum string) error {
+	if quota := uploaderQuota(uploader); quota > 0 {
+		var used int64
+		err := q.QueryRowContext(ctx, "SELECT COALESCE(SUM(size), 0) FROM videos WHERE uploader = ? AND id <> ? AND "+uploaderUsageFilter,
+			uploader, exclude).Scan(&used)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения каталога: %v", err)
+		}
+		if used+size > quota {
+			return &storageLimitError{Reason: limitUploaderQuota, Uploader: uploader, Limit: quota, Used: used, Requested: size}
+		}
+	}
+	if cfg.LibraryQuota > 0 {
+		if sum != "" {
+			var n int
+			if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_blobs WHERE sha256 = ?", sum).Scan(&n); err != nil {
+				return fmt.Errorf("ошибка чтения каталога: %v", err)
+			}
+			if n > 0 {
+				return nil
+			}
+		}
+		// Хранимые файлы и резервы идущих загрузок (с запасом: загрузка может
+		// оказаться копией уже хранимого содержимого)
+		var used int64
+		err := q.QueryRowContext(ctx, `SELECT (SELECT COALESCE(SUM(size), 0) FROM video_blobs) +
+			(SELECT COALESCE(SUM(size), 0) FROM videos WHERE status = ? AND id <> ?)`,
+			videoStatusUploading, exclude).Scan(&used)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения каталога: %v", err)
+		}
+		if used+size > cfg.LibraryQuota {
+			return &storageLimitError{Reason: limitLibraryQuota, Limit: cfg.LibraryQuota, Used: used, Requested: size}
+		}
+	}
+	return nil
+}
+
+// ReserveUpload проверяет квоты для принятого файла загрузки v и записывает его
+// размер в запись "uploading", занимая место до FinishUpload. Резервы идут по
+// очереди под блокировкой незавершённых загрузок, поэтому одновременные
+// загрузки видят друг друга и не превышают квоту вместе.
+func (c *videoCatalog) ReserveUpload(ctx context.Context, v *Video, size int64, sum string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pending int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM videos WHERE status = ? FOR UPDATE", videoStatusUploading).Scan(&pending); err != nil {
+		return err
+	}
+	if err := quotaCheck(ctx, tx, v.ID, v.Uploader, size, sum); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE videos SET size = ?, sha256 = ? WHERE id = ? AND status = ?",
+		size, sum, v.ID, videoStatusUploading)
+	if err != nil {
+		return err
+	}
+	// Записи уже нет: загрузка шла дольше UPLOAD_STALE_HOURS и её убрала очистка
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errVideoNotFound
+	}
+	return tx.Commit()
+}
+
+// videoStagingDir — папка, куда пишется загрузка: для S3 это временные файлы в системной папке
+func videoStagingDir() string {
+	if cfg.StorageBackend == "s3" {
+		return os.TempDir()
+	}
+	return cfg.VideoDir
+}
+
+// checkFreeSpace проверяет, что после записи need байт в dir на диске останется
+// MIN_FREE_SPACE_MB. Если место узнать не удалось, загрузка не блокируется.
+func checkFreeSpace(dir string, need int64) error {
+	if cfg.MinFreeSpace <= 0 {
+		return nil
+	}
+	free, err := diskFree(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Не удалось узнать свободное место в %s: %v", dir, err)
+		return nil
+	}
+	if free-need < cfg.MinFreeSpace {
+		return &storageLimitError{Reason: limitFreeSpace, Limit: cfg.MinFreeSpace, Used: free, Requested: need}
+	}
+	return nil
+}
+
+// checkUploadLimits — проверка перед приёмом файла известного (или оценочного) размера
+func checkUploadLimits(ctx context.Context, uploader, dir string, size int64) error {
+	if err := checkUploadQuota(ctx, uploader, size); err != nil {
+		return err
+	}
+	return checkFreeSpace(dir, size)
+}
+
+// spaceCheckInterval — как часто по ходу загрузки проверяется свободное место
+const spaceCheckInterval = 16 << 20
+
+// spaceGuardReader прерывает загрузку, если на диске с dir кончается место
+type spaceGuardReader struct {
+	r    io.Reader
+	dir  string
+	n    int64
+	next int64
+}
+
+func newSpaceGuardReader(r io.Reader, dir string) *spaceGuardReader {
+	return &spaceGuardReader{r: r, dir: dir}
+}
+
+func (g *spaceGuardReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	g.n += int64(n)
+	if g.n >= g.next {
+		g.next = g.n + spaceCheckInterval
+		if spaceErr := checkFreeSpace(g.dir, 0); spaceErr != nil {
+			return n, spaceErr
+		}
+	}
+	return n, err
+}
+
+// writeStorageLimitError отвечает 507 с описанием превышенного предела
+func writeStorageLimitError(w http.ResponseWriter, err error) {
+	body := map[string]interface{}{
+		"status":  "error",
+		"message": err.Error(),
+	}
+	var limitErr *storageLimitError
+	if errors.As(err, &limitErr) {
+		body["message"] = limitErr.Error()
+		body["reason"] = limitErr.Reason
+		body["limit"] = limitErr.Limit
+		body["requested"] = limitErr.Requested
+		if limitErr.Reason == limitFreeSpace {
+			body["free"] = limitErr.Used
+		} else {
+			body["used"] = limitErr.Used
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	json.NewEncoder(w).Encode(body)
+}
+
+// StoredBytes — размер всех хранимых файлов видео
+func (c *videoCatalog) StoredBytes(ctx context.Context) (int64, error) {
+	var n int64
+	err := c.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(size), 0) FROM video_blobs").Scan(&n)
+	return n, err
+}
+
+// BlobStored сообщает, хранится ли уже содержимое с хешем sum
+func (c *videoCatalog) BlobStored(ctx context.Context, sum string) (bool, error) {
+	var n int
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_blobs WHERE sha256 = ?", sum).Scan(&n)
+	return n > 0, err
+}
+
+// uploaderUsageFilter — какие видео занимают место загрузившего: все, кроме
+// незавершённых загрузок без резерва (размер принятого файла записывает
+// ReserveUpload). Видео в корзине учитываются, пока их не удалят окончательно.
+// Одно условие для проверки квоты и для /api/videos/usage.
+const uploaderUsageFilter = "(status <> '" + videoStatusUploading + "' OR size > 0)"
+
+// uploaderUsage — занятое одним загрузившим
+type uploaderUsage struct {
+	Uploader string
+	Videos   int
+	Bytes    int64
+}
+
+// UsageByUploader возвращает занятое место по загрузившим, начиная с наибольшего
+func (c *videoCatalog) UsageByUploader(ctx context.Context) ([]uploaderUsage, error) {
+	// Идущие загрузки занимают место, но видео ещё не считаются
+	rows, err := c.db.QueryContext(ctx, `SELECT uploader, COALESCE(SUM(status <> ?), 0), COALESCE(SUM(size), 0) FROM videos
+		WHERE `+uploaderUsageFilter+` GROUP BY uploader ORDER BY 3 DESC, uploader`, videoStatusUploading)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []uploaderUsage
+	for rows.Next() {
+		var u uploaderUsage
+		if err := rows.Scan(&u.Uploader, &u.Videos, &u.Bytes); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+// videoUsageHandler отдаёт занятое место, квоты и свободное место на диске
+// (GET /api/videos/usage)
+func videoUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	stored, err := catalog.StoredBytes(ctx)
+	if err != nil {
+		log.Printf("Ошибка чтения каталога видео: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
+	byUploader, err := catalog.UsageByUploader(ctx)
+	if err != nil {
+		log.Printf("Ошибка чтения каталога видео: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
+
+	me := requestIdentity(r)
+	var myBytes, totalBytes int64
+	var myVideos, totalVideos int
+	uploaders := []map[string]interface{}{}
+	for _, u := range byUploader {
+		totalBytes += u.Bytes
+		totalVideos += u.Videos
+		if u.Uploader == me {
+			myBytes, myVideos = u.Bytes, u.Videos
+		}
+		uploaders = append(uploaders, map[string]interface{}{
+			"uploader": u.Uploader,
+			"videos":   u.Videos,
+			"used":     u.Bytes,
+			"quota":    uploaderQuota(u.Uploader),
+		})
+	}
+
+	library := map[string]interface{}{
+		"used":         stored,
+		"videos":       totalVideos,
+		"videos_bytes": totalBytes, // до исключения повторов
+		"quota":        cfg.LibraryQuota,
+	}
+	if cfg.LibraryQuota > 0 {
+		library["available"] = max(cfg.LibraryQuota-stored, 0)
+	}
+	myQuota := uploaderQuota(me)
+	uploader := map[string]interface{}{
+		"uploader": me,
+		"videos":   myVideos,
+		"used":     myBytes,
+		"quota":    myQuota,
+	}
+	if myQuota > 0 {
+		uploader["available"] = max(myQuota-myBytes, 0)
+	}
+	disk := map[string]interface{}{
+		"min_free": cfg.MinFreeSpace,
+	}
+	if free, err := diskFree(videoStagingDir()); err == nil {
+		disk["free"] = free
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"library":   library,
+		"uploader":  uploader,
+		"uploaders": uploaders,
+		"disk":      disk,
+	})
+}
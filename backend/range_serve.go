@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Отдача файлов по RFC 9110: условные запросы (раздел 13) и запросы диапазонов
+// (раздел 14), включая суффиксные диапазоны и несколько диапазонов в одном
+// ответе multipart/byteranges.
+
+var (
+	// errRangeSyntax — заголовок Range не разобран; по RFC 9110 его можно игнорировать
+	errRangeSyntax = errors.New("неверный заголовок Range")
+	// errRangeUnsatisfiable — ни один диапазон не пересекается с файлом (416)
+	errRangeUnsatisfiable = errors.New("диапазон за пределами файла")
+)
+
+// maxRanges — больше диапазонов в одном запросе не обслуживаем, отдаём файл целиком
+const maxRanges = 64
+
+// httpRange — диапазон байт [start, start+length)
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange разбирает заголовок Range для файла размером size (RFC 9110, 14.1.1)
+func parseRange(header string, size int64) ([]httpRange, error) {
+	unit, spec, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errRangeSyntax
+	}
+
+	var ranges []httpRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue // пустые элементы списка допускаются
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errRangeSyntax
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// Суффикс: последние N байт
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				continue // неудовлетворимый диапазон
+			}
+			if n > size {
+				n = size
+			}
+			if n > 0 {
+				ranges = append(ranges, httpRange{start: size - n, length: n})
+			}
+			continue
+		}
+
+		start, err := parseRangeInt(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = parseRangeInt(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, errRangeSyntax
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue // неудовлетворимый диапазон
+		}
+		ranges = append(ranges, httpRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeUnsatisfiable
+	}
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, errRangeSyntax
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errRangeSyntax
+	}
+	return n, nil
+}
+
+// videoETag — сильный валидатор из размера, времени изменения и хеша содержимого
+func videoETag(size int64, modtime time.Time, hash string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%s", size, modtime.UnixNano(), hash)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// splitETags разбирает список сущностных тегов (запятые внутри кавычек не разделяют)
+func splitETags(header string) []string {
+	var tags []string
+	for s := strings.TrimSpace(header); s != ""; s = strings.TrimLeft(s, " \t,") {
+		if s[0] == '*' {
+			tags = append(tags, "*")
+			s = s[1:]
+			continue
+		}
+		weak := strings.HasPrefix(s, "W/")
+		body := s
+		if weak {
+			body = s[2:]
+		}
+		if !strings.HasPrefix(body, `"`) {
+			return tags // неверный формат: дальше не разбираем
+		}
+		end := strings.IndexByte(body[1:], '"')
+		if end < 0 {
+			return tags
+		}
+		tag := body[:end+2]
+		if weak {
+			tag = "W/" + tag
+		}
+		tags = append(tags, tag)
+		s = body[end+2:]
+	}
+	return tags
+}
+
+// etagMatch сравнивает теги: сильное сравнение требует, чтобы оба тега были сильными
+func etagMatch(a, b string, strong bool) bool {
+	aWeak, bWeak := strings.HasPrefix(a, "W/"), strings.HasPrefix(b, "W/")
+	if strong && (aWeak || bWeak) {
+		return false
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+func etagListMatch(header, etag string, strong bool) bool {
+	for _, tag := range splitETags(header) {
+		if tag == "*" || etagMatch(tag, etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions проверяет условные заголовки в порядке RFC 9110, 13.2.2.
+// Возвращает 0, если запрос нужно выполнить, иначе код ответа (304 или 412).
+func checkPreconditions(r *http.Request, etag string, modtime time.Time) int {
+	modtime = modtime.Truncate(time.Second) // в HTTP-датах нет долей секунды
+	hasModtime := !modtime.IsZero()
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && hasModtime {
+		if t, err := http.ParseTime(ius); err == nil && modtime.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	isGet := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatch(inm, etag, false) {
+			if isGet {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && isGet && hasModtime {
+		if t, err := http.ParseTime(ims); err == nil && !modtime.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// ifRangeAllows решает, применять ли Range при заданном If-Range (RFC 9110, 13.1.5)
+func ifRangeAllows(r *http.Request, etag string, modtime time.Time) bool {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagMatch(ir, etag, true)
+	}
+	// Дата годится как валидатор только при точном совпадении с Last-Modified
+	t, err := http.ParseTime(ir)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.Truncate(time.Second))
+}
+
+// serveRanges отдаёт содержимое с учётом условных заголовков и Range.
+// Content-Type должен быть уже выставлен вызывающим.
+func serveRanges(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, size int64, modtime time.Time, etag string) {
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	switch checkPreconditions(r, etag, modtime) {
+	case http.StatusNotModified:
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case http.StatusPreconditionFailed:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	var ranges []httpRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && r.Method == http.MethodGet && ifRangeAllows(r, etag, modtime) {
+		var err error
+		ranges, err = parseRange(rangeHeader, size)
+		switch {
+		case errors.Is(err, errRangeUnsatisfiable):
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		case err != nil:
+			ranges = nil // неразобранный Range игнорируется
+		case len(ranges) > maxRanges || sumRanges(ranges) > size:
+			ranges = nil // слишком много или перекрывающиеся диапазоны: отдаём целиком
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			copyRange(w, content, httpRange{start: 0, length: size})
+		}
+	case 1:
+		h.Set("Content-Range", ranges[0].contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		copyRange(w, content, ranges[0])
+	default:
+		serveMultipartRanges(w, content, size, ranges)
+	}
+}
+
+func sumRanges(ranges []httpRange) int64 {
+	var total int64
+	for _, rg := range ranges {
+		total += rg.length
+	}
+	return total
+}
+
+// copyRange отправляет диапазон файла; ошибки записи означают, что клиент ушёл
+func copyRange(w io.Writer, content io.ReadSeeker, rg httpRange) bool {
+	if _, err := content.Seek(rg.start, io.SeekStart); err != nil {
+		log.Printf("Ошибка seek файла: %v", err)
+		return false
+	}
+	if _, err := io.CopyN(w, content, rg.length); err != nil {
+		log.Printf("Ошибка отправки данных: %v", err)
+		return false
+	}
+	return true
+}
+
+// serveMultipartRanges отдаёт несколько диапазонов как multipart/byteranges (RFC 9110, 14.6)
+func serveMultipartRanges(w http.ResponseWriter, content io.ReadSeeker, size int64, ranges []httpRange) {
+	contentType := w.Header().Get("Content-Type")
+	boundary := multipartBoundary()
+
+	// Заголовки частей формируем заранее, чтобы знать точный Content-Length
+	parts := make([]string, len(ranges))
+	length := int64(0)
+	for i, rg := range ranges {
+		var b strings.Builder
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("--" + boundary + "\r\n")
+		if contentType != "" {
+			b.WriteString("Content-Type: " + contentType + "\r\n")
+		}
+		b.WriteString("Content-Range: " + rg.contentRange(size) + "\r\n\r\n")
+		parts[i] = b.String()
+		length += int64(len(parts[i])) + rg.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	for i, rg := range ranges {
+		if _, err := io.WriteString(w, parts[i]); err != nil {
+			return
+		}
+		if !copyRange(w, content, rg) {
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+func multipartBoundary() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
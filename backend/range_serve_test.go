@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Примеры из RFC 9110 (раздел 14.1.2) для представления длиной 10000 байт
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		size   int64
+		want   []httpRange
+		err    error
+	}{
+		// Первые 500 байт
+		{"bytes=0-499", 10000, []httpRange{{0, 500}}, nil},
+		// Вторые 500 байт
+		{"bytes=500-999", 10000, []httpRange{{500, 500}}, nil},
+		// Последние 500 байт: суффикс и открытый диапазон
+		{"bytes=-500", 10000, []httpRange{{9500, 500}}, nil},
+		{"bytes=9500-", 10000, []httpRange{{9500, 500}}, nil},
+		// Первый и последний байт
+		{"bytes=0-0,-1", 10000, []httpRange{{0, 1}, {9999, 1}}, nil},
+		// Несколько диапазонов, в том числе смежные и перекрывающиеся
+		{"bytes=500-600,601-999", 10000, []httpRange{{500, 101}, {601, 399}}, nil},
+		{"bytes=500-700,601-999", 10000, []httpRange{{500, 201}, {601, 399}}, nil},
+		// Пробелы и пустые элементы списка (RFC 9110, 5.6.1)
+		{"bytes= 0-1 , , 5-6", 10000, []httpRange{{0, 2}, {5, 2}}, nil},
+		{"Bytes=0-0", 10000, []httpRange{{0, 1}}, nil},
+		// Конец за пределами файла обрезается
+		{"bytes=9500-20000", 10000, []httpRange{{9500, 500}}, nil},
+		// Суффикс длиннее файла — весь файл
+		{"bytes=-20000", 10000, []httpRange{{0, 10000}}, nil},
+		// Неудовлетворимые диапазоны пропускаются
+		{"bytes=20000-,0-0", 10000, []httpRange{{0, 1}}, nil},
+		{"bytes=10000-", 10000, nil, errRangeUnsatisfiable},
+		{"bytes=-0", 10000, nil, errRangeUnsatisfiable},
+		{"bytes=0-0", 0, nil, errRangeUnsatisfiable},
+		{"bytes=-5", 0, nil, errRangeUnsatisfiable},
+		// Синтаксические ошибки: заголовок игнорируется
+		{"items=0-1", 10000, nil, errRangeSyntax},
+		{"bytes=1", 10000, nil, errRangeSyntax},
+		{"bytes=5-1", 10000, nil, errRangeSyntax},
+		{"bytes=a-b", 10000, nil, errRangeSyntax},
+		{"bytes=-", 10000, nil, errRangeSyntax},
+		{"bytes=+1-2", 10000, nil, errRangeSyntax},
+		{"bytes=99999999999999999999-", 10000, nil, errRangeSyntax},
+	}
+	for _, c := range cases {
+		got, err := parseRange(c.header, c.size)
+		if !errors.Is(err, c.err) || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("parseRange(%q, %d) = %v, %v; want %v, %v", c.header, c.size, got, err, c.want, c.err)
+		}
+	}
+}
+
+const testRangeSize = 10000
+
+var (
+	testRangeBody    = strings.Repeat("0123456789", testRangeSize/10)
+	testRangeModtime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	testRangeETag    = `"abc"`
+)
+
+// serveTestRanges выполняет запрос к serveRanges с файлом testRangeBody
+func serveTestRanges(method string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/video/1", nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "video/mp4")
+	serveRanges(w, r, strings.NewReader(testRangeBody), testRangeSize, testRangeModtime.Add(300*time.Millisecond), testRangeETag)
+	return w
+}
+
+func TestServeRanges(t *testing.T) {
+	manyRanges := func(n int) string {
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = fmt.Sprintf("%d-%d", i*10, i*10+1)
+		}
+		return "bytes=" + strings.Join(parts, ",")
+	}
+	cases := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		status       int
+		contentRange string
+		body         string // для 200 и одного диапазона
+		parts        int    // для multipart
+	}{
+		{"без Range", "GET", nil, 200, "", testRangeBody, 0},
+		{"HEAD", "HEAD", map[string]string{"Range": "bytes=0-1"}, 200, "", "", 0},
+		{"один диапазон", "GET", map[string]string{"Range": "bytes=0-499"}, 206, "bytes 0-499/10000", testRangeBody[:500], 0},
+		{"0-0", "GET", map[string]string{"Range": "bytes=0-0"}, 206, "bytes 0-0/10000", "0", 0},
+		{"суффикс", "GET", map[string]string{"Range": "bytes=-3"}, 206, "bytes 9997-9999/10000", "789", 0},
+		{"два диапазона", "GET", map[string]string{"Range": "bytes=0-0,-1"}, 206, "", "", 2},
+		{"перекрывающиеся", "GET", map[string]string{"Range": "bytes=500-700,601-999"}, 206, "", "", 2},
+		{"перекрытия больше файла", "GET", map[string]string{"Range": "bytes=0-,0-"}, 200, "", testRangeBody, 0},
+		{"64 диапазона", "GET", map[string]string{"Range": manyRanges(maxRanges)}, 206, "", "", maxRanges},
+		{"65 диапазонов", "GET", map[string]string{"Range": manyRanges(maxRanges + 1)}, 200, "", testRangeBody, 0},
+		{"неудовлетворимый", "GET", map[string]string{"Range": "bytes=10000-"}, 416, "bytes */10000", "", 0},
+		{"неверный синтаксис", "GET", map[string]string{"Range": "bytes=5-1"}, 200, "", testRangeBody, 0},
+		{"другая единица", "GET", map[string]string{"Range": "items=0-1"}, 200, "", testRangeBody, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := serveTestRanges(c.method, c.header)
+			if w.Code != c.status {
+				t.Fatalf("статус %d, want %d", w.Code, c.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != c.contentRange {
+				t.Errorf("Content-Range %q, want %q", got, c.contentRange)
+			}
+			if w.Header().Get("Accept-Ranges") != "bytes" || w.Header().Get("ETag") != testRangeETag {
+				t.Errorf("нет Accept-Ranges или ETag: %v", w.Header())
+			}
+			switch {
+			case c.parts > 0:
+				checkMultipartRanges(t, w, c.header["Range"], c.parts)
+			case c.status == 200 || c.status == 206:
+				if w.Body.String() != c.body {
+					t.Errorf("тело %.40q, want %.40q", w.Body.String(), c.body)
+				}
+				want := len(c.body)
+				if c.method == "HEAD" {
+					want = testRangeSize
+				}
+				if w.Header().Get("Content-Length") != strconv.Itoa(want) {
+					t.Errorf("Content-Length %q, want %d", w.Header().Get("Content-Length"), want)
+				}
+			}
+		})
+	}
+}
+
+// checkMultipartRanges разбирает ответ multipart/byteranges (RFC 9110, 14.6)
+// и сверяет части и Content-Length с запрошенными диапазонами
+func checkMultipartRanges(t *testing.T, w *httptest.ResponseRecorder, rangeHeader string, parts int) {
+	t.Helper()
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+		t.Fatalf("Content-Length %s, фактическая длина тела %s", got, want)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		t.Fatalf("Content-Type %q: %v", w.Header().Get("Content-Type"), err)
+	}
+	ranges, err := parseRange(rangeHeader, testRangeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if i != parts {
+				t.Fatalf("частей %d, want %d", i, parts)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rg := ranges[i]
+		if got, want := part.Header.Get("Content-Range"), rg.contentRange(testRangeSize); got != want {
+			t.Errorf("часть %d: Content-Range %q, want %q", i, got, want)
+		}
+		if part.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("часть %d: Content-Type %q", i, part.Header.Get("Content-Type"))
+		}
+		data, _ := io.ReadAll(part)
+		if string(data) != testRangeBody[rg.start:rg.start+rg.length] {
+			t.Errorf("часть %d: данные %q", i, data)
+		}
+	}
+}
+
+// Порядок проверки условий — RFC 9110, 13.2.2
+func TestCheckPreconditions(t *testing.T) {
+	modtime := testRangeModtime.Add(300 * time.Millisecond)
+	before := testRangeModtime.Add(-time.Hour).Format(http.TimeFormat)
+	exact := testRangeModtime.Format(http.TimeFormat)
+	after := testRangeModtime.Add(time.Hour).Format(http.TimeFormat)
+
+	cases := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"без условий", "GET", nil, 0},
+		// Шаг 1: If-Match, сильное сравнение
+		{"If-Match совпадает", "GET", map[string]string{"If-Match": `"x", "abc"`}, 0},
+		{"If-Match *", "GET", map[string]string{"If-Match": "*"}, 0},
+		{"If-Match не совпадает", "GET", map[string]string{"If-Match": `"x"`}, 412},
+		{"If-Match слабый тег", "GET", map[string]string{"If-Match": `W/"abc"`}, 412},
+		// Шаг 2: If-Unmodified-Since только без If-Match
+		{"If-Unmodified-Since раньше", "GET", map[string]string{"If-Unmodified-Since": before}, 412},
+		{"If-Unmodified-Since точно", "GET", map[string]string{"If-Unmodified-Since": exact}, 0},
+		{"If-Match важнее If-Unmodified-Since", "GET", map[string]string{"If-Match": `"abc"`, "If-Unmodified-Since": before}, 0},
+		{"неверная дата игнорируется", "GET", map[string]string{"If-Unmodified-Since": "вчера"}, 0},
+		// Шаг 3: If-None-Match, слабое сравнение
+		{"If-None-Match совпадает", "GET", map[string]string{"If-None-Match": `"abc"`}, 304},
+		{"If-None-Match слабый тег", "HEAD", map[string]string{"If-None-Match": `W/"abc"`}, 304},
+		{"If-None-Match *", "GET", map[string]string{"If-None-Match": "*"}, 304},
+		{"If-None-Match список с запятой в теге", "GET", map[string]string{"If-None-Match": `"a,b", "abc"`}, 304},
+		{"If-None-Match не совпадает", "GET", map[string]string{"If-None-Match": `"x"`}, 0},
+		{"If-None-Match для POST", "POST", map[string]string{"If-None-Match": `"abc"`}, 412},
+		// Шаг 4: If-Modified-Since только без If-None-Match и только для GET/HEAD
+		{"If-Modified-Since не изменён", "GET", map[string]string{"If-Modified-Since": exact}, 304},
+		{"If-Modified-Since изменён", "GET", map[string]string{"If-Modified-Since": before}, 0},
+		{"If-None-Match важнее If-Modified-Since", "GET", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": after}, 0},
+		{"If-Modified-Since для POST", "POST", map[string]string{"If-Modified-Since": after}, 0},
+		// 412 от шагов 1–2 важнее 304 от шагов 3–4
+		{"If-Match раньше If-None-Match", "GET", map[string]string{"If-Match": `"x"`, "If-None-Match": `"abc"`}, 412},
+		{"If-Unmodified-Since раньше If-Modified-Since", "GET", map[string]string{"If-Unmodified-Since": before, "If-Modified-Since": after}, 412},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/", nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := checkPreconditions(r, testRangeETag, modtime); got != c.want {
+			t.Errorf("%s: %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestServeRangesConditional(t *testing.T) {
+	w := serveTestRanges("GET", map[string]string{"If-None-Match": testRangeETag})
+	if w.Code != 304 || w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("304: статус %d, тело %d байт, Content-Type %q", w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("ETag") != testRangeETag || w.Header().Get("Last-Modified") != testRangeModtime.Format(http.TimeFormat) {
+		t.Errorf("304 без валидаторов: %v", w.Header())
+	}
+	w = serveTestRanges("GET", map[string]string{"If-Match": `"x"`, "Range": "bytes=0-1"})
+	if w.Code != 412 {
+		t.Errorf("If-Match с Range: статус %d, want 412", w.Code)
+	}
+}
+
+// If-Range: диапазон отдаётся, только если валидатор совпал (RFC 9110, 13.1.5)
+func TestIfRange(t *testing.T) {
+	cases := []struct {
+		name    string
+		ifRange string
+		status  int
+	}{
+		{"сильный тег совпадает", testRangeETag, 206},
+		{"сильный тег не совпадает", `"other"`, 200},
+		{"слабый тег никогда не совпадает", `W/"abc"`, 200},
+		{"дата совпадает с Last-Modified", testRangeModtime.Format(http.TimeFormat), 206},
+		{"дата позже Last-Modified", testRangeModtime.Add(time.Hour).Format(http.TimeFormat), 200},
+		{"дата раньше Last-Modified", testRangeModtime.Add(-time.Hour).Format(http.TimeFormat), 200},
+		{"неверная дата", "вчера", 200},
+	}
+	for _, c := range cases {
+		w := serveTestRanges("GET", map[string]string{"Range": "bytes=0-9", "If-Range": c.ifRange})
+		if w.Code != c.status {
+			t.Errorf("%s: статус %d, want %d", c.name, w.Code, c.status)
+		}
+		if c.status == 200 && w.Body.Len() != testRangeSize {
+			t.Errorf("%s: отдано %d байт вместо всего файла", c.name, w.Body.Len())
+		}
+	}
+}
+
+func TestSplitETags(t *testing.T) {
+	cases := map[string][]string{
+		`"a"`:                {`"a"`},
+		`"a", W/"b",  "c,d"`: {`"a"`, `W/"b"`, `"c,d"`},
+		`*`:                  {"*"},
+		`"a", bad, "b"`:      {`"a"`},
+		`"unterminated`:      nil,
+	}
+	for in, want := range cases {
+		if got := splitETags(in); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("splitETags(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
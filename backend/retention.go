@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Правила хранения видео из файла RETENTION_POLICY_FILE:
+//
+//	{"default": {"max_age_days": 365, "keep_newest": 500, "unplayed_days": 180},
+//	 "overrides": [
+//	   {"tag": "archive", "keep": true},
+//	   {"folder": "lectures", "max_age_days": 0, "unplayed_days": 90}
+//	 ]}
+//
+// Видео подчиняется первому подходящему исключению (метка или папка вместе
+// с вложенными), иначе правилу по умолчанию. Незаданные поля исключения берутся
+// из правила по умолчанию, 0 отключает ограничение, keep запрещает удаление.
+// keep_newest считается внутри группы видео одного правила.
+//
+// Задача video-retention перемещает подпавшие видео в корзину, откуда их
+// окончательно удаляет trash-purge, и пишет каждое удаление в
+// video_retention_audit. GET /api/retention — отчёт без удаления.
+
+// retentionRule — ограничения хранения
+type retentionRule struct {
+	MaxAgeDays   *int `json:"max_age_days,omitempty"`
+	KeepNewest   *int `json:"keep_newest,omitempty"`
+	UnplayedDays *int `json:"unplayed_days,omitempty"`
+	Keep         bool `json:"keep,omitempty"`
+}
+
+// retentionOverride — исключение для метки или папки
+type retentionOverride struct {
+	Tag    string `json:"tag,omitempty"`
+	Folder string `json:"folder,omitempty"`
+	retentionRule
+}
+
+type retentionPolicy struct {
+	Default   retentionRule       `json:"default"`
+	Overrides []retentionOverride `json:"overrides"`
+}
+
+// loadRetentionPolicy читает правила; без RETENTION_POLICY_FILE правил нет (nil)
+func loadRetentionPolicy() (*retentionPolicy, error) {
+	if cfg.RetentionPolicyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.RetentionPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	var p retentionPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("неверный формат %s: %v", cfg.RetentionPolicyFile, err)
+	}
+	for i, o := range p.Overrides {
+		if (o.Tag == "") == (o.Folder == "") {
+			return nil, fmt.Errorf("%s: исключение %d должно задавать либо tag, либо folder", cfg.RetentionPolicyFile, i+1)
+		}
+	}
+	return &p, nil
+}
+
+// effectiveRule — правило с подставленными значениями по умолчанию
+type effectiveRule struct {
+	Name         string
+	MaxAgeDays   int
+	KeepNewest   int
+	UnplayedDays int
+	Keep         bool
+}
+
+func (p *retentionPolicy) resolve(name string, r retentionRule) effectiveRule {
+	pick := func(v, def *int) int {
+		if v != nil {
+			return *v
+		}
+		if def != nil {
+			return *def
+		}
+		return 0
+	}
+	return effectiveRule{
+		Name:         name,
+		MaxAgeDays:   pick(r.MaxAgeDays, p.Default.MaxAgeDays),
+		KeepNewest:   pick(r.KeepNewest, p.Default.KeepNewest),
+		UnplayedDays: pick(r.UnplayedDays, p.Default.UnplayedDays),
+		Keep:         r.Keep,
+	}
+}
+
+// ruleFor выбирает правило для видео
+func (p *retentionPolicy) ruleFor(v *Video) effectiveRule {
+	for _, o := range p.Overrides {
+		switch {
+		case o.Tag != "":
+			for _, tag := range v.Tags {
+				if strings.EqualFold(tag, o.Tag) {
+					return p.resolve("tag:"+o.Tag, o.retentionRule)
+				}
+			}
+		case v.Folder == o.Folder || strings.HasPrefix(v.Folder, o.Folder+"/"):
+			return p.resolve("folder:"+o.Folder, o.retentionRule)
+		}
+	}
+	return p.resolve("default", p.Default)
+}
+
+// retentionAction — видео, подпавшее под правило
+type retentionAction struct {
+	Video  *Video
+	Rule   string
+	Reason string
+}
+
+// planRetention определяет, какие видео удалить по правилам на момент now
+func planRetention(videos []*Video, p *retentionPolicy, now time.Time) []retentionAction {
+	groups := make(map[string][]*Video)
+	rules := make(map[string]effectiveRule)
+	for _, v := range videos {
+		rule := p.ruleFor(v)
+		rules[rule.Name] = rule
+		groups[rule.Name] = append(groups[rule.Name], v)
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var actions []retentionAction
+	for _, name := range names {
+		rule, group := rules[name], groups[name]
+		if rule.Keep {
+			continue
+		}
+		// Новейшие первыми, чтобы keep_newest оставил именно их
+		sort.Slice(group, func(i, j int) bool {
+			if !group[i].CreatedAt.Equal(group[j].CreatedAt) {
+				return group[i].CreatedAt.After(group[j].CreatedAt)
+			}
+			return group[i].ID > group[j].ID
+		})
+		for i, v := range group {
+			reason := retentionReason(rule, v, i, now)
+			if reason != "" {
+				actions = append(actions, retentionAction{Video: v, Rule: name, Reason: reason})
+			}
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Video.ID < actions[j].Video.ID })
+	return actions
+}
+
+// retentionReason объясняет, почему видео с номером rank (от новейшего) подлежит
+// удалению; пустая строка — видео остаётся
+func retentionReason(rule effectiveRule, v *Video, rank int, now time.Time) string {
+	if rule.MaxAgeDays > 0 && v.CreatedAt.Before(now.AddDate(0, 0, -rule.MaxAgeDays)) {
+		return fmt.Sprintf("загружено больше %d дн. назад", rule.MaxAgeDays)
+	}
+	if rule.KeepNewest > 0 && rank >= rule.KeepNewest {
+		return fmt.Sprintf("не входит в %d новейших", rule.KeepNewest)
+	}
+	if rule.UnplayedDays > 0 {
+		last := v.LastPlayedAt
+		if last.IsZero() {
+			last = v.CreatedAt
+		}
+		if last.Before(now.AddDate(0, 0, -rule.UnplayedDays)) {
+			return fmt.Sprintf("не просматривалось %d дн.", rule.UnplayedDays)
+		}
+	}
+	return ""
+}
+
+// retentionReport — итог применения правил
+type retentionReport struct {
+	Checked int
+	Actions []retentionAction
+	Removed int
+}
+
+// applyRetention применяет правила хранения к видео библиотеки. С dryRun только
+// сообщает, что было бы удалено.
+func applyRetention(ctx context.Context, policy *retentionPolicy, dryRun bool, logf func(format string, args ...interface{})) (retentionReport, error) {
+	var report retentionReport
+	if policy == nil {
+		return report, nil
+	}
+
+	all, err := catalog.All(ctx)
+	if err != nil {
+		return report, fmt.Errorf("ошибка чтения каталога: %v", err)
+	}
+	tags, err := catalog.TagsByVideo(ctx)
+	if err != nil {
+		return report, fmt.Errorf("ошибка чтения меток: %v", err)
+	}
+	var videos []*Video
+	for _, v := range all {
+		if v.Status != videoStatusReady && v.Status != videoStatusMissing && v.Status != videoStatusCorrupted {
+			continue // загружаются или уже в корзине
+		}
+		v.Tags = tags[v.ID]
+		videos = append(videos, v)
+	}
+	report.Checked = len(videos)
+	report.Actions = planRetention(videos, policy, time.Now())
+
+	for _, a := range report.Actions {
+		logf("Хранение: %s (id %d, %s): %s", a.Video.Key, a.Video.ID, a.Rule, a.Reason)
+		if dryRun {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		by, now := "retention:"+a.Rule, time.Now()
+		err := catalog.TrashByRetention(ctx, a, by, now)
+		if errors.Is(err, errVideoNotFound) {
+			continue // удалено или перемещено в корзину, пока шла проверка
+		}
+		if err != nil {
+			return report, fmt.Errorf("видео %d: %v", a.Video.ID, err)
+		}
+		videoTrashed(a.Video, by, now)
+		report.Removed++
+	}
+	return report, nil
+}
+
+// TrashByRetention перемещает видео в корзину по правилу хранения и записывает
+// это в журнал одной транзакцией: без записи в журнале видео в корзину не попадает
+func (c *videoCatalog) TrashByRetention(ctx context.Context, a retentionAction, by string, at time.Time) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := trashRow(ctx, tx, a.Video.ID, by, at); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO video_retention_audit (video_id, storage_key, title, rule, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, a.Video.ID, a.Video.Key, a.Video.Title, a.Rule, a.Reason, at)
+	if err != nil {
+		return fmt.Errorf("журнал хранения: %v", err)
+	}
+	return tx.Commit()
+}
+
+// RetentionAudit возвращает последние limit записей журнала хранения
+func (c *videoCatalog) RetentionAudit(ctx context.Context, limit int) ([]map[string]interface{}, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT id, video_id, storage_key, title, rule, reason, created_at
+		FROM video_retention_audit ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		var id, videoID int64
+		var key, title, rule, reason string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &videoID, &key, &title, &rule, &reason, &createdAt); err != nil {
+			return nil, err
+		}
+		list = append(list, map[string]interface{}{
+			"id":         id,
+			"video_id":   videoID,
+			"filename":   key,
+			"title":      title,
+			"rule":       rule,
+			"reason":     reason,
+			"removed_at": createdAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return list, rows.Err()
+}
+
+// runVideoRetention — задача video-retention
+func runVideoRetention(ctx context.Context) error {
+	policy, err := loadRetentionPolicy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		jobLog(ctx).Printf("Хранение: RETENTION_POLICY_FILE не задан, правил нет")
+		return nil
+	}
+	report, err := applyRetention(ctx, policy, false, jobLog(ctx).Printf)
+	jobLog(ctx).Printf("Хранение: проверено видео %d, в корзину перемещено %d", report.Checked, report.Removed)
+	return err
+}
+
+// retentionHandler — отчёт о том, что удалили бы правила хранения (GET /api/retention)
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	policy, err := loadRetentionPolicy()
+	if err != nil {
+		log.Printf("Правила хранения: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report, err := applyRetention(r.Context(), policy, true, func(string, ...interface{}) {})
+	if err != nil {
+		log.Printf("Ошибка проверки правил хранения: %v", err)
+		http.Error(w, "Ошибка проверки правил хранения", http.StatusInternalServerError)
+		return
+	}
+
+	actions := []map[string]interface{}{}
+	var size int64
+	for _, a := range report.Actions {
+		item := a.Video.toJSON()
+		item["rule"] = a.Rule
+		item["reason"] = a.Reason
+		actions = append(actions, item)
+		size += a.Video.Size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": true,
+		"policy":  policy,
+		"checked": report.Checked,
+		"size":    size,
+		"videos":  actions,
+	})
+}
+
+// retentionAuditHandler — журнал удалений по правилам хранения (GET /api/retention/audit?limit=N)
+func retentionAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit должен быть от 1 до 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	list, err := catalog.RetentionAudit(r.Context(), limit)
+	if err != nil {
+		log.Printf("Ошибка чтения журнала хранения: %v", err)
+		http.Error(w, "Ошибка чтения журнала хранения", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Статусы запуска задачи
+const (
+	JobStatusRunning = "running"
+	JobStatusSuccess = "success"
+	JobStatusFailed  = "failed"
+	JobStatusTimeout = "timeout"
+	JobStatusSkipped = "skipped"
+)
+
+// JobFunc — тело задачи. Задача должна завершаться при отмене ctx.
+type JobFunc func(ctx context.Context) error
+
+// Источник запуска задачи
+const (
+	JobTriggerSchedule = "schedule"
+	JobTriggerManual   = "manual"
+	JobTriggerCatchUp  = "catch-up"
+)
+
+// JobRun — результат одного запуска задачи
+type JobRun struct {
+	ID       int64         `json:"id"`
+	Job      string        `json:"job"`
+	Trigger  string        `json:"trigger"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Output   string        `json:"output"`
+}
+
+// Job — задача планировщика
+type Job struct {
+	Name     string
+	Schedule *cronSchedule
+	Timeout  time.Duration
+	Run      JobFunc
+	// CatchUp — при старте выполнить задачу один раз, если запуски были пропущены
+	CatchUp bool
+
+	mu      sync.Mutex
+	running bool
+	paused  bool
+	next    time.Time
+	lastID  int64
+	history []JobRun // последние запуски, новые в конце
+}
+
+var (
+	errJobNotFound = errors.New("задача не найдена")
+	errJobRunning  = errors.New("задача уже выполняется")
+)
+
+// Сколько байт вывода сохранять для одного запуска
+const jobOutputLimit = 64 << 10
+
+type jobLoggerKey struct{}
+
+// jobLog возвращает логгер текущего запуска задачи: его вывод попадает
+// и в общий журнал, и в историю запуска. Вне задачи — стандартный логгер.
+func jobLog(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(jobLoggerKey{}).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
+
+// cappedBuffer хранит не больше limit байт, остальное отбрасывает
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return b.buf.String() + "\n... вывод обрезан ..."
+	}
+	return b.buf.String()
+}
+
+// Сколько последних запусков хранить в памяти для каждой задачи
+const jobHistoryLimit = 100
+
+// Scheduler запускает задачи по расписанию cron.
+// Одна и та же задача не запускается повторно, пока не закончился предыдущий запуск.
+type Scheduler struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string
+	stop  chan struct{}
+	// store — необязательное хранилище состояния (без него всё живёт только в памяти)
+	store schedulerStore
+}
+
+var scheduler = newScheduler()
+
+func newScheduler() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*Job), stop: make(chan struct{})}
+}
+
+// Register добавляет задачу. spec — выражение cron, loc — зона по умолчанию.
+func (s *Scheduler) Register(name, spec string, loc *time.Location, timeout time.Duration, fn JobFunc) (*Job, error) {
+	schedule, err := parseCron(spec, loc)
+	if err != nil {
+		return nil, fmt.Errorf("задача %s: %v", name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[name]; exists {
+		return nil, fmt.Errorf("задача %s уже зарегистрирована", name)
+	}
+	job := &Job{Name: name, Schedule: schedule, Timeout: timeout, Run: fn}
+	s.jobs[name] = job
+	s.order = append(s.order, name)
+	return job, nil
+}
+
+// Start восстанавливает состояние задач из хранилища и запускает цикл ожидания для каждой
+func (s *Scheduler) Start() {
+	for _, job := range s.Jobs() {
+		if s.store != nil {
+			s.restore(job)
+		}
+		go s.loop(job)
+	}
+}
+
+// restore загружает паузу и историю задачи, ищет пропущенные запуски
+// и при необходимости выполняет задачу один раз, чтобы наверстать их.
+func (s *Scheduler) restore(job *Job) {
+	now := time.Now()
+	state, ok, err := s.store.LoadJob(job.Name)
+	if err != nil {
+		log.Printf("Задача %s: не удалось загрузить состояние: %v", job.Name, err)
+		return
+	}
+	if !ok {
+		// Первый запуск: запоминаем точку отсчёта для поиска пропусков в будущем
+		if err := s.store.InitJob(job.Name, now); err != nil {
+			log.Printf("Задача %s: не удалось сохранить состояние: %v", job.Name, err)
+		}
+		return
+	}
+
+	runs, err := s.store.LoadRuns(job.Name, jobHistoryLimit)
+	if err != nil {
+		log.Printf("Задача %s: не удалось загрузить историю: %v", job.Name, err)
+	}
+	job.mu.Lock()
+	job.paused = state.Paused
+	job.history = runs
+	for _, run := range runs {
+		job.lastID = max(job.lastID, run.ID)
+	}
+	job.mu.Unlock()
+
+	if state.LastSlot.IsZero() {
+		return
+	}
+	missed, lastMissed := 0, time.Time{}
+	for slot := job.Schedule.Next(state.LastSlot); !slot.IsZero() && slot.Before(now); slot = job.Schedule.Next(slot) {
+		missed++
+		lastMissed = slot
+		if missed >= 1000 {
+			break
+		}
+	}
+	if missed == 0 {
+		return
+	}
+
+	log.Printf("Задача %s: пропущено запусков: %d, последний — %s", job.Name, missed, lastMissed.Format("2006-01-02 15:04:05 MST"))
+	if job.CatchUp {
+		go s.runSlot(job, lastMissed, JobTriggerCatchUp)
+	}
+}
+
+// Stop останавливает циклы задач (уже идущие запуски не прерываются)
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) loop(job *Job) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Задача %s: расписание %q никогда не сработает", job.Name, job.Schedule.spec)
+			return
+		}
+		job.mu.Lock()
+		job.next = next
+		job.mu.Unlock()
+		log.Printf("Задача %s: следующий запуск %s", job.Name, next.Format("2006-01-02 15:04:05 MST"))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			go s.runSlot(job, next, JobTriggerSchedule)
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runSlot выполняет запуск для слота расписания. Если задача приостановлена
+// или слот уже занял другой экземпляр приложения, запуск не выполняется.
+func (s *Scheduler) runSlot(job *Job, slot time.Time, trigger string) {
+	if s.paused(job) {
+		log.Printf("Задача %s приостановлена, запуск пропущен", job.Name)
+		return
+	}
+	if s.store != nil {
+		claimed, err := s.store.ClaimSlot(job.Name, slot)
+		if err != nil {
+			log.Printf("Задача %s: не удалось отметить слот в БД, выполняем без координации: %v", job.Name, err)
+		} else if !claimed {
+			log.Printf("Задача %s: слот %s уже выполнен другим экземпляром", job.Name, slot.Format("2006-01-02 15:04:05"))
+			return
+		}
+	}
+	s.runJob(job, trigger)
+}
+
+// paused сообщает, приостановлена ли задача. При наличии хранилища пауза
+// перечитывается из БД: её могли поставить или снять на другом экземпляре.
+func (s *Scheduler) paused(job *Job) bool {
+	if s.store != nil {
+		state, ok, err := s.store.LoadJob(job.Name)
+		if err != nil {
+			log.Printf("Задача %s: не удалось прочитать паузу из БД, используем локальное состояние: %v", job.Name, err)
+		} else if ok {
+			job.mu.Lock()
+			job.paused = state.Paused
+			job.mu.Unlock()
+		}
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.paused
+}
+
+// runJob выполняет задачу с таймаутом и записывает результат.
+// Если предыдущий запуск ещё идёт, запуск пропускается.
+func (s *Scheduler) runJob(job *Job, trigger string) JobRun {
+	run, ok := s.begin(job, trigger)
+	if !ok {
+		return run
+	}
+	return s.execute(job, run)
+}
+
+// begin отмечает начало запуска и добавляет его в историю со статусом running.
+// Возвращает false, если задача уже выполняется.
+func (s *Scheduler) begin(job *Job, trigger string) (JobRun, bool) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.lastID++
+	run := JobRun{ID: job.lastID, Job: job.Name, Trigger: trigger, Start: time.Now()}
+	if job.running {
+		run.Status = JobStatusSkipped
+		run.Error = "предыдущий запуск ещё не завершён"
+		job.appendRun(run)
+		log.Printf("Задача %s: запуск пропущен, предыдущий ещё не завершён", job.Name)
+		return run, false
+	}
+	job.running = true
+	run.Status = JobStatusRunning
+	job.appendRun(run)
+	return run, true
+}
+
+// execute выполняет тело задачи, начатой через begin
+func (s *Scheduler) execute(job *Job, run JobRun) JobRun {
+	release, ok := s.acquireLease(job)
+	if !ok {
+		job.mu.Lock()
+		job.running = false
+		job.mu.Unlock()
+		run.Status = JobStatusSkipped
+		run.Error = "задача выполняется на другом экземпляре"
+		s.record(job, run)
+		return run
+	}
+
+	output := &cappedBuffer{limit: jobOutputLimit}
+	logger := log.New(io.MultiWriter(log.Writer(), output), "["+job.Name+"] ", log.LstdFlags)
+
+	ctx := context.WithValue(context.Background(), jobLoggerKey{}, logger)
+	cancel := context.CancelFunc(func() {})
+	if job.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("паника: %v", p)
+			}
+		}()
+		done <- job.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		run.Status = JobStatusSuccess
+		if err != nil {
+			run.Status = JobStatusFailed
+			run.Error = err.Error()
+		}
+		release()
+		job.mu.Lock()
+		job.running = false
+		job.mu.Unlock()
+	case <-ctx.Done():
+		run.Status = JobStatusTimeout
+		run.Error = fmt.Sprintf("превышен таймаут %v", job.Timeout)
+		// Задача считается запущенной (и аренда удерживается), пока тело действительно не вернётся
+		go func() {
+			<-done
+			release()
+			job.mu.Lock()
+			job.running = false
+			job.mu.Unlock()
+		}()
+	}
+	cancel()
+
+	run.Duration = time.Since(run.Start)
+	run.Output = output.String()
+	s.record(job, run)
+	return run
+}
+
+// acquireLease берёт аренду задачи в хранилище и продлевает её, пока задача выполняется.
+// Возвращает функцию освобождения и false, если задачу держит другой экземпляр.
+func (s *Scheduler) acquireLease(job *Job) (func(), bool) {
+	if s.store == nil {
+		return func() {}, true
+	}
+
+	ttl := 10 * time.Minute
+	if job.Timeout > 0 {
+		ttl = job.Timeout + time.Minute
+	}
+	ok, err := s.store.AcquireLease(job.Name, schedulerInstanceID, ttl)
+	if err != nil {
+		log.Printf("Задача %s: не удалось взять аренду, выполняем без координации: %v", job.Name, err)
+		return func() {}, true
+	}
+	if !ok {
+		return nil, false
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if ok, err := s.store.AcquireLease(job.Name, schedulerInstanceID, ttl); err != nil || !ok {
+					log.Printf("Задача %s: не удалось продлить аренду: %v", job.Name, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			if err := s.store.ReleaseLease(job.Name, schedulerInstanceID); err != nil {
+				log.Printf("Задача %s: не удалось освободить аренду: %v", job.Name, err)
+			}
+		})
+	}, true
+}
+
+// appendRun добавляет запуск в историю (вызывается под job.mu)
+func (job *Job) appendRun(run JobRun) {
+	job.history = append(job.history, run)
+	if len(job.history) > jobHistoryLimit {
+		job.history = job.history[len(job.history)-jobHistoryLimit:]
+	}
+}
+
+// record обновляет запись о запуске в истории задачи и пишет итог в журнал
+func (s *Scheduler) record(job *Job, run JobRun) {
+	job.mu.Lock()
+	updated := false
+	for i := len(job.history) - 1; i >= 0; i-- {
+		if job.history[i].ID == run.ID {
+			job.history[i] = run
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		job.appendRun(run)
+	}
+	job.mu.Unlock()
+
+	if s.store != nil {
+		if err := s.store.SaveRun(run); err != nil {
+			log.Printf("Задача %s: не удалось сохранить результат запуска: %v", job.Name, err)
+		}
+	}
+
+	if run.Error != "" {
+		log.Printf("Задача %s: %s за %v: %s", job.Name, run.Status, run.Duration.Round(time.Millisecond), run.Error)
+	} else {
+		log.Printf("Задача %s: %s за %v", job.Name, run.Status, run.Duration.Round(time.Millisecond))
+	}
+}
+
+// Trigger немедленно запускает задачу в фоне и возвращает запись о запуске
+func (s *Scheduler) Trigger(name string) (JobRun, error) {
+	job := s.Job(name)
+	if job == nil {
+		return JobRun{}, errJobNotFound
+	}
+	run, ok := s.begin(job, JobTriggerManual)
+	if !ok {
+		return run, errJobRunning
+	}
+	go s.execute(job, run)
+	return run, nil
+}
+
+// SetPaused приостанавливает или возобновляет запуски задачи по расписанию
+func (s *Scheduler) SetPaused(name string, paused bool) error {
+	job := s.Job(name)
+	if job == nil {
+		return errJobNotFound
+	}
+	job.mu.Lock()
+	job.paused = paused
+	job.mu.Unlock()
+	if s.store != nil {
+		return s.store.SetPaused(name, paused)
+	}
+	return nil
+}
+
+// Job возвращает задачу по имени или nil
+func (s *Scheduler) Job(name string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[name]
+}
+
+// Jobs возвращает задачи в порядке регистрации
+func (s *Scheduler) Jobs() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*Job, 0, len(s.order))
+	for _, name := range s.order {
+		jobs = append(jobs, s.jobs[name])
+	}
+	return jobs
+}
+
+// JobState — снимок состояния задачи для API
+type JobState struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Timezone string    `json:"timezone"`
+	Timeout  string    `json:"timeout"`
+	NextRun  time.Time `json:"next_run"`
+	Paused   bool      `json:"paused"`
+	Running  bool      `json:"running"`
+	LastRun  *JobRun   `json:"last_run"`
+}
+
+// State возвращает снимок состояния задачи
+func (job *Job) State() JobState {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	st := JobState{
+		Name:     job.Name,
+		Schedule: job.Schedule.spec,
+		Timezone: job.Schedule.loc.String(),
+		Timeout:  job.Timeout.String(),
+		NextRun:  job.next,
+		Paused:   job.paused,
+		Running:  job.running,
+	}
+	if n := len(job.history); n > 0 {
+		last := job.history[n-1]
+		st.LastRun = &last
+	}
+	return st
+}
+
+// Runs возвращает страницу истории запусков задачи, новые первыми, и общее число записей.
+// С хранилищем история читается из БД целиком, а не только последние jobHistoryLimit
+// запусков из памяти; незавершённые запуски этого экземпляра (их в БД ещё нет) идут первыми.
+func (s *Scheduler) Runs(job *Job, offset, limit int) ([]JobRun, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("неверная страница истории: смещение %d, размер %d", offset, limit)
+	}
+	if s.store == nil {
+		runs, total := job.Runs(offset, limit)
+		return runs, total, nil
+	}
+
+	var active []JobRun
+	job.mu.Lock()
+	for i := len(job.history) - 1; i >= 0; i-- {
+		if job.history[i].Status == JobStatusRunning {
+			active = append(active, job.history[i])
+		}
+	}
+	job.mu.Unlock()
+
+	runs := []JobRun{}
+	if offset < len(active) {
+		runs = append(runs, active[offset:min(len(active), offset+limit)]...)
+	}
+	stored, total, err := s.store.PageRuns(job.Name, max(offset-len(active), 0), limit-len(runs))
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(runs, stored...), total + len(active), nil
+}
+
+// Runs возвращает страницу истории запусков из памяти, новые первыми, и общее число записей
+func (job *Job) Runs(offset, limit int) ([]JobRun, int) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	total := len(job.history)
+	runs := []JobRun{}
+	if offset < 0 {
+		return runs, total
+	}
+	for i := total - 1 - offset; i >= 0 && len(runs) < limit; i-- {
+		runs = append(runs, job.history[i])
+	}
+	return runs, total
+}
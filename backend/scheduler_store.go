@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// schedulerStore хранит состояние задач между перезапусками и координирует
+// несколько экземпляров приложения: слот расписания выполняется один раз,
+// а задача одновременно выполняется только на одном экземпляре (аренда в БД).
+type schedulerStore interface {
+	// LoadJob возвращает сохранённое состояние задачи (ok=false, если задачи ещё нет)
+	LoadJob(job string) (state storedJobState, ok bool, err error)
+	// InitJob создаёт запись о задаче с точкой отсчёта для поиска пропусков
+	InitJob(job string, baseline time.Time) error
+	// ClaimSlot отмечает слот расписания как занятый; false — его уже занял другой экземпляр
+	ClaimSlot(job string, slot time.Time) (bool, error)
+	SetPaused(job string, paused bool) error
+	SaveRun(run JobRun) error
+	LoadRuns(job string, limit int) ([]JobRun, error)
+	// PageRuns возвращает страницу сохранённых запусков, новые первыми, и их общее число
+	PageRuns(job string, offset, limit int) ([]JobRun, int, error)
+
+	AcquireLease(job, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(job, owner string) error
+}
+
+// storedJobState — сохранённое состояние задачи
+type storedJobState struct {
+	LastSlot time.Time
+	Paused   bool
+}
+
+// mysqlSchedulerStore — реализация schedulerStore на MySQL
+type mysqlSchedulerStore struct {
+	db *sql.DB
+}
+
+func newMySQLSchedulerStore(dsn string) (*mysqlSchedulerStore, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &mysqlSchedulerStore{db: db}, nil
+}
+
+func (s *mysqlSchedulerStore) LoadJob(job string) (storedJobState, bool, error) {
+	var st storedJobState
+	var lastSlot sql.NullTime
+	err := s.db.QueryRow("SELECT last_slot, paused FROM scheduler_jobs WHERE name = ?", job).Scan(&lastSlot, &st.Paused)
+	if err == sql.ErrNoRows {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	st.LastSlot = lastSlot.Time
+	return st, true, nil
+}
+
+func (s *mysqlSchedulerStore) InitJob(job string, baseline time.Time) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO scheduler_jobs (name, last_slot, paused) VALUES (?, ?, FALSE)", job, baseline)
+	return err
+}
+
+func (s *mysqlSchedulerStore) ClaimSlot(job string, slot time.Time) (bool, error) {
+	res, err := s.db.Exec(`UPDATE scheduler_jobs SET last_slot = ?
+		WHERE name = ? AND (last_slot IS NULL OR last_slot < ?)`, slot, job, slot)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *mysqlSchedulerStore) SetPaused(job string, paused bool) error {
+	_, err := s.db.Exec("UPDATE scheduler_jobs SET paused = ? WHERE name = ?", paused, job)
+	return err
+}
+
+func (s *mysqlSchedulerStore) SaveRun(run JobRun) error {
+	_, err := s.db.Exec(`INSERT INTO scheduler_runs
+		(job, run_id, run_trigger, started_at, duration_ms, status, error, output, instance)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Job, run.ID, run.Trigger, run.Start, run.Duration.Milliseconds(), run.Status, run.Error, run.Output, schedulerInstanceID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE scheduler_jobs SET last_run_at = ?, last_status = ? WHERE name = ?`,
+		run.Start, run.Status, run.Job)
+	return err
+}
+
+func (s *mysqlSchedulerStore) LoadRuns(job string, limit int) ([]JobRun, error) {
+	runs, err := s.queryRuns(job, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Возвращаем в хронологическом порядке
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, nil
+}
+
+func (s *mysqlSchedulerStore) PageRuns(job string, offset, limit int) ([]JobRun, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM scheduler_runs WHERE job = ?", job).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	runs, err := s.queryRuns(job, offset, limit)
+	return runs, total, err
+}
+
+// queryRuns читает запуски задачи от новых к старым
+func (s *mysqlSchedulerStore) queryRuns(job string, offset, limit int) ([]JobRun, error) {
+	rows, err := s.db.Query(`SELECT run_id, run_trigger, started_at, duration_ms, status, error, output
+		FROM scheduler_runs WHERE job = ? ORDER BY id DESC LIMIT ? OFFSET ?`, job, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []JobRun{}
+	for rows.Next() {
+		run := JobRun{Job: job}
+		var durationMS int64
+		if err := rows.Scan(&run.ID, &run.Trigger, &run.Start, &durationMS, &run.Status, &run.Error, &run.Output); err != nil {
+			return nil, err
+		}
+		run.Duration = time.Duration(durationMS) * time.Millisecond
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// AcquireLease берёт или продлевает аренду задачи. Чужая аренда перехватывается только после истечения.
+func (s *mysqlSchedulerStore) AcquireLease(job, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// Порядок присваиваний важен: expires_at сравнивает уже обновлённого owner
+	_, err := s.db.Exec(`INSERT INTO scheduler_locks (job, owner, expires_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			owner = IF(expires_at < ? OR owner = VALUES(owner), VALUES(owner), owner),
+			expires_at = IF(owner = VALUES(owner), VALUES(expires_at), expires_at)`,
+		job, owner, now.Add(ttl), now)
+	if err != nil {
+		return false, err
+	}
+	var current string
+	if err := s.db.QueryRow("SELECT owner FROM scheduler_locks WHERE job = ?", job).Scan(&current); err != nil {
+		return false, err
+	}
+	return current == owner, nil
+}
+
+func (s *mysqlSchedulerStore) ReleaseLease(job, owner string) error {
+	_, err := s.db.Exec("DELETE FROM scheduler_locks WHERE job = ? AND owner = ?", job, owner)
+	return err
+}
+
+// schedulerInstanceID однозначно определяет экземпляр приложения в арендах
+var schedulerInstanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
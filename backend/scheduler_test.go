@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSchedulerStore — schedulerStore в памяти, общий для нескольких экземпляров планировщика
+type memSchedulerStore struct {
+	mu   sync.Mutex
+	jobs map[string]storedJobState
+	runs []JobRun // в порядке сохранения
+}
+
+func newMemSchedulerStore() *memSchedulerStore {
+	return &memSchedulerStore{jobs: make(map[string]storedJobState)}
+}
+
+func (m *memSchedulerStore) LoadJob(job string) (storedJobState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.jobs[job]
+	return st, ok, nil
+}
+
+func (m *memSchedulerStore) InitJob(job string, baseline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[job]; !ok {
+		m.jobs[job] = storedJobState{LastSlot: baseline}
+	}
+	return nil
+}
+
+func (m *memSchedulerStore) ClaimSlot(job string, slot time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.jobs[job]
+	if !st.LastSlot.Before(slot) {
+		return false, nil
+	}
+	st.LastSlot = slot
+	m.jobs[job] = st
+	return true, nil
+}
+
+func (m *memSchedulerStore) SetPaused(job string, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.jobs[job]
+	st.Paused = paused
+	m.jobs[job] = st
+	return nil
+}
+
+func (m *memSchedulerStore) SaveRun(run JobRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs = append(m.runs, run)
+	return nil
+}
+
+func (m *memSchedulerStore) LoadRuns(job string, limit int) ([]JobRun, error) {
+	runs, _, err := m.PageRuns(job, 0, limit)
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, err
+}
+
+func (m *memSchedulerStore) PageRuns(job string, offset, limit int) ([]JobRun, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []JobRun
+	for i := len(m.runs) - 1; i >= 0; i-- {
+		if m.runs[i].Job == job {
+			all = append(all, m.runs[i])
+		}
+	}
+	page := []JobRun{}
+	for i := offset; i < len(all) && len(page) < limit; i++ {
+		page = append(page, all[i])
+	}
+	return page, len(all), nil
+}
+
+func (m *memSchedulerStore) AcquireLease(job, owner string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (m *memSchedulerStore) ReleaseLease(job, owner string) error { return nil }
+
+func newTestScheduler(t *testing.T, store schedulerStore, fn JobFunc) (*Scheduler, *Job) {
+	t.Helper()
+	s := newScheduler()
+	s.store = store
+	job, err := s.Register("test", "0 3 * * *", time.UTC, time.Minute, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s, job
+}
+
+func TestSchedulerRunsPagingFromStore(t *testing.T) {
+	store := newMemSchedulerStore()
+	s, job := newTestScheduler(t, store, func(ctx context.Context) error { return nil })
+	const total = jobHistoryLimit + 50
+	for i := 0; i < total; i++ {
+		s.runJob(job, JobTriggerManual)
+	}
+
+	// В памяти только последние jobHistoryLimit запусков
+	if _, n := job.Runs(0, 10); n != jobHistoryLimit {
+		t.Fatalf("в памяти %d запусков, want %d", n, jobHistoryLimit)
+	}
+
+	runs, n, err := s.Runs(job, 0, 20)
+	if err != nil || n != total || len(runs) != 20 || runs[0].ID != total {
+		t.Fatalf("первая страница: %d записей из %d, первая #%d, %v", len(runs), n, runs[0].ID, err)
+	}
+	runs, n, err = s.Runs(job, total-20, 20)
+	if err != nil || n != total || len(runs) != 20 || runs[19].ID != 1 {
+		t.Fatalf("последняя страница: %d записей из %d, %v", len(runs), n, err)
+	}
+	if runs, _, _ := s.Runs(job, total, 20); len(runs) != 0 {
+		t.Fatalf("за концом истории %d записей", len(runs))
+	}
+}
+
+func TestSchedulerRunsIncludeActive(t *testing.T) {
+	store := newMemSchedulerStore()
+	started, finish := make(chan struct{}), make(chan struct{})
+	s, job := newTestScheduler(t, store, func(ctx context.Context) error {
+		started <- struct{}{}
+		<-finish
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		go func() { <-started; finish <- struct{}{} }()
+		s.runJob(job, JobTriggerManual)
+	}
+	if _, err := s.Trigger("test"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	defer close(finish)
+
+	runs, n, err := s.Runs(job, 0, 2)
+	if err != nil || n != 4 || len(runs) != 2 {
+		t.Fatalf("Runs = %d из %d, %v", len(runs), n, err)
+	}
+	if runs[0].Status != JobStatusRunning || runs[0].ID != 4 || runs[1].ID != 3 {
+		t.Fatalf("первая страница %+v", runs)
+	}
+	runs, _, _ = s.Runs(job, 2, 2)
+	if len(runs) != 2 || runs[0].ID != 2 || runs[1].ID != 1 {
+		t.Fatalf("вторая страница %+v", runs)
+	}
+}
+
+// Пауза, поставленная или снятая на другом экземпляре, учитывается перед каждым слотом
+func TestSchedulerPauseFromStore(t *testing.T) {
+	store := newMemSchedulerStore()
+	var mu sync.Mutex
+	calls := 0
+	s, job := newTestScheduler(t, store, func(ctx context.Context) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil
+	})
+	other, _ := newTestScheduler(t, store, func(ctx context.Context) error { return nil })
+	store.InitJob("test", time.Now().Add(-time.Hour))
+
+	slot := time.Now().Add(-30 * time.Minute)
+	if err := other.SetPaused("test", true); err != nil {
+		t.Fatal(err)
+	}
+	s.runSlot(job, slot, JobTriggerSchedule)
+	if calls != 0 || !job.State().Paused {
+		t.Fatalf("задача выполнена на паузе: вызовов %d, paused=%v", calls, job.State().Paused)
+	}
+
+	if err := other.SetPaused("test", false); err != nil {
+		t.Fatal(err)
+	}
+	s.runSlot(job, slot, JobTriggerSchedule)
+	if calls != 1 || job.State().Paused {
+		t.Fatalf("после снятия паузы: вызовов %d, paused=%v", calls, job.State().Paused)
+	}
+}
+
+func TestJobRunsHandlerPaging(t *testing.T) {
+	saved := scheduler
+	t.Cleanup(func() { scheduler = saved })
+	for _, store := range []schedulerStore{nil, newMemSchedulerStore()} {
+		s, job := newTestScheduler(t, store, func(ctx context.Context) error { return nil })
+		scheduler = s
+		for i := 0; i < 3; i++ {
+			s.runJob(job, JobTriggerManual)
+		}
+		cases := []struct {
+			query  string
+			status int
+			runs   int
+		}{
+			{"page=1&per_page=2", http.StatusOK, 2},
+			{"page=2&per_page=2", http.StatusOK, 1},
+			{"page=1000&per_page=20", http.StatusOK, 0},
+			{"page=9223372036854775807", http.StatusBadRequest, 0},
+			{"page=9223372036854775807&per_page=1", http.StatusOK, 0},
+			{"page=461168601842738791&per_page=20", http.StatusBadRequest, 0},
+			{"page=-5", http.StatusOK, 3},
+		}
+		for _, c := range cases {
+			rec := httptest.NewRecorder()
+			jobHandler(rec, httptest.NewRequest(http.MethodGet, "/api/jobs/test/runs?"+c.query, nil))
+			if rec.Code != c.status {
+				t.Fatalf("%s: статус %d, want %d: %s", c.query, rec.Code, c.status, rec.Body)
+			}
+			if c.status != http.StatusOK {
+				continue
+			}
+			var body struct{ Runs []JobRun }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Runs) != c.runs {
+				t.Fatalf("%s: записей %d, want %d", c.query, len(body.Runs), c.runs)
+			}
+		}
+	}
+}
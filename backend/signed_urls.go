@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Подписанные ссылки на видео. Подпись — HMAC-SHA256 от идентификатора видео,
+// срока действия, ссылки для общего доступа, по которой выдан адрес, и, если
+// адрес привязан к клиенту, его IP. Одна подпись действует и для файла, и для
+// HLS (/api/video/{id}/hls/...): в отдаваемые плейлисты параметры подписи
+// дописываются к каждой ссылке.
+//
+//	/api/video/{id}?expires=<unix>&ip=<IP клиента>&share=<id ссылки>&sig=<подпись>
+//
+// С VIDEO_SIGNED_URLS API отдаёт подписанные ссылки, а видео без подписи не
+// отдаётся. Без неё подпись необязательна, но если она есть — проверяется
+// (так работают ссылки для общего доступа, см. video_shares.go). Адрес,
+// выданный по ссылке для общего доступа, перестаёт действовать вместе с ней.
+
+// videoURLKey — ключ подписи: VIDEO_URL_SECRET или случайный ключ процесса
+var videoURLKey = sync.OnceValue(func() []byte {
+	if cfg.VideoURLSecret != "" {
+		return []byte(cfg.VideoURLSecret)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// checkVideoURLConfig проверяет настройки подписи при запуске: без общего
+// VIDEO_URL_SECRET подписанные ссылки не переживают перезапуск и не действуют
+// на других экземплярах, поэтому с VIDEO_SIGNED_URLS секрет обязателен.
+func checkVideoURLConfig() {
+	if cfg.VideoURLSecret != "" {
+		return
+	}
+	if cfg.VideoSignedURLs {
+		log.Fatal("VIDEO_SIGNED_URLS=true требует VIDEO_URL_SECRET: со случайным ключом процесса ссылки ломаются после перезапуска и на других экземплярах")
+	}
+	log.Printf("Внимание: VIDEO_URL_SECRET не задан, адреса видео по ссылкам для общего доступа действуют только до перезапуска и только на этом экземпляре")
+}
+
+// videoURLSignature — подпись ссылки на видео id до expires для клиента ip ("" — любой),
+// выданной по ссылке для общего доступа share (0 — не по ссылке)
+func videoURLSignature(id, expires int64, ip string, share int64) string {
+	mac := hmac.New(sha256.New, videoURLKey())
+	fmt.Fprintf(mac, "video:%d:%d:%s", id, expires, ip)
+	if share != 0 {
+		fmt.Fprintf(mac, ":share:%d", share)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signVideoQuery — параметры подписи ссылки на видео id
+func signVideoQuery(id int64, expires time.Time, ip string, share int64) url.Values {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	if share != 0 {
+		q.Set("share", strconv.FormatInt(share, 10))
+	}
+	q.Set("sig", videoURLSignature(id, expires.Unix(), ip, share))
+	return q
+}
+
+// clientIP — IP-адрес клиента для привязки ссылок
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// signedVideoQuery — строка запроса подписанной ссылки на видео v до expires,
+// выданной по ссылке для общего доступа share (0 — не по ссылке);
+// с VIDEO_URL_BIND_IP ссылка действует только для клиента, сделавшего запрос r
+func signedVideoQuery(r *http.Request, v *Video, expires time.Time, share int64) string {
+	ip := ""
+	if cfg.VideoURLBindIP {
+		ip = clientIP(r)
+	}
+	return "?" + signVideoQuery(v.ID, expires, ip, share).Encode()
+}
+
+// signedVideoJSON — видео для ответа API со ссылками, подписанными до expires
+func signedVideoJSON(r *http.Request, v *Video, expires time.Time, share int64) map[string]interface{} {
+	query := signedVideoQuery(r, v, expires, share)
+	m := v.toJSON()
+	m["url"] = v.streamURL() + query
+	if hls := v.hlsURL(); hls != "" {
+		m["hls_url"] = hls + query
+	}
+	m["url_expires_at"] = expires.Format("2006-01-02 15:04:05")
+	return m
+}
+
+// videoJSON — видео для ответа клиенту: с VIDEO_SIGNED_URLS ссылки подписаны
+// на VIDEO_URL_TTL_MINUTES
+func videoJSON(r *http.Request, v *Video) map[string]interface{} {
+	if !cfg.VideoSignedURLs {
+		return v.toJSON()
+	}
+	return signedVideoJSON(r, v, time.Now().Add(cfg.VideoURLTTL), 0)
+}
+
+// videoStreamURL — адрес файла видео для клиента, подписанный с VIDEO_SIGNED_URLS
+func videoStreamURL(r *http.Request, v *Video) string {
+	if !cfg.VideoSignedURLs {
+		return v.streamURL()
+	}
+	return v.streamURL() + signedVideoQuery(r, v, time.Now().Add(cfg.VideoURLTTL), 0)
+}
+
+// checkVideoAccess проверяет подпись ссылки на видео id и при ошибке отвечает 403
+func checkVideoAccess(w http.ResponseWriter, r *http.Request, id int64) bool {
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" {
+		if cfg.VideoSignedURLs {
+			http.Error(w, "Видео доступно только по подписанной ссылке", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	ip := query.Get("ip")
+	var share int64
+	if s := query.Get("share"); s != "" && err == nil {
+		share, err = strconv.ParseInt(s, 10, 64)
+	}
+	switch {
+	case err != nil || !hmac.Equal([]byte(sig), []byte(videoURLSignature(id, expires, ip, share))):
+		http.Error(w, "Неверная подпись ссылки", http.StatusForbidden)
+		return false
+	case time.Now().Unix() > expires:
+		http.Error(w, "Срок действия ссылки истёк", http.StatusForbidden)
+		return false
+	case ip != "" && ip != clientIP(r):
+		http.Error(w, "Ссылка выдана для другого адреса", http.StatusForbidden)
+		return false
+	}
+	if share != 0 {
+		active, err := catalog.ShareActive(r.Context(), share, id)
+		if err != nil {
+			log.Printf("Ошибка чтения ссылки %d: %v", share, err)
+			http.Error(w, "Ошибка чтения ссылки", http.StatusInternalServerError)
+			return false
+		}
+		if !active {
+			http.Error(w, "Ссылка отозвана или истекла", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// signPlaylistURIs дописывает параметры подписи из запроса к ссылкам плейлиста
+// HLS, иначе плеер запросит следующие плейлисты и сегменты без подписи
+func signPlaylistURIs(playlist []byte, r *http.Request) []byte {
+	query := r.URL.Query()
+	auth := url.Values{}
+	for _, name := range []string{"expires", "ip", "share", "sig"} {
+		if v := query.Get(name); v != "" {
+			auth.Set(name, v)
+		}
+	}
+	if len(auth) == 0 {
+		return playlist
+	}
+	suffix := auth.Encode()
+
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(playlist))
+	for sc.Scan() {
+		line := sc.Text()
+		if line != "" && !strings.HasPrefix(line, "#") {
+			if strings.Contains(line, "?") {
+				line += "&" + suffix
+			} else {
+				line += "?" + suffix
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckVideoAccessShareBinding(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	plain := signVideoQuery(7, expires, "", 0)
+	shared := signVideoQuery(7, expires, "", 42)
+	if shared.Get("sig") == plain.Get("sig") {
+		t.Fatal("подпись не зависит от ссылки для общего доступа")
+	}
+
+	tamper := func(q url.Values, key, value string) url.Values {
+		c := url.Values{}
+		for k, v := range q {
+			c[k] = v
+		}
+		if value == "" {
+			c.Del(key)
+		} else {
+			c.Set(key, value)
+		}
+		return c
+	}
+	cases := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"без ссылки", plain, http.StatusOK},
+		{"параметр share убран", tamper(shared, "share", ""), http.StatusForbidden},
+		{"подменён номер ссылки", tamper(shared, "share", "43"), http.StatusForbidden},
+		{"share добавлен к обычной подписи", tamper(plain, "share", "42"), http.StatusForbidden},
+		{"share не число", tamper(shared, "share", "x"), http.StatusForbidden},
+		{"другое видео", plain, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id := int64(7)
+			if c.name == "другое видео" {
+				id = 8
+			}
+			rec := httptest.NewRecorder()
+			ok := checkVideoAccess(rec, httptest.NewRequest(http.MethodGet, "/api/video/7?"+c.query.Encode(), nil), id)
+			if ok != (c.status == http.StatusOK) || rec.Code != c.status {
+				t.Fatalf("checkVideoAccess = %v, статус %d, want %d", ok, rec.Code, c.status)
+			}
+		})
+	}
+}
+
+func TestSignPlaylistURIsKeepsShare(t *testing.T) {
+	q := signVideoQuery(7, time.Now().Add(time.Hour), "", 42)
+	r := httptest.NewRequest(http.MethodGet, "/api/video/7/hls/master.m3u8?"+q.Encode(), nil)
+	out := string(signPlaylistURIs([]byte("#EXTM3U\n720p.m3u8\n"), r))
+	if !strings.Contains(out, "share=42") || !strings.Contains(out, "sig=") {
+		t.Fatalf("параметры ссылки потеряны: %q", out)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBlobNotFound = errors.New("файл не найден")
+	ErrInvalidKey   = errors.New("некорректное имя файла")
+)
+
+// BlobInfo — сведения об объекте в хранилище
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobReader читает объект с поддержкой Seek, поэтому с ним одинаково
+// работают http.ServeContent и ручная обработка Range на любом хранилище.
+type BlobReader interface {
+	io.ReadSeekCloser
+	Info() BlobInfo
+}
+
+// BlobStore — хранилище файлов видео. Ключ — путь через "/", без ".." и ведущего "/".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (BlobReader, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// Move переносит объект под новый ключ, заменяя существующий
+	Move(ctx context.Context, from, to string) error
+	// List возвращает объекты с указанным префиксом, отсортированные по ключу
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// videoStore — хранилище видео, выбранное в настройках (STORAGE_BACKEND)
+var videoStore BlobStore
+
+// initVideoStore создаёт хранилище видео согласно настройкам
+func initVideoStore() {
+	switch cfg.StorageBackend {
+	case "s3":
+		store, err := newS3BlobStore(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3Prefix)
+		if err != nil {
+			log.Fatal("Не удалось настроить S3-хранилище: ", err)
+		}
+		videoStore = store
+		log.Printf("Видео хранятся в S3: %s/%s", cfg.S3Endpoint, cfg.S3Bucket)
+	case "", "local":
+		if err := os.MkdirAll(cfg.VideoDir, 0755); err != nil {
+			log.Printf("Ошибка создания папки %s: %v", cfg.VideoDir, err)
+		}
+		videoStore = newLocalBlobStore(cfg.VideoDir)
+		log.Printf("Видео хранятся в папке %s", cfg.VideoDir)
+	default:
+		log.Fatalf("Неизвестное хранилище STORAGE_BACKEND=%q (local или s3)", cfg.StorageBackend)
+	}
+}
+
+// validateBlobKey защищает от path traversal
+func validateBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || strings.ContainsRune(key, 0) {
+		return ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// localBlobStore хранит объекты в папке на диске
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) *localBlobStore {
+	return &localBlobStore{root: root}
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.mkdirs(filepath.Dir(p)); err != nil {
+		return 0, err
+	}
+	// Пишем во временный файл рядом и переименовываем: читатели никогда не увидят
+	// недописанный файл, а перезапись существующего ключа атомарна. Sync до
+	// переименования, чтобы после сбоя питания под ключом не оказался пустой файл.
+	f, err := os.CreateTemp(filepath.Dir(p), localTempPrefix+filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(p))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+	return n, nil
+}
+
+// localTempPrefix — начало имени временных файлов Put; List их не показывает
+const localTempPrefix = "."
+
+// mkdirs создаёт недостающие папки и записывает на диск каждую новую запись в родительской
+func (s *localBlobStore) mkdirs(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := s.mkdirs(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// syncDir записывает на диск содержимое папки: без этого созданный или
+// переименованный файл может пропасть после сбоя питания
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RemoveStaleTemp удаляет временные файлы Put, брошенные при сбое, старше before
+func (s *localBlobStore) RemoveStaleTemp(before time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), localTempPrefix) || !strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(before) {
+			return nil
+		}
+		if err := os.Remove(p); err == nil {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// localBlobReader — открытый файл вместе с его сведениями
+type localBlobReader struct {
+	*os.File
+	info BlobInfo
+}
+
+func (r *localBlobReader) Info() BlobInfo { return r.info }
+
+func (s *localBlobStore) Open(ctx context.Context, key string) (BlobReader, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrBlobNotFound
+	}
+	return &localBlobReader{File: f, info: BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}}, nil
+}
+
+func (s *localBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if fi.IsDir() {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	return BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// Убираем опустевшие вложенные папки, как будто их и не было (как в S3)
+	for dir := filepath.Dir(p); dir != filepath.Clean(s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *localBlobStore) Move(ctx context.Context, from, to string) error {
+	src, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := s.mkdirs(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(src)); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(src); dir != filepath.Clean(s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var list []BlobInfo
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil // временные файлы Put
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // файл удалили во время обхода
+		}
+		list = append(list, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения папки %s: %v", s.root, err)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// blobBaseName возвращает имя файла из ключа
+func blobBaseName(key string) string {
+	return path.Base(key)
+}
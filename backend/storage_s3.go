@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3BlobStore — хранилище в S3-совместимом сервисе (AWS S3, MinIO и т.п.).
+// Используется path-style адресация (<endpoint>/<bucket>/<key>) и подпись AWS Signature V4.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func newS3BlobStore(endpoint, region, bucket, accessKey, secretKey, prefix string) (*s3BlobStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("нужны S3_ENDPOINT и S3_BUCKET")
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("неверный S3_ENDPOINT %q", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3BlobStore{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		prefix:    prefix,
+		client:    &http.Client{},
+	}, nil
+}
+
+// objectURL возвращает адрес объекта (или бакета, если key пустой)
+func (s *s3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + s.prefix + key
+	}
+	// Путь кодируем так же, как в подписи, чтобы запрос и подпись совпали
+	u.RawPath = s3EncodePath(u.Path)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do подписывает и выполняет запрос. Тело передаётся без подписи содержимого (UNSIGNED-PAYLOAD).
+func (s *s3BlobStore) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign добавляет заголовки подписи AWS Signature V4
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := []string{"host"}
+	for k := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "range" {
+			signedHeaders = append(signedHeaders, k)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape кодирует строку по правилам SigV4 (RFC 3986, незарезервированные символы как есть)
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EncodePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error читает тело ответа с ошибкой
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("S3: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Put загружает объект. Размер потока заранее неизвестен, поэтому данные
+// сначала пишутся во временный файл, а затем отправляются одним PUT.
+func (s *s3BlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if err := validateBlobKey(key); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp("", s3TempPattern)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return n, err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(key, nil), tmp, n, nil)
+	if err != nil {
+		return n, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return n, s3Error(resp)
+	}
+	return n, nil
+}
+
+// s3TempPattern — временные файлы Put в системной папке: объект в S3
+// появляется только после полной отправки, а брошенный файл остаётся здесь
+const s3TempPattern = "s3-upload-*"
+
+// RemoveStaleTemp удаляет временные файлы Put, брошенные при сбое, старше before
+func (s *s3BlobStore) RemoveStaleTemp(before time.Time) (int, error) {
+	files, err := filepath.Glob(filepath.Join(os.TempDir(), s3TempPattern))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().Before(before) && os.Remove(name) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	if err := validateBlobKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(key, nil), nil, 0, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return BlobInfo{}, s3Error(resp)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3BlobStore) Open(ctx context.Context, key string) (BlobReader, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobReader{store: s, ctx: ctx, info: info}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	// S3 отвечает 204 и на отсутствующий объект, поэтому сначала проверяем наличие
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// Move копирует объект на сервере (CopyObject) и удаляет исходный
+func (s *s3BlobStore) Move(ctx context.Context, from, to string) error {
+	if err := validateBlobKey(from); err != nil {
+		return err
+	}
+	if err := validateBlobKey(to); err != nil {
+		return err
+	}
+	source := s3EncodePath("/" + s.bucket + "/" + s.prefix + from)
+	header := http.Header{"X-Amz-Copy-Source": {source}}
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(to, nil), nil, 0, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	// Ошибка копирования может прийти в теле ответа со статусом 200
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "<Error>") {
+		return fmt.Errorf("ошибка копирования %s: %s", from, body)
+	}
+	return s.Delete(ctx, from)
+}
+
+// s3ListResult — ответ ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var list []BlobInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, s.objectURL("", q), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3: неверный ответ ListObjectsV2: %v", err)
+		}
+
+		for _, c := range result.Contents {
+			list = append(list, BlobInfo{Key: strings.TrimPrefix(c.Key, s.prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// s3BlobReader читает объект ranged-запросами GET: после Seek следующий Read
+// открывает новый запрос с заголовком Range от текущей позиции.
+type s3BlobReader struct {
+	store *s3BlobStore
+	ctx   context.Context
+	info  BlobInfo
+	pos   int64
+	body  io.ReadCloser
+}
+
+func (r *s3BlobReader) Info() BlobInfo { return r.info }
+
+func (r *s3BlobReader) Read(p []byte) (int, error) {
+	if r.pos >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(r.pos, 10) + "-"}}
+		resp, err := r.store.do(r.ctx, http.MethodGet, r.store.objectURL(r.info.Key, nil), nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		// Сервер без поддержки Range отдал объект целиком — пропускаем начало
+		if resp.StatusCode == http.StatusOK && r.pos > 0 {
+			if _, err := io.CopyN(io.Discard, resp.Body, r.pos); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.info.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3BlobReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.info.Size + offset
+	default:
+		return 0, errors.New("неверный whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("отрицательная позиция")
+	}
+	if pos != r.pos && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *s3BlobReader) Close() error {
+	if r.body != nil {
+		err := r.body.Close()
+		r.body = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3Region    = "eu-central-1"
+	testS3Bucket    = "media"
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// fakeS3 — S3 в памяти: проверяет подпись SigV4 каждого запроса и понимает
+// PutObject, CopyObject, HeadObject, GetObject с Range, DeleteObject и
+// ListObjectsV2 с постраничной выдачей
+type fakeS3 struct {
+	t        *testing.T
+	pageSize int
+
+	mu        sync.Mutex
+	objects   map[string]fakeS3Object
+	ranges    []string // заголовки Range запросов GetObject
+	listPages int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, pageSize: 2, objects: make(map[string]fakeS3Object)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySigV4(r); err != nil {
+		f.t.Logf("fake S3: %s %s: %v", r.Method, r.URL, err)
+		fakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testS3Bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, exists := f.objects[key]
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src, ok := f.objects[strings.TrimPrefix(source, "/"+testS3Bucket+"/")]
+		if err != nil || !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = fakeS3Object{data: src.data, modTime: time.Now()}
+		fmt.Fprint(w, "<CopyObjectResult><ETag>\"x\"</ETag></CopyObjectResult>")
+
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case !exists:
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+
+	case r.Method == http.MethodGet:
+		data := obj.data
+		if rg := r.Header.Get("Range"); rg != "" {
+			f.ranges = append(f.ranges, rg)
+			start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rg, "bytes="), "-"))
+			if err != nil || start >= len(data) {
+				fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start:]
+		}
+		w.Write(data)
+
+	default:
+		fakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list — ListObjectsV2 по pageSize объектов; токен продолжения — последний выданный ключ
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	f.listPages++
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if token := q.Get("continuation-token"); token != "" {
+		after, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		i := sort.SearchStrings(keys, string(after))
+		if i < len(keys) && keys[i] == string(after) {
+			i++
+		}
+		keys = keys[i:]
+	}
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+	for _, k := range keys {
+		obj := f.objects[k]
+		result.Contents = append(result.Contents, content{k, len(obj.data), obj.modTime.UTC().Format(time.RFC3339Nano)})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// sigV4Escape — кодирование URI по правилам SigV4: всё, кроме A-Z a-z 0-9 - _ . ~
+func sigV4Escape(s string) string {
+	const unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.~"
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if strings.IndexByte(unreserved, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// verifySigV4 заново вычисляет подпись AWS Signature V4 запроса секретным ключом
+func verifySigV4(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return fmt.Errorf("нет подписи: %q", auth)
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(rest, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		params[k] = v
+	}
+	cred := strings.Split(params["Credential"], "/")
+	if len(cred) != 5 || cred[0] != testS3AccessKey || cred[2] != testS3Region || cred[3] != "s3" || cred[4] != "aws4_request" {
+		return fmt.Errorf("неверный Credential %q", params["Credential"])
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, cred[1]) || time.Since(signedAt).Abs() > 15*time.Minute {
+		return fmt.Errorf("неверный X-Amz-Date %q", amzDate)
+	}
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		return errors.New("нет X-Amz-Content-Sha256")
+	}
+
+	signed := strings.Split(params["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return errors.New("SignedHeaders не отсортированы")
+	}
+	required := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if r.Header.Get("Range") != "" {
+		required = append(required, "range")
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		required = append(required, "x-amz-copy-source")
+	}
+	var headers strings.Builder
+	for _, name := range required {
+		if !contains(signed, name) {
+			return fmt.Errorf("заголовок %s не подписан", name)
+		}
+	}
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, sigV4Escape(k)+"="+sigV4Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+
+	var path []string
+	for _, seg := range strings.Split(r.URL.Path, "/") {
+		path = append(path, sigV4Escape(seg))
+	}
+	canonical := strings.Join([]string{r.Method, strings.Join(path, "/"), strings.Join(pairs, "&"),
+		headers.String(), params["SignedHeaders"], payload}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate,
+		strings.Join(cred[1:], "/"), hex.EncodeToString(hash[:])}, "\n")
+
+	key := []byte("AWS4" + testS3SecretKey)
+	for _, part := range []string{cred[1], cred[2], cred[3], cred[4], stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(params["Signature"])) {
+		return fmt.Errorf("подпись не совпадает, канонический запрос:\n%s", canonical)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestS3Store(t *testing.T, prefix string) (*s3BlobStore, *fakeS3) {
+	t.Helper()
+	fake, srv := newFakeS3(t)
+	store, err := newS3BlobStore(srv.URL, testS3Region, testS3Bucket, testS3AccessKey, testS3SecretKey, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+// testBlobStoreContract — общие требования к BlobStore для всех хранилищ
+func testBlobStoreContract(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	content := []byte(strings.Repeat("0123456789", 100))
+
+	t.Run("Put и Stat", func(t *testing.T) {
+		n, err := store.Put(ctx, "blobs/ab/video.mp4", bytes.NewReader(content))
+		if err != nil || n != int64(len(content)) {
+			t.Fatalf("Put = %d, %v", n, err)
+		}
+		info, err := store.Stat(ctx, "blobs/ab/video.mp4")
+		if err != nil || info.Size != int64(len(content)) || info.Key != "blobs/ab/video.mp4" || info.ModTime.IsZero() {
+			t.Fatalf("Stat = %+v, %v", info, err)
+		}
+		if _, err := store.Stat(ctx, "blobs/ab/none.mp4"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Stat отсутствующего: %v", err)
+		}
+		if _, err := store.Stat(ctx, "blobs/ab"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Stat папки: %v", err)
+		}
+	})
+
+	t.Run("перезапись", func(t *testing.T) {
+		if _, err := store.Put(ctx, "over.mp4", strings.NewReader("old")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Put(ctx, "over.mp4", strings.NewReader("new content")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readBlob(t, store, "over.mp4"); got != "new content" {
+			t.Fatalf("после перезаписи %q", got)
+		}
+	})
+
+	t.Run("Open и Seek", func(t *testing.T) {
+		r, err := store.Open(ctx, "blobs/ab/video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if r.Info().Size != int64(len(content)) {
+			t.Fatalf("Info().Size = %d", r.Info().Size)
+		}
+		buf := make([]byte, 5)
+		steps := []struct {
+			offset int64
+			whence int
+			pos    int64
+		}{
+			{10, io.SeekStart, 10},
+			{7, io.SeekCurrent, 22},
+			{-5, io.SeekEnd, int64(len(content)) - 5},
+			{0, io.SeekStart, 0},
+		}
+		for _, s := range steps {
+			pos, err := r.Seek(s.offset, s.whence)
+			if err != nil || pos != s.pos {
+				t.Fatalf("Seek(%d, %d) = %d, %v; want %d", s.offset, s.whence, pos, err, s.pos)
+			}
+			if _, err := io.ReadFull(r, buf); err != nil {
+				t.Fatalf("чтение с %d: %v", pos, err)
+			}
+			if string(buf) != string(content[pos:pos+5]) {
+				t.Fatalf("с позиции %d прочитано %q, want %q", pos, buf, content[pos:pos+5])
+			}
+		}
+		if _, err := r.Seek(0, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.Read(buf); n != 0 || err != io.EOF {
+			t.Fatalf("чтение в конце = %d, %v", n, err)
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err == nil {
+			t.Fatal("отрицательная позиция принята")
+		}
+		if _, err := store.Open(ctx, "blobs/ab/none.mp4"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Open отсутствующего: %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		for _, key := range []string{"list/c.mp4", "list/a.mp4", "list/sub/b.mp4", "list/d.mp4", "listing.mp4"} {
+			if _, err := store.Put(ctx, key, strings.NewReader(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list, err := store.List(ctx, "list/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, b := range list {
+			keys = append(keys, b.Key)
+			if b.Size != int64(len(b.Key)) {
+				t.Errorf("%s: размер %d", b.Key, b.Size)
+			}
+		}
+		if want := "list/a.mp4 list/c.mp4 list/d.mp4 list/sub/b.mp4"; strings.Join(keys, " ") != want {
+			t.Fatalf("List = %v, want %s", keys, want)
+		}
+		if list, err := store.List(ctx, "nothing/"); err != nil || len(list) != 0 {
+			t.Fatalf("List пустого префикса = %v, %v", list, err)
+		}
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		if _, err := store.Put(ctx, "incoming/tmp1", strings.NewReader("moved")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Move(ctx, "incoming/tmp1", "blobs/cd/moved.mp4"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readBlob(t, store, "blobs/cd/moved.mp4"); got != "moved" {
+			t.Fatalf("после переноса %q", got)
+		}
+		if _, err := store.Stat(ctx, "incoming/tmp1"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("исходный объект остался: %v", err)
+		}
+		if err := store.Move(ctx, "incoming/none", "blobs/cd/x.mp4"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Move отсутствующего: %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := store.Delete(ctx, "blobs/cd/moved.mp4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(ctx, "blobs/cd/moved.mp4"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("объект не удалён: %v", err)
+		}
+		if err := store.Delete(ctx, "blobs/cd/moved.mp4"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("повторное удаление: %v", err)
+		}
+	})
+
+	t.Run("ключи с пробелами и не ASCII", func(t *testing.T) {
+		key := "папка/файл (1)+а&б=в.mp4"
+		if _, err := store.Put(ctx, key, strings.NewReader("юникод")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readBlob(t, store, key); got != "юникод" {
+			t.Fatalf("прочитано %q", got)
+		}
+		list, err := store.List(ctx, "папка/")
+		if err != nil || len(list) != 1 || list[0].Key != key {
+			t.Fatalf("List = %v, %v", list, err)
+		}
+	})
+
+	t.Run("некорректные ключи", func(t *testing.T) {
+		for _, key := range []string{"", "/abs", "a/../b", "a//b", "a\\b", "./a", "a/.."} {
+			if _, err := store.Put(ctx, key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Put(%q): %v", key, err)
+			}
+			if _, err := store.Stat(ctx, key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Stat(%q): %v", key, err)
+			}
+		}
+	})
+}
+
+func readBlob(t *testing.T, store BlobStore, key string) string {
+	t.Helper()
+	r, err := store.Open(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("чтение %q: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	root := t.TempDir()
+	store := newLocalBlobStore(root)
+	testBlobStoreContract(t, store)
+	ctx := context.Background()
+
+	t.Run("пустые папки удаляются", func(t *testing.T) {
+		if _, err := store.Put(ctx, "deep/a/b/c.mp4", strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(ctx, "deep/a/b/c.mp4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "deep")); !os.IsNotExist(err) {
+			t.Fatalf("папка deep осталась: %v", err)
+		}
+	})
+
+	t.Run("временные файлы", func(t *testing.T) {
+		tmp := filepath.Join(root, "blobs", ".x.mp4.tmp-123")
+		if err := os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := store.List(ctx, "blobs/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range list {
+			if strings.Contains(b.Key, ".tmp-") {
+				t.Fatalf("List показал временный файл %s", b.Key)
+			}
+		}
+		if n, err := store.RemoveStaleTemp(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+			t.Fatalf("удалён свежий временный файл: %d, %v", n, err)
+		}
+		if n, err := store.RemoveStaleTemp(time.Now().Add(time.Hour)); err != nil || n != 1 {
+			t.Fatalf("RemoveStaleTemp = %d, %v", n, err)
+		}
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Fatal("временный файл не удалён")
+		}
+	})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	store, fake := newTestS3Store(t, "videos")
+	testBlobStoreContract(t, store)
+	ctx := context.Background()
+
+	t.Run("объекты под префиксом", func(t *testing.T) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		for key := range fake.objects {
+			if !strings.HasPrefix(key, "videos/") {
+				t.Errorf("объект %q вне префикса", key)
+			}
+		}
+	})
+
+	t.Run("постраничный List", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.listPages = 0
+		fake.mu.Unlock()
+		list, err := store.List(ctx, "list/")
+		if err != nil || len(list) != 4 {
+			t.Fatalf("List = %v, %v", list, err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if fake.listPages != 2 {
+			t.Fatalf("страниц запрошено %d, want 2 (по %d объекта)", fake.listPages, fake.pageSize)
+		}
+	})
+
+	t.Run("Seek через Range", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.ranges = nil
+		fake.mu.Unlock()
+		r, err := store.Open(ctx, "blobs/ab/video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		buf := make([]byte, 3)
+		r.Seek(100, io.SeekStart)
+		io.ReadFull(r, buf)
+		io.ReadFull(r, buf) // продолжение того же ответа без нового запроса
+		r.Seek(5, io.SeekStart)
+		io.ReadFull(r, buf)
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if want := "bytes=100- bytes=5-"; strings.Join(fake.ranges, " ") != want {
+			t.Fatalf("запросы Range %q, want %q", fake.ranges, want)
+		}
+	})
+
+	t.Run("неверный ключ доступа", func(t *testing.T) {
+		bad := *store
+		bad.secretKey = "wrong"
+		if _, err := bad.Put(ctx, "x.mp4", strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("запрос с неверной подписью: %v", err)
+		}
+	})
+}
+
+func TestNewS3BlobStore(t *testing.T) {
+	if _, err := newS3BlobStore("", "", "b", "", "", ""); err == nil {
+		t.Error("принят пустой endpoint")
+	}
+	if _, err := newS3BlobStore("http://localhost:9000", "", "", "", "", ""); err == nil {
+		t.Error("принят пустой бакет")
+	}
+	s, err := newS3BlobStore("http://localhost:9000/", "", "b", "", "", "p")
+	if err != nil || s.region != "us-east-1" || s.prefix != "p/" {
+		t.Fatalf("newS3BlobStore = %+v, %v", s, err)
+	}
+	if got := s.objectURL("a b/ц.mp4", nil).String(); got != "http://localhost:9000/b/p/a%20b/%D1%86.mp4" {
+		t.Errorf("objectURL = %s", got)
+	}
+}
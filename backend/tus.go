@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Возобновляемая загрузка видео по протоколу tus 1.0 (https://tus.io/protocols/resumable-upload).
+// Поддерживаются расширения creation, expiration, checksum и termination:
+//
+//	OPTIONS /api/tus/      — возможности сервера
+//	POST    /api/tus/      — создание загрузки (Upload-Length, Upload-Metadata: filename, title, description)
+//	HEAD    /api/tus/{id}  — текущее смещение
+//	PATCH   /api/tus/{id}  — очередной кусок данных
+//	DELETE  /api/tus/{id}  — отмена загрузки
+//
+// Незавершённые загрузки лежат в TUS_DIR: {id}.bin с данными и {id}.json с описанием.
+// Смещение — это размер {id}.bin, поэтому оно переживает перезапуск сервера.
+// Завершённая загрузка попадает в библиотеку видео через addVideo.
+// Превышение квот и нехватка места на диске — 507 с описанием в JSON (см. quota.go).
+
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,checksum,termination"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+
+	// statusChecksumMismatch — код ответа из расширения checksum
+	statusChecksumMismatch = 460
+)
+
+var errTusNotFound = errors.New("загрузка не найдена")
+
+// tusUpload — описание загрузки
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires"`
+	Uploader string            `json:"uploader"`
+	// VideoKey и VideoID — видео в каталоге после завершения загрузки
+	VideoKey string `json:"video_key,omitempty"`
+	VideoID  int64  `json:"video_id,omitempty"`
+}
+
+// tusStore хранит незавершённые загрузки на локальном диске (независимо от STORAGE_BACKEND)
+type tusStore struct {
+	dir string
+
+	mu   sync.Mutex
+	busy map[string]bool // загрузки, в которые сейчас идёт запись
+}
+
+var tusUploads = &tusStore{dir: cfg.TusDir, busy: make(map[string]bool)}
+
+func (s *tusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+func (s *tusStore) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+
+// lock не даёт двум запросам одновременно писать в одну загрузку
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+func (s *tusStore) create(length int64, metadata map[string]string, uploader string) (*tusUpload, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	u := &tusUpload{
+		ID:       hex.EncodeToString(b),
+		Length:   length,
+		Metadata: metadata,
+		Created:  now,
+		Expires:  now.Add(cfg.TusExpiration),
+		Uploader: uploader,
+	}
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := s.save(u); err != nil {
+		os.Remove(s.dataPath(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *tusStore) load(id string) (*tusUpload, error) {
+	if !isTusID(id) {
+		return nil, errTusNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errTusNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, fmt.Errorf("повреждено описание загрузки %s: %v", id, err)
+	}
+	return &u, nil
+}
+
+// save записывает описание через временный файл, чтобы не оставить его недописанным
+func (s *tusStore) save(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+// offset возвращает количество принятых байт
+func (s *tusStore) offset(u *tusUpload) (int64, error) {
+	if u.VideoKey != "" {
+		return u.Length, nil
+	}
+	fi, err := os.Stat(s.dataPath(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// cleanupExpired удаляет загрузки с истёкшим сроком
+func (s *tusStore) cleanupExpired(now time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !s.lock(id) {
+			continue
+		}
+		u, err := s.load(id)
+		if err == nil && now.After(u.Expires) {
+			s.remove(id)
+			removed++
+		}
+		s.unlock(id)
+	}
+	return removed, nil
+}
+
+func isTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata разбирает Upload-Metadata: "key base64,key2 base64,key3"
+func parseTusMetadata(header string) (map[string]string, error) {
+	md := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("пустой ключ в Upload-Metadata")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("неверное значение %q в Upload-Metadata", key)
+		}
+		md[key] = string(decoded)
+	}
+	return md, nil
+}
+
+func formatTusMetadata(md map[string]string) string {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(md[k])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseTusChecksum разбирает Upload-Checksum: "sha1 base64"
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	alg, value, ok := strings.Cut(header, " ")
+	if !ok {
+		return nil, nil, errors.New("неверный формат Upload-Checksum")
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, nil, errors.New("неверная контрольная сумма в Upload-Checksum")
+	}
+	switch alg {
+	case "md5":
+		return md5.New(), sum, nil
+	case "sha1":
+		return sha1.New(), sum, nil
+	case "sha256":
+		return sha256.New(), sum, nil
+	}
+	return nil, nil, fmt.Errorf("алгоритм %q не поддерживается", alg)
+}
+
+// videoFilename возвращает исходное имя файла из метаданных загрузки
+func (u *tusUpload) videoFilename() string {
+	if name := u.Metadata["filename"]; name != "" {
+		return name
+	}
+	return u.Metadata["name"]
+}
+
+// tusHandler обрабатывает запросы протокола tus
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers",
+		"Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, X-Video-Url")
+
+	method := r.Method
+	// Клиенты за прокси, которые режут PATCH и DELETE, передают метод в заголовке
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = strings.ToUpper(override)
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxVideoSize, 10))
+		w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Неподдерживаемая версия протокола tus", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tus/"), "/")
+	if id == "" {
+		if method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		tusCreate(w, r)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		tusHead(w, r, id)
+	case http.MethodPatch:
+		tusPatch(w, r, id)
+	case http.MethodDelete:
+		tusDelete(w, r, id)
+	default:
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length не поддерживается", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Неверный заголовок Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxVideoSize {
+		http.Error(w, "Файл слишком большой. Максимальный размер: 2GB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := (&tusUpload{Metadata: metadata}).videoFilename()
+	if filename == "" {
+		http.Error(w, "Имя файла не указано (filename в Upload-Metadata)", http.StatusBadRequest)
+		return
+	}
+	if !isVideoFile(filename) {
+		http.Error(w, "Файл не является видео", http.StatusBadRequest)
+		return
+	}
+
+	// Загрузка займёт место и в папке tus, и в хранилище после завершения
+	if err := checkUploadLimits(r.Context(), requestIdentity(r), cfg.TusDir, length); err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			log.Printf("tus: загрузка отклонена: %v", err)
+			writeStorageLimitError(w, err)
+			return
+		}
+		log.Printf("tus: ошибка проверки квот: %v", err)
+		http.Error(w, "Ошибка проверки квот", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := tusUploads.create(length, metadata, requestIdentity(r))
+	if err != nil {
+		log.Printf("tus: ошибка создания загрузки: %v", err)
+		http.Error(w, "Не удалось создать загрузку", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("tus: создана загрузка %s (%s, %d bytes)", u.ID, filename, length)
+
+	w.Header().Set("Location", "/api/tus/"+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loadActiveUpload загружает описание и отвечает клиенту, если загрузки нет или она истекла
+func loadActiveUpload(w http.ResponseWriter, id string) *tusUpload {
+	u, err := tusUploads.load(id)
+	if errors.Is(err, errTusNotFound) {
+		http.Error(w, "Загрузка не найдена", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("tus: %v", err)
+		http.Error(w, "Ошибка чтения загрузки", http.StatusInternalServerError)
+		return nil
+	}
+	if time.Now().After(u.Expires) {
+		tusUploads.remove(id)
+		http.Error(w, "Срок загрузки истёк", http.StatusGone)
+		return nil
+	}
+	return u
+}
+
+// setTusUploadHeaders отдаёт состояние загрузки; у завершённой — адрес видео,
+// такой же, как при обычной загрузке (по ID, с VIDEO_SIGNED_URLS — подписанный)
+func setTusUploadHeaders(w http.ResponseWriter, r *http.Request, u *tusUpload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if u.VideoKey == "" {
+		return
+	}
+	video := &Video{ID: u.VideoID, Key: u.VideoKey}
+	if video.ID == 0 {
+		// Загрузка завершена до того, как в описании стали хранить ID
+		v, err := catalog.GetByKey(r.Context(), u.VideoKey)
+		if err != nil {
+			log.Printf("tus: видео %s из загрузки %s не найдено: %v", u.VideoKey, u.ID, err)
+			return
+		}
+		video = v
+	}
+	w.Header().Set("X-Video-Url", videoStreamURL(r, video))
+}
+
+func tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	u := loadActiveUpload(w, id)
+	if u == nil {
+		return
+	}
+	offset, err := tusUploads.offset(u)
+	if err != nil {
+		log.Printf("tus: %v", err)
+		http.Error(w, "Ошибка чтения загрузки", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if len(u.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(u.Metadata))
+	}
+	setTusUploadHeaders(w, r, u, offset)
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Ожидается Content-Type: application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !tusUploads.lock(id) {
+		http.Error(w, "Загрузка уже выполняется другим запросом", http.StatusLocked)
+		return
+	}
+	defer tusUploads.unlock(id)
+
+	u := loadActiveUpload(w, id)
+	if u == nil {
+		return
+	}
+	offset, err := tusUploads.offset(u)
+	if err != nil {
+		log.Printf("tus: %v", err)
+		http.Error(w, "Ошибка чтения загрузки", http.StatusInternalServerError)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		http.Error(w, "Неверный заголовок Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if clientOffset != offset {
+		http.Error(w, fmt.Sprintf("Смещение не совпадает: на сервере %d", offset), http.StatusConflict)
+		return
+	}
+
+	var sum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if sum, expected, err = parseTusChecksum(header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	remaining := u.Length - offset
+	if r.ContentLength > remaining {
+		http.Error(w, "Данные выходят за пределы Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if remaining > 0 {
+		body := newSpaceGuardReader(r.Body, cfg.TusDir)
+		n, status, err := tusWriteChunk(u, offset, body, remaining, sum, expected)
+		if err != nil {
+			log.Printf("tus: загрузка %s: %v", id, err)
+			if status == http.StatusInsufficientStorage {
+				writeStorageLimitError(w, err)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		// По первым байтам сразу отсекаем файлы, которые не являются видео
+		if offset < 64 && (offset+n >= 64 || offset+n == u.Length) {
+			err := tusCheckMagic(u)
+			if errors.Is(err, errInvalidVideo) {
+				tusUploads.remove(id)
+				log.Printf("tus: загрузка %s отклонена: %v", id, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("tus: %v", err)
+				http.Error(w, "Ошибка чтения загрузки", http.StatusInternalServerError)
+				return
+			}
+		}
+		offset += n
+	}
+
+	u.Expires = time.Now().Add(cfg.TusExpiration)
+	if offset == u.Length && u.VideoKey == "" {
+		err := tusFinish(r.Context(), u)
+		if errors.Is(err, errInvalidVideo) {
+			tusUploads.remove(id)
+			log.Printf("tus: загрузка %s отклонена: %v", id, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errInsufficientStorage) {
+			// Данные остаются до истечения срока: повторный PATCH завершит загрузку
+			tusUploads.save(u)
+			log.Printf("tus: загрузка %s не сохранена: %v", id, err)
+			writeStorageLimitError(w, err)
+			return
+		}
+		if err != nil {
+			log.Printf("tus: не удалось сохранить видео из загрузки %s: %v", id, err)
+			http.Error(w, "Ошибка записи файла: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := tusUploads.save(u); err != nil {
+		log.Printf("tus: %v", err)
+	}
+
+	setTusUploadHeaders(w, r, u, offset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusWriteChunk дописывает кусок в файл загрузки. При обрыве соединения принятые байты
+// сохраняются, а кусок с контрольной суммой принимается только целиком.
+func tusWriteChunk(u *tusUpload, offset int64, body io.Reader, remaining int64, sum hash.Hash, expected []byte) (int64, int, error) {
+	f, err := os.OpenFile(tusUploads.dataPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+
+	var dst io.Writer = f
+	if sum != nil {
+		dst = io.MultiWriter(f, sum)
+	}
+	n, copyErr := io.Copy(dst, io.LimitReader(body, remaining+1))
+
+	rollback := func() { f.Truncate(offset) }
+	if n > remaining {
+		rollback()
+		return 0, http.StatusRequestEntityTooLarge, errors.New("данные выходят за пределы Upload-Length")
+	}
+	if errors.Is(copyErr, errInsufficientStorage) {
+		// Принятое сохраняем: клиент продолжит, когда место освободится
+		if sum != nil {
+			rollback()
+			return 0, http.StatusInsufficientStorage, copyErr
+		}
+		f.Sync()
+		return n, http.StatusInsufficientStorage, copyErr
+	}
+	if copyErr != nil {
+		if sum != nil {
+			rollback()
+			return 0, http.StatusBadRequest, fmt.Errorf("кусок получен не полностью: %v", copyErr)
+		}
+		f.Sync()
+		return n, http.StatusBadRequest, fmt.Errorf("соединение прервано, принято %d bytes: %v", n, copyErr)
+	}
+	if sum != nil && !bytes.Equal(sum.Sum(nil), expected) {
+		rollback()
+		return 0, statusChecksumMismatch, errors.New("контрольная сумма не совпадает")
+	}
+	if err := f.Sync(); err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	return n, 0, nil
+}
+
+// tusCheckMagic проверяет сигнатуру по началу принятых данных
+func tusCheckMagic(u *tusUpload) error {
+	f, err := os.Open(tusUploads.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	return checkVideoMagic(head[:n], u.videoFilename())
+}
+
+// tusFinish переносит завершённую загрузку в библиотеку видео
+func tusFinish(ctx context.Context, u *tusUpload) error {
+	f, err := os.Open(tusUploads.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Сохранение не должно прерываться, если клиент отключится, не дождавшись ответа
+	video, err := addVideo(context.WithoutCancel(ctx), videoUpload{
+		OriginalFilename: u.videoFilename(),
+		Title:            u.Metadata["title"],
+		Description:      u.Metadata["description"],
+		Uploader:         u.Uploader,
+	}, f)
+	if err != nil {
+		return err
+	}
+	log.Printf("✅ Видео загружено через tus: %s (%d bytes)", video.Key, video.Size)
+
+	// Описание оставляем до истечения срока, чтобы повторный HEAD видел завершённую загрузку
+	u.VideoKey, u.VideoID = video.Key, video.ID
+	if err := tusUploads.save(u); err != nil {
+		return err
+	}
+	os.Remove(tusUploads.dataPath(u.ID))
+	return nil
+}
+
+func tusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if !tusUploads.lock(id) {
+		http.Error(w, "Загрузка уже выполняется другим запросом", http.StatusLocked)
+		return
+	}
+	defer tusUploads.unlock(id)
+
+	if _, err := tusUploads.load(id); errors.Is(err, errTusNotFound) {
+		http.Error(w, "Загрузка не найдена", http.StatusNotFound)
+		return
+	}
+	tusUploads.remove(id)
+	log.Printf("tus: загрузка %s отменена", id)
+	w.WriteHeader(http.StatusNoContent)
+}
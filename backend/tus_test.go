@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTusVideoURLHeader(t *testing.T) {
+	saved := cfg.VideoSignedURLs
+	t.Cleanup(func() { cfg.VideoSignedURLs = saved })
+	u := &tusUpload{ID: "abc", Length: 10, Expires: time.Now().Add(time.Hour), VideoKey: "clip.mp4", VideoID: 12}
+
+	for _, signed := range []bool{false, true} {
+		cfg.VideoSignedURLs = signed
+		r := httptest.NewRequest(http.MethodHead, "/api/tus/abc", nil)
+		rec := httptest.NewRecorder()
+		setTusUploadHeaders(rec, r, u, u.Length)
+
+		got := rec.Header().Get("X-Video-Url")
+		if !strings.HasPrefix(got, "/api/video/12") {
+			t.Fatalf("signed=%v: X-Video-Url = %q", signed, got)
+		}
+		if signed != strings.Contains(got, "sig=") {
+			t.Fatalf("signed=%v: X-Video-Url = %q", signed, got)
+		}
+		if signed {
+			access := httptest.NewRecorder()
+			if !checkVideoAccess(access, httptest.NewRequest(http.MethodGet, got, nil), 12) {
+				t.Fatalf("адрес из X-Video-Url не открывается: %d", access.Code)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	setTusUploadHeaders(rec, httptest.NewRequest(http.MethodHead, "/api/tus/abc", nil), &tusUpload{Expires: time.Now()}, 3)
+	if rec.Header().Get("X-Video-Url") != "" || rec.Header().Get("Upload-Offset") != "3" {
+		t.Fatalf("незавершённая загрузка: %v", rec.Header())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Хранение видео по содержимому: файл лежит под ключом из его SHA-256
+// (blobs/ab/<hash>), записи каталога ссылаются на него. Одинаковые загрузки
+// хранятся один раз, таблица video_blobs считает ссылки, и файл удаляется
+// вместе с последней ссылкой. Содержимое файла по хешу никогда не меняется.
+
+const (
+	blobPrefix = "blobs/"
+	// incomingPrefix — временные объекты: хеш ещё не посчитан или файл не проверен
+	incomingPrefix = "incoming/"
+)
+
+// contentBlobKey — ключ файла по его SHA-256
+func contentBlobKey(sum string) string {
+	return blobPrefix + sum[:2] + "/" + sum
+}
+
+// putIncoming сохраняет поток во временный объект и считает его SHA-256 на лету
+func putIncoming(ctx context.Context, r io.Reader) (key string, size int64, sum string, err error) {
+	key = incomingPrefix + fmt.Sprintf("%d_%s", time.Now().UnixNano(), generateRandomString(12))
+	hash := sha256.New()
+	size, err = videoStore.Put(ctx, key, io.TeeReader(r, hash))
+	if err != nil {
+		if delErr := videoStore.Delete(context.WithoutCancel(ctx), key); delErr != nil && !errors.Is(delErr, ErrBlobNotFound) {
+			log.Printf("Не удалось удалить временный файл %s: %v", key, delErr)
+		}
+		return "", size, "", err
+	}
+	return key, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// AcquireBlob добавляет ссылку на содержимое с хешем sum. Временный объект
+// incoming переносится на место по хешу, а если такое содержимое уже
+// хранится — удаляется. duplicate сообщает, что файл уже был.
+func (c *videoCatalog) AcquireBlob(ctx context.Context, incoming, sum string, size int64) (key string, duplicate bool, err error) {
+	key = contentBlobKey(sum)
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	// Блокировка строки не даёт одновременному удалению убрать файл из-под новой ссылки
+	var refs int
+	err = tx.QueryRowContext(ctx, "SELECT refs FROM video_blobs WHERE sha256 = ? FOR UPDATE", sum).Scan(&refs)
+	if err != nil && err != sql.ErrNoRows {
+		return "", false, err
+	}
+	exists := err == nil
+	if exists {
+		if _, statErr := videoStore.Stat(ctx, key); statErr != nil {
+			exists = false // запись есть, а файл пропал: кладём заново
+		}
+	}
+
+	if !exists {
+		// Хеш содержимого уже посчитан при записи: наблюдателю не нужно читать файл заново
+		placedBlobs.mark(key, time.Now())
+		if err := videoStore.Move(ctx, incoming, key); err != nil {
+			return "", false, err
+		}
+	}
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO video_blobs (sha256, storage_key, size, refs, created_at, updated_at)
+		VALUES (?, ?, ?, 1, ?, ?) ON DUPLICATE KEY UPDATE refs = refs + 1, updated_at = ?`,
+		sum, key, size, now, now, now)
+	if err != nil {
+		return "", false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+
+	if exists {
+		if err := videoStore.Delete(ctx, incoming); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			log.Printf("Не удалось удалить временный файл %s: %v", incoming, err)
+		}
+	}
+	return key, exists, nil
+}
+
+// ReleaseBlob убирает ссылку на содержимое и удаляет файл, если ссылок не осталось
+func (c *videoCatalog) ReleaseBlob(ctx context.Context, sum string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refs int
+	var key string
+	err = tx.QueryRowContext(ctx, "SELECT refs, storage_key FROM video_blobs WHERE sha256 = ? FOR UPDATE", sum).Scan(&refs, &key)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if refs > 1 {
+		if _, err := tx.ExecContext(ctx, "UPDATE video_blobs SET refs = refs - 1 WHERE sha256 = ?", sum); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM video_blobs WHERE sha256 = ?", sum); err != nil {
+		return err
+	}
+	// Файл удаляем до фиксации: если удалить не получится, ссылка останется
+	if err := videoStore.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	return tx.Commit()
+}
+
+// blobGracePeriod — файлы моложе этого срока сверка не трогает: загрузка могла
+// уже получить ссылку на файл, но ещё не добавить запись в каталог
+const blobGracePeriod = time.Hour
+
+// RemoveOrphanBlobs удаляет файлы, на которые не ссылается ни одна запись каталога,
+// хотя счётчик говорит обратное (например, удаление прервалось между записью
+// и файлом). Возвращает ключи удалённых (с dryRun — подлежащих удалению) файлов.
+func (c *videoCatalog) RemoveOrphanBlobs(ctx context.Context, dryRun bool) ([]string, error) {
+	const orphanCond = `NOT EXISTS (SELECT 1 FROM videos v WHERE v.blob_key = b.storage_key)`
+	cutoff := time.Now().Add(-blobGracePeriod)
+
+	rows, err := c.db.QueryContext(ctx, "SELECT b.sha256, b.storage_key FROM video_blobs b WHERE b.updated_at < ? AND "+orphanCond, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	type orphan struct{ sum, key string }
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.sum, &o.key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, o := range orphans {
+		if dryRun {
+			removed = append(removed, o.key)
+			continue
+		}
+		ok, err := c.removeOrphanBlob(ctx, o.sum, cutoff, orphanCond)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, o.key)
+		}
+	}
+	return removed, nil
+}
+
+// removeOrphanBlob удаляет запись и файл, перепроверив под блокировкой, что ссылок нет
+func (c *videoCatalog) removeOrphanBlob(ctx context.Context, sum string, cutoff time.Time, orphanCond string) (bool, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRowContext(ctx, "SELECT b.storage_key FROM video_blobs b WHERE b.sha256 = ? AND b.updated_at < ? AND "+orphanCond+" FOR UPDATE",
+		sum, cutoff).Scan(&key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM video_blobs WHERE sha256 = ?", sum); err != nil {
+		return false, err
+	}
+	if err := videoStore.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// BlobKeys возвращает ключи всех учтённых файлов
+func (c *videoCatalog) BlobKeys(ctx context.Context) (map[string]bool, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT storage_key FROM video_blobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Каталог видео в таблице videos. Список, отдача и удаление работают по каталогу,
+// а файлы в хранилище — только содержимое, хранимое по хешу (см. video_blobs.go).
+// Расхождения, появившиеся в обход приложения, исправляет команда reconcile.
+
+// Статусы видео в каталоге
+const (
+	// videoStatusUploading — файл ещё загружается; такие записи не видны в списке
+	videoStatusUploading = "uploading"
+	videoStatusReady     = "ready"
+	videoStatusMissing   = "missing" // файл пропал из хранилища
+	// videoStatusCorrupted — содержимое файла не совпало с хешем; файл перенесён
+	// в quarantine/ и вернётся в ready, когда то же содержимое загрузят заново
+	videoStatusCorrupted = "corrupted"
+	// videoStatusTrashed — видео в корзине: не видно и не отдаётся, файл хранится
+	// до восстановления или окончательного удаления (см. video_trash.go)
+	videoStatusTrashed = "trashed"
+)
+
+var errVideoNotFound = errors.New("видео не найдено")
+
+// Video — запись каталога
+type Video struct {
+	ID               int64
+	Key              string // имя видео в адресах API
+	BlobKey          string // ключ файла в хранилище (по SHA-256 содержимого)
+	OriginalFilename string
+	Title            string
+	Description      string
+	Size             int64
+	MIME             string
+	SHA256           string
+	Uploader         string
+	CreatedAt        time.Time
+	Status           string
+	// Faststart — moov в начале файла, воспроизведение начинается без запроса конца файла
+	Faststart bool
+	// HLSStatus — состояние упаковки в HLS (hlsStatus*), пусто — не выполнялась
+	HLSStatus string
+	// DeletedAt и DeletedBy — когда и кем видео перемещено в корзину
+	DeletedAt time.Time
+	DeletedBy string
+	// Folder — папка библиотеки ("" — корень), Tags — метки (таблица video_tags,
+	// заполняются только там, где нужны)
+	Folder string
+	Tags   []string
+	// LastPlayedAt — когда видео последний раз начинали смотреть (нулевое — ни разу)
+	LastPlayedAt time.Time
+	videoMeta
+}
+
+// toJSON — представление видео в ответах API
+func (v *Video) toJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                v.ID,
+		"filename":          v.Key,
+		"original_filename": v.OriginalFilename,
+		"title":             v.Title,
+		"description":       v.Description,
+		"size":              v.Size,
+		"mime_type":         v.MIME,
+		"sha256":            v.SHA256,
+		"uploader":          v.Uploader,
+		"uploaded_at":       v.CreatedAt.Format("2006-01-02 15:04:05"),
+		"status":            v.Status,
+		"url":               v.streamURL(),
+		"duration":          v.Duration,
+		"width":             v.Width,
+		"height":            v.Height,
+		"fps":               v.FPS,
+		"video_codec":       v.VideoCodec,
+		"audio_codec":       v.AudioCodec,
+		"faststart":         v.Faststart,
+		"hls_status":        v.HLSStatus,
+		"hls_url":           v.hlsURL(),
+		"folder":            v.Folder,
+		"tags":              tagsJSON(v.Tags),
+		"last_played_at":    formatOptionalTime(v.LastPlayedAt),
+	}
+}
+
+// formatOptionalTime форматирует время для API; нулевое время — пустая строка
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// streamURL — постоянный адрес файла видео: по id, а не по имени, которое может смениться
+func (v *Video) streamURL() string {
+	return fmt.Sprintf("/api/video/%d", v.ID)
+}
+
+// hlsURL — адрес мастер-плейлиста HLS, если упаковка готова
+func (v *Video) hlsURL() string {
+	if v.HLSStatus != hlsStatusReady {
+		return ""
+	}
+	return fmt.Sprintf("/api/video/%d/hls/%s", v.ID, hlsMasterPlaylist)
+}
+
+// videoCatalog — доступ к таблице videos
+type videoCatalog struct {
+	db *sql.DB
+}
+
+// sql.Open не подключается к БД, поэтому каталог можно создать при старте без проверок
+var catalog = newVideoCatalog(DBConnection)
+
+func newVideoCatalog(dsn string) *videoCatalog {
+	db, _ := sql.Open("mysql", dsn)
+	return &videoCatalog{db: db}
+}
+
+const videoColumns = `id, storage_key, blob_key, original_filename, title, description, size,
+	mime_type, sha256, uploader, created_at, status,
+	duration, width, height, fps, video_codec, audio_codec, faststart, hls_status, deleted_at, deleted_by,
+	folder, last_played_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanVideo(row rowScanner) (*Video, error) {
+	var v Video
+	var deletedAt, lastPlayedAt sql.NullTime
+	err := row.Scan(&v.ID, &v.Key, &v.BlobKey, &v.OriginalFilename, &v.Title, &v.Description, &v.Size,
+		&v.MIME, &v.SHA256, &v.Uploader, &v.CreatedAt, &v.Status,
+		&v.Duration, &v.Width, &v.Height, &v.FPS, &v.VideoCodec, &v.AudioCodec, &v.Faststart, &v.HLSStatus,
+		&deletedAt, &v.DeletedBy,
+		&v.Folder, &lastPlayedAt)
+	if err == sql.ErrNoRows {
+		return nil, errVideoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.DeletedAt = deletedAt.Time
+	v.LastPlayedAt = lastPlayedAt.Time
+	return &v, nil
+}
+
+func (c *videoCatalog) queryVideos(ctx context.Context, query string, args ...interface{}) ([]*Video, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var videos []*Video
+	for rows.Next() {
+		v, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
+
+// Insert добавляет видео и заполняет v.ID
+func (c *videoCatalog) Insert(ctx context.Context, v *Video) error {
+	res, err := c.db.ExecContext(ctx, `INSERT INTO videos
+		(storage_key, blob_key, original_filename, title, description, size, mime_type, sha256, uploader, created_at, status,
+		 duration, width, height, fps, video_codec, audio_codec, faststart, folder)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		v.Key, v.BlobKey, v.OriginalFilename, v.Title, v.Description, v.Size, v.MIME, v.SHA256, v.Uploader, v.CreatedAt, v.Status,
+		v.Duration, v.Width, v.Height, v.FPS, v.VideoCodec, v.AudioCodec, v.Faststart, v.Folder)
+	if err != nil {
+		return err
+	}
+	v.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetByKey ищет видео по имени
+func (c *videoCatalog) GetByKey(ctx context.Context, key string) (*Video, error) {
+	return scanVideo(c.db.QueryRowContext(ctx, "SELECT "+videoColumns+" FROM videos WHERE storage_key = ?", key))
+}
+
+// GetByID ищет видео по идентификатору
+func (c *videoCatalog) GetByID(ctx context.Context, id int64) (*Video, error) {
+	return scanVideo(c.db.QueryRowContext(ctx, "SELECT "+videoColumns+" FROM videos WHERE id = ?", id))
+}
+
+// List возвращает видео с указанным статусом в порядке загрузки
+func (c *videoCatalog) List(ctx context.Context, status string) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+" FROM videos WHERE status = ? ORDER BY id", status)
+}
+
+// videoFilter — условия выборки для списка видео (см. video_search.go)
+type videoFilter struct {
+	Status    string
+	Folder    *string  // nil — любая папка, "" — корень
+	Recursive bool     // вместе с вложенными папками
+	Tags      []string // видео должно иметь все метки
+	Search    string   // слова в названии или описании
+	Exts      []string // расширения без точки в нижнем регистре
+	MinSize   int64    // 0 — без ограничения
+	MaxSize   int64
+	From      time.Time // загружено не раньше From; нулевое — без ограничения
+	To        time.Time // и раньше To
+	Sort      string    // videoSort*, пусто — по времени загрузки
+	Desc      bool
+	Limit     int // 0 — все видео
+	After     *videoCursor
+}
+
+// Find возвращает видео, подходящие под фильтр, в порядке сортировки и курсор
+// следующей страницы (nil, если это последняя)
+func (c *videoCatalog) Find(ctx context.Context, f videoFilter) ([]*Video, *videoCursor, error) {
+	where := []string{"status = ?"}
+	args := []interface{}{f.Status}
+	if f.Folder != nil {
+		switch {
+		case !f.Recursive:
+			where = append(where, "folder = ?")
+			args = append(args, *f.Folder)
+		case *f.Folder != "":
+			cond, condArgs := folderCond("folder", *f.Folder)
+			where = append(where, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	for _, tag := range f.Tags {
+		where = append(where, "EXISTS (SELECT 1 FROM video_tags t WHERE t.video_id = videos.id AND t.tag = ?)")
+		args = append(args, tag)
+	}
+	if q := fullTextQuery(f.Search); q != "" {
+		where = append(where, "MATCH (title, description) AGAINST (? IN BOOLEAN MODE)")
+		args = append(args, q)
+	}
+	if len(f.Exts) > 0 {
+		where = append(where, "ext IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(f.Exts)), ", ")+")")
+		for _, ext := range f.Exts {
+			args = append(args, ext)
+		}
+	}
+	if f.MinSize > 0 {
+		where = append(where, "size >= ?")
+		args = append(args, f.MinSize)
+	}
+	if f.MaxSize > 0 {
+		where = append(where, "size <= ?")
+		args = append(args, f.MaxSize)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To)
+	}
+
+	sort := f.Sort
+	if sort == "" {
+		sort = videoSortUploaded
+	}
+	column := videoSortColumns[sort]
+	cmp, dir := ">", "ASC"
+	if f.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if f.After != nil {
+		value, err := f.After.arg()
+		if err != nil {
+			return nil, nil, err
+		}
+		where = append(where, "("+column+" "+cmp+" ? OR ("+column+" = ? AND id "+cmp+" ?))")
+		args = append(args, value, value, f.After.ID)
+	}
+
+	query := "SELECT " + videoColumns + " FROM videos WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + column + " " + dir + ", id " + dir
+	if f.Limit > 0 {
+		// Лишняя строка показывает, есть ли следующая страница
+		query += " LIMIT " + strconv.Itoa(f.Limit+1)
+	}
+	videos, err := c.queryVideos(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.Limit > 0 && len(videos) > f.Limit {
+		videos = videos[:f.Limit]
+		return videos, newVideoCursor(videos[len(videos)-1], sort, f.Desc), nil
+	}
+	return videos, nil, nil
+}
+
+// LoadTags заполняет метки видео
+func (c *videoCatalog) LoadTags(ctx context.Context, videos []*Video) error {
+	const chunk = 1000
+	for start := 0; start < len(videos); start += chunk {
+		part := videos[start:min(start+chunk, len(videos))]
+		byID := make(map[int64]*Video, len(part))
+		args := make([]interface{}, len(part))
+		for i, v := range part {
+			byID[v.ID] = v
+			v.Tags = nil
+			args[i] = v.ID
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(part)), ", ")
+		rows, err := c.db.QueryContext(ctx, "SELECT video_id, tag FROM video_tags WHERE video_id IN ("+placeholders+") ORDER BY tag", args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			var tag string
+			if err := rows.Scan(&id, &tag); err != nil {
+				rows.Close()
+				return err
+			}
+			byID[id].Tags = append(byID[id].Tags, tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All возвращает все записи каталога независимо от статуса
+func (c *videoCatalog) All(ctx context.Context) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+" FROM videos ORDER BY id")
+}
+
+func (c *videoCatalog) SetStatus(ctx context.Context, id int64, status string) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE videos SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// FinishUpload сохраняет сведения о загруженном содержимом и открывает видео
+func (c *videoCatalog) FinishUpload(ctx context.Context, v *Video) error {
+	res, err := c.db.ExecContext(ctx, `UPDATE videos SET blob_key = ?, size = ?, mime_type = ?, sha256 = ?, status = ?,
+		duration = ?, width = ?, height = ?, fps = ?, video_codec = ?, audio_codec = ?, faststart = ?
+		WHERE id = ? AND status = ?`,
+		v.BlobKey, v.Size, v.MIME, v.SHA256, videoStatusReady,
+		v.Duration, v.Width, v.Height, v.FPS, v.VideoCodec, v.AudioCodec, v.Faststart,
+		v.ID, videoStatusUploading)
+	if err != nil {
+		return err
+	}
+	// Записи уже нет: загрузка шла дольше UPLOAD_STALE_HOURS и её убрала очистка
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errVideoNotFound
+	}
+	v.Status = videoStatusReady
+	return nil
+}
+
+// DeleteStaleUploads удаляет записи загрузок, начатых раньше before и не завершённых
+func (c *videoCatalog) DeleteStaleUploads(ctx context.Context, before time.Time) (int64, error) {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM videos WHERE status = ? AND created_at < ?", videoStatusUploading, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateContent переключает готовое видео с содержимого oldSHA256 на другое.
+// Если видео за это время удалили, переместили в корзину или сменили ему
+// содержимое, запись не меняется и возвращается errVideoNotFound.
+func (c *videoCatalog) UpdateContent(ctx context.Context, id int64, oldSHA256, blobKey string, size int64, sha256 string, faststart bool) error {
+	res, err := c.db.ExecContext(ctx, "UPDATE videos SET blob_key = ?, size = ?, sha256 = ?, faststart = ? WHERE id = ? AND sha256 = ? AND status = ?",
+		blobKey, size, sha256, faststart, id, oldSHA256, videoStatusReady)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errVideoNotFound
+	}
+	return nil
+}
+
+func (c *videoCatalog) SetHLSStatus(ctx context.Context, id int64, status string) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE videos SET hls_status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// playedThrottle — чаще этого отметка о просмотре не обновляется: на один
+// просмотр приходится много запросов диапазонов и сегментов
+const playedThrottle = time.Hour
+
+// MarkPlayed отмечает, что видео начали смотреть
+func (c *videoCatalog) MarkPlayed(ctx context.Context, id int64, at time.Time) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE videos SET last_played_at = ? WHERE id = ? AND (last_played_at IS NULL OR last_played_at < ?)",
+		at, id, at.Add(-playedThrottle))
+	return err
+}
+
+// TagsByVideo возвращает метки всех видео
+func (c *videoCatalog) TagsByVideo(ctx context.Context) (map[int64][]string, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT video_id, tag FROM video_tags ORDER BY video_id, tag")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make(map[int64][]string)
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		tags[id] = append(tags[id], tag)
+	}
+	return tags, rows.Err()
+}
+
+// Delete удаляет запись; метки и элементы плейлистов удаляются каскадно
+func (c *videoCatalog) Delete(ctx context.Context, id int64) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM videos WHERE id = ?", id)
+	return err
+}
+
+// videoTitleFromFilename — название по умолчанию: имя файла без расширения
+func videoTitleFromFilename(filename string) string {
+	name := blobBaseName(strings.ReplaceAll(filename, "\\", "/"))
+	if i := strings.LastIndex(name, "."); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// reconcileReport — итог сверки каталога с хранилищем
+type reconcileReport struct {
+	Added    []string // файлы, добавленные в каталог
+	Missing  []string // записи, файлы которых пропали
+	Restored []string // пропавшие файлы, которые снова появились
+	Skipped  []string // файлы, которые не удалось добавить
+	Orphaned []string // файлы по хешу, на которые никто не ссылается (удалены)
+}
+
+// reconcileCatalog сверяет каталог с хранилищем: добавляет видео, положенные в
+// корень хранилища в обход приложения, помечает записи, файлы которых удалены,
+// и удаляет файлы по хешу, на которые не осталось ссылок. С dryRun только
+// сообщает, что было бы сделано.
+func reconcileCatalog(ctx context.Context, dryRun bool, logf func(format string, args ...interface{})) (reconcileReport, error) {
+	var report reconcileReport
+
+	blobs, err := videoStore.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	videos, err := catalog.All(ctx)
+	if err != nil {
+		return report, fmt.Errorf("ошибка чтения каталога: %v", err)
+	}
+	known, err := catalog.BlobKeys(ctx)
+	if err != nil {
+		return report, fmt.Errorf("ошибка чтения каталога: %v", err)
+	}
+
+	stored := make(map[string]BlobInfo, len(blobs))
+	var loose []BlobInfo
+	for _, b := range blobs {
+		switch {
+		case strings.HasPrefix(b.Key, blobPrefix):
+			stored[b.Key] = b
+		case !strings.Contains(b.Key, "/") && isVideoFile(b.Key):
+			// Видео в корне хранилища положены в обход приложения
+			loose = append(loose, b)
+		}
+	}
+	inCatalog := make(map[string]bool, len(videos))
+	referenced := make(map[string]bool, len(videos))
+
+	for _, v := range videos {
+		inCatalog[v.Key] = true
+		referenced[v.BlobKey] = true
+		_, exists := stored[v.BlobKey]
+		switch {
+		case !exists && v.Status == videoStatusReady:
+			report.Missing = append(report.Missing, v.Key)
+			logf("Файл пропал из хранилища: %s (id %d, %s)", v.Key, v.ID, v.BlobKey)
+			if !dryRun {
+				if err := catalog.SetStatus(ctx, v.ID, videoStatusMissing); err != nil {
+					return report, err
+				}
+			}
+		case exists && (v.Status == videoStatusMissing || v.Status == videoStatusCorrupted):
+			report.Restored = append(report.Restored, v.Key)
+			logf("Файл снова в хранилище: %s (id %d)", v.Key, v.ID)
+			if !dryRun {
+				if err := catalog.SetStatus(ctx, v.ID, videoStatusReady); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	for _, b := range loose {
+		if inCatalog[b.Key] {
+			continue
+		}
+		if time.Since(b.ModTime) < cfg.VideoSettle {
+			// Файл, возможно, ещё копируют: добавит следующая сверка или наблюдатель
+			logf("Файл %s ещё записывается, пропущен", b.Key)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if dryRun {
+			report.Added = append(report.Added, b.Key)
+			logf("Новый файл: %s", b.Key)
+			continue
+		}
+		video, err := catalogStoredBlob(ctx, b)
+		if err != nil {
+			report.Skipped = append(report.Skipped, b.Key)
+			logf("Файл %s пропущен: %v", b.Key, err)
+			continue
+		}
+		referenced[video.BlobKey] = true
+		report.Added = append(report.Added, b.Key)
+		logf("Добавлен в каталог: %s (id %d, %s)", b.Key, video.ID, video.MIME)
+	}
+
+	// Учтённые файлы без ссылок (удаление прервалось между записью и файлом)
+	orphans, err := catalog.RemoveOrphanBlobs(ctx, dryRun)
+	if err != nil {
+		return report, err
+	}
+	// Файлы, которых нет даже в таблице (сбой между переносом и записью)
+	cutoff := time.Now().Add(-blobGracePeriod)
+	for key, b := range stored {
+		if known[key] || referenced[key] || b.ModTime.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := videoStore.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return report, err
+			}
+		}
+		orphans = append(orphans, key)
+	}
+	sort.Strings(orphans)
+	for _, key := range orphans {
+		logf("Файл без ссылок: %s", key)
+	}
+	report.Orphaned = orphans
+	return report, nil
+}
+
+// catalogStoredBlob проверяет видео, положенное в корень хранилища, переносит
+// его на место по хешу и добавляет в каталог под тем же именем
+func catalogStoredBlob(ctx context.Context, b BlobInfo) (*Video, error) {
+	f, err := videoStore.Open(ctx, b.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	container, meta, err := probeVideo(f, b.Size, b.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	f.Close()
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// Запись добавляем до переноса: если что-то не получится, файл останется на месте
+	video := &Video{
+		Key:              b.Key,
+		BlobKey:          contentBlobKey(sum),
+		OriginalFilename: b.Key,
+		Title:            videoTitleFromFilename(b.Key),
+		Size:             b.Size,
+		MIME:             container.MIME,
+		SHA256:           sum,
+		CreatedAt:        b.ModTime,
+		Status:           videoStatusReady,
+		Faststart:        container.Faststart,
+		videoMeta:        meta,
+	}
+	if err := catalog.Insert(ctx, video); err != nil {
+		return nil, err
+	}
+	if _, _, err := catalog.AcquireBlob(ctx, b.Key, sum, b.Size); err != nil {
+		if delErr := catalog.Delete(ctx, video.ID); delErr != nil {
+			log.Printf("Не удалось удалить запись %d: %v", video.ID, delErr)
+		}
+		return nil, err
+	}
+	return video, nil
+}
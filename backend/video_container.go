@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Проверка загруженного видео по содержимому: сигнатура в начале файла и разбор
+// структуры контейнера. Расширение файла должно соответствовать найденному контейнеру,
+// а MIME-тип берётся из контейнера, а не из расширения.
+
+// errInvalidVideo — файл не является видео, повреждён или не совпадает с расширением
+var errInvalidVideo = errors.New("файл не является корректным видео")
+
+func invalidVideo(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidVideo, fmt.Sprintf(format, args...))
+}
+
+// Семейства контейнеров
+const (
+	containerISOBMFF = "isobmff" // mp4, mov, m4v, 3gp
+	containerEBML    = "ebml"    // mkv, webm
+	containerRIFF    = "riff"    // avi
+	containerASF     = "asf"     // wmv
+	containerFLV     = "flv"
+)
+
+// videoContainer — контейнер, определённый по содержимому файла
+type videoContainer struct {
+	Family string
+	// Format — уточнённый формат: mp4, quicktime, m4v, 3gp, matroska, webm, avi, wmv, flv
+	Format string
+	MIME   string
+	// Faststart — описание (moov) идёт перед данными; для не-MP4 всегда true
+	Faststart bool
+}
+
+// containerByExt — какое семейство контейнера ожидается для расширения
+var containerByExt = map[string]string{
+	".mp4":  containerISOBMFF,
+	".m4v":  containerISOBMFF,
+	".mov":  containerISOBMFF,
+	".3gp":  containerISOBMFF,
+	".mkv":  containerEBML,
+	".webm": containerEBML,
+	".avi":  containerRIFF,
+	".wmv":  containerASF,
+	".flv":  containerFLV,
+}
+
+// Атомы, с которых может начинаться QuickTime-файл без ftyp
+var quicktimeLeadAtoms = map[string]bool{
+	"moov": true, "mdat": true, "wide": true, "free": true, "skip": true, "pnot": true,
+}
+
+var (
+	ebmlMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+
+	asfHeaderGUID     = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+	asfDataGUID       = []byte{0x36, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+	asfFilePropsGUID  = []byte{0xA1, 0xDC, 0xAB, 0x8C, 0x47, 0xA9, 0xCF, 0x11, 0x8E, 0xE4, 0x00, 0xC0, 0x0C, 0x20, 0x53, 0x65}
+	asfStreamPropGUID = []byte{0x91, 0x07, 0xDC, 0xB7, 0xB7, 0xA9, 0xCF, 0x11, 0x8E, 0xE6, 0x00, 0xC0, 0x0C, 0x20, 0x53, 0x65}
+)
+
+// sniffContainer определяет семейство контейнера по первым байтам файла
+func sniffContainer(head []byte) string {
+	switch {
+	case len(head) >= 8 && (string(head[4:8]) == "ftyp" || quicktimeLeadAtoms[string(head[4:8])]):
+		return containerISOBMFF
+	case bytes.HasPrefix(head, ebmlMagic):
+		return containerEBML
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return containerRIFF
+	case bytes.HasPrefix(head, asfHeaderGUID):
+		return containerASF
+	case len(head) >= 4 && string(head[0:3]) == "FLV" && head[3] == 1:
+		return containerFLV
+	}
+	return ""
+}
+
+// checkVideoMagic быстро отбраковывает файл по сигнатуре, ещё до сохранения
+func checkVideoMagic(head []byte, filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	family := sniffContainer(head)
+	if family == "" {
+		return invalidVideo("неизвестный формат содержимого")
+	}
+	if want := containerByExt[ext]; family != want {
+		return invalidVideo("содержимое (%s) не соответствует расширению %s", family, ext)
+	}
+	return nil
+}
+
+// probeContainer разбирает структуру контейнера и проверяет соответствие расширению
+func probeContainer(r io.ReadSeeker, size int64, filename string) (videoContainer, error) {
+	head := make([]byte, 16)
+	n, err := readAt(r, 0, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF { // короткий файл отбракует сигнатура
+		return videoContainer{}, err
+	}
+	if err := checkVideoMagic(head[:n], filename); err != nil {
+		return videoContainer{}, err
+	}
+
+	var c videoContainer
+	switch sniffContainer(head[:n]) {
+	case containerISOBMFF:
+		c, err = parseISOBMFF(r, size)
+	case containerEBML:
+		c, err = parseEBML(r, size)
+	case containerRIFF:
+		c, err = parseAVI(r, size)
+	case containerASF:
+		c, err = parseASF(r, size)
+	case containerFLV:
+		c, err = parseFLV(r, size)
+	}
+	if err != nil {
+		return videoContainer{}, err
+	}
+
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".webm" && c.Format != "webm" {
+		return videoContainer{}, invalidVideo("файл .webm содержит %s", c.Format)
+	}
+	return c, nil
+}
+
+// readAt читает len(buf) байт с позиции pos
+func readAt(r io.ReadSeeker, pos int64, buf []byte) (int, error) {
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, buf)
+}
+
+// truncated переводит неожиданный конец файла в ошибку «файл обрезан»
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return invalidVideo("файл обрезан")
+	}
+	return err
+}
+
+// ISO-BMFF (MP4/MOV): последовательность блоков [размер][тип][данные]
+
+type isoBox struct {
+	Type   string
+	Pos    int64 // начало блока
+	Header int64 // длина заголовка
+	Size   int64 // полный размер блока
+}
+
+func (b isoBox) dataStart() int64 { return b.Pos + b.Header }
+func (b isoBox) end() int64       { return b.Pos + b.Size }
+
+// readISOBox читает заголовок блока по позиции pos, не выходящего за end
+func readISOBox(r io.ReadSeeker, pos, end int64) (isoBox, error) {
+	hdr := make([]byte, 16)
+	if end-pos < 8 {
+		return isoBox{}, invalidVideo("неполный заголовок блока на позиции %d", pos)
+	}
+	if _, err := readAt(r, pos, hdr[:8]); err != nil {
+		return isoBox{}, truncated(err)
+	}
+	box := isoBox{Type: string(hdr[4:8]), Pos: pos, Header: 8, Size: int64(binary.BigEndian.Uint32(hdr[0:4]))}
+	switch box.Size {
+	case 0: // блок до конца файла
+		box.Size = end - pos
+	case 1: // 64-битный размер
+		if end-pos < 16 {
+			return isoBox{}, invalidVideo("неполный заголовок блока %q", box.Type)
+		}
+		if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+			return isoBox{}, truncated(err)
+		}
+		box.Header = 16
+		box.Size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+	}
+	if box.Size < box.Header || box.Size > end-pos {
+		return isoBox{}, invalidVideo("блок %q выходит за пределы файла", printableType(box.Type))
+	}
+	return box, nil
+}
+
+func printableType(t string) string {
+	for _, c := range []byte(t) {
+		if c < 0x20 || c > 0x7E {
+			return fmt.Sprintf("%x", t)
+		}
+	}
+	return t
+}
+
+// readISOChildren возвращает дочерние блоки контейнерного блока
+func readISOChildren(r io.ReadSeeker, parent isoBox) ([]isoBox, error) {
+	var children []isoBox
+	for pos := parent.dataStart(); pos < parent.end(); {
+		box, err := readISOBox(r, pos, parent.end())
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, box)
+		pos = box.end()
+	}
+	return children, nil
+}
+
+func parseISOBMFF(r io.ReadSeeker, size int64) (videoContainer, error) {
+	c := videoContainer{Family: containerISOBMFF, Format: "quicktime", MIME: "video/quicktime"}
+	var moov *isoBox
+	hasMedia := false
+
+	for pos, first := int64(0), true; pos < size; first = false {
+		box, err := readISOBox(r, pos, size)
+		if err != nil {
+			return c, err
+		}
+		if first && box.Type != "ftyp" && !quicktimeLeadAtoms[box.Type] {
+			return c, invalidVideo("файл начинается с неизвестного блока %q", printableType(box.Type))
+		}
+
+		switch box.Type {
+		case "ftyp":
+			if !first {
+				return c, invalidVideo("блок ftyp не в начале файла")
+			}
+			brand := make([]byte, 4)
+			if box.Size < box.Header+8 {
+				return c, invalidVideo("слишком короткий блок ftyp")
+			}
+			if _, err := readAt(r, box.dataStart(), brand); err != nil {
+				return c, truncated(err)
+			}
+			c.Format, c.MIME = isoBrandFormat(string(brand))
+		case "moov":
+			if moov != nil {
+				return c, invalidVideo("несколько блоков moov")
+			}
+			moov = &box
+			c.Faststart = !hasMedia
+		case "mdat", "moof":
+			hasMedia = true
+		}
+		pos = box.end()
+	}
+
+	if moov == nil {
+		return c, invalidVideo("нет блока moov")
+	}
+	if !hasMedia {
+		return c, invalidVideo("нет блока mdat с данными")
+	}
+
+	children, err := readISOChildren(r, *moov)
+	if err != nil {
+		return c, err
+	}
+	var hasMvhd, hasTrak bool
+	for _, child := range children {
+		switch child.Type {
+		case "mvhd":
+			hasMvhd = true
+		case "trak":
+			hasTrak = true
+		}
+	}
+	if !hasMvhd || !hasTrak {
+		return c, invalidVideo("в moov нет mvhd или дорожек")
+	}
+	return c, nil
+}
+
+// isoBrandFormat определяет формат по основному бренду из ftyp
+func isoBrandFormat(brand string) (string, string) {
+	switch {
+	case brand == "qt  ":
+		return "quicktime", "video/quicktime"
+	case strings.HasPrefix(brand, "3gp"), strings.HasPrefix(brand, "3g2"):
+		return "3gp", "video/3gpp"
+	case strings.HasPrefix(brand, "M4V"):
+		return "m4v", "video/x-m4v"
+	}
+	return "mp4", "video/mp4"
+}
+
+// EBML (Matroska/WebM): элементы [ID][размер][данные], ID и размер — числа переменной длины
+
+const (
+	ebmlIDHeader   = 0x1A45DFA3
+	ebmlIDDocType  = 0x4282
+	ebmlIDSegment  = 0x18538067
+	ebmlIDTracks   = 0x1654AE6B
+	ebmlIDCluster  = 0x1F43B675
+	ebmlIDVoid     = 0xEC
+	ebmlUnknownLen = -1
+)
+
+type ebmlElement struct {
+	ID      uint64
+	Pos     int64
+	DataPos int64
+	Size    int64 // ebmlUnknownLen, если размер не указан
+}
+
+// readEBMLVint читает число переменной длины; keepMarker оставляет старший бит (для ID)
+func readEBMLVint(r io.Reader, keepMarker bool) (uint64, int, bool, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, 0, false, err
+	}
+	length := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		length++
+		if length > 8 {
+			return 0, 0, false, invalidVideo("неверное число EBML")
+		}
+	}
+	if _, err := io.ReadFull(r, b[1:length]); err != nil {
+		return 0, 0, false, err
+	}
+	value := uint64(b[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+	return value, length, allOnes, nil
+}
+
+func readEBMLElement(r io.ReadSeeker, pos, end int64) (ebmlElement, error) {
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return ebmlElement{}, err
+	}
+	id, idLen, _, err := readEBMLVint(r, true)
+	if err != nil {
+		return ebmlElement{}, truncated(err)
+	}
+	size, sizeLen, unknown, err := readEBMLVint(r, false)
+	if err != nil {
+		return ebmlElement{}, truncated(err)
+	}
+	el := ebmlElement{ID: id, Pos: pos, DataPos: pos + int64(idLen+sizeLen), Size: int64(size)}
+	if unknown {
+		el.Size = ebmlUnknownLen
+	} else if el.Size < 0 || el.DataPos+el.Size > end {
+		return el, invalidVideo("элемент EBML 0x%X выходит за пределы файла", id)
+	}
+	return el, nil
+}
+
+func parseEBML(r io.ReadSeeker, size int64) (videoContainer, error) {
+	c := videoContainer{Family: containerEBML, Faststart: true}
+
+	header, err := readEBMLElement(r, 0, size)
+	if err != nil {
+		return c, err
+	}
+	if header.ID != ebmlIDHeader || header.Size == ebmlUnknownLen {
+		return c, invalidVideo("неверный заголовок EBML")
+	}
+	var docType string
+	for pos := header.DataPos; pos < header.DataPos+header.Size; {
+		el, err := readEBMLElement(r, pos, header.DataPos+header.Size)
+		if err != nil {
+			return c, err
+		}
+		if el.Size == ebmlUnknownLen {
+			return c, invalidVideo("неверный заголовок EBML")
+		}
+		if el.ID == ebmlIDDocType && el.Size <= 64 {
+			buf := make([]byte, el.Size)
+			if _, err := readAt(r, el.DataPos, buf); err != nil {
+				return c, truncated(err)
+			}
+			docType = strings.TrimRight(string(buf), "\x00")
+		}
+		pos = el.DataPos + el.Size
+	}
+	switch docType {
+	case "webm":
+		c.Format, c.MIME = "webm", "video/webm"
+	case "matroska":
+		c.Format, c.MIME = "matroska", "video/x-matroska"
+	default:
+		return c, invalidVideo("неподдерживаемый DocType EBML %q", docType)
+	}
+
+	// После заголовка (и, возможно, пустых элементов Void) идёт Segment
+	pos := header.DataPos + header.Size
+	var segment ebmlElement
+	for {
+		if segment, err = readEBMLElement(r, pos, size); err != nil {
+			return c, err
+		}
+		if segment.ID != ebmlIDVoid {
+			break
+		}
+		pos = segment.DataPos + segment.Size
+	}
+	if segment.ID != ebmlIDSegment {
+		return c, invalidVideo("нет элемента Segment")
+	}
+	segEnd := size
+	if segment.Size != ebmlUnknownLen {
+		segEnd = segment.DataPos + segment.Size
+	}
+
+	// Обходим верхний уровень Segment, пока не встретим дорожки и первый кластер
+	var hasTracks, hasCluster bool
+	for pos := segment.DataPos; pos < segEnd && !(hasTracks && hasCluster); {
+		el, err := readEBMLElement(r, pos, segEnd)
+		if err != nil {
+			return c, err
+		}
+		switch el.ID {
+		case ebmlIDTracks:
+			hasTracks = true
+		case ebmlIDCluster:
+			hasCluster = true
+		}
+		if el.Size == ebmlUnknownLen {
+			// Кластер неизвестной длины (запись потока) — дальше не пройти
+			break
+		}
+		pos = el.DataPos + el.Size
+	}
+	if !hasTracks {
+		return c, invalidVideo("нет описания дорожек (Tracks)")
+	}
+	if !hasCluster {
+		return c, invalidVideo("нет данных (Cluster)")
+	}
+	return c, nil
+}
+
+// RIFF/AVI: "RIFF" [размер LE] "AVI " и список чанков, первым идёт LIST hdrl с avih
+
+func parseAVI(r io.ReadSeeker, size int64) (videoContainer, error) {
+	c := videoContainer{Family: containerRIFF, Format: "avi", MIME: "video/x-msvideo", Faststart: true}
+
+	hdr := make([]byte, 12)
+	if _, err := readAt(r, 0, hdr); err != nil {
+		return c, truncated(err)
+	}
+	riffEnd := 8 + int64(binary.LittleEndian.Uint32(hdr[4:8]))
+	if riffEnd > size {
+		return c, invalidVideo("файл обрезан")
+	}
+
+	var hasHeader, hasMovi bool
+	chunk := make([]byte, 12)
+	for pos := int64(12); pos+8 <= riffEnd; {
+		n, err := readAt(r, pos, chunk)
+		if err != nil && !(err == io.ErrUnexpectedEOF && n >= 8) {
+			return c, truncated(err)
+		}
+		id := string(chunk[0:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		if pos+8+chunkSize > riffEnd {
+			return c, invalidVideo("чанк %q выходит за пределы файла", printableType(id))
+		}
+
+		listType := ""
+		if id == "LIST" && n == 12 {
+			listType = string(chunk[8:12])
+		}
+		if pos == 12 {
+			if listType != "hdrl" {
+				return c, invalidVideo("нет заголовка AVI (LIST hdrl)")
+			}
+			sub := make([]byte, 4)
+			if _, err := readAt(r, pos+12, sub); err != nil || string(sub) != "avih" {
+				return c, invalidVideo("нет заголовка AVI (avih)")
+			}
+			hasHeader = true
+		}
+		if listType == "movi" {
+			hasMovi = true
+		}
+		pos += 8 + chunkSize + chunkSize%2 // чанки выровнены по двум байтам
+	}
+	if !hasHeader {
+		return c, invalidVideo("нет заголовка AVI")
+	}
+	if !hasMovi {
+		return c, invalidVideo("нет данных (LIST movi)")
+	}
+	return c, nil
+}
+
+// ASF (WMV): объект заголовка с вложенными объектами, за ним объект данных
+
+func parseASF(r io.ReadSeeker, size int64) (videoContainer, error) {
+	c := videoContainer{Family: containerASF, Format: "wmv", MIME: "video/x-ms-wmv", Faststart: true}
+
+	hdr := make([]byte, 30)
+	if _, err := readAt(r, 0, hdr); err != nil {
+		return c, truncated(err)
+	}
+	headerSize := int64(binary.LittleEndian.Uint64(hdr[16:24]))
+	count := binary.LittleEndian.Uint32(hdr[24:28])
+	if headerSize < 30 || headerSize > size {
+		return c, invalidVideo("неверный размер заголовка ASF")
+	}
+
+	var hasFileProps, hasStream bool
+	obj := make([]byte, 24)
+	pos := int64(30)
+	for i := uint32(0); i < count; i++ {
+		if pos+24 > headerSize {
+			return c, invalidVideo("объекты заголовка ASF выходят за его пределы")
+		}
+		if _, err := readAt(r, pos, obj); err != nil {
+			return c, truncated(err)
+		}
+		objSize := int64(binary.LittleEndian.Uint64(obj[16:24]))
+		if objSize < 24 || objSize > headerSize-pos {
+			return c, invalidVideo("неверный размер объекта ASF")
+		}
+		switch {
+		case bytes.Equal(obj[:16], asfFilePropsGUID):
+			hasFileProps = true
+		case bytes.Equal(obj[:16], asfStreamPropGUID):
+			hasStream = true
+		}
+		pos += objSize
+	}
+	if !hasFileProps || !hasStream {
+		return c, invalidVideo("в заголовке ASF нет свойств файла или потоков")
+	}
+
+	if _, err := readAt(r, headerSize, obj); err != nil {
+		return c, truncated(err)
+	}
+	dataSize := int64(binary.LittleEndian.Uint64(obj[16:24]))
+	if !bytes.Equal(obj[:16], asfDataGUID) {
+		return c, invalidVideo("нет объекта данных ASF")
+	}
+	if dataSize != 0 && (dataSize < 50 || dataSize > size-headerSize) {
+		return c, invalidVideo("объект данных ASF выходит за пределы файла")
+	}
+	return c, nil
+}
+
+// FLV: заголовок из 9 байт, затем теги, каждый заканчивается размером предыдущего тега
+
+// flvMaxCheckedTags — сколько первых тегов проверяется
+const flvMaxCheckedTags = 64
+
+func parseFLV(r io.ReadSeeker, size int64) (videoContainer, error) {
+	c := videoContainer{Family: containerFLV, Format: "flv", MIME: "video/x-flv", Faststart: true}
+
+	hdr := make([]byte, 13)
+	if _, err := readAt(r, 0, hdr); err != nil {
+		return c, truncated(err)
+	}
+	flags := hdr[4]
+	if flags&0xFA != 0 {
+		return c, invalidVideo("неверные флаги FLV")
+	}
+	if flags&0x01 == 0 {
+		return c, invalidVideo("в FLV нет видео")
+	}
+	dataOffset := int64(binary.BigEndian.Uint32(hdr[5:9]))
+	if dataOffset < 9 || dataOffset+4 > size {
+		return c, invalidVideo("неверный заголовок FLV")
+	}
+	if _, err := readAt(r, dataOffset, hdr[:4]); err != nil {
+		return c, truncated(err)
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return c, invalidVideo("неверный заголовок FLV")
+	}
+
+	tags := 0
+	tag := make([]byte, 11)
+	for pos := dataOffset + 4; pos < size && tags < flvMaxCheckedTags; tags++ {
+		if _, err := readAt(r, pos, tag); err != nil {
+			return c, truncated(err)
+		}
+		switch tag[0] & 0x1F {
+		case 8, 9, 18: // аудио, видео, метаданные
+		default:
+			return c, invalidVideo("неизвестный тег FLV %d", tag[0])
+		}
+		dataSize := int64(tag[1])<<16 | int64(tag[2])<<8 | int64(tag[3])
+		prevPos := pos + 11 + dataSize
+		if prevPos+4 > size {
+			return c, invalidVideo("файл обрезан")
+		}
+		if _, err := readAt(r, prevPos, hdr[:4]); err != nil {
+			return c, truncated(err)
+		}
+		if int64(binary.BigEndian.Uint32(hdr[:4])) != 11+dataSize {
+			return c, invalidVideo("неверный размер тега FLV")
+		}
+		pos = prevPos + 4
+	}
+	if tags == 0 {
+		return c, invalidVideo("в FLV нет данных")
+	}
+	return c, nil
+}
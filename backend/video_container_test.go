@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// ebmlEl собирает элемент EBML: ID как есть, размер — восьмибайтным числом
+func ebmlEl(id uint64, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	var idBytes [8]byte
+	binary.BigEndian.PutUint64(idBytes[:], id)
+	el := bytes.TrimLeft(idBytes[:], "\x00")
+	return append(append(el, ebmlSize(uint64(len(body)))...), body...)
+}
+
+// ebmlSize — размер элемента EBML длиной 8 байт
+func ebmlSize(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	b[0] = 0x01
+	return b
+}
+
+func ebmlUint(id, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return ebmlEl(id, b)
+}
+
+func ebmlHeader(docType string) []byte {
+	return ebmlEl(ebmlIDHeader, ebmlUint(0x4286, 1), ebmlEl(ebmlIDDocType, []byte(docType)))
+}
+
+// synthMKV — Matroska/WebM: 2,5 с, VP9 1280x720 25 к/с и Opus
+func synthMKV(docType string) []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(2500))
+	info := ebmlEl(ebmlIDInfo, ebmlUint(ebmlIDTimecodeScale, 1000000), ebmlEl(ebmlIDDuration, duration))
+	tracks := ebmlEl(ebmlIDTracks,
+		ebmlEl(ebmlIDTrackEntry,
+			ebmlUint(ebmlIDTrackType, 1),
+			ebmlEl(ebmlIDCodecID, []byte("V_VP9")),
+			ebmlUint(ebmlIDDefaultDuration, 40000000),
+			ebmlEl(ebmlIDVideo, ebmlUint(ebmlIDPixelWidth, 1280), ebmlUint(ebmlIDPixelHeight, 720)),
+		),
+		ebmlEl(ebmlIDTrackEntry, ebmlUint(ebmlIDTrackType, 2), ebmlEl(ebmlIDCodecID, []byte("A_OPUS"))),
+	)
+	cluster := ebmlEl(ebmlIDCluster, []byte("cluster data"))
+	return append(ebmlHeader(docType), ebmlEl(ebmlIDSegment, info, tracks, cluster)...)
+}
+
+// synthProbeMP4 — MP4 с moov перед mdat: 5 с, H.264 640x360 30 к/с и AAC
+func synthProbeMP4() []byte {
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 5000)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 640<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 360<<16)
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[12:], 30000)
+	binary.BigEndian.PutUint32(mdhd[16:], 150000)
+	stts := make([]byte, 16)
+	binary.BigEndian.PutUint32(stts[4:], 1)
+	binary.BigEndian.PutUint32(stts[8:], 150)
+	binary.BigEndian.PutUint32(stts[12:], 1000)
+
+	trak := func(handler, codec string, extra ...[]byte) []byte {
+		stsd := append([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 16}, codec+"\x00\x00\x00\x00"...)
+		stbl := mp4Box("stbl", append([][]byte{mp4Box("stsd", stsd)}, extra...)...)
+		hdlr := append(make([]byte, 8), handler+"\x00\x00\x00\x00"...)
+		return mp4Box("trak", mp4Box("tkhd", tkhd),
+			mp4Box("mdia", mp4Box("mdhd", mdhd), mp4Box("hdlr", hdlr), mp4Box("minf", stbl)))
+	}
+	moov := mp4Box("moov", mp4Box("mvhd", mvhd), trak("vide", "avc1", mp4Box("stts", stts)), trak("soun", "mp4a"))
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomavc1")),
+		moov,
+		mp4Box("mdat", []byte("media data")),
+	}, nil)
+}
+
+// mp4Box64 — блок с 64-битным размером (поле размера равно 1)
+func mp4Box64(typ string, size uint64, body []byte) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b, 1)
+	copy(b[4:], typ)
+	binary.BigEndian.PutUint64(b[8:], size)
+	return append(b, body...)
+}
+
+func TestProbeContainerISOBMFF(t *testing.T) {
+	valid := synthProbeMP4()
+	moovAt := bytes.Index(valid, []byte("moov")) - 4
+	mdatAt := bytes.LastIndex(valid, []byte("mdat")) - 4
+	head := valid[:mdatAt] // ftyp и moov
+	moovToEnd := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(moovToEnd[moovAt:], 0)
+	media := []byte("media data")
+
+	sized := func(size uint32) []byte {
+		b := mp4Box("mdat", media)
+		binary.BigEndian.PutUint32(b, size)
+		return append(append([]byte{}, head...), b...)
+	}
+	cases := []struct {
+		name string
+		file []byte
+		ok   bool
+	}{
+		{"корректный", valid, true},
+		{"mdat с размером 0 до конца файла", sized(0), true},
+		{"mdat с 64-битным размером", append(append([]byte{}, head...), mp4Box64("mdat", uint64(16+len(media)), media)...), true},
+		{"64-битный размер больше файла", append(append([]byte{}, head...), mp4Box64("mdat", 1<<40, media)...), false},
+		{"64-битный размер со старшим битом", append(append([]byte{}, head...), mp4Box64("mdat", math.MaxUint64, media)...), false},
+		{"64-битный размер меньше заголовка", append(append([]byte{}, head...), mp4Box64("mdat", 12, media)...), false},
+		{"обрезанный 64-битный заголовок", append(append([]byte{}, head...), mp4Box64("mdat", 100, nil)[:12]...), false},
+		{"размер меньше заголовка", sized(4), false},
+		{"размер больше файла", sized(1000), false},
+		{"moov с размером 0 поглощает mdat", moovToEnd, false},
+		{"нет mdat", head, false},
+		{"нет moov", append(bytes.Clone(valid[:moovAt]), mp4Box("mdat", media)...), false},
+		{"неизвестный первый блок", append(mp4Box("abcd", nil), valid...), false},
+	}
+	for _, c := range cases {
+		_, err := probeContainer(bytes.NewReader(c.file), int64(len(c.file)), "video.mp4")
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, errInvalidVideo) {
+			t.Errorf("%s: ошибка %v, want errInvalidVideo", c.name, err)
+		}
+	}
+
+	// Любой обрезанный файл отклоняется
+	for n := 0; n < len(valid); n++ {
+		if _, err := probeContainer(bytes.NewReader(valid[:n]), int64(n), "video.mp4"); !errors.Is(err, errInvalidVideo) {
+			t.Fatalf("файл, обрезанный до %d байт: %v", n, err)
+		}
+	}
+}
+
+func TestProbeContainerEBML(t *testing.T) {
+	webm, mkv := synthMKV("webm"), synthMKV("matroska")
+	segment := func(parts ...[]byte) []byte {
+		return append(ebmlHeader("webm"), ebmlEl(ebmlIDSegment, parts...)...)
+	}
+	tracks := ebmlEl(ebmlIDTracks, ebmlEl(ebmlIDTrackEntry, ebmlUint(ebmlIDTrackType, 1)))
+	cluster := ebmlEl(ebmlIDCluster, []byte("data"))
+	oversized := func(id uint64) []byte {
+		var idBytes [8]byte
+		binary.BigEndian.PutUint64(idBytes[:], id)
+		return append(bytes.TrimLeft(idBytes[:], "\x00"), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE)
+	}
+	unknownSegment := append(ebmlHeader("webm"), 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	unknownSegment = append(append(unknownSegment, tracks...), cluster...)
+
+	cases := []struct {
+		name     string
+		file     []byte
+		filename string
+		ok       bool
+	}{
+		{"webm", webm, "video.webm", true},
+		{"matroska", mkv, "video.mkv", true},
+		{"webm в .mkv", webm, "video.mkv", true},
+		{"matroska в .webm", mkv, "video.webm", false},
+		{"Segment неизвестной длины", unknownSegment, "video.webm", true},
+		{"Void перед Segment", append(append(ebmlHeader("webm"), ebmlEl(ebmlIDVoid, []byte("pad"))...), ebmlEl(ebmlIDSegment, tracks, cluster)...), "video.webm", true},
+		{"огромная длина заголовка", append(oversized(ebmlIDHeader), ebmlEl(ebmlIDDocType, []byte("webm"))...), "video.webm", false},
+		{"огромная длина DocType", ebmlEl(ebmlIDHeader, oversized(ebmlIDDocType)), "video.webm", false},
+		{"огромная длина Segment", append(append(ebmlHeader("webm"), oversized(ebmlIDSegment)...), tracks...), "video.webm", false},
+		{"огромная длина Tracks", segment(oversized(ebmlIDTracks)), "video.webm", false},
+		{"число EBML длиннее 8 байт", append(ebmlHeader("webm"), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01), "video.webm", false},
+		{"размер длиннее 8 байт", append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x00}, make([]byte, 16)...), "video.webm", false},
+		{"заголовок неизвестной длины", append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0xFF}, ebmlEl(ebmlIDDocType, []byte("webm"))...), "video.webm", false},
+		{"неизвестный DocType", append(ebmlHeader("avi"), ebmlEl(ebmlIDSegment, tracks, cluster)...), "video.webm", false},
+		{"нет Tracks", segment(cluster), "video.webm", false},
+		{"нет Cluster", segment(tracks), "video.webm", false},
+		{"нет Segment", append(ebmlHeader("webm"), tracks...), "video.webm", false},
+	}
+	for _, c := range cases {
+		_, err := probeContainer(bytes.NewReader(c.file), int64(len(c.file)), c.filename)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, errInvalidVideo) {
+			t.Errorf("%s: ошибка %v, want errInvalidVideo", c.name, err)
+		}
+	}
+
+	for n := 0; n < len(webm); n++ {
+		if _, err := probeContainer(bytes.NewReader(webm[:n]), int64(n), "video.webm"); !errors.Is(err, errInvalidVideo) {
+			t.Fatalf("файл, обрезанный до %d байт: %v", n, err)
+		}
+	}
+}
+
+// FuzzProbeContainer: разбор любого содержимого завершается ошибкой или
+// результатом, но не паникой и не зависанием
+func FuzzProbeContainer(f *testing.F) {
+	f.Add(synthProbeMP4(), ".mp4")
+	f.Add(synthMKV("webm"), ".webm")
+	f.Add(synthMKV("matroska"), ".mkv")
+	f.Add(mp4Box64("mdat", 1<<40, nil), ".mov")
+	f.Add([]byte("RIFF\x20\x00\x00\x00AVI LIST\x04\x00\x00\x00hdrl"), ".avi")
+	f.Add(append(bytes.Clone(asfHeaderGUID), make([]byte, 30)...), ".wmv")
+	f.Add([]byte("FLV\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00"), ".flv")
+	f.Fuzz(func(t *testing.T, data []byte, ext string) {
+		c, err := probeContainer(bytes.NewReader(data), int64(len(data)), "video"+ext)
+		if err == nil && (c.Family == "" || c.MIME == "") {
+			t.Fatalf("контейнер принят без формата: %+v", c)
+		}
+	})
+}
+
+func TestProbeContainerASFOverflow(t *testing.T) {
+	object := func(guid []byte, size uint64) []byte {
+		b := append(bytes.Clone(guid), make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(b[16:], size)
+		return b
+	}
+	header := func(objects ...[]byte) []byte {
+		body := bytes.Join(objects, nil)
+		b := append(bytes.Clone(asfHeaderGUID), make([]byte, 14)...)
+		binary.LittleEndian.PutUint64(b[16:], uint64(30+len(body)))
+		binary.LittleEndian.PutUint32(b[24:], uint32(len(objects)))
+		return append(b, body...)
+	}
+	props := append(object(asfFilePropsGUID, 24+8), make([]byte, 8)...)
+	stream := object(asfStreamPropGUID, 24)
+
+	valid := append(header(props, stream), append(object(asfDataGUID, 50), make([]byte, 26)...)...)
+	if _, err := probeContainer(bytes.NewReader(valid), int64(len(valid)), "video.wmv"); err != nil {
+		t.Fatalf("корректный ASF: %v", err)
+	}
+	// Размеры, при сложении с позицией переполняющие int64, не проходят проверку границ
+	for name, file := range map[string][]byte{
+		"объект заголовка": header(props, object(asfStreamPropGUID, math.MaxInt64)),
+		"объект данных":    append(header(props, stream), object(asfDataGUID, math.MaxInt64)...),
+	} {
+		if _, err := probeContainer(bytes.NewReader(file), int64(len(file)), "video.wmv"); !errors.Is(err, errInvalidVideo) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
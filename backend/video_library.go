@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Упорядочивание библиотеки: название, описание, метки и папка видео.
+// Папки образуют дерево путей вида "курсы/go/2024" и хранятся в таблице
+// video_folders, чтобы существовать и без видео; "" — корень.
+//
+//	GET    /api/videos/{id}        — видео с метками
+//	PATCH  /api/videos/{id}        — {"title", "description", "tags", "folder"}, любые поля
+//	GET    /api/folders            — дерево папок со счётчиками видео
+//	POST   /api/folders            — {"path"}: создать папку (и недостающих родителей)
+//	PATCH  /api/folders/{path}     — {"path"}: переименовать или перенести папку с содержимым
+//	DELETE /api/folders/{path}     — удалить пустую папку
+//	GET    /api/tags               — метки и число видео с каждой
+
+const (
+	maxTitleLength       = 255
+	maxDescriptionLength = 10000
+	maxTags              = 50
+	maxTagLength         = 64
+	maxFolderPathLength  = 255
+	maxFolderNameLength  = 64
+	maxFolderDepth       = 16
+)
+
+var (
+	errInvalidFolder  = errors.New("некорректное имя папки")
+	errFolderNotFound = errors.New("папка не найдена")
+	errFolderExists   = errors.New("папка уже существует")
+	errFolderNotEmpty = errors.New("папка не пуста")
+)
+
+// cleanFolderPath приводит путь папки к виду "a/b/c" и проверяет его
+func cleanFolderPath(p string) (string, error) {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return "", nil
+	}
+	parts := strings.Split(p, "/")
+	if len(parts) > maxFolderDepth {
+		return "", fmt.Errorf("%w: вложенность больше %d", errInvalidFolder, maxFolderDepth)
+	}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "." || part == ".." || strings.Contains(part, "\\") || hasControlChars(part) {
+			return "", fmt.Errorf("%w: %q", errInvalidFolder, p)
+		}
+		if utf8.RuneCountInString(part) > maxFolderNameLength {
+			return "", fmt.Errorf("%w: имя длиннее %d символов", errInvalidFolder, maxFolderNameLength)
+		}
+		parts[i] = part
+	}
+	p = strings.Join(parts, "/")
+	if utf8.RuneCountInString(p) > maxFolderPathLength {
+		return "", fmt.Errorf("%w: путь длиннее %d символов", errInvalidFolder, maxFolderPathLength)
+	}
+	return p, nil
+}
+
+// folderParent — родительская папка ("" для папок в корне)
+func folderParent(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// folderWithin сообщает, лежит ли папка p в папке parent или совпадает с ней
+func folderWithin(p, parent string) bool {
+	return parent == "" || p == parent || strings.HasPrefix(p, parent+"/")
+}
+
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// cleanTags убирает пробелы по краям, пустые метки и повторы без учёта регистра
+func cleanTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	clean := []string{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength || hasControlChars(tag) {
+			return nil, fmt.Errorf("некорректная метка %q: до %d символов", tag, maxTagLength)
+		}
+		if key := strings.ToLower(tag); !seen[key] {
+			seen[key] = true
+			clean = append(clean, tag)
+		}
+	}
+	if len(clean) > maxTags {
+		return nil, fmt.Errorf("слишком много меток: не больше %d", maxTags)
+	}
+	return clean, nil
+}
+
+// tagsJSON — метки для ответа API: пустой список вместо null
+func tagsJSON(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// UpdateDetails сохраняет название, описание и папку видео, а с setTags —
+// заменяет и его метки
+func (c *videoCatalog) UpdateDetails(ctx context.Context, v *Video, setTags bool) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE videos SET title = ?, description = ?, folder = ? WHERE id = ?",
+		v.Title, v.Description, v.Folder, v.ID); err != nil {
+		return err
+	}
+	if setTags {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM video_tags WHERE video_id = ?", v.ID); err != nil {
+			return err
+		}
+		for _, tag := range v.Tags {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO video_tags (video_id, tag) VALUES (?, ?)", v.ID, tag); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// tagCount — метка и число видео с ней
+type tagCount struct {
+	Tag    string `json:"tag"`
+	Videos int    `json:"videos"`
+}
+
+// TagCounts возвращает метки доступных видео, начиная с самых частых
+func (c *videoCatalog) TagCounts(ctx context.Context) ([]tagCount, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT t.tag, COUNT(*) FROM video_tags t JOIN videos v ON v.id = t.video_id
+		WHERE v.status = ? GROUP BY t.tag ORDER BY COUNT(*) DESC, t.tag`, videoStatusReady)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []tagCount{}
+	for rows.Next() {
+		var t tagCount
+		if err := rows.Scan(&t.Tag, &t.Videos); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// FolderExists сообщает, есть ли папка; корень есть всегда
+func (c *videoCatalog) FolderExists(ctx context.Context, p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+	var n int
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_folders WHERE path = ?", p).Scan(&n)
+	return n > 0, err
+}
+
+// CreateFolder создаёт папку и недостающих родителей
+func (c *videoCatalog) CreateFolder(ctx context.Context, p string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_folders WHERE path = ? FOR UPDATE", p).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return errFolderExists
+	}
+	if err := insertFolderTx(ctx, tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertFolderTx добавляет папку и её родителей, пропуская существующие
+func insertFolderTx(ctx context.Context, tx *sql.Tx, p string) error {
+	now := time.Now()
+	for dir := p; dir != ""; dir = folderParent(dir) {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO video_folders (path, created_at) VALUES (?, ?)", dir, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// folderCond — условие "папка column — это p или лежит в p"
+func folderCond(column, p string) (string, []interface{}) {
+	prefix := p + "/"
+	return "(" + column + " = ? OR LEFT(" + column + ", ?) = ?)", []interface{}{p, utf8.RuneCountInString(prefix), prefix}
+}
+
+// RenameFolder переименовывает или переносит папку вместе с вложенными папками и видео
+func (c *videoCatalog) RenameFolder(ctx context.Context, from, to string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cond, args := folderCond("path", from)
+	var n, longest int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(MAX(CHAR_LENGTH(path)), 0) FROM video_folders WHERE "+cond+" FOR UPDATE",
+		args...).Scan(&n, &longest); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errFolderNotFound
+	}
+	if longest-utf8.RuneCountInString(from)+utf8.RuneCountInString(to) > maxFolderPathLength {
+		return fmt.Errorf("%w: путь вложенной папки станет длиннее %d символов", errInvalidFolder, maxFolderPathLength)
+	}
+	toCond, toArgs := folderCond("path", to)
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_folders WHERE "+toCond, toArgs...).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return errFolderExists
+	}
+
+	// Новый путь = to + остаток старого пути после from
+	tail := utf8.RuneCountInString(from) + 1
+	if _, err := tx.ExecContext(ctx, "UPDATE video_folders SET path = CONCAT(?, SUBSTRING(path, ?)) WHERE "+cond,
+		append([]interface{}{to, tail}, args...)...); err != nil {
+		return err
+	}
+	vcond, vargs := folderCond("folder", from)
+	if _, err := tx.ExecContext(ctx, "UPDATE videos SET folder = CONCAT(?, SUBSTRING(folder, ?)) WHERE "+vcond,
+		append([]interface{}{to, tail}, vargs...)...); err != nil {
+		return err
+	}
+	if err := insertFolderTx(ctx, tx, folderParent(to)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteFolder удаляет папку без вложенных папок и видео (включая видео в корзине)
+func (c *videoCatalog) DeleteFolder(ctx context.Context, p string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_folders WHERE path = ? FOR UPDATE", p).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errFolderNotFound
+	}
+	cond, args := folderCond("path", p)
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_folders WHERE "+cond, args...).Scan(&n); err != nil {
+		return err
+	}
+	if n > 1 {
+		return fmt.Errorf("%w: есть вложенные папки", errFolderNotEmpty)
+	}
+	vcond, vargs := folderCond("folder", p)
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM videos WHERE "+vcond, vargs...).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: в ней видео: %d", errFolderNotEmpty, n)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM video_folders WHERE path = ?", p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// folderInfo — папка со счётчиками доступных видео
+type folderInfo struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+	Videos int    `json:"videos"` // непосредственно в папке
+	Total  int    `json:"total"`  // вместе с вложенными
+}
+
+// FolderTree возвращает все папки, отсортированные по пути. Папки, известные
+// только по видео (например, добавленные в обход API), тоже попадают в список.
+func (c *videoCatalog) FolderTree(ctx context.Context) ([]folderInfo, error) {
+	counts := make(map[string]int)
+	rows, err := c.db.QueryContext(ctx, "SELECT folder, COUNT(*) FROM videos WHERE status = ? GROUP BY folder", videoStatusReady)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p string
+		var n int
+		if err := rows.Scan(&p, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts[p] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]bool)
+	rows, err = c.db.QueryContext(ctx, "SELECT path FROM video_folders")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		paths[p] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for p := range counts {
+		for dir := p; dir != ""; dir = folderParent(dir) {
+			paths[dir] = true
+		}
+	}
+
+	list := make([]folderInfo, 0, len(paths))
+	for p := range paths {
+		f := folderInfo{Path: p, Name: p[strings.LastIndex(p, "/")+1:], Parent: folderParent(p), Videos: counts[p]}
+		for vp, n := range counts {
+			if vp != "" && folderWithin(vp, p) {
+				f.Total += n
+			}
+		}
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
+}
+
+// videoItemHandler — просмотр (GET) и изменение (PATCH) видео: /api/videos/{id};
+// ссылки для общего доступа — /api/videos/{id}/shares, см. video_shares.go
+func videoItemHandler(w http.ResponseWriter, r *http.Request) {
+	idPart, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/videos/"), "/"), "/")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Некорректный идентификатор видео", http.StatusBadRequest)
+		return
+	}
+	if sub == "shares" || strings.HasPrefix(sub, "shares/") {
+		videoSharesHandler(w, r, id, strings.TrimPrefix(strings.TrimPrefix(sub, "shares"), "/"))
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	video, err := catalog.GetByID(r.Context(), id)
+	if errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusReady && video.Status != videoStatusMissing && video.Status != videoStatusCorrupted) {
+		http.Error(w, "Видео не найдено", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = catalog.LoadTags(r.Context(), []*Video{video})
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(videoJSON(r, video))
+		return
+	}
+
+	var input struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Tags        *[]string `json:"tags"`
+		Folder      *string   `json:"folder"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var changed []string
+	if input.Title != nil {
+		title := strings.TrimSpace(*input.Title)
+		if title == "" || utf8.RuneCountInString(title) > maxTitleLength || hasControlChars(title) {
+			http.Error(w, fmt.Sprintf("Название должно быть от 1 до %d символов", maxTitleLength), http.StatusBadRequest)
+			return
+		}
+		video.Title = title
+		changed = append(changed, "title")
+	}
+	if input.Description != nil {
+		description := strings.TrimSpace(*input.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			http.Error(w, fmt.Sprintf("Описание длиннее %d символов", maxDescriptionLength), http.StatusBadRequest)
+			return
+		}
+		video.Description = description
+		changed = append(changed, "description")
+	}
+	if input.Tags != nil {
+		tags, err := cleanTags(*input.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		video.Tags = tags
+		changed = append(changed, "tags")
+	}
+	if input.Folder != nil {
+		folder, err := cleanFolderPath(*input.Folder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exists, err := catalog.FolderExists(r.Context(), folder)
+		if err != nil {
+			log.Printf("Ошибка чтения каталога: %v", err)
+			http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Папка не найдена: "+folder, http.StatusBadRequest)
+			return
+		}
+		video.Folder = folder
+		changed = append(changed, "folder")
+	}
+
+	if len(changed) > 0 {
+		if err := catalog.UpdateDetails(r.Context(), video, input.Tags != nil); err != nil {
+			log.Printf("Ошибка изменения видео %d: %v", video.ID, err)
+			http.Error(w, "Ошибка сохранения изменений", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Видео %s изменено (%s): %s", video.Key, requestIdentity(r), strings.Join(changed, ", "))
+		events.Publish(EventVideoUpdated, map[string]interface{}{
+			"id":         video.ID,
+			"filename":   video.Key,
+			"changed":    changed,
+			"updated_by": requestIdentity(r),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Видео изменено",
+		"video":   videoJSON(r, video),
+	})
+}
+
+// tagsHandler — метки и число видео с каждой (GET /api/tags)
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := catalog.TagCounts(r.Context())
+	if err != nil {
+		log.Printf("Ошибка чтения меток: %v", err)
+		http.Error(w, "Ошибка чтения меток", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// foldersHandler — дерево папок (GET) и создание папки (POST): /api/folders
+func foldersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tree, err := catalog.FolderTree(r.Context())
+		if err != nil {
+			log.Printf("Ошибка чтения папок: %v", err)
+			http.Error(w, "Ошибка чтения папок", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tree)
+
+	case http.MethodPost:
+		p, ok := decodeFolderPath(w, r)
+		if !ok {
+			return
+		}
+		if p == "" {
+			http.Error(w, "Не указан путь папки", http.StatusBadRequest)
+			return
+		}
+		err := catalog.CreateFolder(r.Context(), p)
+		if errors.Is(err, errFolderExists) {
+			http.Error(w, "Папка уже существует: "+p, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Ошибка создания папки %s: %v", p, err)
+			http.Error(w, "Ошибка создания папки", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Создана папка %s (%s)", p, requestIdentity(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "Папка создана",
+			"path":    p,
+		})
+
+	default:
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+	}
+}
+
+// folderItemHandler — переименование (PATCH) и удаление (DELETE) папки: /api/folders/{path}
+func folderItemHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := cleanFolderPath(strings.TrimPrefix(r.URL.Path, "/api/folders/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p == "" {
+		http.Error(w, "Не указан путь папки", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		to, ok := decodeFolderPath(w, r)
+		if !ok {
+			return
+		}
+		if to == "" {
+			http.Error(w, "Не указан новый путь папки", http.StatusBadRequest)
+			return
+		}
+		if folderWithin(to, p) {
+			http.Error(w, "Нельзя перенести папку в саму себя", http.StatusBadRequest)
+			return
+		}
+		err := catalog.RenameFolder(r.Context(), p, to)
+		switch {
+		case errors.Is(err, errFolderNotFound):
+			http.Error(w, "Папка не найдена: "+p, http.StatusNotFound)
+			return
+		case errors.Is(err, errFolderExists):
+			http.Error(w, "Папка уже существует: "+to, http.StatusConflict)
+			return
+		case errors.Is(err, errInvalidFolder):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Ошибка переименования папки %s: %v", p, err)
+			http.Error(w, "Ошибка переименования папки", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Папка %s переименована в %s (%s)", p, to, requestIdentity(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "Папка переименована",
+			"path":    to,
+		})
+
+	case http.MethodDelete:
+		err := catalog.DeleteFolder(r.Context(), p)
+		switch {
+		case errors.Is(err, errFolderNotFound):
+			http.Error(w, "Папка не найдена: "+p, http.StatusNotFound)
+			return
+		case errors.Is(err, errFolderNotEmpty):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Ошибка удаления папки %s: %v", p, err)
+			http.Error(w, "Ошибка удаления папки", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Папка %s удалена (%s)", p, requestIdentity(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "Папка удалена",
+		})
+
+	default:
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeFolderPath читает {"path": "..."} из тела запроса и проверяет путь
+func decodeFolderPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var input struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON", http.StatusBadRequest)
+		return "", false
+	}
+	p, err := cleanFolderPath(input.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return p, true
+}
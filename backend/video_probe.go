@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+)
+
+// Извлечение технических сведений о видео без внешних программ: длительность,
+// размер кадра, частота кадров и кодеки. Поддерживаются MP4/MOV (блок moov)
+// и Matroska/WebM (Info и Tracks). Для остальных контейнеров сведения не заполняются.
+
+// videoMeta — технические сведения о видео
+type videoMeta struct {
+	Duration   float64 // секунды
+	Width      int
+	Height     int
+	FPS        float64
+	VideoCodec string
+	AudioCodec string
+}
+
+// probeVideoMeta читает сведения из контейнера, уже проверенного probeContainer
+func probeVideoMeta(r io.ReadSeeker, size int64, c videoContainer) (videoMeta, error) {
+	switch c.Family {
+	case containerISOBMFF:
+		return probeISOBMFFMeta(r, size)
+	case containerEBML:
+		return probeEBMLMeta(r, size)
+	}
+	return videoMeta{}, nil
+}
+
+// readBoxData читает начало содержимого блока, не больше max байт
+func readBoxData(r io.ReadSeeker, box isoBox, max int64) ([]byte, error) {
+	n := box.Size - box.Header
+	if n > max {
+		n = max
+	}
+	buf := make([]byte, n)
+	if _, err := readAt(r, box.dataStart(), buf); err != nil {
+		return nil, truncated(err)
+	}
+	return buf, nil
+}
+
+// findISOBox ищет дочерний блок по пути типов, например "mdia", "minf", "stbl"
+func findISOBox(r io.ReadSeeker, parent isoBox, path ...string) (isoBox, bool, error) {
+	for _, typ := range path {
+		children, err := readISOChildren(r, parent)
+		if err != nil {
+			return isoBox{}, false, err
+		}
+		found := false
+		for _, child := range children {
+			if child.Type == typ {
+				parent, found = child, true
+				break
+			}
+		}
+		if !found {
+			return isoBox{}, false, nil
+		}
+	}
+	return parent, true, nil
+}
+
+// isoCodecs — понятные названия кодеков по типу записи в stsd
+var isoCodecs = map[string]string{
+	"avc1": "h264", "avc3": "h264",
+	"hvc1": "hevc", "hev1": "hevc",
+	"av01": "av1",
+	"vp08": "vp8", "vp09": "vp9",
+	"mp4v": "mpeg4",
+	"s263": "h263", "h263": "h263",
+	"jpeg": "mjpeg", "mjpa": "mjpeg",
+	"apcn": "prores", "apch": "prores", "apcs": "prores", "apco": "prores", "ap4h": "prores",
+	"mp4a": "aac",
+	"ac-3": "ac3", "ec-3": "eac3",
+	"Opus": "opus", "fLaC": "flac",
+	".mp3": "mp3",
+	"samr": "amr", "sawb": "amr-wb",
+	"alac": "alac",
+	"sowt": "pcm", "twos": "pcm", "lpcm": "pcm", "ipcm": "pcm",
+}
+
+func isoCodecName(fourcc string) string {
+	if name, ok := isoCodecs[fourcc]; ok {
+		return name
+	}
+	return strings.TrimSpace(fourcc)
+}
+
+func probeISOBMFFMeta(r io.ReadSeeker, size int64) (videoMeta, error) {
+	var meta videoMeta
+
+	var moov isoBox
+	found := false
+	for pos := int64(0); pos < size; {
+		box, err := readISOBox(r, pos, size)
+		if err != nil {
+			return meta, err
+		}
+		if box.Type == "moov" {
+			moov, found = box, true
+			break
+		}
+		pos = box.end()
+	}
+	if !found {
+		return meta, nil
+	}
+
+	children, err := readISOChildren(r, moov)
+	if err != nil {
+		return meta, err
+	}
+	for _, child := range children {
+		switch child.Type {
+		case "mvhd":
+			data, err := readBoxData(r, child, 32)
+			if err != nil {
+				return meta, err
+			}
+			if timescale, duration, ok := parseISOTimes(data); ok {
+				meta.Duration = duration / timescale
+			}
+		case "trak":
+			if err := probeISOTrack(r, child, &meta); err != nil {
+				return meta, err
+			}
+		}
+	}
+	return meta, nil
+}
+
+// parseISOTimes достаёт timescale и duration из mvhd или mdhd
+func parseISOTimes(data []byte) (timescale, duration float64, ok bool) {
+	if len(data) < 4 {
+		return 0, 0, false
+	}
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return 0, 0, false
+		}
+		timescale = float64(binary.BigEndian.Uint32(data[20:24]))
+		duration = float64(binary.BigEndian.Uint64(data[24:32]))
+	} else {
+		if len(data) < 20 {
+			return 0, 0, false
+		}
+		timescale = float64(binary.BigEndian.Uint32(data[12:16]))
+		d := binary.BigEndian.Uint32(data[16:20])
+		if d == math.MaxUint32 { // длительность неизвестна
+			return 0, 0, false
+		}
+		duration = float64(d)
+	}
+	return timescale, duration, timescale > 0
+}
+
+func probeISOTrack(r io.ReadSeeker, trak isoBox, meta *videoMeta) error {
+	hdlr, ok, err := findISOBox(r, trak, "mdia", "hdlr")
+	if err != nil || !ok {
+		return err
+	}
+	data, err := readBoxData(r, hdlr, 12)
+	if err != nil || len(data) < 12 {
+		return err
+	}
+	handler := string(data[8:12])
+	if handler != "vide" && handler != "soun" {
+		return nil
+	}
+
+	stsd, ok, err := findISOBox(r, trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil || !ok {
+		return err
+	}
+	entry, err := readBoxData(r, stsd, 8+8+32)
+	if err != nil {
+		return err
+	}
+	if len(entry) < 16 {
+		return nil
+	}
+	codec := isoCodecName(string(entry[12:16]))
+
+	if handler == "soun" {
+		if meta.AudioCodec == "" {
+			meta.AudioCodec = codec
+		}
+		return nil
+	}
+	if meta.VideoCodec != "" {
+		return nil // берём первую видеодорожку
+	}
+	meta.VideoCodec = codec
+
+	// Размер кадра: из tkhd (с учётом отображения), иначе из записи stsd
+	if tkhd, ok, err := findISOBox(r, trak, "tkhd"); err != nil {
+		return err
+	} else if ok {
+		data, err := readBoxData(r, tkhd, 96)
+		if err != nil {
+			return err
+		}
+		offset := 76
+		if len(data) > 0 && data[0] == 1 {
+			offset = 88
+		}
+		if len(data) >= offset+8 {
+			meta.Width = int(binary.BigEndian.Uint32(data[offset:]) >> 16)
+			meta.Height = int(binary.BigEndian.Uint32(data[offset+4:]) >> 16)
+		}
+	}
+	if (meta.Width == 0 || meta.Height == 0) && len(entry) >= 8+8+28 {
+		// Запись VisualSampleEntry: 8 байт заголовка stsd, 8 байт заголовка записи, 24 служебных
+		meta.Width = int(binary.BigEndian.Uint16(entry[40:42]))
+		meta.Height = int(binary.BigEndian.Uint16(entry[42:44]))
+	}
+
+	// Частота кадров: число сэмплов из stts на длительность дорожки в единицах mdhd
+	mdhd, ok, err := findISOBox(r, trak, "mdia", "mdhd")
+	if err != nil || !ok {
+		return err
+	}
+	data, err = readBoxData(r, mdhd, 32)
+	if err != nil {
+		return err
+	}
+	timescale, _, ok := parseISOTimes(data)
+	if !ok {
+		return nil
+	}
+	stts, ok, err := findISOBox(r, trak, "mdia", "minf", "stbl", "stts")
+	if err != nil || !ok {
+		return err
+	}
+	data, err = readBoxData(r, stts, sttsMaxRead)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return nil
+	}
+	entries := int(binary.BigEndian.Uint32(data[4:8]))
+	var samples, ticks uint64
+	for i := 0; i < entries && 8+i*8+8 <= len(data); i++ {
+		count := uint64(binary.BigEndian.Uint32(data[8+i*8:]))
+		delta := uint64(binary.BigEndian.Uint32(data[12+i*8:]))
+		samples += count
+		ticks += count * delta
+	}
+	if samples > 0 && ticks > 0 {
+		meta.FPS = roundFPS(float64(samples) * timescale / float64(ticks))
+	}
+	return nil
+}
+
+// sttsMaxRead — сколько байт таблицы stts читать (миллион записей; обычно запись одна)
+const sttsMaxRead = 8 + 8<<20
+
+// roundFPS округляет частоту кадров до сотых (29.97, 23.98)
+func roundFPS(fps float64) float64 {
+	return math.Round(fps*100) / 100
+}
+
+// Matroska/WebM
+
+const (
+	ebmlIDInfo            = 0x1549A966
+	ebmlIDTimecodeScale   = 0x2AD7B1
+	ebmlIDDuration        = 0x4489
+	ebmlIDTrackEntry      = 0xAE
+	ebmlIDTrackType       = 0x83
+	ebmlIDCodecID         = 0x86
+	ebmlIDDefaultDuration = 0x23E383
+	ebmlIDVideo           = 0xE0
+	ebmlIDPixelWidth      = 0xB0
+	ebmlIDPixelHeight     = 0xBA
+)
+
+// mkvCodecs — названия кодеков по CodecID
+var mkvCodecs = map[string]string{
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+	"V_VP8":            "vp8",
+	"V_VP9":            "vp9",
+	"V_AV1":            "av1",
+	"V_MPEG4/ISO/ASP":  "mpeg4",
+	"V_MPEG2":          "mpeg2",
+	"V_THEORA":         "theora",
+	"V_MJPEG":          "mjpeg",
+	"A_OPUS":           "opus",
+	"A_VORBIS":         "vorbis",
+	"A_AAC":            "aac",
+	"A_MPEG/L3":        "mp3",
+	"A_AC3":            "ac3",
+	"A_EAC3":           "eac3",
+	"A_FLAC":           "flac",
+	"A_PCM/INT/LIT":    "pcm",
+}
+
+func mkvCodecName(id string) string {
+	if name, ok := mkvCodecs[id]; ok {
+		return name
+	}
+	if strings.HasPrefix(id, "A_AAC") {
+		return "aac"
+	}
+	if len(id) > 2 && id[1] == '_' {
+		id = id[2:]
+	}
+	return strings.ToLower(id)
+}
+
+// readEBMLChildren возвращает дочерние элементы известной длины
+func readEBMLChildren(r io.ReadSeeker, parent ebmlElement) ([]ebmlElement, error) {
+	var children []ebmlElement
+	end := parent.DataPos + parent.Size
+	for pos := parent.DataPos; pos < end; {
+		el, err := readEBMLElement(r, pos, end)
+		if err != nil {
+			return nil, err
+		}
+		if el.Size == ebmlUnknownLen {
+			break
+		}
+		children = append(children, el)
+		pos = el.DataPos + el.Size
+	}
+	return children, nil
+}
+
+func readEBMLBytes(r io.ReadSeeker, el ebmlElement) ([]byte, error) {
+	if el.Size > 1024 {
+		return nil, invalidVideo("слишком длинное значение EBML 0x%X", el.ID)
+	}
+	buf := make([]byte, el.Size)
+	if _, err := readAt(r, el.DataPos, buf); err != nil {
+		return nil, truncated(err)
+	}
+	return buf, nil
+}
+
+func readEBMLUint(r io.ReadSeeker, el ebmlElement) (uint64, error) {
+	buf, err := readEBMLBytes(r, el)
+	if err != nil || len(buf) > 8 {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readEBMLFloat(r io.ReadSeeker, el ebmlElement) (float64, error) {
+	buf, err := readEBMLBytes(r, el)
+	if err != nil {
+		return 0, err
+	}
+	switch len(buf) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	}
+	return 0, nil
+}
+
+func probeEBMLMeta(r io.ReadSeeker, size int64) (videoMeta, error) {
+	var meta videoMeta
+
+	header, err := readEBMLElement(r, 0, size)
+	if err != nil {
+		return meta, err
+	}
+	pos := header.DataPos + header.Size
+	var segment ebmlElement
+	for {
+		if segment, err = readEBMLElement(r, pos, size); err != nil {
+			return meta, err
+		}
+		if segment.ID != ebmlIDVoid {
+			break
+		}
+		pos = segment.DataPos + segment.Size
+	}
+	segEnd := size
+	if segment.Size != ebmlUnknownLen {
+		segEnd = segment.DataPos + segment.Size
+	}
+
+	var haveInfo, haveTracks bool
+	for pos := segment.DataPos; pos < segEnd && !(haveInfo && haveTracks); {
+		el, err := readEBMLElement(r, pos, segEnd)
+		if err != nil {
+			return meta, err
+		}
+		if el.Size == ebmlUnknownLen || el.ID == ebmlIDCluster {
+			break // Info и Tracks идут до кластеров
+		}
+		switch el.ID {
+		case ebmlIDInfo:
+			haveInfo = true
+			if err := probeEBMLInfo(r, el, &meta); err != nil {
+				return meta, err
+			}
+		case ebmlIDTracks:
+			haveTracks = true
+			if err := probeEBMLTracks(r, el, &meta); err != nil {
+				return meta, err
+			}
+		}
+		pos = el.DataPos + el.Size
+	}
+	return meta, nil
+}
+
+func probeEBMLInfo(r io.ReadSeeker, info ebmlElement, meta *videoMeta) error {
+	children, err := readEBMLChildren(r, info)
+	if err != nil {
+		return err
+	}
+	scale := uint64(1000000) // по умолчанию длительность в миллисекундах
+	var duration float64
+	for _, el := range children {
+		switch el.ID {
+		case ebmlIDTimecodeScale:
+			if scale, err = readEBMLUint(r, el); err != nil {
+				return err
+			}
+		case ebmlIDDuration:
+			if duration, err = readEBMLFloat(r, el); err != nil {
+				return err
+			}
+		}
+	}
+	meta.Duration = duration * float64(scale) / 1e9
+	return nil
+}
+
+func probeEBMLTracks(r io.ReadSeeker, tracks ebmlElement, meta *videoMeta) error {
+	entries, err := readEBMLChildren(r, tracks)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.ID != ebmlIDTrackEntry {
+			continue
+		}
+		fields, err := readEBMLChildren(r, entry)
+		if err != nil {
+			return err
+		}
+
+		var trackType, defaultDuration uint64
+		var codecID string
+		var video *ebmlElement
+		for i, el := range fields {
+			switch el.ID {
+			case ebmlIDTrackType:
+				trackType, err = readEBMLUint(r, el)
+			case ebmlIDCodecID:
+				var b []byte
+				b, err = readEBMLBytes(r, el)
+				codecID = strings.TrimRight(string(b), "\x00")
+			case ebmlIDDefaultDuration:
+				defaultDuration, err = readEBMLUint(r, el)
+			case ebmlIDVideo:
+				video = &fields[i]
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		switch trackType {
+		case 1: // видео
+			if meta.VideoCodec != "" {
+				continue
+			}
+			meta.VideoCodec = mkvCodecName(codecID)
+			if defaultDuration > 0 {
+				meta.FPS = roundFPS(1e9 / float64(defaultDuration))
+			}
+			if video != nil {
+				props, err := readEBMLChildren(r, *video)
+				if err != nil {
+					return err
+				}
+				for _, el := range props {
+					switch el.ID {
+					case ebmlIDPixelWidth:
+						w, err := readEBMLUint(r, el)
+						if err != nil {
+							return err
+						}
+						meta.Width = int(w)
+					case ebmlIDPixelHeight:
+						h, err := readEBMLUint(r, el)
+						if err != nil {
+							return err
+						}
+						meta.Height = int(h)
+					}
+				}
+			}
+		case 2: // аудио
+			if meta.AudioCodec == "" {
+				meta.AudioCodec = mkvCodecName(codecID)
+			}
+		}
+	}
+	return nil
+}
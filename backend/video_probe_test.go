@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProbeVideoMeta(t *testing.T) {
+	cases := []struct {
+		name, filename string
+		file           []byte
+		want           videoMeta
+	}{
+		{"mp4", "video.mp4", synthProbeMP4(),
+			videoMeta{Duration: 5, Width: 640, Height: 360, FPS: 30, VideoCodec: "h264", AudioCodec: "aac"}},
+		{"webm", "video.webm", synthMKV("webm"),
+			videoMeta{Duration: 2.5, Width: 1280, Height: 720, FPS: 25, VideoCodec: "vp9", AudioCodec: "opus"}},
+	}
+	for _, c := range cases {
+		_, meta, err := probeVideo(bytes.NewReader(c.file), int64(len(c.file)), c.filename)
+		if err != nil || meta != c.want {
+			t.Errorf("%s: %+v, %v; want %+v", c.name, meta, err, c.want)
+		}
+	}
+}
+
+// Повреждённые сведения внутри корректного контейнера дают ошибку или пустые
+// поля, но не панику и не чтение за пределами блока
+func TestProbeVideoMetaBroken(t *testing.T) {
+	mp4, webm := synthProbeMP4(), synthMKV("webm")
+	patch := func(file []byte, marker string, at int, v ...byte) []byte {
+		file = bytes.Clone(file)
+		copy(file[bytes.Index(file, []byte(marker))+at:], v)
+		return file
+	}
+	oversized := []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}
+
+	cases := []struct {
+		name, filename string
+		file           []byte
+		wantErr        bool
+		want           videoMeta // при отсутствии ошибки
+	}{
+		{"tkhd за пределами trak", "video.mp4", patch(mp4, "tkhd", -4, 0xFF, 0xFF, 0xFF, 0xF0), true, videoMeta{}},
+		{"hdlr с 64-битным размером", "video.mp4", patch(mp4, "hdlr", -4, 0, 0, 0, 1), true, videoMeta{}},
+		// hdlr с размером 0 доходит до конца mdia и поглощает minf: сведений о видео нет
+		{"hdlr с размером 0", "video.mp4", patch(mp4, "hdlr", -4, 0, 0, 0, 0), false,
+			videoMeta{Duration: 5, AudioCodec: "aac"}},
+		// Записей в stts объявлено больше, чем есть: читаются только имеющиеся
+		{"stts с огромным числом записей", "video.mp4", patch(mp4, "stts", 8, 0xFF, 0xFF, 0xFF, 0xF0), false,
+			videoMeta{Duration: 5, Width: 640, Height: 360, FPS: 30, VideoCodec: "h264", AudioCodec: "aac"}},
+		{"огромная длина Duration", "video.webm", patch(webm, "\x44\x89\x01", 2, oversized...), true, videoMeta{}},
+		{"огромная длина CodecID", "video.webm", patch(webm, "V_VP9", -8, oversized...), true, videoMeta{}},
+		{"огромная длина PixelWidth", "video.webm", patch(webm, "\xB0\x01\x00\x00\x00\x00\x00\x00\x08", 1, oversized...), true, videoMeta{}},
+	}
+	for _, c := range cases {
+		container, err := probeContainer(bytes.NewReader(c.file), int64(len(c.file)), c.filename)
+		if err != nil {
+			t.Fatalf("%s: контейнер отклонён: %v", c.name, err)
+		}
+		meta, err := probeVideoMeta(bytes.NewReader(c.file), int64(len(c.file)), container)
+		if c.wantErr && err == nil {
+			t.Errorf("%s: ошибка не обнаружена: %+v", c.name, meta)
+		}
+		if !c.wantErr && (err != nil || meta != c.want) {
+			t.Errorf("%s: %+v, %v; want %+v", c.name, meta, err, c.want)
+		}
+	}
+}
+
+// FuzzProbeVideoMeta: чтение сведений из любого содержимого не паникует,
+// даже если контейнер не прошёл проверку
+func FuzzProbeVideoMeta(f *testing.F) {
+	f.Add(synthProbeMP4())
+	f.Add(synthMKV("webm"))
+	f.Add(synthMKV("matroska"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for _, family := range []string{containerISOBMFF, containerEBML} {
+			probeVideoMeta(r, int64(len(data)), videoContainer{Family: family})
+		}
+		probeVideo(r, int64(len(data)), "video.mp4")
+		probeVideo(r, int64(len(data)), "video.webm")
+	})
+}
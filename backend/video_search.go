@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Параметры списка видео (GET /api/videos). Выборка идёт по индексам каталога:
+// для каждой сортировки есть индекс (status, столбец, id), для поиска — FULLTEXT
+// по названию и описанию. Страницы выдаются по курсору: ответ остаётся массивом,
+// а курсор следующей страницы приходит в заголовках X-Next-Cursor и Link.
+//
+//	folder, recursive, tag — папка и метки (см. video_library.go)
+//	q                      — поиск по словам названия и описания
+//	ext                    — расширение, можно несколько: ext=mp4&ext=webm или ext=mp4,webm
+//	min_size, max_size     — размер в байтах
+//	from, to               — дата загрузки: 2006-01-02, "2006-01-02 15:04:05" или RFC 3339;
+//	                         to в виде даты включает весь день
+//	sort                   — uploaded (по умолчанию), size, name, duration
+//	order                  — asc (по умолчанию) или desc
+//	limit                  — размер страницы, по умолчанию 100, не больше 1000
+//	cursor                 — X-Next-Cursor предыдущей страницы
+
+const (
+	videoSortUploaded = "uploaded"
+	videoSortSize     = "size"
+	videoSortName     = "name"
+	videoSortDuration = "duration"
+)
+
+// videoSortColumns — столбец каталога для каждой сортировки
+var videoSortColumns = map[string]string{
+	videoSortUploaded: "created_at",
+	videoSortSize:     "size",
+	videoSortName:     "title",
+	videoSortDuration: "duration",
+}
+
+const (
+	defaultVideoPageSize = 100
+	maxVideoPageSize     = 1000
+	maxVideoExtLength    = 16
+)
+
+// videoCursor — место, с которого продолжается список: значение сортировки и id
+// последнего видео предыдущей страницы
+type videoCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// newVideoCursor — курсор, указывающий на видео v
+func newVideoCursor(v *Video, sort string, desc bool) *videoCursor {
+	c := &videoCursor{Sort: sort, Desc: desc, ID: v.ID}
+	switch sort {
+	case videoSortSize:
+		c.Value = strconv.FormatInt(v.Size, 10)
+	case videoSortName:
+		c.Value = v.Title
+	case videoSortDuration:
+		c.Value = strconv.FormatFloat(v.Duration, 'g', -1, 64)
+	default:
+		c.Value = v.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+func (c *videoCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// arg — значение курсора в виде аргумента запроса
+func (c *videoCursor) arg() (interface{}, error) {
+	switch c.Sort {
+	case videoSortSize:
+		return strconv.ParseInt(c.Value, 10, 64)
+	case videoSortName:
+		return c.Value, nil
+	case videoSortDuration:
+		return strconv.ParseFloat(c.Value, 64)
+	default:
+		return time.Parse(time.RFC3339Nano, c.Value)
+	}
+}
+
+func parseVideoCursor(s string) (*videoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c videoCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if _, ok := videoSortColumns[c.Sort]; !ok || c.ID <= 0 {
+		return nil, fmt.Errorf("неизвестная сортировка %q", c.Sort)
+	}
+	if _, err := c.arg(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseVideoListQuery разбирает параметры списка видео в фильтр
+func parseVideoListQuery(query url.Values) (videoFilter, error) {
+	filter := videoFilter{Status: videoStatusReady, Sort: videoSortUploaded, Limit: defaultVideoPageSize}
+
+	if query.Has("folder") {
+		folder, err := cleanFolderPath(query.Get("folder"))
+		if err != nil {
+			return filter, err
+		}
+		filter.Folder = &folder
+		filter.Recursive = query.Get("recursive") == "true" || query.Get("recursive") == "1"
+	}
+	if tags := query["tag"]; len(tags) > 0 {
+		clean, err := cleanTags(tags)
+		if err != nil {
+			return filter, err
+		}
+		filter.Tags = clean
+	}
+
+	filter.Search = strings.TrimSpace(query.Get("q"))
+	if utf8.RuneCountInString(filter.Search) > maxTitleLength {
+		return filter, fmt.Errorf("поисковый запрос длиннее %d символов", maxTitleLength)
+	}
+
+	for _, value := range query["ext"] {
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext == "" {
+				continue
+			}
+			if len(ext) > maxVideoExtLength || strings.IndexFunc(ext, func(r rune) bool {
+				return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+			}) >= 0 {
+				return filter, fmt.Errorf("некорректное расширение %q", ext)
+			}
+			filter.Exts = append(filter.Exts, ext)
+		}
+	}
+
+	var err error
+	if filter.MinSize, err = parseSizeParam(query, "min_size"); err != nil {
+		return filter, err
+	}
+	if filter.MaxSize, err = parseSizeParam(query, "max_size"); err != nil {
+		return filter, err
+	}
+	if filter.MaxSize > 0 && filter.MinSize > filter.MaxSize {
+		return filter, errors.New("min_size больше max_size")
+	}
+	if filter.From, err = parseDateParam(query, "from", false); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseDateParam(query, "to", true); err != nil {
+		return filter, err
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, errors.New("from должно быть раньше to")
+	}
+
+	if s := query.Get("sort"); s != "" {
+		if _, ok := videoSortColumns[s]; !ok {
+			return filter, fmt.Errorf("неизвестная сортировка %q: uploaded, size, name или duration", s)
+		}
+		filter.Sort = s
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, errors.New("order должен быть asc или desc")
+	}
+
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxVideoPageSize {
+			return filter, fmt.Errorf("limit должен быть от 1 до %d", maxVideoPageSize)
+		}
+		filter.Limit = n
+	}
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := parseVideoCursor(s)
+		if err != nil {
+			return filter, errors.New("некорректный курсор")
+		}
+		if cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return filter, errors.New("курсор получен для другой сортировки")
+		}
+		filter.After = cursor
+	}
+	return filter, nil
+}
+
+// parseSizeParam читает неотрицательный размер в байтах; 0 — без ограничения
+func parseSizeParam(query url.Values, name string) (int64, error) {
+	s := query.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s должен быть неотрицательным числом байт", name)
+	}
+	return n, nil
+}
+
+// parseDateParam читает дату или время загрузки. Для верхней границы (end)
+// дата без времени означает конец этого дня.
+func parseDateParam(query url.Values, name string, end bool) (time.Time, error) {
+	s := strings.TrimSpace(query.Get(name))
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s: неверная дата %q", name, s)
+}
+
+// fullTextQuery превращает слова запроса в запрос MATCH ... IN BOOLEAN MODE:
+// каждое слово обязательно и ищется по началу. Операторы из запроса убираются.
+func fullTextQuery(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`+-<>()~*"@`, r) {
+			return ' '
+		}
+		return r
+	}, s)
+	words := strings.Fields(s)
+	for i, w := range words {
+		words[i] = "+" + w + "*"
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Ссылки для общего доступа к видео: по ссылке видео можно посмотреть без
+// доступа к API каталога. У ссылки свой срок действия и, при желании, пароль.
+// Токен ссылки в базе не хранится — только его SHA-256, пароль — как PBKDF2.
+//
+//	POST   /api/videos/{id}/shares       — {"expires_in": секунды, "password"}: создать ссылку
+//	GET    /api/videos/{id}/shares       — действующие ссылки на видео
+//	DELETE /api/videos/{id}/shares/{sid} — отозвать ссылку
+//	GET    /api/share/{token}            — видео по ссылке; пароль в заголовке X-Share-Password
+//	POST   /api/share/{token}            — то же, пароль в {"password"}
+//
+// По ссылке выдаются подписанные адреса файла и HLS (см. signed_urls.go),
+// которые действуют не дольше самой ссылки и перестают действовать при её отзыве.
+
+const (
+	defaultShareTTL      = 7 * 24 * time.Hour
+	maxShareTTL          = 365 * 24 * time.Hour
+	maxSharePassword     = 256
+	sharePasswordPBKDF2  = 100000
+	sharePasswordScheme  = "pbkdf2-sha256"
+	shareTokenBytes      = 32
+	maxSharesPerVideo    = 100
+	sharePasswordHeader  = "X-Share-Password"
+	shareNotFoundMessage = "Ссылка не найдена или истекла"
+)
+
+var (
+	errShareNotFound = errors.New("ссылка не найдена")
+	errTooManyShares = fmt.Errorf("у видео не может быть больше %d действующих ссылок", maxSharesPerVideo)
+)
+
+// videoShare — ссылка для общего доступа к видео
+type videoShare struct {
+	ID           int64
+	VideoID      int64
+	PasswordHash string // пусто — без пароля
+	ExpiresAt    time.Time
+	CreatedBy    string
+	CreatedAt    time.Time
+}
+
+// toJSON — ссылка для ответов API (без токена: он показывается только при создании)
+func (s *videoShare) toJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         s.ID,
+		"video_id":   s.VideoID,
+		"password":   s.PasswordHash != "",
+		"expires_at": s.ExpiresAt.Format("2006-01-02 15:04:05"),
+		"created_by": s.CreatedBy,
+		"created_at": s.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// newShareToken — случайный токен ссылки
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareTokenHash — под каким ключом токен хранится в базе
+func shareTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashSharePassword возвращает хеш пароля в виде pbkdf2-sha256$итерации$соль$хеш
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordPBKDF2, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", sharePasswordScheme, sharePasswordPBKDF2,
+		hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// checkSharePassword сравнивает пароль с хешем из hashSharePassword
+func checkSharePassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != sharePasswordScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// Неверные пароли к ссылке: первые shareFreeAttempts проверяются сразу, дальше
+// ссылка блокируется на время, удваивающееся с каждой ошибкой (до shareMaxLockout).
+// Одновременно пароль к ссылке проверяется только один раз, чтобы параллельные
+// запросы не обходили счётчик. Счётчик живёт в памяти экземпляра.
+const (
+	shareFreeAttempts = 5
+	shareMaxLockout   = 15 * time.Minute
+	// shareAttemptsTTL — через сколько без ошибок счётчик ссылки забывается
+	shareAttemptsTTL = time.Hour
+)
+
+type shareFailures struct {
+	count       int
+	lockedUntil time.Time
+	last        time.Time
+	checking    bool
+}
+
+// shareAttemptLimiter считает неверные пароли по ссылкам
+type shareAttemptLimiter struct {
+	mu    sync.Mutex
+	state map[int64]*shareFailures
+}
+
+var shareAttempts = &shareAttemptLimiter{state: make(map[int64]*shareFailures)}
+
+// begin разрешает проверку пароля к ссылке id. Если ссылка заблокирована или
+// пароль к ней уже проверяется, возвращает false и сколько подождать.
+func (l *shareAttemptLimiter) begin(id int64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for sid, f := range l.state {
+		if !f.checking && now.Sub(f.last) > shareAttemptsTTL && now.After(f.lockedUntil) {
+			delete(l.state, sid)
+		}
+	}
+	f := l.state[id]
+	if f == nil {
+		f = &shareFailures{}
+		l.state[id] = f
+	}
+	if f.checking {
+		return time.Second, false
+	}
+	if wait := f.lockedUntil.Sub(now); wait > 0 {
+		return wait, false
+	}
+	f.checking = true
+	return 0, true
+}
+
+// finish записывает результат проверки, начатой begin
+func (l *shareAttemptLimiter) finish(id int64, ok bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.state[id]
+	if f == nil {
+		return
+	}
+	f.checking = false
+	if ok {
+		delete(l.state, id)
+		return
+	}
+	f.count++
+	f.last = now
+	if f.count >= shareFreeAttempts {
+		lockout := shareMaxLockout
+		if shift := f.count - shareFreeAttempts; shift < 20 {
+			lockout = min(time.Second<<shift, shareMaxLockout)
+		}
+		f.lockedUntil = now.Add(lockout)
+	}
+}
+
+const shareColumns = "id, video_id, password_hash, expires_at, created_by, created_at"
+
+func scanShare(row rowScanner) (*videoShare, error) {
+	var s videoShare
+	err := row.Scan(&s.ID, &s.VideoID, &s.PasswordHash, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateShare сохраняет ссылку с токеном tokenHash и заполняет s.ID. Заодно
+// удаляются истёкшие ссылки, чтобы таблица не росла.
+func (c *videoCatalog) CreateShare(ctx context.Context, s *videoShare, tokenHash string) error {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM video_shares WHERE expires_at < ?", s.CreatedAt); err != nil {
+		return err
+	}
+	var active int
+	if err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_shares WHERE video_id = ?", s.VideoID).Scan(&active); err != nil {
+		return err
+	}
+	if active >= maxSharesPerVideo {
+		return errTooManyShares
+	}
+	res, err := c.db.ExecContext(ctx,
+		"INSERT INTO video_shares (token_hash, video_id, password_hash, expires_at, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		tokenHash, s.VideoID, s.PasswordHash, s.ExpiresAt, s.CreatedBy, s.CreatedAt)
+	if err != nil {
+		return err
+	}
+	s.ID, err = res.LastInsertId()
+	return err
+}
+
+// ListShares возвращает действующие ссылки на видео, последние созданные первыми
+func (c *videoCatalog) ListShares(ctx context.Context, videoID int64) ([]*videoShare, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+shareColumns+" FROM video_shares WHERE video_id = ? AND expires_at >= ? ORDER BY id DESC",
+		videoID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*videoShare{}
+	for rows.Next() {
+		s, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// GetShareByToken ищет действующую ссылку по хешу токена
+func (c *videoCatalog) GetShareByToken(ctx context.Context, tokenHash string) (*videoShare, error) {
+	return scanShare(c.db.QueryRowContext(ctx, "SELECT "+shareColumns+" FROM video_shares WHERE token_hash = ? AND expires_at >= ?",
+		tokenHash, time.Now()))
+}
+
+// ShareActive сообщает, действует ли ссылка id на видео videoID: не отозвана и не истекла
+func (c *videoCatalog) ShareActive(ctx context.Context, id, videoID int64) (bool, error) {
+	var n int
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM video_shares WHERE id = ? AND video_id = ? AND expires_at >= ?",
+		id, videoID, time.Now()).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteShare отзывает ссылку id на видео videoID
+func (c *videoCatalog) DeleteShare(ctx context.Context, videoID, id int64) error {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM video_shares WHERE id = ? AND video_id = ?", id, videoID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errShareNotFound
+	}
+	return err
+}
+
+// videoSharesHandler — ссылки для общего доступа к видео: /api/videos/{id}/shares[/{sid}]
+func videoSharesHandler(w http.ResponseWriter, r *http.Request, videoID int64, sub string) {
+	var shareID int64
+	if sub != "" {
+		var err error
+		shareID, err = strconv.ParseInt(sub, 10, 64)
+		if err != nil || shareID <= 0 {
+			http.Error(w, "Некорректный идентификатор ссылки", http.StatusBadRequest)
+			return
+		}
+	}
+	if (shareID == 0 && r.Method != http.MethodGet && r.Method != http.MethodPost) ||
+		(shareID != 0 && r.Method != http.MethodDelete) {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	video, err := catalog.GetByID(r.Context(), videoID)
+	if errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusReady && video.Status != videoStatusMissing && video.Status != videoStatusCorrupted) {
+		http.Error(w, "Видео не найдено", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога: %v", err)
+		http.Error(w, "Ошибка чтения каталога видео", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := catalog.ListShares(r.Context(), videoID)
+		if err != nil {
+			log.Printf("Ошибка чтения ссылок на видео %d: %v", videoID, err)
+			http.Error(w, "Ошибка чтения ссылок", http.StatusInternalServerError)
+			return
+		}
+		shares := make([]map[string]interface{}, 0, len(list))
+		for _, s := range list {
+			shares = append(shares, s.toJSON())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shares)
+
+	case http.MethodPost:
+		createVideoShare(w, r, video)
+
+	case http.MethodDelete:
+		err := catalog.DeleteShare(r.Context(), videoID, shareID)
+		if errors.Is(err, errShareNotFound) {
+			http.Error(w, "Ссылка не найдена", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Ошибка отзыва ссылки %d на видео %d: %v", shareID, videoID, err)
+			http.Error(w, "Ошибка отзыва ссылки", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Ссылка %d на видео %d отозвана (%s)", shareID, videoID, requestIdentity(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "Ссылка отозвана",
+		})
+	}
+}
+
+// createVideoShare — создание ссылки для общего доступа (POST .../shares)
+func createVideoShare(w http.ResponseWriter, r *http.Request, video *Video) {
+	var input struct {
+		ExpiresIn int64  `json:"expires_in"`
+		Password  string `json:"password"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultShareTTL
+	if input.ExpiresIn != 0 {
+		if input.ExpiresIn < 60 || input.ExpiresIn > int64(maxShareTTL/time.Second) {
+			http.Error(w, fmt.Sprintf("expires_in должен быть от 60 до %d секунд", int64(maxShareTTL/time.Second)), http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(input.ExpiresIn) * time.Second
+	}
+	if utf8.RuneCountInString(input.Password) > maxSharePassword {
+		http.Error(w, fmt.Sprintf("Пароль длиннее %d символов", maxSharePassword), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	share := &videoShare{
+		VideoID:   video.ID,
+		ExpiresAt: now.Add(ttl),
+		CreatedBy: requestIdentity(r),
+		CreatedAt: now,
+	}
+	token, err := newShareToken()
+	if err == nil && input.Password != "" {
+		share.PasswordHash, err = hashSharePassword(input.Password)
+	}
+	if err == nil {
+		err = catalog.CreateShare(r.Context(), share, shareTokenHash(token))
+	}
+	if errors.Is(err, errTooManyShares) {
+		http.Error(w, "У видео слишком много действующих ссылок", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка создания ссылки на видео %d: %v", video.ID, err)
+		http.Error(w, "Ошибка создания ссылки", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Создана ссылка %d на видео %d до %s (%s)", share.ID, video.ID,
+		share.ExpiresAt.Format("2006-01-02 15:04:05"), share.CreatedBy)
+
+	m := share.toJSON()
+	m["token"] = token
+	m["url"] = "/api/share/" + token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Ссылка создана",
+		"share":   m,
+	})
+}
+
+// sharePasswordAccepted проверяет пароль к ссылке с учётом блокировки после
+// неверных попыток; при отказе отвечает клиенту сам
+func sharePasswordAccepted(w http.ResponseWriter, r *http.Request, share *videoShare, password string) bool {
+	reject := func(status int, message string) bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":            "error",
+			"message":           message,
+			"password_required": true,
+		})
+		return false
+	}
+	// Пустой и заведомо слишком длинный пароль отклоняются без PBKDF2
+	if password == "" {
+		return reject(http.StatusUnauthorized, "Ссылка защищена паролем")
+	}
+	if len(password) > maxSharePassword*4 {
+		return reject(http.StatusUnauthorized, "Неверный пароль")
+	}
+
+	now := time.Now()
+	wait, ok := shareAttempts.begin(share.ID, now)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(max(wait.Round(time.Second), time.Second)/time.Second)))
+		return reject(http.StatusTooManyRequests, "Слишком много попыток ввода пароля, повторите позже")
+	}
+	valid := checkSharePassword(share.PasswordHash, password)
+	shareAttempts.finish(share.ID, valid, time.Now())
+	if !valid {
+		log.Printf("Неверный пароль к ссылке %d на видео %d (%s)", share.ID, share.VideoID, clientIP(r))
+		return reject(http.StatusUnauthorized, "Неверный пароль")
+	}
+	return true
+}
+
+// shareHandler открывает видео по ссылке для общего доступа: /api/share/{token}
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, shareNotFoundMessage, http.StatusNotFound)
+		return
+	}
+
+	password := r.Header.Get(sharePasswordHeader)
+	if r.Method == http.MethodPost {
+		var input struct {
+			Password string `json:"password"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&input); err != nil {
+			http.Error(w, "Неверный JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		password = input.Password
+	}
+
+	share, err := catalog.GetShareByToken(r.Context(), shareTokenHash(token))
+	var video *Video
+	if err == nil {
+		video, err = catalog.GetByID(r.Context(), share.VideoID)
+	}
+	if errors.Is(err, errShareNotFound) || errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusReady) {
+		http.Error(w, shareNotFoundMessage, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения ссылки: %v", err)
+		http.Error(w, "Ошибка чтения ссылки", http.StatusInternalServerError)
+		return
+	}
+
+	if share.PasswordHash != "" && !sharePasswordAccepted(w, r, share, password) {
+		return
+	}
+
+	// Адреса видео действуют не дольше ссылки и не дольше VIDEO_URL_TTL_MINUTES
+	expires := time.Now().Add(cfg.VideoURLTTL)
+	if share.ExpiresAt.Before(expires) {
+		expires = share.ExpiresAt
+	}
+	full := signedVideoJSON(r, video, expires, share.ID)
+	result := map[string]interface{}{
+		"share_expires_at": share.ExpiresAt.Format("2006-01-02 15:04:05"),
+	}
+	for _, key := range []string{"id", "title", "description", "original_filename", "size", "mime_type",
+		"duration", "width", "height", "url", "hls_url", "url_expires_at"} {
+		result[key] = full[key]
+	}
+	result["download_url"] = full["url"].(string) + "&download=1"
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShareAttemptLimiter(t *testing.T) {
+	l := &shareAttemptLimiter{state: make(map[int64]*shareFailures)}
+	now := time.Now()
+
+	fail := func(at time.Time) {
+		t.Helper()
+		if wait, ok := l.begin(1, at); !ok {
+			t.Fatalf("попытка запрещена, ждать %v", wait)
+		}
+		l.finish(1, false, at)
+	}
+	for i := 0; i < shareFreeAttempts-1; i++ {
+		fail(now)
+	}
+	fail(now)
+	if wait, ok := l.begin(1, now); ok || wait != time.Second {
+		t.Fatalf("после %d ошибок: ждать %v, разрешено %v", shareFreeAttempts, wait, ok)
+	}
+
+	// Блокировка удваивается с каждой ошибкой и не превышает shareMaxLockout
+	at := now
+	for want := time.Second; want < shareMaxLockout; want *= 2 {
+		at = at.Add(want)
+		fail(at)
+		if wait, _ := l.begin(1, at); wait != min(2*want, shareMaxLockout) {
+			t.Fatalf("блокировка %v, want %v", wait, min(2*want, shareMaxLockout))
+		}
+	}
+
+	// Другие ссылки не блокируются
+	if _, ok := l.begin(2, at); !ok {
+		t.Fatal("заблокирована чужая ссылка")
+	}
+	// Пока пароль проверяется, параллельная попытка отклоняется
+	if _, ok := l.begin(2, at); ok {
+		t.Fatal("параллельная проверка разрешена")
+	}
+	l.finish(2, true, at)
+
+	// Верный пароль сбрасывает счётчик
+	at = at.Add(shareMaxLockout)
+	if _, ok := l.begin(1, at); !ok {
+		t.Fatal("блокировка не снялась")
+	}
+	l.finish(1, true, at)
+	if _, ok := l.begin(1, at); !ok {
+		t.Fatal("счётчик не сброшен верным паролем")
+	}
+	l.finish(1, true, at)
+}
+
+func TestSharePasswordAccepted(t *testing.T) {
+	saved := shareAttempts
+	t.Cleanup(func() { shareAttempts = saved })
+	shareAttempts = &shareAttemptLimiter{state: make(map[int64]*shareFailures)}
+
+	hash, err := hashSharePassword("секрет")
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := &videoShare{ID: 5, VideoID: 1, PasswordHash: hash}
+	try := func(password string) int {
+		rec := httptest.NewRecorder()
+		if sharePasswordAccepted(rec, httptest.NewRequest(http.MethodGet, "/api/share/x", nil), share, password) {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+
+	if code := try(""); code != http.StatusUnauthorized {
+		t.Fatalf("без пароля: %d", code)
+	}
+	if code := try("секрет"); code != http.StatusOK {
+		t.Fatalf("верный пароль: %d", code)
+	}
+	for i := 0; i < shareFreeAttempts; i++ {
+		if code := try("неверный"); code != http.StatusUnauthorized {
+			t.Fatalf("попытка %d: %d", i+1, code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	sharePasswordAccepted(rec, httptest.NewRequest(http.MethodGet, "/api/share/x", nil), share, "секрет")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("после %d ошибок: %d, Retry-After %q", shareFreeAttempts, rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Корзина видео. Удаление через API не трогает файл: запись получает статус
+// trashed, время и автора удаления, пропадает из списка и перестаёт отдаваться.
+// Файл и HLS остаются до восстановления или окончательного удаления — вручную
+// или задачей trash-purge через TRASH_RETENTION_DAYS дней.
+//
+//	GET    /api/trash                — содержимое корзины
+//	DELETE /api/trash                — очистить корзину
+//	POST   /api/trash/{name}/restore — восстановить видео
+//	DELETE /api/trash/{name}         — удалить видео окончательно
+
+// Trash перемещает видео в корзину
+func (c *videoCatalog) Trash(ctx context.Context, id int64, by string, at time.Time) error {
+	return trashRow(ctx, c.db, id, by, at)
+}
+
+// execer — *sql.DB или *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// trashRow переводит запись в корзину; errVideoNotFound — видео уже в корзине или удалено
+func trashRow(ctx context.Context, db execer, id int64, by string, at time.Time) error {
+	res, err := db.ExecContext(ctx, "UPDATE videos SET status = ?, deleted_at = ?, deleted_by = ? WHERE id = ? AND status IN (?, ?, ?)",
+		videoStatusTrashed, at, by, id, videoStatusReady, videoStatusMissing, videoStatusCorrupted)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errVideoNotFound
+	}
+	return nil
+}
+
+// Restore возвращает видео из корзины со статусом status
+func (c *videoCatalog) Restore(ctx context.Context, id int64, status string) error {
+	res, err := c.db.ExecContext(ctx, "UPDATE videos SET status = ?, deleted_at = NULL, deleted_by = '' WHERE id = ? AND status = ?",
+		status, id, videoStatusTrashed)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errVideoNotFound
+	}
+	return nil
+}
+
+// DeleteTrashed удаляет запись, только если видео всё ещё в корзине: видео
+// могли восстановить или уже удалить параллельно (двойной запрос, задача
+// trash-purge). Если запись не удалена, возвращает errVideoNotFound — тогда
+// ссылку на файл освобождать нельзя, иначе её освободят дважды.
+func (c *videoCatalog) DeleteTrashed(ctx context.Context, id int64) error {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM videos WHERE id = ? AND status = ?", id, videoStatusTrashed)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errVideoNotFound
+	}
+	return nil
+}
+
+// ListTrash возвращает видео в корзине, начиная с удалённых последними
+func (c *videoCatalog) ListTrash(ctx context.Context) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+" FROM videos WHERE status = ? ORDER BY deleted_at DESC, id DESC", videoStatusTrashed)
+}
+
+// TrashedBefore возвращает видео, перемещённые в корзину раньше before
+func (c *videoCatalog) TrashedBefore(ctx context.Context, before time.Time) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+" FROM videos WHERE status = ? AND deleted_at < ? ORDER BY id",
+		videoStatusTrashed, before)
+}
+
+// trashPurgeAt — когда видео будет удалено из корзины окончательно
+func trashPurgeAt(v *Video) time.Time {
+	return v.DeletedAt.AddDate(0, 0, cfg.TrashRetentionDays)
+}
+
+// trashJSON — видео в корзине для ответов API
+func trashJSON(v *Video) map[string]interface{} {
+	m := v.toJSON()
+	m["deleted_at"] = v.DeletedAt.Format("2006-01-02 15:04:05")
+	m["deleted_by"] = v.DeletedBy
+	m["purge_at"] = trashPurgeAt(v).Format("2006-01-02 15:04:05")
+	return m
+}
+
+// trashVideo перемещает видео в корзину от имени by
+func trashVideo(ctx context.Context, v *Video, by string) error {
+	now := time.Now()
+	if err := catalog.Trash(ctx, v.ID, by, now); err != nil {
+		return err
+	}
+	videoTrashed(v, by, now)
+	return nil
+}
+
+// videoTrashed отражает перемещение в корзину, уже записанное в каталог
+func videoTrashed(v *Video, by string, at time.Time) {
+	v.Status, v.DeletedAt, v.DeletedBy = videoStatusTrashed, at, by
+	log.Printf("Видео %s перемещено в корзину (%s)", v.Key, by)
+
+	events.Publish(EventVideoTrashed, map[string]interface{}{
+		"id":         v.ID,
+		"filename":   v.Key,
+		"size":       v.Size,
+		"deleted_by": by,
+	})
+}
+
+// restoreVideo возвращает видео из корзины. Если файл за это время пропал
+// из хранилища, видео восстанавливается со статусом missing.
+func restoreVideo(ctx context.Context, v *Video, by string) error {
+	status := videoStatusReady
+	if _, err := videoStore.Stat(ctx, v.BlobKey); errors.Is(err, ErrBlobNotFound) {
+		status = videoStatusMissing
+	}
+	if err := catalog.Restore(ctx, v.ID, status); err != nil {
+		return err
+	}
+	v.Status, v.DeletedAt, v.DeletedBy = status, time.Time{}, ""
+	log.Printf("Видео %s восстановлено из корзины (%s)", v.Key, by)
+
+	events.Publish(EventVideoRestored, map[string]interface{}{
+		"id":          v.ID,
+		"filename":    v.Key,
+		"restored_by": by,
+	})
+	return nil
+}
+
+// purgeVideo удаляет видео из корзины окончательно: запись, затем ссылку на файл
+// (файл удаляется, если на это содержимое больше не ссылается ни одна запись),
+// затем HLS. Если видео уже нет в корзине, возвращает errVideoNotFound.
+func purgeVideo(ctx context.Context, v *Video) error {
+	if err := catalog.DeleteTrashed(ctx, v.ID); err != nil {
+		return err
+	}
+	if err := catalog.ReleaseBlob(ctx, v.SHA256); err != nil {
+		log.Printf("Ошибка освобождения файла %s: %v (исправит reconcile)", v.BlobKey, err)
+	}
+	if err := deleteHLS(ctx, v.ID); err != nil {
+		log.Printf("Ошибка удаления HLS видео %d: %v", v.ID, err)
+	}
+	log.Printf("Видео удалено: %s", v.Key)
+
+	events.Publish(EventVideoDeleted, map[string]interface{}{
+		"id":         v.ID,
+		"filename":   v.Key,
+		"size":       v.Size,
+		"deleted_by": v.DeletedBy,
+	})
+	return nil
+}
+
+// purgeVideos удаляет видео окончательно и возвращает число удалённых
+func purgeVideos(ctx context.Context, videos []*Video) (int, error) {
+	purged := 0
+	for _, v := range videos {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		err := purgeVideo(ctx, v)
+		if errors.Is(err, errVideoNotFound) {
+			continue // восстановлено или уже удалено параллельно
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// trashHandler — содержимое корзины (GET) и её очистка (DELETE)
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := catalog.ListTrash(r.Context())
+		if err != nil {
+			log.Printf("Ошибка чтения корзины: %v", err)
+			http.Error(w, "Ошибка чтения корзины", http.StatusInternalServerError)
+			return
+		}
+		videos := []map[string]interface{}{}
+		for _, v := range list {
+			videos = append(videos, trashJSON(v))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"retention_days": cfg.TrashRetentionDays,
+			"videos":         videos,
+		})
+
+	case http.MethodDelete:
+		list, err := catalog.ListTrash(r.Context())
+		if err != nil {
+			log.Printf("Ошибка чтения корзины: %v", err)
+			http.Error(w, "Ошибка чтения корзины", http.StatusInternalServerError)
+			return
+		}
+		purged, err := purgeVideos(r.Context(), list)
+		if err != nil {
+			log.Printf("Ошибка очистки корзины: %v", err)
+			http.Error(w, "Ошибка очистки корзины", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Корзина очищена (%s): удалено видео: %d", requestIdentity(r), purged)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "success",
+			"message": "Корзина очищена",
+			"purged":  purged,
+		})
+
+	default:
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+	}
+}
+
+// trashItemHandler — восстановление (POST .../restore) и окончательное удаление (DELETE) видео из корзины
+func trashItemHandler(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/trash/"), "/")
+	if name == "" || strings.Contains(name, "..") || strings.Contains(name, "\\") {
+		http.Error(w, "Некорректное имя файла", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case action == "restore" && r.Method == http.MethodPost:
+	case action == "" && r.Method == http.MethodDelete:
+	case action == "" || action == "restore":
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	video, err := catalog.GetByKey(r.Context(), name)
+	if errors.Is(err, errVideoNotFound) || (err == nil && video.Status != videoStatusTrashed) {
+		http.Error(w, "Видео нет в корзине", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка чтения каталога: %v", err)
+		http.Error(w, "Ошибка чтения корзины", http.StatusInternalServerError)
+		return
+	}
+
+	if action == "restore" {
+		err := restoreVideo(r.Context(), video, requestIdentity(r))
+		if errors.Is(err, errVideoNotFound) {
+			http.Error(w, "Видео нет в корзине", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Ошибка восстановления видео %d: %v", video.ID, err)
+			http.Error(w, "Ошибка восстановления видео", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "success",
+			"message": "Видео восстановлено",
+			"video":   videoJSON(r, video),
+		})
+		return
+	}
+
+	err = purgeVideo(r.Context(), video)
+	if errors.Is(err, errVideoNotFound) {
+		http.Error(w, "Видео нет в корзине", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка удаления записи каталога %d: %v", video.ID, err)
+		http.Error(w, "Ошибка удаления файла", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Видео удалено окончательно",
+	})
+}
+
+// runTrashPurge окончательно удаляет видео, пролежавшие в корзине дольше TRASH_RETENTION_DAYS
+func runTrashPurge(ctx context.Context) error {
+	cutoff := time.Now().AddDate(0, 0, -cfg.TrashRetentionDays)
+	videos, err := catalog.TrashedBefore(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	purged, err := purgeVideos(ctx, videos)
+	jobLog(ctx).Printf("Корзина: удалено окончательно видео: %d из %d", purged, len(videos))
+	return err
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Наблюдение за папкой видео. Файлы кладут в корень VIDEO_DIR (например, через
+// scp) и удаляют в обход приложения; наблюдатель (inotify, только Linux и
+// локальное хранилище) сразу отражает это в каталоге:
+//   - новый видеофайл в корне, который VIDEO_SETTLE_SECONDS не менялся,
+//     проверяется и добавляется в каталог, как при сверке reconcile;
+//   - удалённый файл по хешу переводит его видео в missing, вернувшийся — обратно в ready;
+//   - файл по хешу, изменённый на месте, проверяется заново (с ограничением
+//     INTEGRITY_CHECK_MB_PER_SEC): если содержимое не совпадает с хешем, файл
+//     уходит в quarantine/, а видео — в corrupted. Файлы, которые только что
+//     положило на место само приложение (AcquireBlob), уже проверены по хешу
+//     и повторно не читаются.
+//
+// События могут теряться (переполнение очереди inotify, перезапуск), поэтому
+// задача video-rescan периодически выполняет полную сверку.
+
+// quarantinePrefix — изменённые в обход приложения файлы, не совпадающие со своим хешем
+const quarantinePrefix = "quarantine/"
+
+// rescanMu не даёт сверке и наблюдателю одновременно добавить один и тот же файл
+var rescanMu sync.Mutex
+
+// rescanRequested — сверка уже запрошена и ещё не началась
+var rescanRequested atomic.Bool
+
+// placedBlobs — файлы по хешу, которые приложение только что положило на место
+var placedBlobs = &placedBlobSet{placed: make(map[string]time.Time)}
+
+// placedBlobSet запоминает, когда приложение положило файл по хешу, чтобы
+// наблюдатель не пересчитывал хеш содержимого, которое только что посчитано
+type placedBlobSet struct {
+	mu     sync.Mutex
+	placed map[string]time.Time
+}
+
+// placedBlobTTL — сколько помнить положенный файл: событие о нём приходит
+// после VIDEO_SETTLE_SECONDS
+func placedBlobTTL() time.Duration {
+	return cfg.VideoSettle + time.Minute
+}
+
+// mark отмечает, что key кладётся на место приложением
+func (s *placedBlobSet) mark(key string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, at := range s.placed {
+		if now.Sub(at) > placedBlobTTL() {
+			delete(s.placed, k)
+		}
+	}
+	s.placed[key] = now
+}
+
+// consume сообщает, что файл key с временем изменения modTime положило
+// приложение и с тех пор его не меняли. Отметка снимается: следующее событие
+// о файле проверяется как обычно.
+func (s *placedBlobSet) consume(key string, modTime, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.placed[key]
+	if !ok {
+		return false
+	}
+	delete(s.placed, key)
+	return now.Sub(at) <= placedBlobTTL() && !modTime.After(at)
+}
+
+// startVideoWatcher запускает наблюдение за папкой видео, если оно включено
+func startVideoWatcher() {
+	if !cfg.VideoWatch {
+		return
+	}
+	if cfg.StorageBackend == "s3" {
+		log.Printf("Наблюдение за папкой видео недоступно для S3, изменения найдёт сверка video-rescan")
+		return
+	}
+	queue := newWatchQueue()
+	if err := watchVideoDir(cfg.VideoDir, queue); err != nil {
+		log.Printf("Наблюдение за папкой видео %s не запущено: %v (изменения найдёт сверка video-rescan)", cfg.VideoDir, err)
+		return
+	}
+	go queue.run(context.Background())
+	log.Printf("Наблюдение за папкой видео %s включено", cfg.VideoDir)
+}
+
+// runVideoRescan — полная сверка каталога с хранилищем (задача video-rescan)
+func runVideoRescan(ctx context.Context) error {
+	rescanMu.Lock()
+	defer rescanMu.Unlock()
+	return rescanLocked(ctx, jobLog(ctx).Printf)
+}
+
+func rescanLocked(ctx context.Context, logf func(format string, args ...interface{})) error {
+	report, err := reconcileCatalog(ctx, false, logf)
+	if err != nil {
+		return err
+	}
+	logf("Сверка видео: добавлено %d, пропало %d, восстановлено %d, пропущено %d, файлов без ссылок %d",
+		len(report.Added), len(report.Missing), len(report.Restored), len(report.Skipped), len(report.Orphaned))
+	return nil
+}
+
+// requestRescan запускает внеочередную сверку, когда события могли потеряться
+func requestRescan(reason string) {
+	if rescanRequested.Swap(true) {
+		return
+	}
+	log.Printf("Внеочередная сверка каталога видео: %s", reason)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		defer cancel()
+		rescanMu.Lock()
+		defer rescanMu.Unlock()
+		rescanRequested.Store(false)
+		if err := rescanLocked(ctx, log.Printf); err != nil {
+			log.Printf("Ошибка сверки каталога видео: %v", err)
+		}
+	}()
+}
+
+// watchQueue откладывает обработку файлов, пока они не перестанут меняться:
+// повторное событие для того же файла переносит срок
+type watchQueue struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+	wake    chan struct{}
+}
+
+func newWatchQueue() *watchQueue {
+	return &watchQueue{pending: make(map[string]time.Time), wake: make(chan struct{}, 1)}
+}
+
+// add ставит ключ хранилища в очередь на обработку через delay
+func (q *watchQueue) add(key string, delay time.Duration) {
+	q.mu.Lock()
+	q.pending[key] = time.Now().Add(delay)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due забирает ключи, срок которых наступил, и возвращает время до следующего срока
+func (q *watchQueue) due(now time.Time) ([]string, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	next := time.Duration(-1)
+	for key, at := range q.pending {
+		if wait := at.Sub(now); wait > 0 {
+			if next < 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		keys = append(keys, key)
+		delete(q.pending, key)
+	}
+	return keys, next
+}
+
+func (q *watchQueue) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		keys, next := q.due(time.Now())
+		for _, key := range keys {
+			wait, err := processWatchedKey(ctx, key)
+			if err != nil {
+				log.Printf("Наблюдение за папкой видео: %s: %v", key, err)
+			}
+			if wait > 0 {
+				q.add(key, wait)
+			}
+		}
+		if len(keys) > 0 {
+			continue
+		}
+		if next < 0 {
+			next = time.Hour
+		}
+		timer.Reset(next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// processWatchedKey обрабатывает изменившийся файл хранилища. Если файл ещё
+// меняется, возвращает, через сколько проверить его снова.
+func processWatchedKey(ctx context.Context, key string) (time.Duration, error) {
+	if path.Dir(key) == "." {
+		return importLooseVideo(ctx, key)
+	}
+	return checkStoredBlob(ctx, key)
+}
+
+// settleWait — сколько ещё ждать, пока файл, изменённый в modTime, не будет считаться записанным
+func settleWait(modTime time.Time) time.Duration {
+	return max(cfg.VideoSettle-time.Since(modTime), 0)
+}
+
+// importLooseVideo добавляет в каталог видео, положенное в корень хранилища
+func importLooseVideo(ctx context.Context, key string) (time.Duration, error) {
+	info, err := videoStore.Stat(ctx, key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return 0, nil // удалён или уже перенесён на место по хешу
+	}
+	if err != nil {
+		return 0, err
+	}
+	if wait := settleWait(info.ModTime); wait > 0 {
+		return wait, nil
+	}
+
+	rescanMu.Lock()
+	defer rescanMu.Unlock()
+	if _, err := catalog.GetByKey(ctx, key); err == nil {
+		log.Printf("Файл %s не добавлен: в каталоге уже есть видео с таким именем", key)
+		return 0, nil
+	} else if !errors.Is(err, errVideoNotFound) {
+		return 0, err
+	}
+	video, err := catalogStoredBlob(ctx, info)
+	if err != nil {
+		log.Printf("Файл %s не добавлен в каталог: %v", key, err)
+		return 0, nil
+	}
+	log.Printf("Добавлен в каталог: %s (id %d, %s)", key, video.ID, video.MIME)
+
+	processInBackground(video)
+	events.Publish(EventVideoUploaded, map[string]interface{}{
+		"id":                video.ID,
+		"filename":          video.Key,
+		"original_filename": video.OriginalFilename,
+		"size":              video.Size,
+		"sha256":            video.SHA256,
+		"duplicate":         false,
+		"mime_type":         video.MIME,
+		"uploader":          video.Uploader,
+		"duration":          video.Duration,
+		"source":            "watcher",
+	})
+	return 0, nil
+}
+
+// checkStoredBlob приводит статусы видео в соответствие с файлом по хешу key
+func checkStoredBlob(ctx context.Context, key string) (time.Duration, error) {
+	videos, err := catalog.VideosByBlob(ctx, key)
+	if err != nil || len(videos) == 0 {
+		return 0, err // файл ещё не в каталоге (идёт загрузка) или ни на что не ссылается
+	}
+	info, err := videoStore.Stat(ctx, key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return 0, setVideosStatus(ctx, videos, videoStatusReady, videoStatusMissing, "файл удалён из хранилища")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if wait := settleWait(info.ModTime); wait > 0 {
+		return wait, nil
+	}
+
+	if !placedBlobs.consume(key, info.ModTime, time.Now()) {
+		sum, err := blobChecksum(ctx, key, cfg.IntegrityCheckRate)
+		if err != nil {
+			return 0, err
+		}
+		if sum != path.Base(key) {
+			log.Printf("Файл %s изменён в обход приложения и не совпадает с хешем", key)
+			return 0, quarantineBlob(ctx, key, videos)
+		}
+	}
+	if err := setVideosStatus(ctx, videos, videoStatusMissing, videoStatusReady, "файл снова в хранилище"); err != nil {
+		return 0, err
+	}
+	return 0, setVideosStatus(ctx, videos, videoStatusCorrupted, videoStatusReady, "файл снова в хранилище")
+}
+
+// quarantineBlob переносит файл по хешу key, не совпадающий со своим хешем,
+// в quarantine/ и переводит ссылающиеся на него видео в corrupted. Запись
+// video_blobs остаётся: повторная загрузка того же содержимого вернёт файл на место.
+func quarantineBlob(ctx context.Context, key string, videos []*Video) error {
+	quarantined := quarantinePrefix + path.Base(key) + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := videoStore.Move(ctx, key, quarantined); err != nil {
+		return err
+	}
+	log.Printf("Файл %s перенесён в %s", key, quarantined)
+	for _, from := range []string{videoStatusReady, videoStatusMissing} {
+		if err := setVideosStatus(ctx, videos, from, videoStatusCorrupted, "содержимое файла не совпадает с хешем"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setVideosStatus переводит видео из статуса from в статус to
+func setVideosStatus(ctx context.Context, videos []*Video, from, to, reason string) error {
+	for _, v := range videos {
+		if v.Status != from {
+			continue
+		}
+		if err := catalog.SetStatus(ctx, v.ID, to); err != nil {
+			return err
+		}
+		log.Printf("Видео %s (id %d): %s, статус %s", v.Key, v.ID, reason, to)
+	}
+	return nil
+}
+
+// blobChecksum считает SHA-256 содержимого файла в хранилище, читая его
+// не быстрее rate байт в секунду (0 — без ограничения)
+func blobChecksum(ctx context.Context, key string, rate int64) (string, error) {
+	f, err := videoStore.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &throttledReader{ctx: ctx, r: f, rate: rate, start: time.Now()}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// throttledReader ограничивает скорость чтения и прерывает его при отмене ctx,
+// чтобы долгий подсчёт хеша не мешал отдаче видео и укладывался в таймаут задачи
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64 // байт в секунду, 0 — без ограничения
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if t.rate > 0 {
+		if int64(len(p)) > t.rate {
+			p = p[:t.rate]
+		}
+		// Ждём, пока прочитанное не уложится в допустимую скорость
+		due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+		if wait := due - time.Since(t.start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return 0, t.ctx.Err()
+			}
+		}
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	return n, err
+}
+
+// VideosByBlob возвращает записи, ссылающиеся на файл по хешу key
+func (c *videoCatalog) VideosByBlob(ctx context.Context, key string) ([]*Video, error) {
+	return c.queryVideos(ctx, "SELECT "+videoColumns+" FROM videos WHERE blob_key = ? ORDER BY id", key)
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// События inotify для папок хранилища: появление и удаление файлов и папок
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ONLYDIR
+
+// inotifyEventSize — размер заголовка struct inotify_event без имени
+const inotifyEventSize = syscall.SizeofInotifyEvent
+
+// inotifyWatcher следит за корнем хранилища (видео, положенные в обход
+// приложения) и папками blobs/ и blobs/xx/ (файлы по хешу)
+type inotifyWatcher struct {
+	fd    int
+	root  string
+	queue *watchQueue
+
+	mu   sync.Mutex
+	dirs map[int32]string // дескриптор наблюдения → папка относительно root
+}
+
+// watchVideoDir начинает наблюдение за папкой root; события передаются в queue
+func watchVideoDir(root string, queue *watchQueue) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &inotifyWatcher{fd: fd, root: root, queue: queue, dirs: make(map[int32]string)}
+	if err := w.addDir("", false); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go w.readEvents()
+	return nil
+}
+
+// watchedDir сообщает, нужно ли следить за папкой rel
+func watchedDir(rel string) bool {
+	switch strings.Count(rel, "/") {
+	case 0:
+		return rel == "" || rel+"/" == blobPrefix
+	case 1:
+		return strings.HasPrefix(rel, blobPrefix)
+	}
+	return false
+}
+
+// addDir начинает наблюдение за папкой rel и вложенными в неё и ставит в очередь
+// видео, уже лежащие в корне. С queueFiles в очередь ставятся и файлы по хешу:
+// они могли появиться в новой папке до начала наблюдения. При запуске их
+// проверять не нужно — это сделает сверка.
+func (w *inotifyWatcher) addDir(rel string, queueFiles bool) error {
+	dir := filepath.Join(w.root, filepath.FromSlash(rel))
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[int32(wd)] = rel
+	w.mu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child := path.Join(rel, e.Name())
+		switch {
+		case e.IsDir():
+			if !watchedDir(child) {
+				continue
+			}
+			if err := w.addDir(child, queueFiles); err != nil {
+				log.Printf("Не удалось следить за папкой %s: %v", child, err)
+			}
+		case strings.HasPrefix(e.Name(), localTempPrefix):
+		case rel == "":
+			// Видео в корне добавляются сразу, не дожидаясь сверки
+			if isVideoFile(e.Name()) {
+				w.queue.add(child, 0)
+			}
+		case queueFiles:
+			w.queue.add(child, 0)
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) readEvents() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Наблюдение за папкой видео остановлено: %v", err)
+			return
+		}
+		for off := 0; off+inotifyEventSize <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := string(bytes.TrimRight(buf[off+inotifyEventSize:off+inotifyEventSize+nameLen], "\x00"))
+			off += inotifyEventSize + nameLen
+			w.handle(wd, mask, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		requestRescan("переполнена очередь событий inotify")
+		return
+	}
+	w.mu.Lock()
+	rel, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd) // папка удалена
+	}
+	w.mu.Unlock()
+	if !ok || name == "" || strings.HasPrefix(name, localTempPrefix) {
+		return
+	}
+	key := path.Join(rel, name)
+
+	if mask&syscall.IN_ISDIR != 0 {
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && watchedDir(key):
+			if err := w.addDir(key, true); err != nil {
+				log.Printf("Не удалось следить за папкой %s: %v", key, err)
+			}
+		case mask&syscall.IN_MOVED_FROM != 0 && watchedDir(key):
+			// Папку с файлами перенесли целиком: событий о файлах не будет
+			requestRescan("перенесена папка " + key)
+		}
+		return
+	}
+
+	if rel == "" {
+		// Видео в корне: ждём, пока файл допишут; удаление ещё не добавленного
+		// файла (или его перенос на место по хешу) каталог не затрагивает
+		if mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 && isVideoFile(name) {
+			w.queue.add(key, cfg.VideoSettle)
+		}
+		return
+	}
+	if mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_MOVED_FROM|syscall.IN_DELETE) != 0 {
+		w.queue.add(key, cfg.VideoSettle)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchVideoDir не поддерживается на этой платформе: изменения найдёт сверка video-rescan
+func watchVideoDir(root string, queue *watchQueue) error {
+	return errors.ErrUnsupported
+}
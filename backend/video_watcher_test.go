@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobChecksum(t *testing.T) {
+	saved := videoStore
+	t.Cleanup(func() { videoStore = saved })
+	videoStore = newLocalBlobStore(t.TempDir())
+	ctx := context.Background()
+
+	content := strings.Repeat("x", 64<<10)
+	hash := sha256.Sum256([]byte(content))
+	sum := hex.EncodeToString(hash[:])
+	if _, err := videoStore.Put(ctx, contentBlobKey(sum), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Хеш считается по всему файлу, а не по началу
+	if got, err := blobChecksum(ctx, contentBlobKey(sum), 0); err != nil || got != sum {
+		t.Fatalf("blobChecksum = %s, %v; want %s", got, err, sum)
+	}
+	if _, err := videoStore.Put(ctx, contentBlobKey(sum), strings.NewReader(content[:len(content)-1]+"y")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := blobChecksum(ctx, contentBlobKey(sum), 0); got == sum {
+		t.Fatal("изменение в конце файла не замечено")
+	}
+
+	// 64 КБ при 256 КБ/с читаются не меньше чем за четверть секунды
+	start := time.Now()
+	if _, err := blobChecksum(ctx, contentBlobKey(sum), 256<<10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("ограничение скорости не сработало: %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := blobChecksum(cancelled, contentBlobKey(sum), 1<<10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("чтение не прервано по таймауту: %v", err)
+	}
+}
+
+func TestPlacedBlobSet(t *testing.T) {
+	savedSettle := cfg.VideoSettle
+	t.Cleanup(func() { cfg.VideoSettle = savedSettle })
+	cfg.VideoSettle = 10 * time.Second
+
+	s := &placedBlobSet{placed: make(map[string]time.Time)}
+	now := time.Now()
+	written := now.Add(-time.Minute) // перенос сохраняет время изменения загруженного файла
+
+	s.mark("blobs/aa/a", now)
+	if !s.consume("blobs/aa/a", written, now.Add(5*time.Second)) {
+		t.Fatal("файл, положенный приложением, проверяется заново")
+	}
+	if s.consume("blobs/aa/a", written, now.Add(5*time.Second)) {
+		t.Fatal("отметка не снята после первого события")
+	}
+
+	// Файл переписали уже после того, как приложение положило его на место
+	s.mark("blobs/bb/b", now)
+	if s.consume("blobs/bb/b", now.Add(time.Second), now.Add(5*time.Second)) {
+		t.Fatal("изменённый после переноса файл не проверяется")
+	}
+
+	// Устаревшая отметка не действует и вычищается при следующей
+	s.mark("blobs/cc/c", now)
+	if s.consume("blobs/cc/c", written, now.Add(2*time.Minute)) {
+		t.Fatal("устаревшая отметка пропустила проверку")
+	}
+	s.mark("blobs/dd/d", now)
+	s.mark("blobs/ee/e", now.Add(2*time.Minute))
+	if _, ok := s.placed["blobs/dd/d"]; ok {
+		t.Fatal("устаревшая отметка не вычищена")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxVideoSize — максимальный размер загружаемого видео (2GB)
+const maxVideoSize = 2 << 30
+
+// videoUpload — сведения о загружаемом видео от клиента
+type videoUpload struct {
+	OriginalFilename string
+	Title            string
+	Description      string
+	Uploader         string
+}
+
+// addVideo проверяет видео, сохраняет его содержимое в хранилище, добавляет
+// в каталог под новым уникальным именем и оповещает подписчиков. Через неё
+// проходят и обычная, и возобновляемая (tus) загрузка. Повторная загрузка того же
+// содержимого создаёт новую запись, ссылающуюся на уже сохранённый файл.
+// Ошибки проверки содержимого оборачивают errInvalidVideo, превышение квот и
+// нехватка места на диске — errInsufficientStorage.
+//
+// Запись каталога создаётся до приёма файла в состоянии "uploading" и не видна
+// в списке, пока содержимое не сохранено целиком и не проверено. Если процесс
+// упадёт посреди загрузки, запись и временный файл уберёт sweepStaleUploads.
+func addVideo(ctx context.Context, upload videoUpload, r io.Reader) (*Video, error) {
+	ext := strings.ToLower(filepath.Ext(upload.OriginalFilename))
+	key := fmt.Sprintf("%d_%s%s", time.Now().Unix(), generateRandomString(8), ext)
+
+	// Сигнатуру проверяем до записи, чтобы не сохранять заведомо чужой файл
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(64)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if err := checkVideoMagic(head, upload.OriginalFilename); err != nil {
+		return nil, err
+	}
+
+	title := upload.Title
+	if title == "" {
+		title = videoTitleFromFilename(upload.OriginalFilename)
+	}
+	video := &Video{
+		Key:              key,
+		OriginalFilename: upload.OriginalFilename,
+		Title:            title,
+		Description:      upload.Description,
+		Uploader:         upload.Uploader,
+		CreatedAt:        time.Now(),
+		Status:           videoStatusUploading,
+	}
+	if err := catalog.Insert(ctx, video); err != nil {
+		return nil, fmt.Errorf("ошибка записи в каталог: %v", err)
+	}
+
+	// Хеш считаем при записи: по нему файл встанет на постоянное место.
+	// Если по ходу записи на диске кончается место, загрузка прерывается.
+	incoming, size, sum, err := putIncoming(ctx, newSpaceGuardReader(br, videoStagingDir()))
+	if err != nil {
+		abandonUpload(video)
+		return nil, err
+	}
+
+	// Размер до записи мог быть неизвестен: квоты проверяем по фактическому
+	// и сразу занимаем место, чтобы его видели одновременные загрузки
+	if err := catalog.ReserveUpload(ctx, video, size, sum); err != nil {
+		videoStore.Delete(context.WithoutCancel(ctx), incoming)
+		abandonUpload(video)
+		return nil, err
+	}
+
+	// Структуру разбираем по сохранённому файлу: moov может оказаться в самом конце
+	container, meta, err := probeStoredVideo(ctx, incoming, upload.OriginalFilename)
+	if err != nil {
+		if delErr := videoStore.Delete(context.WithoutCancel(ctx), incoming); delErr != nil {
+			log.Printf("Не удалось удалить отклонённый файл %s: %v", incoming, delErr)
+		}
+		abandonUpload(video)
+		return nil, err
+	}
+
+	blobKey, duplicate, err := catalog.AcquireBlob(ctx, incoming, sum, size)
+	if err != nil {
+		videoStore.Delete(context.WithoutCancel(ctx), incoming)
+		abandonUpload(video)
+		return nil, fmt.Errorf("ошибка сохранения файла: %v", err)
+	}
+	if duplicate {
+		log.Printf("Содержимое %s уже хранится, новая запись ссылается на %s", upload.OriginalFilename, blobKey)
+	}
+
+	video.BlobKey = blobKey
+	video.Size = size
+	video.MIME = container.MIME
+	video.SHA256 = sum
+	video.Faststart = container.Faststart
+	video.videoMeta = meta
+	if err := catalog.FinishUpload(ctx, video); err != nil {
+		if relErr := catalog.ReleaseBlob(context.WithoutCancel(ctx), sum); relErr != nil {
+			log.Printf("Не удалось освободить файл %s: %v", blobKey, relErr)
+		}
+		abandonUpload(video)
+		return nil, fmt.Errorf("ошибка записи в каталог: %v", err)
+	}
+
+	processInBackground(video)
+
+	events.Publish(EventVideoUploaded, map[string]interface{}{
+		"id":                video.ID,
+		"filename":          key,
+		"original_filename": upload.OriginalFilename,
+		"size":              size,
+		"sha256":            sum,
+		"duplicate":         duplicate,
+		"mime_type":         video.MIME,
+		"uploader":          video.Uploader,
+		"duration":          video.Duration,
+	})
+	return video, nil
+}
+
+// abandonUpload удаляет запись незавершённой загрузки. Клиент мог уже
+// отключиться, поэтому удаление не зависит от контекста запроса.
+func abandonUpload(v *Video) {
+	if err := catalog.Delete(context.Background(), v.ID); err != nil {
+		log.Printf("Не удалось удалить запись незавершённой загрузки %d: %v (удалится при следующем запуске)", v.ID, err)
+	}
+}
+
+// sweepStaleUploads убирает следы загрузок, прерванных сбоем: временные объекты
+// incoming/, недописанные временные файлы хранилища и записи каталога в
+// состоянии "uploading". Трогает только то, что старше UPLOAD_STALE_HOURS:
+// другой экземпляр приложения может в это время принимать файлы.
+func sweepStaleUploads(ctx context.Context) {
+	before := time.Now().Add(-cfg.UploadStaleAfter)
+
+	incoming, err := videoStore.List(ctx, incomingPrefix)
+	if err != nil {
+		log.Printf("Очистка загрузок: ошибка чтения хранилища: %v", err)
+	} else {
+		removed := 0
+		for _, b := range incoming {
+			if b.ModTime.After(before) {
+				continue
+			}
+			if err := videoStore.Delete(ctx, b.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+				log.Printf("Очистка загрузок: не удалось удалить %s: %v", b.Key, err)
+				continue
+			}
+			removed++
+		}
+		if removed > 0 {
+			log.Printf("Очистка загрузок: удалено временных объектов: %d", removed)
+		}
+	}
+
+	if store, ok := videoStore.(interface {
+		RemoveStaleTemp(before time.Time) (int, error)
+	}); ok {
+		n, err := store.RemoveStaleTemp(before)
+		if err != nil {
+			log.Printf("Очистка загрузок: ошибка удаления временных файлов: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Очистка загрузок: удалено недописанных файлов: %d", n)
+		}
+	}
+
+	n, err := catalog.DeleteStaleUploads(ctx, before)
+	if err != nil {
+		log.Printf("Очистка загрузок: ошибка чтения каталога: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Очистка загрузок: удалено записей незавершённых загрузок: %d", n)
+	}
+}
+
+// processInBackground запускает включённую в настройках обработку после загрузки:
+// перенос moov, затем упаковку в HLS. Шаги идут по очереди, потому что
+// faststart заменяет файл, из которого читает упаковщик.
+func processInBackground(v *Video) {
+	faststart := cfg.VideoFaststart && !v.Faststart
+	if !faststart && !cfg.VideoHLS {
+		return
+	}
+	video := *v // запись из ответа клиенту не трогаем
+	go func() {
+		ctx := context.Background()
+		if faststart {
+			changed, err := faststartVideo(ctx, &video)
+			if err != nil {
+				log.Printf("Faststart %s: %v", video.Key, err)
+			} else if changed {
+				log.Printf("Faststart %s: moov перенесён в начало файла", video.Key)
+			}
+		}
+		if cfg.VideoHLS {
+			err := packageHLS(ctx, &video)
+			switch {
+			case errors.Is(err, errHLSUnsupported):
+				log.Printf("HLS %s: пропущено: %v", video.Key, err)
+			case err != nil:
+				log.Printf("HLS %s: %v", video.Key, err)
+			default:
+				log.Printf("HLS %s: готово", video.Key)
+			}
+		}
+	}()
+}
+
+// notePlayback отмечает начало просмотра для правил хранения: запрос файла
+// без Range или с его начала. Запись в каталог не задерживает ответ.
+func notePlayback(r *http.Request, v *Video) {
+	if r.Method != http.MethodGet || time.Since(v.LastPlayedAt) < playedThrottle {
+		return
+	}
+	if rg := strings.ReplaceAll(r.Header.Get("Range"), " ", ""); rg != "" && !strings.HasPrefix(rg, "bytes=0-") {
+		return
+	}
+	id := v.ID
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := catalog.MarkPlayed(ctx, id, time.Now()); err != nil {
+			log.Printf("Не удалось отметить просмотр видео %d: %v", id, err)
+		}
+	}()
+}
+
+// probeStoredVideo проверяет контейнер видео, уже сохранённого в хранилище, и читает его сведения
+func probeStoredVideo(ctx context.Context, key, filename string) (videoContainer, videoMeta, error) {
+	f, err := videoStore.Open(ctx, key)
+	if err != nil {
+		return videoContainer{}, videoMeta{}, err
+	}
+	defer f.Close()
+	return probeVideo(f, f.Info().Size, filename)
+}
+
+// probeVideo проверяет контейнер и читает технические сведения. Ошибка чтения
+// сведений не отклоняет видео: структура уже проверена, сведения останутся пустыми.
+func probeVideo(r io.ReadSeeker, size int64, filename string) (videoContainer, videoMeta, error) {
+	container, err := probeContainer(r, size, filename)
+	if err != nil {
+		return container, videoMeta{}, err
+	}
+	meta, err := probeVideoMeta(r, size, container)
+	if err != nil {
+		log.Printf("Не удалось прочитать сведения о видео %s: %v", filename, err)
+		meta = videoMeta{}
+	}
+	return container, meta, nil
+}
+
+// requestIdentity определяет, кто выполняет запрос: пользователь, переданный
+// авторизующим прокси в X-Remote-User, иначе IP-адрес клиента
+func requestIdentity(r *http.Request) string {
+	if user := strings.TrimSpace(r.Header.Get("X-Remote-User")); user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}